@@ -0,0 +1,223 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/cloudprivacylabs/opencypher/graph"
+	"github.com/spf13/cobra"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+)
+
+// Kinds of bundle issues
+const (
+	// A schema or overlay of the variant cannot be found or loaded
+	BundleIssueMissingLayer = "missingLayer"
+	// The value type of an overlay is different from the value type
+	// of the schema
+	BundleIssueValueTypeMismatch = "valueTypeMismatch"
+	// A reference attribute refers to a type that is not in the bundle
+	BundleIssueUnresolvedReference = "unresolvedReference"
+	// The variant cannot be composed or compiled
+	BundleIssueError = "error"
+)
+
+// BundleIssue is a problem found in a bundle variant
+type BundleIssue struct {
+	Variant string `json:"variant,omitempty"`
+	Kind    string `json:"kind"`
+	Layer   string `json:"layer,omitempty"`
+	Msg     string `json:"msg"`
+}
+
+// Check resolves, composes, and compiles every variant of the
+// bundle, and returns the issues found. Variants are checked
+// independently, so a problem in one variant does not hide the
+// problems of others.
+func (bundle *Bundle) Check(ctx *ls.Context, loader func(string) (*ls.Layer, error), fileLoader func(string) (io.ReadCloser, error)) []BundleIssue {
+	issues := make([]BundleIssue, 0)
+	spreadsheets, err := bundle.LoadSpreadsheets(ctx)
+	if err != nil {
+		return append(issues, BundleIssue{Kind: BundleIssueError, Msg: err.Error()})
+	}
+	names := make([]string, 0, len(bundle.TypeNames))
+	for name, variant := range bundle.TypeNames {
+		if variant != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	composed := make(map[string]*ls.Layer)
+	for _, name := range names {
+		// Work on a copy of the variant, resolveLayers sets the layers
+		variant := *bundle.TypeNames[name]
+		variant.Overlays = append([]BundleSchemaRef{}, variant.Overlays...)
+		single := Bundle{
+			TypeNames:      map[string]*BundleVariant{name: &variant},
+			ConflictPolicy: bundle.ConflictPolicy,
+		}
+		layers := make(map[string]*ls.Layer, len(spreadsheets))
+		for k, v := range spreadsheets {
+			layers[k] = v
+		}
+		if err := single.resolveLayers(ctx, layers, loader, fileLoader); err != nil {
+			issues = append(issues, BundleIssue{Variant: name, Kind: BundleIssueMissingLayer, Msg: err.Error()})
+			continue
+		}
+		// Composition fails for mismatched value types, so those
+		// variants are not composed
+		mismatch := false
+		schemaType := variant.layer.GetValueType()
+		for _, ovl := range variant.Overlays {
+			if t := ovl.layer.GetValueType(); len(t) > 0 && len(schemaType) > 0 && t != schemaType {
+				mismatch = true
+				issues = append(issues, BundleIssue{
+					Variant: name,
+					Kind:    BundleIssueValueTypeMismatch,
+					Layer:   ovl.layer.GetID(),
+					Msg:     fmt.Sprintf("Overlay value type %s does not match schema value type %s", t, schemaType),
+				})
+			}
+		}
+		if mismatch {
+			continue
+		}
+		variants, err := single.composeVariants(ctx)
+		if err != nil {
+			issues = append(issues, BundleIssue{Variant: name, Kind: BundleIssueError, Msg: err.Error()})
+			continue
+		}
+		composed[name] = variants[name]
+	}
+
+	schemaLoader := &ls.BundleByType{Variants: composed}
+	for _, name := range names {
+		layer, ok := composed[name]
+		if !ok {
+			continue
+		}
+		canCompile := true
+		layer.ForEachAttribute(func(node graph.Node, _ []graph.Node) bool {
+			if !node.GetLabels().Has(ls.AttributeTypeReference) {
+				return true
+			}
+			ref := ls.AsPropertyValue(node.GetProperty(ls.ReferenceTerm)).AsString()
+			if _, ok := composed[ref]; ok {
+				return true
+			}
+			canCompile = false
+			// If the referenced variant failed, it is already reported
+			if _, ok := bundle.TypeNames[ref]; !ok {
+				issues = append(issues, BundleIssue{
+					Variant: name,
+					Kind:    BundleIssueUnresolvedReference,
+					Layer:   layer.GetID(),
+					Msg:     fmt.Sprintf("Attribute %s refers to %s", ls.GetAttributeID(node), ref),
+				})
+			}
+			return true
+		})
+		if !canCompile {
+			continue
+		}
+		compiler := ls.Compiler{
+			Loader: schemaLoader,
+		}
+		if _, err := compiler.Compile(ctx, name); err != nil {
+			issues = append(issues, BundleIssue{Variant: name, Kind: BundleIssueError, Layer: layer.GetID(), Msg: err.Error()})
+		}
+	}
+	return issues
+}
+
+func init() {
+	rootCmd.AddCommand(bundleCmd)
+	bundleCmd.AddCommand(bundleCheckCmd)
+	bundleCheckCmd.Flags().String("bundleProfile", "", "Check the variants of the named bundle profile")
+	bundleCheckCmd.Flags().String("output", "text", "Output format, text or json")
+}
+
+var bundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Schema bundle operations",
+	Long: `A bundle maps type names to schema variants. A bundle can import
+other bundles, and define named profiles:
+
+  import:
+    - common.bundle.yaml
+  typeNames:
+    Person:
+      schema: person.schema.json
+      overlays:
+        - schema: person-dpv.overlay.json
+  profiles:
+    dev:
+      typeNames:
+        Person:
+          overlays:
+            - schema: person-dev.overlay.json
+
+Imported bundles are merged first, and the definitions of the
+importing bundle override them: the schema of a variant replaces the
+imported schema, and the overlays are appended to the imported
+overlays, unless the variant sets replaceOverlays. The variants of
+the profile selected with --bundleProfile override the bundle
+variants the same way.`,
+}
+
+var bundleCheckCmd = &cobra.Command{
+	Use:   "check bundleFile...",
+	Short: "Check all variants of bundles",
+	Long: `Resolve, compose, and compile every variant of the bundles, and
+report missing layers, value type mismatches between schemas and
+overlays, unresolved references, and composition and compilation
+errors. Exits with nonzero status if there are issues.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := getContext()
+		profile, _ := cmd.Flags().GetString("bundleProfile")
+		bundle, err := readBundles(ctx, args, profile)
+		if err != nil {
+			return err
+		}
+		issues := bundle.Check(ctx, loadLayerFile, DefaultFileLoader)
+		format, _ := cmd.Flags().GetString("output")
+		if format == "json" {
+			d, _ := json.MarshalIndent(issues, "", "  ")
+			fmt.Println(string(d))
+		} else if len(issues) == 0 {
+			fmt.Printf("%d variants, no issues\n", len(bundle.TypeNames))
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "Variant\tIssue\tLayer\tMessage")
+			for _, x := range issues {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", x.Variant, x.Kind, x.Layer, x.Msg)
+			}
+			w.Flush()
+		}
+		if len(issues) > 0 {
+			os.Exit(1)
+		}
+		return nil
+	},
+}
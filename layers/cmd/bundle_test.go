@@ -0,0 +1,310 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+)
+
+func testLayerJSON(layerType, id, valueType, rootID, attributes string) string {
+	return `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "ls:` + layerType + `",
+  "@id": "` + id + `",
+  "ls:valueType": "` + valueType + `",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "` + rootID + `",
+    "ls:Object/attributes": [` + attributes + `]
+  }
+}`
+}
+
+func TestBundleImportProfileCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"person.json": testLayerJSON("Schema", "http://person/schema", "Person", "http://person",
+			`{"@id": "name", "@type": "ls:Value", "ls:attributeName": "name"},
+             {"@id": "contact", "@type": "ls:Reference", "ls:attributeName": "contact", "ls:Reference/ref": "Contact"}`),
+		"contact.json": testLayerJSON("Schema", "http://contact/schema", "Contact", "http://contact",
+			`{"@id": "email", "@type": "ls:Value", "ls:attributeName": "email"}`),
+		"dangling.json": testLayerJSON("Schema", "http://dangling/schema", "Dangling", "http://dangling",
+			`{"@id": "ref", "@type": "ls:Reference", "ls:Reference/ref": "Nowhere"}`),
+		"dpv.json": testLayerJSON("Overlay", "http://person/dpv", "Person", "http://person",
+			`{"@id": "name", "@type": "ls:Value", "ls:description": "dpv"}`),
+		"dev.json": testLayerJSON("Overlay", "http://person/dev", "Person", "http://person",
+			`{"@id": "name", "@type": "ls:Value", "ls:description": "dev"}`),
+		"other.json": testLayerJSON("Overlay", "http://other/ovl", "Other", "http://person",
+			`{"@id": "name", "@type": "ls:Value", "ls:description": "other"}`),
+		"common.bundle.json": `{"typeNames": {
+  "Person": {"schema": "person.json", "overlays": [{"schema": "dpv.json"}]},
+  "Contact": {"schema": "contact.json"}}}`,
+		"app.bundle.json": `{"import": ["common.bundle.json"],
+  "profiles": {"dev": {"typeNames": {"Person": {"overlays": [{"schema": "dev.json"}], "replaceOverlays": true}}}}}`,
+		"broken.bundle.json": `{"import": ["app.bundle.json"], "typeNames": {
+  "Mismatch": {"schema": "person.json", "overlays": [{"schema": "other.json"}]},
+  "Missing": {"schema": "missing.json"},
+  "Dangling": {"schema": "dangling.json"}}}`,
+		"cycle1.bundle.json": `{"import": ["cycle2.bundle.json"]}`,
+		"cycle2.bundle.json": `{"import": ["cycle1.bundle.json"]}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := ls.DefaultContext()
+	description := func(profile string) string {
+		loader, err := LoadBundleProfile(ctx, []string{filepath.Join(dir, "app.bundle.json")}, profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layer, err := loader.LoadSchema("Person")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ls.AsPropertyValue(layer.GetAttributeByID("name").GetProperty(ls.DescriptionTerm)).AsString()
+	}
+	if s := description(""); s != "dpv" {
+		t.Errorf("Wrong imported variant: %s", s)
+	}
+	if s := description("dev"); s != "dev" {
+		t.Errorf("Wrong profile variant: %s", s)
+	}
+	if _, err := readBundles(ctx, []string{filepath.Join(dir, "app.bundle.json")}, "prod"); err == nil {
+		t.Errorf("Expecting unknown profile error")
+	}
+
+	bundle, err := readBundles(ctx, []string{filepath.Join(dir, "app.bundle.json")}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issues := bundle.Check(ctx, loadLayerFile, DefaultFileLoader); len(issues) != 0 {
+		t.Errorf("Unexpected issues: %v", issues)
+	}
+
+	bundle, err = readBundles(ctx, []string{filepath.Join(dir, "broken.bundle.json")}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]string)
+	for _, x := range bundle.Check(ctx, loadLayerFile, DefaultFileLoader) {
+		found[x.Variant] = x.Kind
+	}
+	expected := map[string]string{
+		"Mismatch": BundleIssueValueTypeMismatch,
+		"Missing":  BundleIssueMissingLayer,
+		"Dangling": BundleIssueUnresolvedReference,
+	}
+	for k, v := range expected {
+		if found[k] != v {
+			t.Errorf("Expecting %s for %s, got %s", v, k, found[k])
+		}
+	}
+	if len(found) != len(expected) {
+		t.Errorf("Unexpected issues: %v", found)
+	}
+
+	_, err = readBundles(ctx, []string{filepath.Join(dir, "cycle1.bundle.json")}, "")
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Expecting import cycle error, got %v", err)
+	}
+}
+
+func TestBundleCacheKeyJSONSchemaRefs(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"a.json":      `{"definitions": {"Person": {"type": "object", "properties": {"address": {"$ref": "b.json#/definitions/Address"}}}}}`,
+		"b.json":      `{"definitions": {"Address": {"$ref": "c.json"}}}`,
+		"c.json":      `{"type": "string"}`,
+		"bundle.json": `{"typeNames": {"Person": {"jsonSchema": {"ref": "a.json#/definitions/Person", "layerId": "http://person"}}}}`,
+	})
+	bundle := filepath.Join(dir, "bundle.json")
+	key1, err := bundleCacheKey(ls.DefaultContext(), []string{bundle}, "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "c.json"), []byte(`{"type": "integer"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	key2, err := bundleCacheKey(ls.DefaultContext(), []string{bundle}, "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key1 == key2 {
+		t.Errorf("Key did not change with a transitively referenced file")
+	}
+	key3, err := bundleCacheKey(ls.DefaultContext().SetProvenance(true), []string{bundle}, "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key3 == key2 {
+		t.Errorf("Key did not change with provenance")
+	}
+}
+
+func TestBundleCacheKeyFileHashes(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"a.json":      `{"definitions": {"Person": {"type": "string"}}}`,
+		"bundle.json": `{"typeNames": {"Person": {"jsonSchema": {"ref": "a.json#/definitions/Person", "layerId": "http://person"}}}}`,
+	})
+	bundle := filepath.Join(dir, "bundle.json")
+	file := filepath.Join(dir, "a.json")
+	key1, err := bundleCacheKey(ls.DefaultContext(), []string{bundle}, "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file with the same modification time and size is not read again
+	if err := ioutil.WriteFile(file, []byte(`{"definitions": {"Person": {"type": "object"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	key2, err := bundleCacheKey(ls.DefaultContext(), []string{bundle}, "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key1 != key2 {
+		t.Errorf("Unchanged file is hashed again")
+	}
+	modTime := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	key3, err := bundleCacheKey(ls.DefaultContext(), []string{bundle}, "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key3 == key2 {
+		t.Errorf("Key did not change with the modification time")
+	}
+}
+
+func TestBundleOverlayInheritedAttribute(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"person.json": testLayerJSON("Schema", "http://person/schema", "Person", "http://person",
+			`{"@id": "name", "@type": "ls:Value", "ls:attributeName": "name"},
+             {"@id": "address", "@type": "ls:Object", "ls:attributeName": "address",
+              "ls:Object/attributes": [{"@id": "city", "@type": "ls:Value", "ls:attributeName": "city"}]}`),
+		"patient.json": `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "ls:Schema",
+  "@id": "http://patient/schema",
+  "ls:valueType": "Patient",
+  "ls:extends": "Person",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "http://patient",
+    "ls:Object/attributes": [{"@id": "mrn", "@type": "ls:Value", "ls:attributeName": "mrn"}]
+  }
+}`,
+		"patient.ovl.json": `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "ls:Overlay",
+  "@id": "http://patient/ovl",
+  "ls:valueType": "Patient",
+  "ls:attributeOverlays": {"@list": [
+    {"@id": "name", "@type": "ls:Value", "ls:description": "patient name"},
+    {"@id": "city", "@type": "ls:Value", "ls:description": "patient city"}
+  ]}
+}`,
+		"bundle.json": `{"typeNames": {
+  "Patient": {"schema": "patient.json", "overlays": [{"schema": "patient.ovl.json"}]},
+  "Person": {"schema": "person.json"}}}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := ls.DefaultContext()
+	loader, err := LoadBundle(ctx, []string{filepath.Join(dir, "bundle.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler := ls.Compiler{Loader: loader}
+	patient, err := compiler.Compile(ctx, "Patient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, expected := range map[string]string{"name": "patient name", "city": "patient city"} {
+		node := patient.GetAttributeByID(id)
+		if node == nil {
+			t.Errorf("Missing inherited attribute %s", id)
+			continue
+		}
+		if s := ls.AsPropertyValue(node.GetProperty(ls.DescriptionTerm)).AsString(); s != expected {
+			t.Errorf("Wrong description for %s: %s", id, s)
+		}
+	}
+	if patient.GetAttributeByID("mrn") == nil {
+		t.Errorf("Missing mrn")
+	}
+	person, err := loader.LoadSchema("Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := ls.AsPropertyValue(person.GetAttributeByID("name").GetProperty(ls.DescriptionTerm)).AsString(); s != "" {
+		t.Errorf("Base schema modified by overlay: %s", s)
+	}
+}
+
+func TestBundleBaseOverlays(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"base.bundle.json": `{"conflictPolicy": "preferLater", "typeNames": {
+  "Person": {"schema": "person.json", "overlays": [{"schema": "dpv.json"}], "replaceOverlays": true},
+  "Contact": {"schema": "contact.json"}}}`,
+		"app.bundle.json": `{"base": "base.bundle.json", "typeNames": {
+  "Person": {"overlays": [{"schema": "dev.json"}]},
+  "Contact": {"schema": "contact2.json"}}}`,
+		"replace.bundle.json": `{"base": "base.bundle.json", "typeNames": {
+  "Person": {"overlays": [{"schema": "dev.json"}], "replaceOverlays": true}}}`,
+	})
+	ctx := ls.DefaultContext()
+	overlays := func(variant *BundleVariant) []string {
+		ret := make([]string, 0)
+		for _, x := range variant.Overlays {
+			ret = append(ret, filepath.Base(x.Schema))
+		}
+		return ret
+	}
+	bundle, err := readBundles(ctx, []string{filepath.Join(dir, "app.bundle.json")}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := overlays(bundle.TypeNames["Person"]); strings.Join(s, ",") != "dpv.json,dev.json" {
+		t.Errorf("Wrong overlays: %v", s)
+	}
+	if s := filepath.Base(bundle.TypeNames["Contact"].Schema); s != "contact2.json" {
+		t.Errorf("Base schema overrides derived schema: %s", s)
+	}
+	if bundle.ConflictPolicy != "preferLater" {
+		t.Errorf("Wrong conflict policy: %s", bundle.ConflictPolicy)
+	}
+
+	bundle, err = readBundles(ctx, []string{filepath.Join(dir, "replace.bundle.json")}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := overlays(bundle.TypeNames["Person"]); strings.Join(s, ",") != "dev.json" {
+		t.Errorf("Wrong replaced overlays: %v", s)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+)
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheClearCmd)
+}
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Compiled schema cache operations",
+	Long: `Compiled schemas are cached on disk, keyed by the contents of all
+the files contributing to the schema and the LSA version. The cache
+directory is $LSA_CACHE_DIR if set, or lsa/compiled under the user
+cache directory. Use --noCache to disable the cache.`,
+}
+
+var cacheClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Remove all cached compiled schemas",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir, err := ls.DefaultCompiledSchemaCacheDir()
+		if err != nil {
+			return err
+		}
+		cache := ls.CompiledSchemaCache{Dir: dir}
+		if err := cache.Clear(); err != nil {
+			return err
+		}
+		fmt.Printf("Cleared %s\n", dir)
+		return nil
+	},
+}
@@ -19,6 +19,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 
 	"github.com/spf13/cobra"
 
@@ -28,6 +30,9 @@ import (
 )
 
 func ReadGraph(gfile []string, interner ls.Interner, inputFormat string) (graph.Graph, error) {
+	if inputFormat == "binary" {
+		return ReadBinaryGraph(gfile, interner)
+	}
 	if inputFormat == "json" {
 		return ReadJSONGraph(gfile, interner)
 	}
@@ -37,17 +42,82 @@ func ReadGraph(gfile []string, interner ls.Interner, inputFormat string) (graph.
 	return nil, fmt.Errorf("Unrecognized input format: %s", inputFormat)
 }
 
+// ReadGraphFrom reads a graph from the reader in the given format
+func ReadGraphFrom(in io.Reader, interner ls.Interner, inputFormat string) (graph.Graph, error) {
+	if inputFormat == "binary" {
+		target := graph.NewOCGraph()
+		err := ls.NewBinaryGraphDecoder(in, interner).Decode(target)
+		return target, err
+	}
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	if inputFormat == "json" {
+		return unmarshalJSONGraph(data, interner)
+	}
+	if inputFormat == "jsonld" {
+		return unmarshalJSONLDGraph(data, interner)
+	}
+	return nil, fmt.Errorf("Unrecognized input format: %s", inputFormat)
+}
+
+// ReadBinaryGraph reads a graph in binary format from the files, or
+// from stdin if there are no files. The graphs of all files are read
+// into the same graph. The input is streamed.
+func ReadBinaryGraph(gfile []string, interner ls.Interner) (graph.Graph, error) {
+	if len(gfile) == 0 {
+		return ReadGraphFrom(os.Stdin, interner, "binary")
+	}
+	target := graph.NewOCGraph()
+	for _, file := range gfile {
+		if err := readBinaryGraphFile(file, interner, target); err != nil {
+			return nil, fmt.Errorf("While reading %s: %w", file, err)
+		}
+	}
+	return target, nil
+}
+
+func readBinaryGraphFile(file string, interner ls.Interner, target graph.Graph) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ls.NewBinaryGraphDecoder(f, interner).Decode(target)
+}
+
+// GraphFileFormat returns "binary" if the file is a binary graph
+// file, and "json" otherwise
+func GraphFileFormat(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	header := make([]byte, len(ls.BinaryGraphMagic))
+	n, _ := io.ReadFull(f, header)
+	if ls.IsBinaryGraph(header[:n]) {
+		return "binary", nil
+	}
+	return "json", nil
+}
+
 func ReadJSONLDGraph(gfile []string, interner ls.Interner) (graph.Graph, error) {
 	data, err := ReadFileOrStdin(gfile)
 	if err != nil {
 		return nil, err
 	}
+	return unmarshalJSONLDGraph(data, interner)
+}
+
+func unmarshalJSONLDGraph(data []byte, interner ls.Interner) (graph.Graph, error) {
 	var v interface{}
 	if err := json.Unmarshal(data, &v); err != nil {
 		return nil, err
 	}
 	g := graph.NewOCGraph()
-	err = ls.UnmarshalJSONLDGraph(v, g, interner)
+	err := ls.UnmarshalJSONLDGraph(v, g, interner)
 	return g, err
 }
 
@@ -56,14 +126,20 @@ func ReadJSONGraph(gfile []string, interner ls.Interner) (graph.Graph, error) {
 	if err != nil {
 		return nil, err
 	}
+	return unmarshalJSONGraph(data, interner)
+}
+
+func unmarshalJSONGraph(data []byte, interner ls.Interner) (graph.Graph, error) {
 	target := graph.NewOCGraph()
-	m := ls.JSONMarshaler{}
-	err = m.Unmarshal(data, target)
+	m := ls.NewJSONMarshaler(interner)
+	err := m.Unmarshal(data, target)
 	return target, err
 }
 
 func WriteGraph(cmd *cobra.Command, graph graph.Graph, format string, out io.Writer) error {
 	switch format {
+	case "binary":
+		return ls.NewBinaryGraphEncoder(out).Encode(graph)
 	case "json":
 		m := ls.JSONMarshaler{}
 		return m.Encode(graph, out)
@@ -0,0 +1,50 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmdutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+)
+
+func TestReadBinaryGraphFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := make([]string, 0)
+	for _, name := range []string{"a.bin", "b.bin"} {
+		g := ls.NewDocumentGraph()
+		n := g.NewNode([]string{ls.DocumentNodeTerm}, map[string]interface{}{ls.NodeValueTerm: ls.StringPropertyValue(name)})
+		g.NewEdge(n, g.NewNode([]string{ls.DocumentNodeTerm}, nil), ls.HasTerm, nil)
+		buf := bytes.Buffer{}
+		if err := ls.NewBinaryGraphEncoder(&buf).Encode(g); err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	g, err := ReadBinaryGraph(files, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.NumNodes() != 4 || g.NumEdges() != 2 {
+		t.Errorf("Expecting 4 nodes and 2 edges, got %d %d", g.NumNodes(), g.NumEdges())
+	}
+}
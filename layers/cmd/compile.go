@@ -20,7 +20,6 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/cloudprivacylabs/lsa/pkg/ls"
-	"github.com/cloudprivacylabs/lsa/pkg/repo/fs"
 
 	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
 )
@@ -49,22 +48,11 @@ var compileCmd = &cobra.Command{
 				fail("Schema is required")
 			}
 			if len(repoDir) > 0 {
-				var repo *fs.Repository
-				var err error
-				repo, err = getRepo(repoDir, ctx.GetInterner())
+				repo, err := getRepo(repoDir, ctx.GetInterner())
 				if err != nil {
 					failErr(err)
 				}
-				layer, err = repo.GetComposedSchema(ctx, schemaName)
-				if err != nil {
-					failErr(err)
-				}
-				compiler := ls.Compiler{
-					Loader: ls.SchemaLoaderFunc(func(x string) (*ls.Layer, error) {
-						return repo.LoadAndCompose(ctx, x)
-					}),
-				}
-				layer, err = compiler.Compile(ctx, schemaName)
+				layer, err = repo.GetCompiledSchema(ctx, schemaName)
 				if err != nil {
 					failErr(err)
 				}
@@ -95,7 +83,8 @@ var compileCmd = &cobra.Command{
 				}
 			}
 		} else {
-			loader, err := LoadBundle(ctx, bundleNames)
+			bundleProfile, _ := cmd.Flags().GetString("bundleProfile")
+			loader, err := LoadBundleProfile(ctx, bundleNames, bundleProfile)
 			if err != nil {
 				failErr(err)
 			}
@@ -18,6 +18,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 
 	"github.com/spf13/cobra"
 
@@ -30,31 +32,91 @@ func init() {
 	composeCmd.Flags().String("output", "jsonld", "Output format (dot, json, jsonld, web)")
 	composeCmd.Flags().String("repo", "", "Schema repository directory. If a repository is given, all layers are resolved using that repository. Otherwise, all layers are read as files.")
 	composeCmd.Flags().StringSlice("bundle", nil, "Bundle file(s)")
+	composeCmd.Flags().String("bundleProfile", "", "Use the variants of the named bundle profile")
 	composeCmd.Flags().String("type", "", "Value Type")
+	composeCmd.Flags().Bool("provenance", false, "Record the layers contributing to each attribute term in the output")
+	composeCmd.Flags().String("conflictPolicy", "", "Composition conflict policy (error, preferLater, preferEarlier/preferSchema). Overrides the bundle conflict policy")
+	composeCmd.Flags().Bool("dryRun", false, "Compose without failing on conflicts, and report all composition conflicts. With --bundle and without --type, composes all variants of the bundle")
+}
+
+// sortConflicts sorts conflicts by attribute, term, and source layer
+func sortConflicts(conflicts []ls.CompositionConflict) {
+	sort.SliceStable(conflicts, func(i, j int) bool {
+		if conflicts[i].AttributeID != conflicts[j].AttributeID {
+			return conflicts[i].AttributeID < conflicts[j].AttributeID
+		}
+		if conflicts[i].Term != conflicts[j].Term {
+			return conflicts[i].Term < conflicts[j].Term
+		}
+		return conflicts[i].SourceLayer < conflicts[j].SourceLayer
+	})
+}
+
+// writeConflicts writes the conflict report as json, or as text
+func writeConflicts(conflicts []ls.CompositionConflict, format string) {
+	sortConflicts(conflicts)
+	if format == "json" {
+		d, _ := json.MarshalIndent(conflicts, "", "  ")
+		fmt.Println(string(d))
+		return
+	}
+	if len(conflicts) == 0 {
+		fmt.Println("No conflicts")
+		return
+	}
+	for _, c := range conflicts {
+		fmt.Printf("%s %s:\n", c.AttributeID, c.Term)
+		fmt.Printf("    %v (%s)\n", c.TargetValue, strings.Join(c.TargetLayers, ", "))
+		fmt.Printf("    %v (%s)\n", c.SourceValue, c.SourceLayer)
+	}
 }
 
 var composeCmd = &cobra.Command{
 	Use:   "compose",
 	Short: "Compose a schema from components",
-	Long:  `Compose a schema from components and output the resulting schema layer.`,
+	Long: `Compose a schema from components and output the resulting schema layer.
+
+If two layers set different values for a term that cannot be composed,
+composition fails. Use --dryRun to collect and report all such
+conflicts, or --conflictPolicy to resolve them by preferring the later
+or the earlier layer. Bundles can also declare a conflictPolicy.`,
 
 	Args: cobra.MinimumNArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := getContext()
+		provenance, _ := cmd.Flags().GetBool("provenance")
+		dryRun, _ := cmd.Flags().GetBool("dryRun")
+		// Provenance gives the layers contributing conflicting values
+		ctx.SetProvenance(provenance || dryRun)
+		if p, _ := cmd.Flags().GetString("conflictPolicy"); len(p) > 0 {
+			policy, err := ls.ParseConflictPolicy(p)
+			if err != nil {
+				failErr(err)
+			}
+			ctx.SetConflictPolicy(policy)
+		}
+		var conflicts *ls.CompositionConflicts
+		if dryRun {
+			conflicts = &ls.CompositionConflicts{}
+			ctx.SetConflictRecorder(conflicts)
+		}
 		repoDir, _ := cmd.Flags().GetString("repo")
 		bundleNames, _ := cmd.Flags().GetStringSlice("bundle")
 		typeName, _ := cmd.Flags().GetString("type")
 		interner := ls.NewInterner()
 		var output *ls.Layer
 		if len(repoDir) == 0 {
-			if len(bundleNames) > 0 && len(typeName) > 0 {
-				bundle, err := LoadBundle(ctx, bundleNames)
+			if len(bundleNames) > 0 && (len(typeName) > 0 || dryRun) {
+				bundleProfile, _ := cmd.Flags().GetString("bundleProfile")
+				bundle, err := LoadBundleProfile(ctx, bundleNames, bundleProfile)
 				if err != nil {
 					failErr(err)
 				}
-				output, err = bundle.LoadSchema(typeName)
-				if err != nil {
-					failErr(err)
+				if len(typeName) > 0 {
+					output, err = bundle.LoadSchema(typeName)
+					if err != nil {
+						failErr(err)
+					}
 				}
 			} else {
 				if len(args) == 0 {
@@ -88,6 +150,15 @@ var composeCmd = &cobra.Command{
 				failErr(err)
 			}
 		}
+		if dryRun {
+			format, _ := cmd.Flags().GetString("output")
+			all := conflicts.All()
+			writeConflicts(all, format)
+			if len(all) > 0 {
+				os.Exit(1)
+			}
+			return
+		}
 		if output != nil {
 			format, _ := cmd.Flags().GetString("output")
 			if format == "jsonld" {
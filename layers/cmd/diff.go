@@ -0,0 +1,145 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
+	"github.com/cloudprivacylabs/lsa/pkg/diff"
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+)
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().Bool("compat", false, "Check if the new schema is compatible with the old schema")
+	diffCmd.Flags().String("repo", "", "Schema repository directory. If given, layers are loaded from the repository and can be given as id@version")
+	diffCmd.Flags().StringSlice("bundle", nil, "Bundle file(s). If given, layers are loaded by type name from the bundle")
+	diffCmd.Flags().String("output", "text", "Output format (text, json, dot). Compatibility reports support text and json")
+	diffCmd.Flags().Bool("failOnBreaking", false, "Exit with nonzero status if there are breaking changes")
+}
+
+// loadLayerForDiff loads a layer from a repository, a bundle, or a file
+func loadLayerForDiff(ctx *ls.Context, cmd *cobra.Command, name string) (*ls.Layer, error) {
+	repoDir, _ := cmd.Flags().GetString("repo")
+	bundleNames, _ := cmd.Flags().GetStringSlice("bundle")
+	var layer *ls.Layer
+	switch {
+	case len(repoDir) > 0:
+		repo, err := getRepo(repoDir, ctx.GetInterner())
+		if err != nil {
+			return nil, err
+		}
+		layer, err = repo.LoadAndCompose(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+	case len(bundleNames) > 0:
+		bundle, err := LoadBundle(ctx, bundleNames)
+		if err != nil {
+			return nil, err
+		}
+		layer, err = bundle.LoadSchema(name)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		data, err := cmdutil.ReadURL(name)
+		if err != nil {
+			return nil, err
+		}
+		layers, err := ReadLayers(data, ctx.GetInterner())
+		if err != nil {
+			return nil, err
+		}
+		layer = layers[0]
+	}
+	if layer == nil {
+		return nil, fmt.Errorf("Not found: %s", name)
+	}
+	return layer, nil
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff oldLayer newLayer",
+	Short: "Compare two layers",
+	Long: `Compare two layers, or two composed schema variants.
+
+Reports the added, removed, and moved attributes, and the property
+changes of each attribute. Attributes are matched by ID, and by
+attribute name path if the ID changed. With --output dot, renders the
+attribute trees with added, removed, moved, and modified attributes
+color coded.
+
+With --compat, compares a new version of a schema to the old version
+and classifies the changes as compatible or breaking. Removed
+attributes, type changes, new required attributes, narrowed
+enumerations, new or changed patterns, changed entityIdFields, and
+changed reference targets are breaking. Attributes are matched by ID,
+and by attribute name path if the ID changed.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := getContext()
+		compat, _ := cmd.Flags().GetBool("compat")
+		output, _ := cmd.Flags().GetString("output")
+		oldLayer, err := loadLayerForDiff(ctx, cmd, args[0])
+		if err != nil {
+			return err
+		}
+		newLayer, err := loadLayerForDiff(ctx, cmd, args[1])
+		if err != nil {
+			return err
+		}
+		if !compat {
+			d := diff.Diff(oldLayer, newLayer)
+			switch output {
+			case "json":
+				data, err := json.MarshalIndent(d, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(data))
+			case "text":
+				d.WriteText(os.Stdout)
+			case "dot":
+				return d.WriteDOT(os.Stdout)
+			default:
+				return fmt.Errorf("Unknown output format: %s", output)
+			}
+			return nil
+		}
+		report := diff.CheckCompatibility(oldLayer, newLayer)
+		switch output {
+		case "json":
+			data, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+		case "text":
+			report.WriteText(os.Stdout)
+		default:
+			return fmt.Errorf("Unknown output format: %s", output)
+		}
+		if failOnBreaking, _ := cmd.Flags().GetBool("failOnBreaking"); failOnBreaking && !report.Compatible {
+			os.Exit(1)
+		}
+		return nil
+	},
+}
@@ -24,7 +24,7 @@ import (
 
 func init() {
 	rootCmd.AddCommand(dotCmd)
-	dotCmd.Flags().String("input", "json", "Input graph format (json, jsonld)")
+	dotCmd.Flags().String("input", "json", "Input graph format (json, jsonld, binary)")
 	dotCmd.Flags().String("rankdir", "LR", "rankdir")
 	dotCmd.Flags().String("output", "dot", "Output format (dot, json, jsonld, web)")
 }
@@ -0,0 +1,144 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+)
+
+func init() {
+	rootCmd.AddCommand(explainCmd)
+	explainCmd.Flags().String("repo", "", "Schema repository directory")
+	explainCmd.Flags().String("schema", "", "Schema variant id to compose from the repository")
+	explainCmd.Flags().StringSlice("bundle", nil, "Bundle file(s)")
+	explainCmd.Flags().String("type", "", "Value type of the variant to compose from the bundle")
+	explainCmd.Flags().String("output", "text", "Output format (text, json)")
+}
+
+// explainedTerm is the provenance of a term with the final value
+type explainedTerm struct {
+	ls.ProvenanceEntry
+	Value interface{} `json:"value,omitempty"`
+}
+
+var explainCmd = &cobra.Command{
+	Use:   "explain attributeId [layer files...]",
+	Short: "Explain which layers contributed the terms of an attribute",
+	Long: `Compose a schema with provenance recording, and explain which layers
+contributed the value of each term of the given attribute.
+
+The schema is composed from the schema variant given with --repo and
+--schema, from the bundle variant given with --bundle and --type, or
+from the layer files given as arguments. A single layer file that is
+already composed with provenance is used as is.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := getContext()
+		ctx.SetProvenance(true)
+		repoDir, _ := cmd.Flags().GetString("repo")
+		bundleNames, _ := cmd.Flags().GetStringSlice("bundle")
+		var layer *ls.Layer
+		switch {
+		case len(repoDir) > 0:
+			schemaName, _ := cmd.Flags().GetString("schema")
+			repo, err := getRepo(repoDir, ctx.GetInterner())
+			if err != nil {
+				return err
+			}
+			layer, err = repo.LoadAndCompose(ctx, schemaName)
+			if err != nil {
+				return err
+			}
+		case len(bundleNames) > 0:
+			typeName, _ := cmd.Flags().GetString("type")
+			bundle, err := LoadBundle(ctx, bundleNames)
+			if err != nil {
+				return err
+			}
+			layer, err = bundle.LoadSchema(typeName)
+			if err != nil {
+				return err
+			}
+		default:
+			if len(args) < 2 {
+				return fmt.Errorf("Layer files required")
+			}
+			for _, file := range args[1:] {
+				data, err := cmdutil.ReadURL(file)
+				if err != nil {
+					return err
+				}
+				layers, err := ReadLayers(data, ctx.GetInterner())
+				if err != nil {
+					return fmt.Errorf("Cannot read %s: %w", file, err)
+				}
+				if layer == nil {
+					layer = layers[0]
+					continue
+				}
+				if err := layer.Compose(ctx, layers[0]); err != nil {
+					return fmt.Errorf("Cannot compose %s: %w", file, err)
+				}
+			}
+		}
+		if layer == nil {
+			return fmt.Errorf("Schema not found")
+		}
+		attr := layer.GetAttributeByID(args[0])
+		if attr == nil {
+			return fmt.Errorf("Attribute not found: %s", args[0])
+		}
+		terms := make([]explainedTerm, 0)
+		for _, entry := range ls.GetProvenance(attr) {
+			t := explainedTerm{ProvenanceEntry: entry}
+			if pv := ls.AsPropertyValue(attr.GetProperty(entry.Term)); pv != nil {
+				t.Value = pv.GetNativeValue()
+			}
+			terms = append(terms, t)
+		}
+		output, _ := cmd.Flags().GetString("output")
+		switch output {
+		case "json":
+			data, err := json.MarshalIndent(map[string]interface{}{
+				"attributeId": args[0],
+				"layerId":     layer.GetID(),
+				"terms":       terms,
+			}, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+		case "text":
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "Term\tValue\tComposition\tLayers")
+			for _, t := range terms {
+				fmt.Fprintf(w, "%s\t%v\t%s\t%s\n", t.Term, t.Value, t.Composition, strings.Join(t.Layers, ", "))
+			}
+			return w.Flush()
+		default:
+			return fmt.Errorf("Unknown output format: %s", output)
+		}
+		return nil
+	},
+}
@@ -23,6 +23,7 @@ import (
 
 	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
 	lscsv "github.com/cloudprivacylabs/lsa/pkg/csv"
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
 )
 
 type CSVExport struct {
@@ -51,7 +52,7 @@ params:`)
         The query is evauated with 'root' pointing to the current row root node`)
 }
 
-func (ecsv *CSVExport) Run(pipeline *PipelineContext) error {
+func (ecsv *CSVExport) Run(pipeline *pipeline.PipelineContext) error {
 	if !ecsv.initialized {
 		if ecsv.SpecFile != "" {
 			if err := cmdutil.ReadJSONOrYAML(ecsv.SpecFile, &ecsv.Writer); err != nil {
@@ -73,7 +74,7 @@ func (ecsv *CSVExport) Run(pipeline *PipelineContext) error {
 			}
 			ecsv.csvWriter = csv.NewWriter(f)
 		} else {
-			ecsv.csvWriter = csv.NewWriter(os.Stdout)
+			ecsv.csvWriter = csv.NewWriter(pipeline.Output)
 		}
 		ecsv.initialized = true
 	}
@@ -88,10 +89,10 @@ func (ecsv *CSVExport) Run(pipeline *PipelineContext) error {
 
 func init() {
 	exportCmd.AddCommand(exportCSVCmd)
-	exportCSVCmd.Flags().String("input", "json", "Input graph format (json, jsonld)")
+	exportCSVCmd.Flags().String("input", "json", "Input graph format (json, jsonld, binary)")
 	exportCSVCmd.Flags().String("spec", "", "Export spec")
 
-	operations["export/csv"] = func() Step { return &CSVExport{} }
+	pipeline.RegisterStep("export/csv", func() pipeline.Step { return &CSVExport{} })
 }
 
 var exportCSVCmd = &cobra.Command{
@@ -120,7 +121,7 @@ row root node. If a column query is not specified, it is assumed to be:
 	RunE: func(cmd *cobra.Command, args []string) error {
 		step := &CSVExport{}
 		step.SpecFile, _ = cmd.Flags().GetString("spec")
-		p := []Step{
+		p := []pipeline.Step{
 			NewReadGraphStep(cmd),
 			step,
 		}
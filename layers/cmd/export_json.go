@@ -20,6 +20,7 @@ import (
 	"github.com/spf13/cobra"
 
 	jsoningest "github.com/cloudprivacylabs/lsa/pkg/json"
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
 	"github.com/cloudprivacylabs/opencypher/graph"
 )
 
@@ -34,23 +35,23 @@ operation: export/json
 params:`)
 }
 
-func (*JSONExport) Run(pipeline *PipelineContext) error {
+func (*JSONExport) Run(pipeline *pipeline.PipelineContext) error {
 	for _, node := range graph.Sources(pipeline.GetGraphRO()) {
 		exportOptions := jsoningest.ExportOptions{}
 		data, err := jsoningest.Export(node, exportOptions)
 		if err != nil {
 			failErr(err)
 		}
-		data.Encode(ExportTarget)
+		data.Encode(pipeline.Output)
 	}
 	return nil
 }
 
 func init() {
 	exportCmd.AddCommand(exportJSONCmd)
-	exportJSONCmd.Flags().String("input", "json", "Input graph format (json, jsonld)")
+	exportJSONCmd.Flags().String("input", "json", "Input graph format (json, jsonld, binary)")
 
-	operations["export/json"] = func() Step { return &JSONExport{} }
+	pipeline.RegisterStep("export/json", func() pipeline.Step { return &JSONExport{} })
 }
 
 var exportJSONCmd = &cobra.Command{
@@ -59,7 +60,7 @@ var exportJSONCmd = &cobra.Command{
 	Args:  cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		step := &JSONExport{}
-		p := []Step{
+		p := []pipeline.Step{
 			NewReadGraphStep(cmd),
 			step,
 		}
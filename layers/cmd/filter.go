@@ -0,0 +1,249 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cloudprivacylabs/opencypher"
+	"github.com/cloudprivacylabs/opencypher/graph"
+	"github.com/spf13/cobra"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
+)
+
+// FilterStep keeps or drops the nodes of the graph that match any of
+// the given criteria. The filtered graph becomes the pipeline graph.
+type FilterStep struct {
+	// Drop the matching nodes instead of keeping them
+	Drop   bool     `json:"drop" yaml:"drop"`
+	Labels []string `json:"labels" yaml:"labels"`
+	// Properties are of the form term, or term=value
+	Properties    []string `json:"properties" yaml:"properties"`
+	SchemaNodeIDs []string `json:"schemaNodeIds" yaml:"schemaNodeIds"`
+	// Pattern is an openCypher query. The nodes in the results match.
+	Pattern string `json:"pattern" yaml:"pattern"`
+	// IncludeEntity selects the descendants of the matching nodes
+	// within the same entity
+	IncludeEntity bool `json:"includeEntity" yaml:"includeEntity"`
+	// IncludeSchema keeps the schema nodes the kept document nodes are
+	// instances of
+	IncludeSchema bool `json:"includeSchema" yaml:"includeSchema"`
+}
+
+func (FilterStep) Help() {
+	fmt.Println(`Filter the graph
+Keep or drop the nodes that match any of the given criteria. The
+edges between kept nodes are kept. The filtered graph becomes the
+pipeline graph.
+
+operation: filter
+params:
+  drop: false            # Drop the matching nodes instead of keeping them
+  labels:                # Nodes with any of these labels match
+    - label
+  properties:            # Nodes with the property, or the property value
+    - term
+    - term=value
+  schemaNodeIds:         # Instances of these schema nodes match
+    - schemaNodeId
+  pattern: openCypher    # Nodes in the query results match, e.g.
+                         # match (n {entitySchema:"https://person"}) return n
+  includeEntity: false   # Also select the descendants of the matching
+                         # nodes within the same entity
+  includeSchema: false   # Keep the schema nodes of the kept nodes`)
+}
+
+// matches returns the nodes of g that match any of the criteria
+func (step *FilterStep) matches(g graph.Graph) (map[graph.Node]struct{}, error) {
+	ret := make(map[graph.Node]struct{})
+	type propertyFilter struct {
+		term  string
+		value *string
+	}
+	props := make([]propertyFilter, 0, len(step.Properties))
+	for _, p := range step.Properties {
+		if i := strings.Index(p, "="); i != -1 {
+			v := p[i+1:]
+			props = append(props, propertyFilter{term: p[:i], value: &v})
+		} else {
+			props = append(props, propertyFilter{term: p})
+		}
+	}
+	schemaNodeIDs := make(map[string]struct{}, len(step.SchemaNodeIDs))
+	for _, x := range step.SchemaNodeIDs {
+		schemaNodeIDs[x] = struct{}{}
+	}
+	for nodes := g.GetNodes(); nodes.Next(); {
+		node := nodes.Node()
+		matched := false
+		labels := node.GetLabels()
+		for _, l := range step.Labels {
+			if labels.Has(l) {
+				matched = true
+				break
+			}
+		}
+		if !matched && len(schemaNodeIDs) > 0 {
+			_, matched = schemaNodeIDs[ls.AsPropertyValue(node.GetProperty(ls.SchemaNodeIDTerm)).AsString()]
+		}
+		for i := 0; i < len(props) && !matched; i++ {
+			v, ok := node.GetProperty(props[i].term)
+			if !ok {
+				continue
+			}
+			if props[i].value == nil {
+				matched = true
+			} else if pv, ok := v.(*ls.PropertyValue); ok {
+				matched = pv.Has(*props[i].value)
+			} else {
+				matched = fmt.Sprint(v) == *props[i].value
+			}
+		}
+		if matched {
+			ret[node] = struct{}{}
+		}
+	}
+	if len(step.Pattern) > 0 {
+		v, err := opencypher.ParseAndEvaluate(step.Pattern, opencypher.NewEvalContext(g))
+		if err != nil {
+			return nil, err
+		}
+		rs, ok := v.Get().(opencypher.ResultSet)
+		if !ok {
+			return nil, fmt.Errorf("Filter pattern does not return a result set: %s", step.Pattern)
+		}
+		for _, row := range rs.Rows {
+			for _, col := range row {
+				switch t := col.Get().(type) {
+				case graph.Node:
+					ret[t] = struct{}{}
+				case []graph.Edge:
+					for _, edge := range t {
+						ret[edge.GetFrom()] = struct{}{}
+						ret[edge.GetTo()] = struct{}{}
+					}
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Filter returns a new graph containing the filtered nodes of g
+func (step *FilterStep) Filter(g graph.Graph) (graph.Graph, error) {
+	selected, err := step.matches(g)
+	if err != nil {
+		return nil, err
+	}
+	if step.IncludeEntity {
+		for node := range selected {
+			ls.IterateDescendants(node, func(n graph.Node) bool {
+				selected[n] = struct{}{}
+				return true
+			}, func(edge graph.Edge) ls.EdgeFuncResult {
+				if !ls.IsDocumentNode(edge.GetTo()) {
+					return ls.SkipEdgeResult
+				}
+				return ls.FollowEdgesInEntity(edge)
+			}, false)
+		}
+	}
+	keep := selected
+	if step.Drop {
+		keep = make(map[graph.Node]struct{})
+		for nodes := g.GetNodes(); nodes.Next(); {
+			if _, ok := selected[nodes.Node()]; !ok {
+				keep[nodes.Node()] = struct{}{}
+			}
+		}
+	}
+	if step.IncludeSchema {
+		for node := range keep {
+			if !ls.IsDocumentNode(node) {
+				continue
+			}
+			for _, schemaNode := range ls.InstanceOf(node) {
+				keep[schemaNode] = struct{}{}
+			}
+		}
+	}
+	target := graph.NewOCGraph()
+	ls.CopyGraph(target, g, func(n graph.Node) bool {
+		_, ok := keep[n]
+		return ok
+	}, func(edge graph.Edge) bool {
+		_, from := keep[edge.GetFrom()]
+		_, to := keep[edge.GetTo()]
+		return from && to
+	})
+	return target, nil
+}
+
+func (step *FilterStep) Run(pipeline *pipeline.PipelineContext) error {
+	g, err := step.Filter(pipeline.GetGraphRO())
+	if err != nil {
+		return err
+	}
+	pipeline.SetGraph(g)
+	return pipeline.Next()
+}
+
+func init() {
+	rootCmd.AddCommand(filterCmd)
+	filterCmd.Flags().String("input", "json", "Input graph format (json, jsonld, binary)")
+	filterCmd.Flags().String("output", "json", "Output format, json, jsonld, binary, or dot")
+	filterCmd.Flags().Bool("drop", false, "Drop the matching nodes instead of keeping them")
+	filterCmd.Flags().StringSlice("label", nil, "Nodes with the label match")
+	filterCmd.Flags().StringSlice("property", nil, "Nodes with the property (term), or the property value (term=value) match")
+	filterCmd.Flags().StringSlice("schemaNodeId", nil, "Instances of the schema node match")
+	filterCmd.Flags().String("pattern", "", "Nodes in the results of the openCypher query match")
+	filterCmd.Flags().Bool("includeEntity", false, "Also select the descendants of the matching nodes within the same entity")
+	filterCmd.Flags().Bool("includeSchema", false, "Keep the schema nodes of the kept nodes")
+
+	pipeline.RegisterStep("filter", func() pipeline.Step { return &FilterStep{} })
+}
+
+var filterCmd = &cobra.Command{
+	Use:   "filter [graphFile]",
+	Short: "Extract a subgraph",
+	Long: `Keep or drop the nodes that match any of the given criteria, and
+write the resulting graph. The edges between kept nodes are kept.
+
+  layers filter --property https://lschema.org/entitySchema=https://person --includeEntity graph.json`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		step := &FilterStep{}
+		step.Drop, _ = cmd.Flags().GetBool("drop")
+		step.Labels, _ = cmd.Flags().GetStringSlice("label")
+		step.Properties, _ = cmd.Flags().GetStringSlice("property")
+		step.SchemaNodeIDs, _ = cmd.Flags().GetStringSlice("schemaNodeId")
+		step.Pattern, _ = cmd.Flags().GetString("pattern")
+		step.IncludeEntity, _ = cmd.Flags().GetBool("includeEntity")
+		step.IncludeSchema, _ = cmd.Flags().GetBool("includeSchema")
+		wr := NewWriteGraphStep(cmd)
+		// Schema nodes are selected by the filter
+		wr.IncludeSchema = true
+		p := []pipeline.Step{
+			NewReadGraphStep(cmd),
+			step,
+			wr,
+		}
+		_, err := runPipeline(p, "", args)
+		return err
+	},
+}
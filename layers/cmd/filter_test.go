@@ -0,0 +1,67 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+func TestFilter(t *testing.T) {
+	g := ls.NewDocumentGraph()
+	schemaNode := g.NewNode([]string{ls.AttributeNodeTerm, ls.AttributeTypeValue}, nil)
+	newEntity := func(id, name string) graph.Node {
+		root := g.NewNode([]string{ls.DocumentNodeTerm, ls.AttributeTypeObject}, map[string]interface{}{
+			ls.EntitySchemaTerm: ls.StringPropertyValue("https://person"),
+			ls.EntityIDTerm:     ls.StringPropertyValue(id),
+		})
+		value := g.NewNode([]string{ls.DocumentNodeTerm, ls.AttributeTypeValue}, map[string]interface{}{
+			ls.SchemaNodeIDTerm: ls.StringPropertyValue("name"),
+			ls.NodeValueTerm:    ls.StringPropertyValue(name),
+		})
+		g.NewEdge(root, value, ls.HasTerm, nil)
+		g.NewEdge(value, schemaNode, ls.InstanceOfTerm, nil)
+		return root
+	}
+	john := newEntity("1", "John")
+	jane := newEntity("2", "Jane")
+	g.NewEdge(john, jane, ls.HasTerm, nil)
+
+	count := func(step FilterStep) (int, int) {
+		out, err := step.Filter(g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.NumNodes(), out.NumEdges()
+	}
+	// John and his name, but not the nested entity
+	if n, e := count(FilterStep{Properties: []string{ls.EntityIDTerm + "=1"}, IncludeEntity: true}); n != 2 || e != 1 {
+		t.Errorf("Entity filter: %d nodes %d edges", n, e)
+	}
+	if n, e := count(FilterStep{Properties: []string{ls.EntityIDTerm + "=1"}, IncludeEntity: true, IncludeSchema: true}); n != 3 || e != 2 {
+		t.Errorf("Entity filter with schema: %d nodes %d edges", n, e)
+	}
+	if n, _ := count(FilterStep{SchemaNodeIDs: []string{"name"}, Drop: true}); n != 3 {
+		t.Errorf("Drop filter: %d nodes", n)
+	}
+	if n, _ := count(FilterStep{Labels: []string{ls.AttributeNodeTerm}}); n != 1 {
+		t.Errorf("Label filter: %d nodes", n)
+	}
+	if n, _ := count(FilterStep{Pattern: `match (n {` + "`" + ls.NodeValueTerm + "`" + `:"Jane"}) return n`}); n != 1 {
+		t.Errorf("Pattern filter: %d nodes", n)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
+	"github.com/cloudprivacylabs/lsa/pkg/diff"
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+)
+
+func init() {
+	rootCmd.AddCommand(graphDiffCmd)
+	graphDiffCmd.Flags().String("input", "json", "Input graph format (json, jsonld, binary)")
+	graphDiffCmd.Flags().String("output", "text", "Output format, text or json")
+	graphDiffCmd.Flags().Bool("failOnChange", false, "Exit with nonzero status if the graphs are different")
+
+	rootCmd.AddCommand(graphPatchCmd)
+	graphPatchCmd.Flags().String("input", "json", "Input graph format (json, jsonld, binary)")
+	graphPatchCmd.Flags().String("output", "json", "Output format, json, jsonld, binary, or dot")
+	graphPatchCmd.Flags().Bool("includeSchema", false, "Include schema in the output")
+	graphPatchCmd.Flags().String("changes", "", "Change set file written by graphdiff --output json")
+}
+
+var graphDiffCmd = &cobra.Command{
+	Use:   "graphdiff oldGraph newGraph",
+	Short: "Compare two document graphs",
+	Long: `Compare two document graphs, and report the added and removed
+entities, and the added, removed, and modified nodes of the entities
+that are in both graphs.
+
+Entities are aligned by entity schema and entity ID. The nodes of an
+entity are aligned by their path of schema node IDs and attribute
+indexes from the entity root. The JSON output is a change set that
+can be applied to a graph using graphpatch.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		interner := ls.NewInterner()
+		format, _ := cmd.Flags().GetString("input")
+		oldGraph, err := cmdutil.ReadGraph([]string{args[0]}, interner, format)
+		if err != nil {
+			return err
+		}
+		newGraph, err := cmdutil.ReadGraph([]string{args[1]}, interner, format)
+		if err != nil {
+			return err
+		}
+		changes := diff.DiffGraphs(oldGraph, newGraph)
+		output, _ := cmd.Flags().GetString("output")
+		switch output {
+		case "json":
+			data, err := json.MarshalIndent(changes, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+		case "text":
+			changes.WriteText(os.Stdout)
+		default:
+			return fmt.Errorf("Unknown output format: %s", output)
+		}
+		if fail, _ := cmd.Flags().GetBool("failOnChange"); fail && !changes.IsEmpty() {
+			os.Exit(1)
+		}
+		return nil
+	},
+}
+
+var graphPatchCmd = &cobra.Command{
+	Use:   "graphpatch [graphFile]",
+	Short: "Apply a change set to a document graph",
+	Long: `Apply a change set written by graphdiff --output json to a
+document graph, and write the patched graph.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		changesFile, _ := cmd.Flags().GetString("changes")
+		if len(changesFile) == 0 {
+			return fmt.Errorf("Change set file is required")
+		}
+		var changes diff.GraphChangeSet
+		if err := cmdutil.ReadJSON(changesFile, &changes); err != nil {
+			return err
+		}
+		format, _ := cmd.Flags().GetString("input")
+		g, err := cmdutil.ReadGraph(args, ls.NewInterner(), format)
+		if err != nil {
+			return err
+		}
+		if err := diff.PatchGraph(g, changes); err != nil {
+			return err
+		}
+		output, _ := cmd.Flags().GetString("output")
+		includeSchema, _ := cmd.Flags().GetBool("includeSchema")
+		return OutputIngestedGraph(cmd, output, g, os.Stdout, includeSchema)
+	},
+}
@@ -23,53 +23,95 @@ import (
 
 	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
 	"github.com/cloudprivacylabs/lsa/pkg/ls"
-	"github.com/cloudprivacylabs/lsa/pkg/repo/fs"
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
+	"github.com/cloudprivacylabs/lsa/pkg/transform"
 	"github.com/cloudprivacylabs/opencypher/graph"
 )
 
 func addSchemaFlags(flags *pflag.FlagSet) {
-	flags.String("repo", "", "Schema repository directory")
+	flags.String("repo", "", "Schema repository directory, or the URL of a repository server")
 	flags.String("schema", "", "If repo is given, the schema id. Otherwise schema file.")
 	flags.String("type", "", "Use if a bundle is given for data types. The type name to ingest.")
 	flags.StringSlice("bundle", nil, "Schema bundle(s).")
+	flags.String("bundleProfile", "", "Use the variants of the named bundle profile")
 }
 
 func init() {
 	rootCmd.AddCommand(ingestCmd)
 	addSchemaFlags(ingestCmd.PersistentFlags())
 	ingestCmd.PersistentFlags().String("compiledschema", "", "Use the given compiled schema")
-	ingestCmd.PersistentFlags().String("output", "json", "Output format, json, jsonld, or dot")
+	ingestCmd.PersistentFlags().String("initialGraph", "", "Load this graph and ingest data onto it")
+	ingestCmd.PersistentFlags().String("output", "json", "Output format, json, jsonld, binary, or dot")
 	ingestCmd.PersistentFlags().Bool("includeSchema", false, "Include schema in the output")
 	ingestCmd.PersistentFlags().Bool("embedSchemaNodes", true, "Embed schema nodes into document nodes")
 	ingestCmd.PersistentFlags().Bool("onlySchemaAttributes", false, "Only ingest nodes that have an associated schema attribute")
+	ingestCmd.PersistentFlags().Bool("link", false, "Link references after ingestion")
+	ingestCmd.PersistentFlags().Bool("strictLinks", false, "Link references after ingestion, and fail if a reference cannot be resolved")
+	ingestCmd.PersistentFlags().String("linkReport", "", "Link references after ingestion, and write the link resolution report to this file as JSON")
+	ingestCmd.PersistentFlags().Bool("deferLinks", false, "Link references after ingestion, and record unresolved references as pending links")
+	ingestCmd.PersistentFlags().Bool("upsert", false, "Ingest into the initial graph, and merge entities with the same schema and ID into existing entities")
+	ingestCmd.PersistentFlags().String("mergePolicy", ls.MergeReplace, "Default merge policy for upsert: replace, keepFirst, or append")
+	ingestCmd.PersistentFlags().StringToString("attributeMergePolicy", nil, "Merge policies for upsert by attribute ID (attrId=policy)")
+	ingestCmd.PersistentFlags().String("upsertReport", "", "Write the changes made to existing entities to this file as JSON")
 }
 
-type BaseIngestParams struct {
-	Repo                 string   `json:"repo" yaml:"repo"`
-	Schema               string   `json:"schema" yaml:"schema"`
-	Type                 string   `json:"type" yaml:"type"`
-	Bundle               []string `json:"bundle" yaml:"bundle"`
-	CompiledSchema       string   `json:"compiledSchema" yaml:"compiledSchema"`
-	EmbedSchemaNodes     bool     `json:"embedSchemaNodes" yaml:"embedSchemaNodes"`
-	OnlySchemaAttributes bool     `json:"onlySchemaAttributes" yaml:"onlySchemaAttributes"`
+// SchemaParams are the parameters of the steps that load a schema
+type SchemaParams struct {
+	Repo           string   `json:"repo" yaml:"repo"`
+	Schema         string   `json:"schema" yaml:"schema"`
+	Type           string   `json:"type" yaml:"type"`
+	Bundle         []string `json:"bundle" yaml:"bundle"`
+	BundleProfile  string   `json:"bundleProfile" yaml:"bundleProfile"`
+	CompiledSchema string   `json:"compiledSchema" yaml:"compiledSchema"`
 }
 
 // IsEmptySchema returns true if none of the schema properties are set
-func (b BaseIngestParams) IsEmptySchema() bool {
-	return len(b.Repo) == 0 && len(b.Schema) == 0 && len(b.Type) == 0 && len(b.Bundle) == 0 && len(b.CompiledSchema) == 0
+func (s SchemaParams) IsEmptySchema() bool {
+	return len(s.Repo) == 0 && len(s.Schema) == 0 && len(s.Type) == 0 && len(s.Bundle) == 0 && len(s.CompiledSchema) == 0
+}
+
+func (s *SchemaParams) fromCmd(cmd *cobra.Command) {
+	s.CompiledSchema, _ = cmd.Flags().GetString("compiledschema")
+	s.Repo, _ = cmd.Flags().GetString("repo")
+	s.Schema, _ = cmd.Flags().GetString("schema")
+	s.Bundle, _ = cmd.Flags().GetStringSlice("bundle")
+	s.Type, _ = cmd.Flags().GetString("type")
+	s.BundleProfile, _ = cmd.Flags().GetString("bundleProfile")
+}
+
+type BaseIngestParams struct {
+	SchemaParams
+	EmbedSchemaNodes     bool   `json:"embedSchemaNodes" yaml:"embedSchemaNodes"`
+	OnlySchemaAttributes bool   `json:"onlySchemaAttributes" yaml:"onlySchemaAttributes"`
+	Link                 bool   `json:"link" yaml:"link"`
+	StrictLinks          bool   `json:"strictLinks" yaml:"strictLinks"`
+	LinkReport           string `json:"linkReport" yaml:"linkReport"`
+	DeferLinks           bool   `json:"deferLinks" yaml:"deferLinks"`
+
+	Upsert                 bool              `json:"upsert" yaml:"upsert"`
+	MergePolicy            string            `json:"mergePolicy" yaml:"mergePolicy"`
+	AttributeMergePolicies map[string]string `json:"attributeMergePolicies" yaml:"attributeMergePolicies"`
+	UpsertReport           string            `json:"upsertReport" yaml:"upsertReport"`
+
+	linkReport   *ls.LinkReport
+	upsertReport *ls.UpsertReport
 }
 
 func (b *BaseIngestParams) fromCmd(cmd *cobra.Command) {
-	b.CompiledSchema, _ = cmd.Flags().GetString("compiledschema")
-	b.Repo, _ = cmd.Flags().GetString("repo")
-	b.Schema, _ = cmd.Flags().GetString("schema")
-	b.Bundle, _ = cmd.Flags().GetStringSlice("bundle")
-	b.Type, _ = cmd.Flags().GetString("type")
+	b.SchemaParams.fromCmd(cmd)
 	b.EmbedSchemaNodes, _ = cmd.Flags().GetBool("embedSchemaNodes")
 	b.OnlySchemaAttributes, _ = cmd.Flags().GetBool("onlySchemaAttributes")
+	b.Link, _ = cmd.Flags().GetBool("link")
+	b.StrictLinks, _ = cmd.Flags().GetBool("strictLinks")
+	b.LinkReport, _ = cmd.Flags().GetString("linkReport")
+	b.DeferLinks, _ = cmd.Flags().GetBool("deferLinks")
+	b.Upsert, _ = cmd.Flags().GetBool("upsert")
+	b.MergePolicy, _ = cmd.Flags().GetString("mergePolicy")
+	b.AttributeMergePolicies, _ = cmd.Flags().GetStringToString("attributeMergePolicy")
+	b.UpsertReport, _ = cmd.Flags().GetString("upsertReport")
 }
 
-const baseIngestParamsHelp = `  
+const schemaParamsHelp = `  
   # Schema loading parameters
   # One of:
   #   bundle/type
@@ -79,14 +121,35 @@ const baseIngestParamsHelp = `
 
   bundle: bundleFileName
   type: typeName in bundle
-  repo: schema repository directory
+  bundleProfile: name of the bundle profile to use
+  repo: schema repository directory, or repository server URL
   schema: if repo is given, the ID of the schema. Otherwise, the schema file
-  compiledSchema: compiled schema graph file
+  compiledSchema: compiled schema graph file`
+
+const baseIngestParamsHelp = schemaParamsHelp + `
 
   # Ingestion control
 
   embedSchemaNodes: false
-  onlySchemaAttributes: false`
+  onlySchemaAttributes: false
+
+  # Linking
+
+  link: false          # Link references after ingestion
+  strictLinks: false   # Link, and fail if a reference cannot be resolved
+  linkReport: fileName # Link, and write the link resolution report as JSON
+  deferLinks: false    # Link, and record unresolved references as pending links
+                       # to be resolved by a later link step
+
+  # Upsert
+
+  upsert: false        # Ingest into the current graph, and merge entities
+                       # with the same schema and ID into existing entities
+  mergePolicy: replace # Default merge policy: replace, keepFirst, or append
+  attributeMergePolicies:
+    attrId: policy     # Merge policies by attribute ID. These override
+                       # the mergePolicy annotations of the schema
+  upsertReport: fileName # Write the changes to existing entities as JSON`
 
 var ingestCmd = &cobra.Command{
 	Use:   "ingest",
@@ -134,16 +197,137 @@ type. The bundle is a JSON file:
   layers ingest csv --compiledSchema <schemaGraphFile> --schema <schemaId>
 
 This form will use a previously compiled schema.
+
+  layers ingest json --schema <schemaFile> --initialGraph <graphFile> --upsert
+
+This form ingests data into the initial graph. Ingested entities
+that have the same entity schema and ID as an existing entity are
+merged into the existing entity. The merge policy of an attribute
+(replace, keepFirst, or append) is given by --attributeMergePolicy,
+or by the mergePolicy annotation of the schema attribute, or by
+--mergePolicy.
 `,
 }
 
+// applyConditionalAnnotations applies the guarded annotations of
+// the schema to the ingested graph
+func applyConditionalAnnotations(pipeline *pipeline.PipelineContext, layer *ls.Layer) error {
+	if layer == nil {
+		return nil
+	}
+	return transform.ApplyConditionalAnnotations(pipeline.Context, pipeline.GetGraphRW(), layer)
+}
+
+// newGraph starts a new graph for the ingested data. When upserting,
+// the data is ingested into the current graph.
+func (b *BaseIngestParams) newGraph(pipeline *pipeline.PipelineContext) {
+	if !b.Upsert {
+		pipeline.SetGraph(ls.NewDocumentGraph())
+	}
+}
+
+// newGraphBuilder returns a builder for the pipeline graph. The
+// builder shares the entity index of the pipeline, so the index is
+// maintained incrementally instead of being rebuilt for every input
+// or row.
+func (b *BaseIngestParams) newGraphBuilder(pipeline *pipeline.PipelineContext) ls.GraphBuilder {
+	builder := ls.NewGraphBuilder(pipeline.GetGraphRW(), ls.GraphBuilderOptions{
+		EmbedSchemaNodes:     b.EmbedSchemaNodes,
+		OnlySchemaAttributes: b.OnlySchemaAttributes,
+		DeferUnresolvedLinks: b.DeferLinks,
+	})
+	builder.SetEntityIndex(pipeline.GetEntityIndex())
+	return builder
+}
+
+// upsert merges the ingested entities into the existing entities if
+// upsert is enabled. The upsert report accumulates the changes of
+// all inputs, and it is written when the pipeline finishes.
+func (b *BaseIngestParams) upsert(builder ls.GraphBuilder) error {
+	if !b.Upsert {
+		return nil
+	}
+	options := ls.UpsertOptions{
+		DefaultPolicy:     b.MergePolicy,
+		AttributePolicies: b.AttributeMergePolicies,
+	}
+	if len(options.DefaultPolicy) > 0 {
+		if err := ls.ValidateMergePolicy(options.DefaultPolicy); err != nil {
+			return err
+		}
+	}
+	for _, policy := range options.AttributePolicies {
+		if err := ls.ValidateMergePolicy(policy); err != nil {
+			return err
+		}
+	}
+	if b.upsertReport == nil {
+		b.upsertReport = ls.NewUpsertReport()
+	}
+	return builder.UpsertEntities(options, b.upsertReport)
+}
+
+// linkIngestedGraph links the references of the entities ingested or
+// changed since the last link if linking is enabled. The link report
+// accumulates the results of all inputs, and it is written when the
+// pipeline finishes. If links are deferred, unresolved references are
+// recorded as pending links.
+func (b *BaseIngestParams) linkIngestedGraph(pipeline *pipeline.PipelineContext, layer *ls.Layer) error {
+	if layer == nil || (!b.Link && !b.StrictLinks && !b.DeferLinks && len(b.LinkReport) == 0) {
+		return nil
+	}
+	builder := b.newGraphBuilder(pipeline)
+	report := ls.NewLinkReport()
+	if err := builder.LinkChangedEntities(layer, report); err != nil {
+		return err
+	}
+	if len(b.LinkReport) > 0 {
+		if b.linkReport == nil {
+			b.linkReport = ls.NewLinkReport()
+		}
+		b.linkReport.Resolved += report.Resolved
+		b.linkReport.Pending += report.Pending
+		b.linkReport.Unresolved = append(b.linkReport.Unresolved, report.Unresolved...)
+	}
+	if b.StrictLinks {
+		return report.Err()
+	}
+	return nil
+}
+
+// Finish writes the upsert and link reports once all inputs are
+// ingested. The following steps are already run for every input, so
+// they are not run again.
+func (b *BaseIngestParams) Finish(pipeline *pipeline.PipelineContext) error {
+	if len(b.UpsertReport) > 0 {
+		if b.upsertReport == nil {
+			b.upsertReport = ls.NewUpsertReport()
+		}
+		if err := writeJSONReport(b.UpsertReport, b.upsertReport); err != nil {
+			return err
+		}
+	}
+	if len(b.LinkReport) > 0 {
+		if b.linkReport == nil {
+			b.linkReport = ls.NewLinkReport()
+		}
+		if err := writeJSONReport(b.LinkReport, b.linkReport); err != nil {
+			return err
+		}
+	}
+	b.upsertReport = nil
+	b.linkReport = nil
+	return nil
+}
+
 func loadSchemaCmd(ctx *ls.Context, cmd *cobra.Command) *ls.Layer {
 	compiledSchema, _ := cmd.Flags().GetString("compiledschema")
 	repoDir, _ := cmd.Flags().GetString("repo")
 	schemaName, _ := cmd.Flags().GetString("schema")
 	bundleNames, _ := cmd.Flags().GetStringSlice("bundle")
 	typeName, _ := cmd.Flags().GetString("type")
-	layer, err := LoadSchemaFromFileOrRepo(ctx, compiledSchema, repoDir, schemaName, typeName, bundleNames)
+	bundleProfile, _ := cmd.Flags().GetString("bundleProfile")
+	layer, err := LoadSchemaFromFileOrRepo(ctx, compiledSchema, repoDir, schemaName, typeName, bundleNames, bundleProfile)
 	if err != nil {
 		failErr(err)
 	}
@@ -180,74 +364,70 @@ func loadCompiledSchema(ctx *ls.Context, compiledSchema, schemaName string) (*ls
 	return layer, layers, nil
 }
 
-func LoadSchemaFromFileOrRepo(ctx *ls.Context, compiledSchema, repoDir, schemaName, typeName string, bundleNames []string) (*ls.Layer, error) {
+func LoadSchemaFromFileOrRepo(ctx *ls.Context, compiledSchema, repoDir, schemaName, typeName string, bundleNames []string, bundleProfile string) (*ls.Layer, error) {
 	if len(compiledSchema) > 0 {
 		l, _, err := loadCompiledSchema(ctx, compiledSchema, schemaName)
 		return l, err
 	}
 	if len(bundleNames) > 0 {
-		schLoader, err := LoadBundle(ctx, bundleNames)
-		if err != nil {
-			return nil, err
-		}
-		compiler := ls.Compiler{
-			Loader: schLoader,
-		}
 		name := schemaName
 		if len(typeName) > 0 {
 			name = typeName
 		}
-		layer, err := compiler.Compile(ctx, name)
+		compile := func() (*ls.Layer, error) {
+			schLoader, err := LoadBundleProfile(ctx, bundleNames, bundleProfile)
+			if err != nil {
+				return nil, err
+			}
+			compiler := ls.Compiler{
+				Loader: schLoader,
+			}
+			return compiler.Compile(ctx, name)
+		}
+		if compiledSchemaCache == nil {
+			return compile()
+		}
+		key, err := bundleCacheKey(ctx, bundleNames, bundleProfile, name)
 		if err != nil {
 			return nil, err
 		}
-		return layer, nil
+		return compiledSchemaCache.Compile(ctx, key, compile)
 	}
 	if len(schemaName) == 0 {
 		return nil, fmt.Errorf("Empty schema name")
 	}
-	var repo *fs.Repository
 	if len(repoDir) > 0 {
-		var err error
-		repo, err = getRepo(repoDir, ctx.GetInterner())
+		repo, err := getRepo(repoDir, ctx.GetInterner())
 		if err != nil {
 			return nil, err
 		}
-		layer, err := repo.GetComposedSchema(ctx, schemaName)
+		return repo.GetCompiledSchema(ctx, schemaName)
+	}
+	data, err := cmdutil.ReadURL(schemaName)
+	if err != nil {
+		return nil, err
+	}
+	compile := func() (*ls.Layer, error) {
+		layers, err := ReadLayers(data, ctx.GetInterner())
 		if err != nil {
 			return nil, err
 		}
+		if len(layers) > 1 {
+			return nil, fmt.Errorf("Multiple layers in schema input")
+		}
 		compiler := ls.Compiler{
 			Loader: ls.SchemaLoaderFunc(func(x string) (*ls.Layer, error) {
-				return repo.LoadAndCompose(ctx, x)
+				if x == schemaName || x == layers[0].GetID() {
+					return layers[0], nil
+				}
+				return nil, fmt.Errorf("Not found")
 			}),
 		}
-		layer, err = compiler.Compile(ctx, schemaName)
-		if err != nil {
-			return nil, err
-		}
-		return layer, nil
-	}
-	data, err := cmdutil.ReadURL(schemaName)
-	if err != nil {
-		return nil, err
-	}
-	layers, err := ReadLayers(data, ctx.GetInterner())
-	if err != nil {
-		return nil, err
-	}
-	if len(layers) > 1 {
-		return nil, fmt.Errorf("Multiple layers in schema input")
-	}
-	compiler := ls.Compiler{
-		Loader: ls.SchemaLoaderFunc(func(x string) (*ls.Layer, error) {
-			if x == schemaName || x == layers[0].GetID() {
-				return layers[0], nil
-			}
-			return nil, fmt.Errorf("Not found")
-		}),
+		return compiler.Compile(ctx, schemaName)
 	}
-	return compiler.Compile(ctx, schemaName)
+	key := ls.NewCompiledSchemaCacheKey(ctx)
+	key.AddFile(schemaName, data)
+	return compiledSchemaCache.Compile(ctx, key.String(), compile)
 }
 
 func OutputIngestedGraph(cmd *cobra.Command, outFormat string, target graph.Graph, wr io.Writer, includeSchema bool) error {
@@ -20,7 +20,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
 	"strings"
 	"text/template"
 
@@ -28,10 +27,12 @@ import (
 
 	csvingest "github.com/cloudprivacylabs/lsa/pkg/csv"
 	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
 )
 
 type CSVIngester struct {
 	BaseIngestParams
+	pipeline.ErrorPolicy
 	StartRow     int    `json:"startRow" yaml:"startRow"`
 	EndRow       int    `json:"endRow" yaml:"endRow"`
 	HeaderRow    int    `json:"headerRow" yaml:"headerRow"`
@@ -59,19 +60,23 @@ params:`)
   #  .dataIndex: The index of the current data row
   #  .columns: The current row data
   ingestByRows: false  # If true, ingest row by row. Otherwise, ingest one file at a time.`)
+	fmt.Println(pipeline.ErrorPolicyHelp)
+	fmt.Println(`  # continueOnError applies to parsing and ingesting rows, and
+  # the steps following ingestion if ingestByRows is true`)
 }
 
-func (ci *CSVIngester) Run(pipeline *PipelineContext) error {
+func (ci *CSVIngester) Run(pipeline *pipeline.PipelineContext) error {
 	var layer *ls.Layer
 	var err error
 	if !ci.initialized {
-		layer, err = LoadSchemaFromFileOrRepo(pipeline.Context, ci.CompiledSchema, ci.Repo, ci.Schema, ci.Type, ci.Bundle)
+		layer, err = LoadSchemaFromFileOrRepo(pipeline.Context, ci.CompiledSchema, ci.Repo, ci.Schema, ci.Type, ci.Bundle, ci.BundleProfile)
 		if err != nil {
 			return err
 		}
 		pipeline.Properties["layer"] = layer
 		ci.initialized = true
 	}
+	layer, _ = pipeline.Properties["layer"].(*ls.Layer)
 
 	parser := csvingest.Parser{
 		OnlySchemaAttributes: ci.OnlySchemaAttributes,
@@ -88,15 +93,17 @@ func (ci *CSVIngester) Run(pipeline *PipelineContext) error {
 	if ci.HeaderRow >= ci.StartRow {
 		return errors.New("Header row is ahead of start row")
 	}
+	defer ci.ErrorPolicy.Close()
 
-	for _, inputFile := range pipeline.InputFiles {
-		file, err := os.Open(inputFile)
+	for _, input := range pipeline.Inputs {
+		inputFile := input.Name()
+		file, err := input.Open()
 		if err != nil {
 			return fmt.Errorf("While reading input %s: %w", inputFile, err)
 		}
 		reader := csv.NewReader(file)
 		if !ci.IngestByRows {
-			pipeline.SetGraph(ls.NewDocumentGraph())
+			ci.newGraph(pipeline)
 		}
 		reader.Comma = rune(ci.Delimiter[0])
 
@@ -107,8 +114,18 @@ func (ci *CSVIngester) Run(pipeline *PipelineContext) error {
 				break
 			}
 			if err != nil {
-				file.Close()
-				return err
+				// Malformed rows are handled by the error policy. Other
+				// read errors cannot be recovered from.
+				var parseErr *csv.ParseError
+				if !errors.As(err, &parseErr) {
+					file.Close()
+					return err
+				}
+				if err := ci.HandleError(pipeline, inputFile, row, rowData, err); err != nil {
+					file.Close()
+					return err
+				}
+				continue
 			}
 			if ci.HeaderRow == row {
 				parser.ColumnNames = rowData
@@ -122,12 +139,9 @@ func (ci *CSVIngester) Run(pipeline *PipelineContext) error {
 				break
 			}
 			if ci.IngestByRows {
-				pipeline.SetGraph(ls.NewDocumentGraph())
+				ci.newGraph(pipeline)
 			}
-			builder := ls.NewGraphBuilder(pipeline.GetGraphRW(), ls.GraphBuilderOptions{
-				EmbedSchemaNodes:     ci.EmbedSchemaNodes,
-				OnlySchemaAttributes: ci.OnlySchemaAttributes,
-			})
+			builder := ci.newGraphBuilder(pipeline)
 			templateData := map[string]interface{}{
 				"rowIndex":  row,
 				"dataIndex": row - ci.StartRow,
@@ -140,22 +154,55 @@ func (ci *CSVIngester) Run(pipeline *PipelineContext) error {
 			}
 			parsed, err := parser.ParseDoc(pipeline.Context, strings.TrimSpace(buf.String()), rowData)
 			if err != nil {
-				file.Close()
-				return err
+				if err := ci.HandleError(pipeline, inputFile, row, rowData, err); err != nil {
+					file.Close()
+					return err
+				}
+				continue
 			}
 			_, err = ls.Ingest(builder, parsed)
 			if err != nil {
-				file.Close()
-				return err
+				if err := ci.HandleError(pipeline, inputFile, row, rowData, err); err != nil {
+					file.Close()
+					return err
+				}
+				continue
+			}
+			if err := ci.upsert(builder); err != nil {
+				if err := ci.HandleError(pipeline, inputFile, row, rowData, err); err != nil {
+					file.Close()
+					return err
+				}
+				continue
 			}
 			if ci.IngestByRows {
-				if err := pipeline.Next(); err != nil {
+				if err := applyConditionalAnnotations(pipeline, layer); err != nil {
+					if err := ci.HandleError(pipeline, inputFile, row, rowData, err); err != nil {
+						file.Close()
+						return err
+					}
+					continue
+				}
+				if err := ci.linkIngestedGraph(pipeline, layer); err != nil {
+					if err := ci.HandleError(pipeline, inputFile, row, rowData, err); err != nil {
+						file.Close()
+						return err
+					}
+					continue
+				}
+				if err := ci.HandleError(pipeline, inputFile, row, rowData, pipeline.Next()); err != nil {
 					file.Close()
 					return err
 				}
 			}
 		}
 		if !ci.IngestByRows {
+			if err := applyConditionalAnnotations(pipeline, layer); err != nil {
+				return fmt.Errorf("While reading input %s: %w", inputFile, err)
+			}
+			if err := ci.linkIngestedGraph(pipeline, layer); err != nil {
+				return fmt.Errorf("While reading input %s: %w", inputFile, err)
+			}
 			if err := pipeline.Next(); err != nil {
 				return fmt.Errorf("While reading input %s: %w", inputFile, err)
 			}
@@ -172,10 +219,11 @@ func init() {
 	ingestCSVCmd.Flags().String("id", "row_{{.rowIndex}}", "Object ID Go template for ingested data if no ID is declared in the schema")
 	ingestCSVCmd.Flags().String("compiledschema", "", "Use the given compiled schema")
 	ingestCSVCmd.Flags().String("delimiter", ",", "Delimiter char")
-	ingestCSVCmd.Flags().String("initialGraph", "", "Load this graph and ingest data onto it")
 	ingestCSVCmd.Flags().Bool("byFile", false, "Ingest one file at a time. Default is row at a time.")
+	ingestCSVCmd.Flags().Bool("continueOnError", false, "Skip rows that fail, and continue with the next row")
+	ingestCSVCmd.Flags().String("deadLetter", "", "Write failing rows and errors to this file")
 
-	operations["ingest/csv"] = func() Step {
+	pipeline.RegisterStep("ingest/csv", func() pipeline.Step {
 		return &CSVIngester{
 			BaseIngestParams: BaseIngestParams{
 				EmbedSchemaNodes: true,
@@ -184,7 +232,7 @@ func init() {
 			HeaderRow: -1,
 			StartRow:  0,
 		}
-	}
+	})
 }
 
 var ingestCSVCmd = &cobra.Command{
@@ -224,7 +272,9 @@ var ingestCSVCmd = &cobra.Command{
 			return err
 		}
 		ing.IngestByRows = !byFile
-		p := []Step{
+		ing.ContinueOnError, _ = cmd.Flags().GetBool("continueOnError")
+		ing.DeadLetterFile, _ = cmd.Flags().GetString("deadLetter")
+		p := []pipeline.Step{
 			&ing,
 			NewWriteGraphStep(cmd),
 		}
@@ -15,16 +15,14 @@
 package cmd
 
 import (
-	"bytes"
 	"fmt"
-	"io"
 
 	"github.com/spf13/cobra"
 	"golang.org/x/text/encoding"
 
-	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
 	jsoningest "github.com/cloudprivacylabs/lsa/pkg/json"
 	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
 )
 
 type JSONIngester struct {
@@ -43,17 +41,18 @@ params:`)
 	fmt.Println(`  id:""   # Base ID for the root node`)
 }
 
-func (ji *JSONIngester) Run(pipeline *PipelineContext) error {
+func (ji *JSONIngester) Run(pipeline *pipeline.PipelineContext) error {
 	var layer *ls.Layer
 	var err error
 	if !ji.initialized {
-		layer, err = LoadSchemaFromFileOrRepo(pipeline.Context, ji.CompiledSchema, ji.Repo, ji.Schema, ji.Type, ji.Bundle)
+		layer, err = LoadSchemaFromFileOrRepo(pipeline.Context, ji.CompiledSchema, ji.Repo, ji.Schema, ji.Type, ji.Bundle, ji.BundleProfile)
 		if err != nil {
 			return err
 		}
 		pipeline.Properties["layer"] = layer
 		ji.initialized = true
 	}
+	layer, _ = pipeline.Properties["layer"].(*ls.Layer)
 
 	enc := encoding.Nop
 	if layer != nil {
@@ -63,37 +62,13 @@ func (ji *JSONIngester) Run(pipeline *PipelineContext) error {
 		}
 	}
 
-	inputIndex := 0
-	var inputName string
-	nextInput := func() (io.Reader, error) {
-		if len(pipeline.InputFiles) == 0 {
-			if inputIndex > 0 {
-				return nil, nil
-			}
-			inputIndex++
-			inp, err := cmdutil.StreamFileOrStdin(nil, enc)
-			inputName = "stdin"
-			return inp, err
-		}
-		if inputIndex >= len(pipeline.InputFiles) {
-			return nil, nil
-		}
-		inputName = pipeline.InputFiles[inputIndex]
-		data, err := cmdutil.ReadURL(inputName, enc)
-		if err != nil {
-			return nil, err
-		}
-		inputIndex++
-		return bytes.NewReader(data), nil
-	}
-	for {
-		input, err := nextInput()
+	for _, inp := range pipeline.Inputs {
+		inputName := inp.Name()
+		stream, err := inp.Open()
 		if err != nil {
-			return err
-		}
-		if input == nil {
-			break
+			return fmt.Errorf("While reading input %s: %w", inputName, err)
 		}
+		input := enc.NewDecoder().Reader(stream)
 
 		parser := jsoningest.Parser{
 			OnlySchemaAttributes: ji.OnlySchemaAttributes,
@@ -101,17 +76,24 @@ func (ji *JSONIngester) Run(pipeline *PipelineContext) error {
 		if layer != nil {
 			parser.SchemaNode = layer.GetSchemaRootNode()
 		}
-		pipeline.SetGraph(ls.NewDocumentGraph())
-		builder := ls.NewGraphBuilder(pipeline.GetGraphRW(), ls.GraphBuilderOptions{
-			EmbedSchemaNodes:     ji.EmbedSchemaNodes,
-			OnlySchemaAttributes: ji.OnlySchemaAttributes,
-		})
+		ji.newGraph(pipeline)
+		builder := ji.newGraphBuilder(pipeline)
 		baseID := ji.ID
 
 		_, err = jsoningest.IngestStream(pipeline.Context, baseID, input, parser, builder)
+		stream.Close()
 		if err != nil {
 			return fmt.Errorf("While reading input %s: %w", inputName, err)
 		}
+		if err := ji.upsert(builder); err != nil {
+			return fmt.Errorf("While reading input %s: %w", inputName, err)
+		}
+		if err := applyConditionalAnnotations(pipeline, layer); err != nil {
+			return fmt.Errorf("While reading input %s: %w", inputName, err)
+		}
+		if err := ji.linkIngestedGraph(pipeline, layer); err != nil {
+			return fmt.Errorf("While reading input %s: %w", inputName, err)
+		}
 
 		if err := pipeline.Next(); err != nil {
 			return fmt.Errorf("Input was %s: %w", inputName, err)
@@ -124,13 +106,13 @@ func init() {
 	ingestCmd.AddCommand(ingestJSONCmd)
 	ingestJSONCmd.Flags().String("id", "http://example.org/root", "Base ID to use for ingested nodes")
 
-	operations["ingest/json"] = func() Step {
+	pipeline.RegisterStep("ingest/json", func() pipeline.Step {
 		return &JSONIngester{
 			BaseIngestParams: BaseIngestParams{
 				EmbedSchemaNodes: true,
 			},
 		}
-	}
+	})
 }
 
 var ingestJSONCmd = &cobra.Command{
@@ -142,7 +124,7 @@ var ingestJSONCmd = &cobra.Command{
 		ing := JSONIngester{}
 		ing.fromCmd(cmd)
 		ing.ID, _ = cmd.Flags().GetString("id")
-		p := []Step{
+		p := []pipeline.Step{
 			&ing,
 			NewWriteGraphStep(cmd),
 		}
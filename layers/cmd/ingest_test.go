@@ -0,0 +1,265 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
+)
+
+const ingestTestSchema = `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@id": "https://person",
+  "@type": "ls:Schema",
+  "ls:valueType": "Person",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "person",
+    "ls:entityIdFields": "id",
+    "ls:Object/attributes": [
+      {"@id": "id", "@type": "ls:Value", "ls:attributeIndex": 0},
+      {"@id": "name", "@type": "ls:Value", "ls:attributeIndex": 1}
+    ]
+  }
+}`
+
+// writeTestFiles writes the files to a temporary directory, and
+// returns the directory
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// runTestPipeline runs the steps with the input files without using
+// the compiled schema cache
+func runTestPipeline(t *testing.T, steps []pipeline.Step, inputs ...string) error {
+	cache := compiledSchemaCache
+	compiledSchemaCache = nil
+	defer func() { compiledSchemaCache = cache }()
+	ctx := pipeline.NewContext(ls.DefaultContext(), steps...)
+	for _, input := range inputs {
+		ctx.SetInputs(append(ctx.Inputs, pipeline.FileInput(input))...)
+	}
+	return ctx.Run()
+}
+
+func TestIngestSharedEntityIndex(t *testing.T) {
+	const numRows = 300
+	rows := strings.Builder{}
+	for i := 0; i < numRows; i++ {
+		fmt.Fprintf(&rows, "%d,name%d\n", i, i)
+	}
+	dir := writeTestFiles(t, map[string]string{"schema.json": ingestTestSchema, "data.csv": rows.String()})
+	ingester := &CSVIngester{IngestByRows: true, EndRow: -1, HeaderRow: -1, Delimiter: ","}
+	ingester.Schema = filepath.Join(dir, "schema.json")
+	ingester.Upsert = true
+	var index *ls.EntityIndex
+	n := 0
+	check := pipeline.StepFunc(func(ctx *pipeline.PipelineContext) error {
+		n++
+		ix := ctx.GetEntityIndex()
+		if index == nil {
+			index = ix
+		} else if ix != index {
+			t.Fatalf("Entity index rebuilt at row %d", n)
+		}
+		if ix.Len() != n {
+			t.Fatalf("Expecting %d entities in the index, got %d", n, ix.Len())
+		}
+		return nil
+	})
+	if err := runTestPipeline(t, []pipeline.Step{ingester, check}, filepath.Join(dir, "data.csv")); err != nil {
+		t.Fatal(err)
+	}
+	if n != numRows {
+		t.Errorf("Expecting %d rows, got %d", numRows, n)
+	}
+}
+
+const linkTestSchema = `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@id": "https://person",
+  "@type": "ls:Schema",
+  "ls:valueType": "Person",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "person",
+    "ls:entityIdFields": "id",
+    "ls:Object/attributes": [
+      {"@id": "id", "@type": "ls:Value", "ls:attributeIndex": 0},
+      {"@id": "managerId", "@type": "ls:Value", "ls:attributeIndex": 1},
+      {"@id": "manager", "@type": "ls:Reference", "ls:Reference/ref": "https://person", "ls:Reference/fk": "managerId", "ls:Reference/label": "manager", "ls:Reference/link": "to", "ls:ingestAs": "%s"}
+    ]
+  }
+}`
+
+func TestUpsertLinkNoDuplicates(t *testing.T) {
+	for _, ingestAs := range []string{"node", "edge"} {
+		dir := writeTestFiles(t, map[string]string{
+			"schema.json": fmt.Sprintf(linkTestSchema, ingestAs),
+			"data.csv":    "1,\n2,1\n3,1\n",
+		})
+		ingester := &CSVIngester{IngestByRows: true, EndRow: -1, HeaderRow: -1, Delimiter: ","}
+		ingester.Schema = filepath.Join(dir, "schema.json")
+		ingester.Upsert = true
+		ingester.Link = true
+		numLinks := 0
+		check := pipeline.StepFunc(func(ctx *pipeline.PipelineContext) error {
+			numLinks = 0
+			for edges := ctx.GetGraphRO().GetEdges(); edges.Next(); {
+				if edges.Edge().GetLabel() == "manager" {
+					numLinks++
+				}
+			}
+			return nil
+		})
+		data := filepath.Join(dir, "data.csv")
+		if err := runTestPipeline(t, []pipeline.Step{ingester, check}, data, data); err != nil {
+			t.Fatal(err)
+		}
+		if numLinks != 2 {
+			t.Errorf("%s: Expecting 2 link edges, got %d", ingestAs, numLinks)
+		}
+	}
+}
+
+func TestUpsertLinkReports(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"schema.json": fmt.Sprintf(linkTestSchema, "edge"),
+		"data.csv":    "1,\n2,1\n3,1\n",
+	})
+	ingester := &CSVIngester{IngestByRows: true, EndRow: -1, HeaderRow: -1, Delimiter: ","}
+	ingester.Schema = filepath.Join(dir, "schema.json")
+	ingester.Upsert = true
+	ingester.Link = true
+	ingester.UpsertReport = filepath.Join(dir, "upsert.json")
+	ingester.LinkReport = filepath.Join(dir, "link.json")
+	// The reports are written once, when all rows are ingested
+	check := pipeline.StepFunc(func(ctx *pipeline.PipelineContext) error {
+		for _, file := range []string{ingester.UpsertReport, ingester.LinkReport} {
+			if _, err := os.Stat(file); err == nil {
+				t.Errorf("Report %s written before the pipeline finished", file)
+			}
+		}
+		return nil
+	})
+	data := filepath.Join(dir, "data.csv")
+	if err := runTestPipeline(t, []pipeline.Step{ingester, check}, data, data); err != nil {
+		t.Fatal(err)
+	}
+	var upsertReport ls.UpsertReport
+	var linkReport ls.LinkReport
+	for file, report := range map[string]interface{}{ingester.UpsertReport: &upsertReport, ingester.LinkReport: &linkReport} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(upsertReport.Entities) != 3 {
+		t.Errorf("Expecting 3 upserted entities, got %d", len(upsertReport.Entities))
+	}
+	// Only the entities of each row are linked, so each of the two
+	// references is resolved once for every input
+	if linkReport.Resolved != 4 {
+		t.Errorf("Expecting 4 resolved links, got %d", linkReport.Resolved)
+	}
+}
+
+func TestIngestCSVRaggedRows(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"schema.json": ingestTestSchema,
+		"data.csv":    "1,a\n2,b,extra\n3,\"c\n4,d\n",
+	})
+	ingester := &CSVIngester{IngestByRows: true, EndRow: -1, HeaderRow: -1, Delimiter: ","}
+	ingester.Schema = filepath.Join(dir, "schema.json")
+	n := 0
+	count := pipeline.StepFunc(func(ctx *pipeline.PipelineContext) error {
+		n++
+		return nil
+	})
+	if err := runTestPipeline(t, []pipeline.Step{ingester, count}, filepath.Join(dir, "data.csv")); err == nil {
+		t.Errorf("Expecting error without continueOnError")
+	}
+
+	n = 0
+	deadLetter := strings.Builder{}
+	ingester = &CSVIngester{IngestByRows: true, EndRow: -1, HeaderRow: -1, Delimiter: ","}
+	ingester.Schema = filepath.Join(dir, "schema.json")
+	ingester.ContinueOnError = true
+	ingester.DeadLetter = &deadLetter
+	if err := runTestPipeline(t, []pipeline.Step{ingester, count}, filepath.Join(dir, "data.csv")); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Expecting 1 ingested row, got %d", n)
+	}
+	if s := deadLetter.String(); strings.Count(s, "\n") != 2 {
+		t.Errorf("Expecting 2 dead letter records, got %s", s)
+	}
+}
+
+func TestIngestDeferLinksUpsertRows(t *testing.T) {
+	for _, ingestAs := range []string{"node", "edge"} {
+		dir := writeTestFiles(t, map[string]string{
+			"schema.json": fmt.Sprintf(linkTestSchema, ingestAs),
+			"data1.csv":   "1,9\n2,9\n",
+			"data2.csv":   "3,1\n9,3\n2,9\n",
+		})
+		ingester := &CSVIngester{IngestByRows: true, EndRow: -1, HeaderRow: -1, Delimiter: ","}
+		ingester.Schema = filepath.Join(dir, "schema.json")
+		ingester.Upsert = true
+		ingester.DeferLinks = true
+		var numLinks, numPending, numEntities int
+		check := pipeline.StepFunc(func(ctx *pipeline.PipelineContext) error {
+			g := ctx.GetGraphRO()
+			for edges := g.GetEdges(); edges.Next(); {
+				if edges.Edge().GetLabel() == "manager" {
+					numLinks++
+				}
+			}
+			numPending = len(ls.GetPendingLinkNodes(g))
+			numEntities = 0
+			for nodes := g.GetNodes(); nodes.Next(); {
+				node := nodes.Node()
+				if ls.IsDocumentNode(node) && ls.AsPropertyValue(node.GetProperty(ls.SchemaNodeIDTerm)).AsString() == "person" {
+					numEntities++
+				}
+			}
+			return nil
+		})
+		err := runTestPipeline(t, []pipeline.Step{ingester, &LinkStep{}, check}, filepath.Join(dir, "data1.csv"), filepath.Join(dir, "data2.csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if numLinks != 4 || numPending != 0 || numEntities != 4 {
+			t.Errorf("%s: Expecting 4 links, 0 pending links, 4 entities, got %d, %d, %d", ingestAs, numLinks, numPending, numEntities)
+		}
+	}
+}
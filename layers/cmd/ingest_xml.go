@@ -15,16 +15,14 @@
 package cmd
 
 import (
-	"bytes"
 	"fmt"
-	"io"
 
 	"golang.org/x/text/encoding"
 
 	"github.com/spf13/cobra"
 
-	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
 	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
 	xmlingest "github.com/cloudprivacylabs/lsa/pkg/xml"
 )
 
@@ -44,17 +42,18 @@ params:`)
 	fmt.Println(`  id:""   # Base ID for the root node`)
 }
 
-func (xml *XMLIngester) Run(pipeline *PipelineContext) error {
+func (xml *XMLIngester) Run(pipeline *pipeline.PipelineContext) error {
 	var layer *ls.Layer
 	var err error
 	if !xml.initialized {
-		layer, err = LoadSchemaFromFileOrRepo(pipeline.Context, xml.CompiledSchema, xml.Repo, xml.Schema, xml.Type, xml.Bundle)
+		layer, err = LoadSchemaFromFileOrRepo(pipeline.Context, xml.CompiledSchema, xml.Repo, xml.Schema, xml.Type, xml.Bundle, xml.BundleProfile)
 		if err != nil {
 			return err
 		}
 		pipeline.Properties["layer"] = layer
 		xml.initialized = true
 	}
+	layer, _ = pipeline.Properties["layer"].(*ls.Layer)
 
 	enc := encoding.Nop
 	if layer != nil {
@@ -64,53 +63,27 @@ func (xml *XMLIngester) Run(pipeline *PipelineContext) error {
 		}
 	}
 
-	inputIndex := 0
-	var inputName string
-	nextInput := func() (io.Reader, error) {
-		if len(pipeline.InputFiles) == 0 {
-			if inputIndex > 0 {
-				return nil, nil
-			}
-			inputIndex++
-			inp, err := cmdutil.StreamFileOrStdin(nil, enc)
-			inputName = "stdin"
-			return inp, err
-		}
-		if inputIndex >= len(pipeline.InputFiles) {
-			return nil, nil
-		}
-		inputName = pipeline.InputFiles[inputIndex]
-		data, err := cmdutil.ReadURL(inputName, enc)
-		if err != nil {
-			return nil, err
-		}
-		inputIndex++
-		return bytes.NewReader(data), nil
-	}
-	for {
-		input, err := nextInput()
+	for _, inp := range pipeline.Inputs {
+		inputName := inp.Name()
+		stream, err := inp.Open()
 		if err != nil {
-			return err
-		}
-		if input == nil {
-			break
+			return fmt.Errorf("While reading input %s: %w", inputName, err)
 		}
+		input := enc.NewDecoder().Reader(stream)
 
-		pipeline.SetGraph(ls.NewDocumentGraph())
+		xml.newGraph(pipeline)
 		parser := xmlingest.Parser{
 			OnlySchemaAttributes: xml.OnlySchemaAttributes,
 		}
 		if layer != nil {
 			parser.SchemaNode = layer.GetSchemaRootNode()
 		}
-		builder := ls.NewGraphBuilder(pipeline.GetGraphRW(), ls.GraphBuilderOptions{
-			EmbedSchemaNodes:     xml.EmbedSchemaNodes,
-			OnlySchemaAttributes: xml.OnlySchemaAttributes,
-		})
+		builder := xml.newGraphBuilder(pipeline)
 
 		baseID := xml.ID
 
 		parsed, err := parser.ParseStream(pipeline.Context, baseID, input)
+		stream.Close()
 		if err != nil {
 			return fmt.Errorf("While reading input %s: %w", inputName, err)
 		}
@@ -118,6 +91,15 @@ func (xml *XMLIngester) Run(pipeline *PipelineContext) error {
 		if err != nil {
 			return fmt.Errorf("While reading input %s: %w", inputName, err)
 		}
+		if err := xml.upsert(builder); err != nil {
+			return fmt.Errorf("While reading input %s: %w", inputName, err)
+		}
+		if err := applyConditionalAnnotations(pipeline, layer); err != nil {
+			return fmt.Errorf("While reading input %s: %w", inputName, err)
+		}
+		if err := xml.linkIngestedGraph(pipeline, layer); err != nil {
+			return fmt.Errorf("While reading input %s: %w", inputName, err)
+		}
 		if err := pipeline.Next(); err != nil {
 			return fmt.Errorf("Input was %s: %w", inputName, err)
 		}
@@ -129,13 +111,13 @@ func init() {
 	ingestCmd.AddCommand(ingestXMLCmd)
 	ingestXMLCmd.Flags().String("id", "http://example.org/root", "Base ID to use for ingested nodes")
 
-	operations["ingest/xml"] = func() Step {
+	pipeline.RegisterStep("ingest/xml", func() pipeline.Step {
 		return &XMLIngester{
 			BaseIngestParams: BaseIngestParams{
 				EmbedSchemaNodes: true,
 			},
 		}
-	}
+	})
 }
 
 var ingestXMLCmd = &cobra.Command{
@@ -147,7 +129,7 @@ var ingestXMLCmd = &cobra.Command{
 		ing := XMLIngester{}
 		ing.fromCmd(cmd)
 		ing.ID, _ = cmd.Flags().GetString("id")
-		p := []Step{
+		p := []pipeline.Step{
 			&ing,
 			NewWriteGraphStep(cmd),
 		}
@@ -0,0 +1,154 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/cloudprivacylabs/opencypher/graph"
+	"github.com/spf13/cobra"
+
+	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
+)
+
+// LinkStep accumulates the graphs of all inputs, and once all inputs
+// are processed, resolves the pending links of the accumulated
+// graph. The remaining steps run once, using the accumulated graph.
+type LinkStep struct {
+	Report           string `json:"report" yaml:"report"`
+	Strict           bool   `json:"strict" yaml:"strict"`
+	RemoveUnresolved bool   `json:"removeUnresolved" yaml:"removeUnresolved"`
+
+	// The distinct graphs passed to the step. An ingester that
+	// upserts passes the same growing graph for every row or input,
+	// so each graph is combined once, when all inputs are processed.
+	graphs []graph.Graph
+}
+
+func (LinkStep) Help() {
+	fmt.Println(`Resolve pending links
+Accumulate the graphs of all inputs, and once all inputs are
+processed, resolve the references that could not be resolved during
+ingestion. Ingest with deferLinks to record unresolved references as
+pending links. The steps following the link step run once, using the
+accumulated graph.
+
+operation: link
+params:
+  report: fileName         # Write the link resolution report as JSON
+  strict: false            # Fail if a pending link cannot be resolved
+  removeUnresolved: false  # Remove the pending links that cannot be resolved`)
+}
+
+func (step *LinkStep) Run(pipeline *pipeline.PipelineContext) error {
+	g := pipeline.GetGraphRO()
+	for _, x := range step.graphs {
+		if x == g {
+			return nil
+		}
+	}
+	step.graphs = append(step.graphs, g)
+	return nil
+}
+
+func (step *LinkStep) Finish(pipeline *pipeline.PipelineContext) error {
+	g := ls.NewDocumentGraph()
+	for _, x := range step.graphs {
+		ls.CopyGraph(g, x, nil, nil)
+	}
+	step.graphs = nil
+	report := ls.NewLinkReport()
+	if err := ls.ResolvePendingLinks(g, nil, report, step.RemoveUnresolved); err != nil {
+		return err
+	}
+	pipeline.GetLogger().Debug(map[string]interface{}{"link": "resolved", "resolved": report.Resolved, "unresolved": len(report.Unresolved)})
+	if len(step.Report) > 0 {
+		if err := writeJSONReport(step.Report, report); err != nil {
+			return err
+		}
+	}
+	if step.Strict {
+		if err := report.Err(); err != nil {
+			return err
+		}
+	}
+	pipeline.SetGraph(g)
+	return pipeline.Next()
+}
+
+// writeJSONReport writes the report to the file as JSON
+func writeJSONReport(file string, report interface{}) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+func init() {
+	rootCmd.AddCommand(linkCmd)
+	linkCmd.Flags().String("input", "json", "Input graph format (json, jsonld, binary)")
+	linkCmd.Flags().String("output", "json", "Output format, json, jsonld, binary, or dot")
+	linkCmd.Flags().Bool("includeSchema", false, "Include schema in the output")
+	linkCmd.Flags().String("report", "", "Write the link resolution report to this file as JSON")
+	linkCmd.Flags().Bool("strict", false, "Fail if a pending link cannot be resolved")
+	linkCmd.Flags().Bool("removeUnresolved", false, "Remove the pending links that cannot be resolved")
+
+	pipeline.RegisterStep("link", func() pipeline.Step { return &LinkStep{} })
+}
+
+var linkCmd = &cobra.Command{
+	Use:   "link [graphFile...]",
+	Short: "Resolve the pending links of ingested graphs",
+	Long: `Combine the input graphs, and resolve the references that could
+not be resolved when the graphs were ingested. Ingest with --deferLinks
+to record unresolved references as pending links.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		step := &LinkStep{}
+		step.Report, _ = cmd.Flags().GetString("report")
+		step.Strict, _ = cmd.Flags().GetBool("strict")
+		step.RemoveUnresolved, _ = cmd.Flags().GetBool("removeUnresolved")
+		format, _ := cmd.Flags().GetString("input")
+		readGraphs := pipeline.StepFunc(func(pipeline *pipeline.PipelineContext) error {
+			for _, input := range pipeline.Inputs {
+				in, err := input.Open()
+				if err != nil {
+					return err
+				}
+				g, err := cmdutil.ReadGraphFrom(in, pipeline.GetInterner(), format)
+				in.Close()
+				if err != nil {
+					return fmt.Errorf("While reading input %s: %w", input.Name(), err)
+				}
+				pipeline.SetGraph(g)
+				if err := pipeline.Next(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		p := []pipeline.Step{
+			readGraphs,
+			step,
+			NewWriteGraphStep(cmd),
+		}
+		_, err := runPipeline(p, "", args)
+		return err
+	},
+}
@@ -17,6 +17,7 @@ package cmd
 import (
 	"fmt"
 
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
 	"github.com/cloudprivacylabs/opencypher"
 
 	"github.com/spf13/cobra"
@@ -34,9 +35,11 @@ params:
   expr: opencypherExpression`)
 }
 
-func (oc *OCStep) Run(pipeline *PipelineContext) error {
+func (oc *OCStep) Run(pipeline *pipeline.PipelineContext) error {
 	ctx := opencypher.NewEvalContext(pipeline.GetGraphRW())
 	output, err := opencypher.ParseAndEvaluate(oc.Expr, ctx)
+	// The expression may modify the graph
+	pipeline.InvalidateEntityIndex()
 	if err != nil {
 		return err
 	}
@@ -49,11 +52,11 @@ func (oc *OCStep) Run(pipeline *PipelineContext) error {
 
 func init() {
 	rootCmd.AddCommand(ocCmd)
-	ocCmd.Flags().String("input", "json", "Input graph format (json, jsonld)")
+	ocCmd.Flags().String("input", "json", "Input graph format (json, jsonld, binary)")
 	ocCmd.Flags().String("expr", "", "Opencypher expression to run")
 	ocCmd.MarkFlagRequired("expr")
 
-	operations["oc"] = func() Step { return &OCStep{} }
+	pipeline.RegisterStep("oc", func() pipeline.Step { return &OCStep{} })
 }
 
 var ocCmd = &cobra.Command{
@@ -64,7 +67,7 @@ var ocCmd = &cobra.Command{
 		step := &OCStep{}
 		step.Expr, _ = cmd.Flags().GetString("expr")
 
-		p := []Step{
+		p := []pipeline.Step{
 			NewReadGraphStep(cmd),
 			step,
 		}
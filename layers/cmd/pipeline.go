@@ -1,140 +1,20 @@
 package cmd
 
 import (
+	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
 
-	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
-	"github.com/cloudprivacylabs/lsa/pkg/ls"
-	"github.com/cloudprivacylabs/opencypher/graph"
 	"github.com/spf13/cobra"
-)
-
-type PipelineContext struct {
-	*ls.Context
-	graph       graph.Graph
-	roots       []graph.Node
-	InputFiles  []string
-	currentStep int
-	steps       []Step
-	Properties  map[string]interface{}
-	graphOwner  *PipelineContext
-}
-
-type Step interface {
-	Run(*PipelineContext) error
-}
-
-type Pipeline []Step
-
-func unmarshalStep(operation string, stepData interface{}) (Step, error) {
-	op := operations[operation]
-	if op == nil {
-		return nil, fmt.Errorf("Unknown pipeline operation: %s", operation)
-	}
-	step := op()
-	if step == nil {
-		return nil, fmt.Errorf("Invalid step: %s", operation)
-	}
-	stepData = cmdutil.YAMLToMap(stepData)
-	d, err := json.Marshal(stepData)
-	if err != nil {
-		panic(err)
-	}
-	if err := json.Unmarshal(d, step); err != nil {
-		return nil, err
-	}
-	return step, nil
-}
-
-type stepMarshal struct {
-	Operation string      `json:"operation" yaml:"operation"`
-	Step      interface{} `json:"params" yaml:"params"`
-}
-
-func unmarshalPipeline(stepMarshals []stepMarshal) ([]Step, error) {
-	steps := make([]Step, 0, len(stepMarshals))
-	for _, stage := range stepMarshals {
-		step, err := unmarshalStep(stage.Operation, stage.Step)
-		if err != nil {
-			return nil, err
-		}
-		steps = append(steps, step)
-	}
-	return steps, nil
-}
-
-func (p *Pipeline) UnmarshalJSON(in []byte) error {
-	var steps []stepMarshal
-	err := json.Unmarshal(in, &steps)
-	if err != nil {
-		return err
-	}
-	*p, err = unmarshalPipeline(steps)
-	return err
-}
-
-type ForkStep struct {
-	Steps map[string]Pipeline `json:"pipelines" yaml:"pipelines"`
-}
-
-func (ForkStep) Help() {
-	fmt.Println(`Create multiple parallel pipelines.
-
-operation: fork
-params: 
-  pipelines:
-    pipelineName:
-      -
-      -
-    pipelineName:
-      -
-      -`)
-}
-
-func (fork ForkStep) Run(ctx *PipelineContext) error {
-	for idx, pipe := range fork.Steps {
-		if err := forkPipeline(pipe, ctx, idx); err != nil {
-			return err
-		}
-	}
-	return nil
-}
 
-func forkPipeline(pipe Pipeline, ctx *PipelineContext, name string) error {
-	pctx := &PipelineContext{
-		Context:     getContext(),
-		graph:       ctx.graph,
-		roots:       ctx.roots,
-		InputFiles:  ctx.InputFiles,
-		steps:       pipe,
-		currentStep: -1,
-		graphOwner:  ctx.graphOwner,
-	}
-	cpMap := make(map[string]interface{})
-	for k, prop := range ctx.Properties {
-		cpMap[k] = prop
-	}
-	pctx.Properties = cpMap
-	pctx.Context.GetLogger().Debug(map[string]interface{}{"Starting new fork": name})
-	err := pctx.Next()
-	var perr pipelineError
-	if err != nil {
-		if !errors.As(err, &perr) {
-			err = pipelineError{wrapped: fmt.Errorf("fork: %s, %w", name, err), step: pctx.currentStep}
-		}
-		return err
-	}
-	return nil
-}
-
-type StepFunc func(*PipelineContext) error
-
-func (f StepFunc) Run(ctx *PipelineContext) error { return f(ctx) }
-
-var operations = make(map[string]func() Step)
+	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
+)
 
 type ReadGraphStep struct {
 	Format string
@@ -146,8 +26,16 @@ func NewReadGraphStep(cmd *cobra.Command) ReadGraphStep {
 	return rd
 }
 
-func (rd ReadGraphStep) Run(pipeline *PipelineContext) error {
-	g, err := cmdutil.ReadGraph(pipeline.InputFiles, pipeline.Context.GetInterner(), rd.Format)
+func (rd ReadGraphStep) Run(pipeline *pipeline.PipelineContext) error {
+	if len(pipeline.Inputs) == 0 {
+		return fmt.Errorf("No input graph")
+	}
+	in, err := pipeline.Inputs[0].Open()
+	if err != nil {
+		return err
+	}
+	g, err := cmdutil.ReadGraphFrom(in, pipeline.Context.GetInterner(), rd.Format)
+	in.Close()
 	if err != nil {
 		return err
 	}
@@ -166,7 +54,7 @@ func (WriteGraphStep) Help() {
 
 operation: writeGraph
 params:
-  format: json, jsonld, dot, web. Json is the default
+  format: json, jsonld, binary, dot, web. Json is the default
   includeSchema: If false, filter out schema nodes`)
 }
 
@@ -177,77 +65,31 @@ func NewWriteGraphStep(cmd *cobra.Command) WriteGraphStep {
 	return wr
 }
 
-func (wr WriteGraphStep) Run(pipeline *PipelineContext) error {
+func (wr WriteGraphStep) Run(pipeline *pipeline.PipelineContext) error {
 	if len(wr.Format) == 0 {
 		wr.Format = "json"
 	}
 	grph := pipeline.GetGraphRO()
-	return OutputIngestedGraph(wr.Cmd, wr.Format, grph, os.Stdout, wr.IncludeSchema)
-}
-
-type pipelineError struct {
-	wrapped error
-	step    int
-}
-
-func (e pipelineError) Error() string {
-	return fmt.Sprintf("Pipeline error at step %d: %v", e.step, e.wrapped)
-}
-
-func (e pipelineError) Unwrap() error {
-	return e.wrapped
-}
-
-func (ctx *PipelineContext) GetGraphRO() graph.Graph {
-	return ctx.graph
-}
-
-func (ctx *PipelineContext) GetGraphRW() graph.Graph {
-	if ctx != ctx.graphOwner {
-		newTarget := graph.NewOCGraph()
-		nodeMap := ls.CopyGraph(newTarget, ctx.graph, nil, nil)
-		ctx.graph = newTarget
-		for _, root := range ctx.graphOwner.roots {
-			ctx.roots = append(ctx.roots, nodeMap[root])
-		}
-		ctx.graphOwner = ctx
-	}
-	return ctx.graph
-}
-
-func (ctx *PipelineContext) SetGraph(g graph.Graph) *PipelineContext {
-	ctx.graph = g
-	return ctx
-}
-
-func (ctx *PipelineContext) Next() error {
-	ctx.currentStep++
-	if ctx.currentStep >= len(ctx.steps) {
-		return nil
-	}
-	err := ctx.steps[ctx.currentStep].Run(ctx)
-	var perr pipelineError
-	if err != nil && !errors.As(err, &perr) {
-		err = pipelineError{wrapped: err, step: ctx.currentStep}
-	}
-	ctx.currentStep--
-	return err
+	return OutputIngestedGraph(wr.Cmd, wr.Format, grph, pipeline.Output, wr.IncludeSchema)
 }
 
 func init() {
 	rootCmd.AddCommand(pipelineCmd)
 	pipelineCmd.Flags().String("file", "", "Pipeline build file")
 	pipelineCmd.Flags().String("initialGraph", "", "Load this graph and ingest data onto it")
+	pipelineCmd.Flags().StringArray("set", nil, "Set a pipeline variable (key=value)")
+	pipelineCmd.Flags().String("env", "", "Read pipeline variables from a file containing key=value lines")
+	pipelineCmd.Flags().String("metrics", "", "Write step metrics to this file as JSON")
+	pipelineCmd.Flags().Bool("printMetrics", false, "Print a step metrics summary to stderr")
 
-	operations["writeGraph"] = func() Step { return &WriteGraphStep{} }
-	operations["fork"] = func() Step { return &ForkStep{} }
+	pipeline.RegisterStep("writeGraph", func() pipeline.Step { return &WriteGraphStep{} })
 
 	oldHelp := pipelineCmd.HelpFunc()
 	pipelineCmd.SetHelpFunc(func(cmd *cobra.Command, _ []string) {
 		oldHelp(cmd, []string{})
 		type helper interface{ Help() }
-		for _, x := range operations {
-			w := x()
+		for _, name := range pipeline.GetStepNames() {
+			w := pipeline.GetStepFactory(name)()
 			if h, ok := w.(helper); ok {
 				fmt.Println("------------------------")
 				h.Help()
@@ -256,36 +98,75 @@ func init() {
 	})
 }
 
-func readPipeline(file string) ([]Step, error) {
-	var stepMarshals []stepMarshal
-	err := cmdutil.ReadJSONOrYAML(file, &stepMarshals)
+// readPipeline reads a pipeline file or URL, and expands the
+// ${variable} references in step parameters. The relative include
+// paths of a local pipeline file are resolved against the directory
+// of the file.
+func readPipeline(file string, vars map[string]string) (pipeline.Pipeline, error) {
+	data, err := cmdutil.ReadURL(file)
 	if err != nil {
 		return nil, err
 	}
-	return unmarshalPipeline(stepMarshals)
+	dir := ""
+	if u, err := url.Parse(file); err == nil {
+		switch u.Scheme {
+		case "":
+			dir = filepath.Dir(file)
+		case "file":
+			dir = filepath.Dir(u.Path)
+		}
+	}
+	return pipeline.ReadPipelineInDir(bytes.NewReader(data), vars, dir)
+}
+
+// inputsFromArgs returns the pipeline inputs for the command line
+// arguments. Arguments can be files or URLs. If there are no
+// arguments, the input is stdin.
+func inputsFromArgs(args []string) []pipeline.Input {
+	if len(args) == 0 {
+		return []pipeline.Input{pipeline.ReaderInput("stdin", os.Stdin)}
+	}
+	ret := make([]pipeline.Input, 0, len(args))
+	for _, arg := range args {
+		if u, err := url.Parse(arg); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			arg := arg
+			ret = append(ret, pipeline.InputFunc(arg, func() (io.ReadCloser, error) {
+				data, err := cmdutil.ReadURL(arg)
+				if err != nil {
+					return nil, err
+				}
+				return ioutil.NopCloser(bytes.NewReader(data)), nil
+			}))
+			continue
+		}
+		ret = append(ret, pipeline.FileInput(arg))
+	}
+	return ret
+}
+
+func runPipeline(steps []pipeline.Step, initialGraph string, inputs []string) (*pipeline.PipelineContext, error) {
+	return runPipelineWithVars(steps, initialGraph, inputs, nil)
 }
 
-func runPipeline(steps []Step, initialGraph string, inputs []string) (*PipelineContext, error) {
-	var g graph.Graph
-	var err error
+// runPipelineWithVars runs the pipeline using the command line
+// inputs, writing output to ExportTarget
+func runPipelineWithVars(steps []pipeline.Step, initialGraph string, inputs []string, vars map[string]string) (*pipeline.PipelineContext, error) {
+	ctx := pipeline.NewContext(getContext(), steps...).
+		SetInputs(inputsFromArgs(inputs)...).
+		SetOutput(ExportTarget).
+		SetVars(vars)
 	if initialGraph != "" {
-		g, err = cmdutil.ReadJSONGraph([]string{initialGraph}, nil)
+		format, err := cmdutil.GraphFileFormat(initialGraph)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		g = ls.NewDocumentGraph()
-	}
-	pipeline := &PipelineContext{
-		graph:       g,
-		Context:     getContext(),
-		InputFiles:  inputs,
-		steps:       steps,
-		currentStep: -1,
-		Properties:  make(map[string]interface{}),
+		g, err := cmdutil.ReadGraph([]string{initialGraph}, ctx.GetInterner(), format)
+		if err != nil {
+			return nil, err
+		}
+		ctx.SetGraph(g)
 	}
-	pipeline.graphOwner = pipeline
-	return pipeline, pipeline.Next()
+	return ctx, ctx.Run()
 }
 
 var pipelineCmd = &cobra.Command{
@@ -297,12 +178,62 @@ var pipelineCmd = &cobra.Command{
 		if err != nil {
 			failErr(err)
 		}
-		steps, err := readPipeline(file)
+		vars, err := pipelineVarsFromCmd(cmd)
+		if err != nil {
+			failErr(err)
+		}
+		steps, err := readPipeline(file, vars)
 		if err != nil {
 			failErr(err)
 		}
 		initialGraph, _ := cmd.Flags().GetString("initialGraph")
-		_, err = runPipeline(steps, initialGraph, args)
+		ctx, err := runPipelineWithVars(steps, initialGraph, args, vars)
+		if ctx != nil {
+			if merr := writeMetrics(cmd, ctx.GetMetrics()); merr != nil && err == nil {
+				err = merr
+			}
+		}
 		return err
 	},
 }
+
+// writeMetrics writes the pipeline metrics based on the --metrics
+// and --printMetrics flags
+func writeMetrics(cmd *cobra.Command, metrics *pipeline.Metrics) error {
+	if print, _ := cmd.Flags().GetBool("printMetrics"); print {
+		if err := metrics.WriteTable(os.Stderr); err != nil {
+			return err
+		}
+	}
+	file, _ := cmd.Flags().GetString("metrics")
+	if len(file) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(metrics, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// pipelineVarsFromCmd reads the pipeline variables from the env file
+// and the --set flags. --set overrides the env file.
+func pipelineVarsFromCmd(cmd *cobra.Command) (map[string]string, error) {
+	vars := make(map[string]string)
+	if envFile, _ := cmd.Flags().GetString("env"); len(envFile) > 0 {
+		v, err := pipeline.ReadEnvFile(envFile)
+		if err != nil {
+			return nil, err
+		}
+		vars = v
+	}
+	sets, _ := cmd.Flags().GetStringArray("set")
+	for _, x := range sets {
+		key, value, err := pipeline.ParseVarAssignment(x)
+		if err != nil {
+			return nil, err
+		}
+		vars[key] = value
+	}
+	return vars, nil
+}
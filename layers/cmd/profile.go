@@ -0,0 +1,546 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudprivacylabs/opencypher/graph"
+	"github.com/spf13/cobra"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
+	"github.com/cloudprivacylabs/lsa/pkg/validators"
+)
+
+// Attribute population status in a profile report
+const (
+	PopulatedNever     = "never"
+	PopulatedSometimes = "sometimes"
+	PopulatedAlways    = "always"
+)
+
+// ValueCount is a value and the number of its occurrences
+type ValueCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// AttributeProfile contains the statistics collected for the
+// instances of a schema attribute
+type AttributeProfile struct {
+	SchemaNodeID       string `json:"schemaNodeId"`
+	AttributeName      string `json:"attributeName,omitempty"`
+	Type               string `json:"type,omitempty"`
+	ParentSchemaNodeID string `json:"parentSchemaNodeId,omitempty"`
+	// Number of document nodes that are instances of the attribute
+	Instances int `json:"instances"`
+	// Number of instances of the parent attribute
+	ParentInstances int `json:"parentInstances"`
+	// Number of instances of the parent attribute that contain at
+	// least one instance of this attribute
+	Present  int     `json:"present"`
+	Coverage float64 `json:"coverage"`
+	Status   string  `json:"status"`
+
+	// Value statistics. These are only collected for value attributes
+	Empty     int          `json:"empty,omitempty"`
+	Distinct  int          `json:"distinct,omitempty"`
+	MinLength *int         `json:"minLength,omitempty"`
+	MaxLength *int         `json:"maxLength,omitempty"`
+	Min       *float64     `json:"min,omitempty"`
+	Max       *float64     `json:"max,omitempty"`
+	Mean      *float64     `json:"mean,omitempty"`
+	TopValues []ValueCount `json:"topValues,omitempty"`
+
+	// For enumerated attributes, the number of occurrences of each
+	// option, and the values that are not one of the options
+	EnumValues       []ValueCount `json:"enumValues,omitempty"`
+	UnexpectedValues []ValueCount `json:"unexpectedValues,omitempty"`
+}
+
+// ProfileReport is the schema coverage report of the profiled graphs
+type ProfileReport struct {
+	Schema        string `json:"schema,omitempty"`
+	Graphs        int    `json:"graphs"`
+	Entities      int    `json:"entities"`
+	DocumentNodes int    `json:"documentNodes"`
+	// Document nodes that are not instances of a schema attribute, and
+	// the number of such nodes by attribute name
+	UnmatchedNodes int          `json:"unmatchedNodes"`
+	Unmatched      []ValueCount `json:"unmatched,omitempty"`
+
+	NeverPopulated     int `json:"neverPopulated"`
+	SometimesPopulated int `json:"sometimesPopulated"`
+	AlwaysPopulated    int `json:"alwaysPopulated"`
+
+	Attributes []AttributeProfile `json:"attributes"`
+}
+
+type attributeStats struct {
+	profile    AttributeProfile
+	enum       []string
+	values     map[string]int
+	numeric    bool
+	sum        float64
+	numValues  int
+	minLength  int
+	maxLength  int
+	min, max   float64
+	order      int
+	fromSchema bool
+}
+
+// GraphProfiler collects schema coverage and value statistics from
+// document graphs
+type GraphProfiler struct {
+	// Number of most frequent values to report for each attribute
+	TopN int
+
+	layer      *ls.Layer
+	attributes map[string]*attributeStats
+	unmatched  map[string]int
+	report     ProfileReport
+}
+
+// NewGraphProfiler returns a new profiler. If layer is nonnil, the
+// attributes of the layer are reported even if they have no
+// instances.
+func NewGraphProfiler(layer *ls.Layer, topN int) *GraphProfiler {
+	ret := &GraphProfiler{
+		TopN:       topN,
+		layer:      layer,
+		attributes: make(map[string]*attributeStats),
+		unmatched:  make(map[string]int),
+	}
+	if layer == nil {
+		return ret
+	}
+	ret.report.Schema = layer.GetID()
+	layer.ForEachAttribute(func(node graph.Node, _ []graph.Node) bool {
+		stats := ret.getStats(ls.GetNodeID(node))
+		stats.fromSchema = true
+		stats.setSchemaNode(node)
+		if parent := ls.GetParentAttribute(node); parent != nil {
+			stats.profile.ParentSchemaNodeID = ls.GetNodeID(parent)
+		}
+		return true
+	})
+	return ret
+}
+
+func (p *GraphProfiler) getStats(schemaNodeID string) *attributeStats {
+	stats := p.attributes[schemaNodeID]
+	if stats == nil {
+		stats = &attributeStats{
+			profile: AttributeProfile{SchemaNodeID: schemaNodeID},
+			values:  make(map[string]int),
+			numeric: true,
+			order:   len(p.attributes),
+		}
+		p.attributes[schemaNodeID] = stats
+	}
+	return stats
+}
+
+// setSchemaNode sets the attribute name, type, and enumeration
+// options from the schema node, or from a document node with embedded
+// schema properties
+func (stats *attributeStats) setSchemaNode(node graph.Node) {
+	if len(stats.profile.AttributeName) == 0 {
+		stats.profile.AttributeName = ls.AsPropertyValue(ls.GetNodeOrSchemaProperty(node, ls.AttributeNameTerm)).AsString()
+	}
+	if len(stats.profile.Type) == 0 {
+		if types := ls.FilterAttributeTypes(node.GetLabels().Slice()); len(types) > 0 {
+			stats.profile.Type = types[0]
+		}
+	}
+	if stats.enum == nil {
+		if options := ls.AsPropertyValue(ls.GetNodeOrSchemaProperty(node, validators.EnumTerm)); options != nil {
+			if options.IsString() {
+				stats.enum = []string{options.AsString()}
+			} else {
+				stats.enum = options.AsStringSlice()
+			}
+		}
+	}
+}
+
+// Add collects the statistics of the document nodes of g
+func (p *GraphProfiler) Add(g graph.Graph) {
+	p.report.Graphs++
+	// The parent instances containing instances of an attribute
+	present := make(map[*attributeStats]map[graph.Node]struct{})
+	for nodes := g.GetNodes(); nodes.Next(); {
+		node := nodes.Node()
+		if !ls.IsDocumentNode(node) {
+			continue
+		}
+		p.report.DocumentNodes++
+		if ls.IsNodeEntityRoot(node) {
+			p.report.Entities++
+		}
+		schemaNodeID := ls.AsPropertyValue(node.GetProperty(ls.SchemaNodeIDTerm)).AsString()
+		if len(schemaNodeID) == 0 {
+			p.report.UnmatchedNodes++
+			p.unmatched[ls.AsPropertyValue(node.GetProperty(ls.AttributeNameTerm)).AsString()]++
+			continue
+		}
+		stats := p.getStats(schemaNodeID)
+		stats.profile.Instances++
+		if !stats.fromSchema {
+			stats.setSchemaNode(node)
+		}
+		// Only the attribute tree parents are counted. Parents
+		// connected with reference links are not.
+		for edges := node.GetEdgesWithLabel(graph.IncomingEdge, ls.HasTerm); edges.Next(); {
+			parent := edges.Edge().GetFrom()
+			if !ls.IsDocumentNode(parent) {
+				continue
+			}
+			parentID := ls.AsPropertyValue(parent.GetProperty(ls.SchemaNodeIDTerm)).AsString()
+			if len(parentID) == 0 {
+				continue
+			}
+			if len(stats.profile.ParentSchemaNodeID) == 0 && !stats.fromSchema {
+				stats.profile.ParentSchemaNodeID = parentID
+			}
+			if parentID != stats.profile.ParentSchemaNodeID {
+				continue
+			}
+			set := present[stats]
+			if set == nil {
+				set = make(map[graph.Node]struct{})
+				present[stats] = set
+			}
+			set[parent] = struct{}{}
+		}
+		if node.HasLabel(ls.AttributeTypeValue) {
+			value, ok := ls.GetRawNodeValue(node)
+			if !ok || len(value) == 0 {
+				stats.profile.Empty++
+				continue
+			}
+			stats.addValue(value)
+		}
+	}
+	for stats, parents := range present {
+		stats.profile.Present += len(parents)
+	}
+}
+
+func (stats *attributeStats) addValue(value string) {
+	stats.values[value]++
+	if stats.numValues == 0 || len(value) < stats.minLength {
+		stats.minLength = len(value)
+	}
+	if stats.numValues == 0 || len(value) > stats.maxLength {
+		stats.maxLength = len(value)
+	}
+	if stats.numeric {
+		if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+			stats.numeric = false
+		} else {
+			if stats.numValues == 0 || f < stats.min {
+				stats.min = f
+			}
+			if stats.numValues == 0 || f > stats.max {
+				stats.max = f
+			}
+			stats.sum += f
+		}
+	}
+	stats.numValues++
+}
+
+// sortValueCounts returns the values sorted by descending count, and
+// then by value
+func sortValueCounts(values map[string]int) []ValueCount {
+	ret := make([]ValueCount, 0, len(values))
+	for k, v := range values {
+		ret = append(ret, ValueCount{Value: k, Count: v})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Value < ret[j].Value
+	})
+	return ret
+}
+
+// Report returns the profile report of the graphs collected so far
+func (p *GraphProfiler) Report() ProfileReport {
+	report := p.report
+	report.Unmatched = nil
+	if report.UnmatchedNodes > 0 {
+		report.Unmatched = sortValueCounts(p.unmatched)
+	}
+	all := make([]*attributeStats, 0, len(p.attributes))
+	for _, stats := range p.attributes {
+		all = append(all, stats)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].order < all[j].order })
+	report.Attributes = make([]AttributeProfile, 0, len(all))
+	for _, stats := range all {
+		profile := stats.profile
+		if len(profile.ParentSchemaNodeID) > 0 {
+			if parent := p.attributes[profile.ParentSchemaNodeID]; parent != nil {
+				profile.ParentInstances = parent.profile.Instances
+			}
+		} else {
+			// The schema root attribute is present once for each graph
+			// that has an instance of it
+			profile.ParentInstances = profile.Instances
+			profile.Present = profile.Instances
+		}
+		if profile.ParentInstances > 0 {
+			profile.Coverage = float64(profile.Present) / float64(profile.ParentInstances)
+		}
+		switch {
+		case profile.Instances == 0:
+			profile.Status = PopulatedNever
+			report.NeverPopulated++
+		case profile.Present >= profile.ParentInstances:
+			profile.Status = PopulatedAlways
+			report.AlwaysPopulated++
+		default:
+			profile.Status = PopulatedSometimes
+			report.SometimesPopulated++
+		}
+		if stats.numValues > 0 {
+			profile.Distinct = len(stats.values)
+			minLength, maxLength := stats.minLength, stats.maxLength
+			profile.MinLength, profile.MaxLength = &minLength, &maxLength
+			if stats.numeric {
+				min, max, mean := stats.min, stats.max, stats.sum/float64(stats.numValues)
+				profile.Min, profile.Max, profile.Mean = &min, &max, &mean
+			}
+			values := sortValueCounts(stats.values)
+			if p.TopN >= 0 && len(values) > p.TopN {
+				profile.TopValues = values[:p.TopN]
+			} else {
+				profile.TopValues = values
+			}
+		}
+		if stats.enum != nil {
+			profile.EnumValues = make([]ValueCount, 0, len(stats.enum))
+			options := make(map[string]struct{}, len(stats.enum))
+			for _, option := range stats.enum {
+				options[option] = struct{}{}
+				profile.EnumValues = append(profile.EnumValues, ValueCount{Value: option, Count: stats.values[option]})
+			}
+			unexpected := make(map[string]int)
+			for value, count := range stats.values {
+				if _, ok := options[value]; !ok {
+					unexpected[value] = count
+				}
+			}
+			if len(unexpected) > 0 {
+				profile.UnexpectedValues = sortValueCounts(unexpected)
+			}
+		}
+		report.Attributes = append(report.Attributes, profile)
+	}
+	return report
+}
+
+var profileHTMLTemplate = template.Must(template.New("profile").Funcs(template.FuncMap{
+	"percent": func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) },
+	"deref": func(f *float64) string {
+		if f == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*f, 'g', -1, 64)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Profile{{if .Schema}} of {{.Schema}}{{end}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+tr.never { background: #fdd; }
+tr.sometimes { background: #ffd; }
+</style>
+</head>
+<body>
+<h1>Profile{{if .Schema}} of {{.Schema}}{{end}}</h1>
+<table>
+<tr><th>Graphs</th><td>{{.Graphs}}</td></tr>
+<tr><th>Entities</th><td>{{.Entities}}</td></tr>
+<tr><th>Document nodes</th><td>{{.DocumentNodes}}</td></tr>
+<tr><th>Nodes without schema attribute</th><td>{{.UnmatchedNodes}}</td></tr>
+<tr><th>Attributes never populated</th><td>{{.NeverPopulated}}</td></tr>
+<tr><th>Attributes sometimes populated</th><td>{{.SometimesPopulated}}</td></tr>
+<tr><th>Attributes always populated</th><td>{{.AlwaysPopulated}}</td></tr>
+</table>
+{{if .Unmatched}}
+<h2>Nodes without schema attribute</h2>
+<table>
+<tr><th>Attribute name</th><th>Count</th></tr>
+{{range .Unmatched}}<tr><td>{{.Value}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Attributes</h2>
+<table>
+<tr><th>Schema node</th><th>Name</th><th>Status</th><th>Instances</th><th>Coverage</th><th>Empty</th><th>Distinct</th><th>Length</th><th>Min</th><th>Max</th><th>Mean</th><th>Values</th></tr>
+{{range .Attributes}}<tr class="{{.Status}}"><td>{{.SchemaNodeID}}</td><td>{{.AttributeName}}</td><td>{{.Status}}</td><td>{{.Instances}}</td><td>{{percent .Coverage}} ({{.Present}}/{{.ParentInstances}})</td><td>{{.Empty}}</td><td>{{.Distinct}}</td><td>{{if .MinLength}}{{.MinLength}}-{{.MaxLength}}{{end}}</td><td>{{deref .Min}}</td><td>{{deref .Max}}</td><td>{{deref .Mean}}</td>
+<td>{{if .EnumValues}}Options: {{range .EnumValues}}{{.Value}} ({{.Count}}) {{end}}{{if .UnexpectedValues}}<br>Unexpected: {{range .UnexpectedValues}}{{.Value}} ({{.Count}}) {{end}}{{end}}{{else}}{{range .TopValues}}{{.Value}} ({{.Count}}) {{end}}{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// WriteHTML writes the report as an HTML page
+func (report ProfileReport) WriteHTML(w io.Writer) error {
+	return profileHTMLTemplate.Execute(w, report)
+}
+
+// ProfileStep collects schema coverage and value statistics from
+// the graphs of all inputs, and writes the report once all inputs
+// are processed. The input graphs are passed to the next step
+// unmodified.
+type ProfileStep struct {
+	SchemaParams
+	Report string `json:"report" yaml:"report"`
+	Format string `json:"format" yaml:"format"`
+	TopN   *int   `json:"topN" yaml:"topN"`
+
+	profiler *GraphProfiler
+}
+
+func (ProfileStep) Help() {
+	fmt.Println(`Profile graphs
+Collect schema coverage and value statistics for each schemaNodeId
+from the document graphs of all inputs, and write the report once
+all inputs are processed. The report lists the schema attributes
+that never or only sometimes have instances, value distributions,
+the values of enumerated attributes, and the document nodes that are
+not instances of a schema attribute. If a schema is given, or if there
+is a schema in the pipeline, attributes without instances are
+reported as well. The graphs are passed to the next step unmodified.
+
+operation: profile
+params:
+  report: fileName    # Write the report to this file. Default is stdout
+  format: json        # json or html
+  topN: 10            # Number of most frequent values reported for each attribute`)
+	fmt.Println(schemaParamsHelp)
+}
+
+func (step *ProfileStep) Run(pipeline *pipeline.PipelineContext) error {
+	if step.profiler == nil {
+		var layer *ls.Layer
+		if step.IsEmptySchema() {
+			layer, _ = pipeline.Properties["layer"].(*ls.Layer)
+		} else {
+			var err error
+			layer, err = LoadSchemaFromFileOrRepo(pipeline.Context, step.CompiledSchema, step.Repo, step.Schema, step.Type, step.Bundle, step.BundleProfile)
+			if err != nil {
+				return err
+			}
+		}
+		topN := 10
+		if step.TopN != nil {
+			topN = *step.TopN
+		}
+		step.profiler = NewGraphProfiler(layer, topN)
+	}
+	step.profiler.Add(pipeline.GetGraphRO())
+	return pipeline.Next()
+}
+
+func (step *ProfileStep) Finish(pipeline *pipeline.PipelineContext) error {
+	profiler := step.profiler
+	step.profiler = nil
+	if profiler == nil {
+		profiler = NewGraphProfiler(nil, 0)
+	}
+	report := profiler.Report()
+	var w io.Writer = os.Stdout
+	if len(step.Report) > 0 {
+		f, err := os.Create(step.Report)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	switch step.Format {
+	case "", "json":
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case "html":
+		return report.WriteHTML(w)
+	}
+	return fmt.Errorf("Unknown report format: %s", step.Format)
+}
+
+func init() {
+	rootCmd.AddCommand(profileCmd)
+	addSchemaFlags(profileCmd.Flags())
+	profileCmd.Flags().String("compiledschema", "", "Use the given compiled schema")
+	profileCmd.Flags().String("input", "json", "Input graph format (json, jsonld, binary)")
+	profileCmd.Flags().String("output", "json", "Report format, json or html")
+	profileCmd.Flags().String("report", "", "Write the report to this file instead of stdout")
+	profileCmd.Flags().Int("topN", 10, "Number of most frequent values reported for each attribute")
+
+	pipeline.RegisterStep("profile", func() pipeline.Step { return &ProfileStep{} })
+}
+
+var profileCmd = &cobra.Command{
+	Use:   "profile [graphFile]",
+	Short: "Report schema coverage and value statistics of a graph",
+	Long: `Collect schema coverage and value statistics for each schemaNodeId
+from a document graph, and write a JSON or HTML report. The report
+lists the schema attributes that never or only sometimes have
+instances, value distributions, the values of enumerated attributes,
+and the document nodes that are not instances of a schema attribute
+(ingested with onlySchemaAttributes=false).
+
+If a schema is given, the attributes of the schema that have no
+instances are reported as well.
+
+  layers profile --schema person.schema.json --output html --report profile.html graph.json`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		step := &ProfileStep{}
+		step.fromCmd(cmd)
+		step.Report, _ = cmd.Flags().GetString("report")
+		step.Format, _ = cmd.Flags().GetString("output")
+		topN, _ := cmd.Flags().GetInt("topN")
+		step.TopN = &topN
+		p := []pipeline.Step{
+			NewReadGraphStep(cmd),
+			step,
+		}
+		_, err := runPipeline(p, "", args)
+		return err
+	},
+}
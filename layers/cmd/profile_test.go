@@ -0,0 +1,135 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/cloudprivacylabs/opencypher/graph"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+)
+
+const profileTestSchema = `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@id": "https://person",
+  "@type": "ls:Schema",
+  "ls:valueType": "Person",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "person",
+    "ls:Object/attributes": [
+      {"@id": "id", "@type": "ls:Value", "ls:attributeName": "id"},
+      {"@id": "status", "@type": "ls:Value", "ls:attributeName": "status", "ls:validation/enumeration": ["a", "b"]},
+      {"@id": "score", "@type": "ls:Value", "ls:attributeName": "score"},
+      {"@id": "email", "@type": "ls:Value", "ls:attributeName": "email"}
+    ]
+  }
+}`
+
+func TestProfile(t *testing.T) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(profileTestSchema), &v); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := ls.UnmarshalLayer(v, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler := ls.Compiler{
+		Loader: ls.SchemaLoaderFunc(func(string) (*ls.Layer, error) { return layer, nil }),
+	}
+	layer, err = compiler.Compile(ls.DefaultContext(), "https://person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := ls.NewGraphBuilder(nil, ls.GraphBuilderOptions{EmbedSchemaNodes: true})
+	for _, row := range [][]string{{"1", "a", "10"}, {"2", "a", ""}, {"3", "x", "20"}} {
+		_, root, _ := builder.ObjectAsNode(layer.GetSchemaRootNode(), nil)
+		builder.ValueAsNode(layer.GetAttributeByID("id"), root, row[0])
+		builder.ValueAsNode(layer.GetAttributeByID("status"), root, row[1])
+		if len(row[2]) > 0 {
+			builder.ValueAsNode(layer.GetAttributeByID("score"), root, row[2])
+		}
+		_, extra, _ := builder.ValueAsNode(nil, root, "extra")
+		extra.SetProperty(ls.AttributeNameTerm, ls.StringPropertyValue("nickname"))
+	}
+
+	profiler := NewGraphProfiler(layer, 10)
+	profiler.Add(builder.GetGraph())
+	report := profiler.Report()
+	if report.Entities != 3 || report.UnmatchedNodes != 3 {
+		t.Errorf("Wrong counts: %+v", report)
+	}
+	if len(report.Unmatched) != 1 || report.Unmatched[0].Value != "nickname" {
+		t.Errorf("Wrong unmatched: %v", report.Unmatched)
+	}
+	attrs := make(map[string]AttributeProfile)
+	for _, a := range report.Attributes {
+		attrs[a.SchemaNodeID] = a
+	}
+	if a := attrs["email"]; a.Status != PopulatedNever {
+		t.Errorf("Wrong email: %+v", a)
+	}
+	if a := attrs["id"]; a.Status != PopulatedAlways || a.Distinct != 3 {
+		t.Errorf("Wrong id: %+v", a)
+	}
+	if a := attrs["score"]; a.Status != PopulatedSometimes || a.Present != 2 || a.ParentInstances != 3 || a.Mean == nil || *a.Mean != 15 {
+		t.Errorf("Wrong score: %+v", a)
+	}
+	status := attrs["status"]
+	if len(status.EnumValues) != 2 || status.EnumValues[0].Count != 2 || status.EnumValues[1].Count != 0 {
+		t.Errorf("Wrong enum values: %v", status.EnumValues)
+	}
+	if len(status.UnexpectedValues) != 1 || status.UnexpectedValues[0].Value != "x" {
+		t.Errorf("Wrong unexpected values: %v", status.UnexpectedValues)
+	}
+	if err := report.WriteHTML(&bytes.Buffer{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProfileLinkParents(t *testing.T) {
+	g := ls.NewDocumentGraph()
+	newNode := func(schemaNodeID string) graph.Node {
+		return g.NewNode([]string{ls.DocumentNodeTerm}, map[string]interface{}{
+			ls.SchemaNodeIDTerm: ls.StringPropertyValue(schemaNodeID),
+		})
+	}
+	person := newNode("person")
+	g.NewEdge(person, newNode("name"), ls.HasTerm, nil)
+	// contact is a separate entity linked from person
+	contact := newNode("contact")
+	g.NewEdge(person, contact, "contact", nil)
+	g.NewEdge(contact, newNode("email"), ls.HasTerm, nil)
+
+	profiler := NewGraphProfiler(nil, 10)
+	profiler.Add(g)
+	attrs := make(map[string]AttributeProfile)
+	for _, a := range profiler.Report().Attributes {
+		attrs[a.SchemaNodeID] = a
+	}
+	if a := attrs["contact"]; a.ParentSchemaNodeID != "" || a.Status != PopulatedAlways {
+		t.Errorf("Wrong contact: %+v", a)
+	}
+	if a := attrs["email"]; a.ParentSchemaNodeID != "contact" || a.Present != 1 || a.ParentInstances != 1 {
+		t.Errorf("Wrong email: %+v", a)
+	}
+	if a := attrs["name"]; a.ParentSchemaNodeID != "person" || a.Status != PopulatedAlways {
+		t.Errorf("Wrong name: %+v", a)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/repo/fs"
+	httprepo "github.com/cloudprivacylabs/lsa/pkg/repo/http"
+)
+
+func init() {
+	rootCmd.AddCommand(repoCmd)
+	repoCmd.AddCommand(repoListCmd)
+	repoCmd.AddCommand(repoServeCmd)
+	repoServeCmd.Flags().String("addr", ":8080", "Address to listen")
+}
+
+var repoCmd = &cobra.Command{
+	Use:   "repo",
+	Short: "Schema repository operations",
+}
+
+var repoListCmd = &cobra.Command{
+	Use:   "list repoDir",
+	Short: "List the schemas, overlays, and schema variants in a repository",
+	Long: `List all versions of the schemas, overlays, and schema variants in a
+repository. For each schema version, the overlays that can be applied
+to that version are listed.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := getFSRepo(args[0], ls.NewInterner())
+		if err != nil {
+			return err
+		}
+		index := append([]fs.IndexEntry{}, repo.GetIndex()...)
+		sort.SliceStable(index, func(i, j int) bool {
+			if index[i].Type != index[j].Type {
+				return index[i].Type > index[j].Type
+			}
+			if index[i].ID != index[j].ID {
+				return index[i].ID < index[j].ID
+			}
+			return compareVersionStrings(index[i].Version, index[j].Version) < 0
+		})
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "Type\tID\tVersion\tValue type\tTarget version\tFile")
+		for _, x := range index {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", shortLayerType(x.Type), x.ID, x.Version, x.ValueType, x.TargetVersion, x.File)
+			if x.Type != ls.SchemaTerm {
+				continue
+			}
+			for _, ovl := range repo.GetOverlaysFor(x) {
+				version := ovl.Version
+				if len(version) > 0 {
+					version = "@" + version
+				}
+				fmt.Fprintf(w, "\t  overlay %s%s\t\t\t\t\n", ovl.ID, version)
+			}
+		}
+		return w.Flush()
+	},
+}
+
+var repoServeCmd = &cobra.Command{
+	Use:   "serve repoDir",
+	Short: "Serve a schema repository over HTTP",
+	Long: `Serve the schemas, overlays, and schema variants of a repository
+over HTTP. The following endpoints are available:
+
+  GET /index                        Index entries of the repository
+  GET /layer?id=ref                 Raw schema, overlay, or schema variant
+  GET /schema?id=ref                Layer or composed schema variant
+  GET /schema?valueType=t           Composed schema variant for the value type
+  GET /schema?id=ref&compiled=true  Compiled schema graph
+
+The server URL can be used as the --repo argument of other commands.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Requests are served concurrently
+		repo, err := getFSRepo(args[0], ls.NewSyncInterner())
+		if err != nil {
+			return err
+		}
+		addr, _ := cmd.Flags().GetString("addr")
+		server := httprepo.NewServer(repo)
+		server.OnError = func(r *http.Request, err error) {
+			logger.Error(map[string]interface{}{"url": r.URL.String(), "error": err.Error()})
+		}
+		fmt.Printf("Serving %s at %s\n", args[0], addr)
+		return http.ListenAndServe(addr, server)
+	},
+}
+
+func shortLayerType(t string) string {
+	switch t {
+	case ls.SchemaTerm:
+		return "Schema"
+	case ls.OverlayTerm:
+		return "Overlay"
+	case ls.SchemaVariantTerm:
+		return "SchemaVariant"
+	}
+	return t
+}
+
+// compareVersionStrings compares semantic versions. Unversioned and
+// invalid versions come first.
+func compareVersionStrings(a, b string) int {
+	va, erra := ls.ParseVersion(a)
+	vb, errb := ls.ParseVersion(b)
+	switch {
+	case erra != nil && errb != nil:
+		return 0
+	case erra != nil:
+		return -1
+	case errb != nil:
+		return 1
+	}
+	return va.Compare(vb)
+}
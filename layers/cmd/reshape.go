@@ -19,6 +19,7 @@ import (
 
 	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
 	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
 	"github.com/cloudprivacylabs/lsa/pkg/transform"
 	"github.com/spf13/cobra"
 )
@@ -90,13 +91,13 @@ https://lschema.org/transform namespace:
 	fmt.Println(baseIngestParamsHelp)
 }
 
-func (rs *ReshapeStep) Run(pipeline *PipelineContext) error {
+func (rs *ReshapeStep) Run(pipeline *pipeline.PipelineContext) error {
 	var err error
 	if !rs.initialized {
 		if rs.IsEmptySchema() {
 			rs.layer, _ = pipeline.Properties["layer"].(*ls.Layer)
 		} else {
-			rs.layer, err = LoadSchemaFromFileOrRepo(pipeline.Context, rs.CompiledSchema, rs.Repo, rs.Schema, rs.Type, rs.Bundle)
+			rs.layer, err = LoadSchemaFromFileOrRepo(pipeline.Context, rs.CompiledSchema, rs.Repo, rs.Schema, rs.Type, rs.Bundle, rs.BundleProfile)
 			if err != nil {
 				return err
 			}
@@ -134,11 +135,11 @@ func init() {
 	rootCmd.AddCommand(reshapeCmd)
 	addSchemaFlags(reshapeCmd.Flags())
 	reshapeCmd.Flags().String("compiledschema", "", "Use the given compiled schema")
-	reshapeCmd.Flags().String("input", "json", "Input graph format (json, jsonld)")
-	reshapeCmd.PersistentFlags().String("output", "json", "Output format, json, jsonld, or dot")
+	reshapeCmd.Flags().String("input", "json", "Input graph format (json, jsonld, binary)")
+	reshapeCmd.PersistentFlags().String("output", "json", "Output format, json, jsonld, binary, or dot")
 	reshapeCmd.Flags().String("script", "", "Transformation script file")
 
-	operations["reshape"] = func() Step { return &ReshapeStep{} }
+	pipeline.RegisterStep("reshape", func() pipeline.Step { return &ReshapeStep{} })
 }
 
 var reshapeCmd = &cobra.Command{
@@ -149,7 +150,7 @@ var reshapeCmd = &cobra.Command{
 		step := &ReshapeStep{}
 		step.fromCmd(cmd)
 		step.ScriptFile, _ = cmd.Flags().GetString("script")
-		p := []Step{
+		p := []pipeline.Step{
 			NewReadGraphStep(cmd),
 			step,
 			NewWriteGraphStep(cmd),
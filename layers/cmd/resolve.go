@@ -0,0 +1,161 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
+	"github.com/cloudprivacylabs/lsa/pkg/transform"
+)
+
+// ResolveEntitiesStep matches the entities of the graph using an
+// entity resolution spec, and connects or merges the matching
+// entities
+type ResolveEntitiesStep struct {
+	// SpecFile is a YAML or JSON entity resolution spec
+	SpecFile string `json:"spec" yaml:"spec"`
+	// Threshold and Action override the spec
+	Threshold   float64 `json:"threshold" yaml:"threshold"`
+	Action      string  `json:"action" yaml:"action"`
+	MergePolicy string  `json:"mergePolicy" yaml:"mergePolicy"`
+	Report      string  `json:"report" yaml:"report"`
+
+	resolver    *transform.EntityResolver
+	initialized bool
+}
+
+func (ResolveEntitiesStep) Help() {
+	fmt.Println(`Resolve entities
+Score pairs of entities using attribute comparators, and connect the
+entities whose score is above a threshold with sameAs edges, or merge
+them. To resolve entities from multiple inputs, accumulate them using
+the link step first.
+
+operation: resolve
+params:
+  spec: fileName        # Entity resolution spec, YAML or JSON
+  threshold: 0.85       # Overrides the spec threshold
+  action: sameAs        # sameAs or merge, overrides the spec action
+  mergePolicy: replace  # Default merge policy if action is merge
+  report: fileName      # Write the matches as JSON
+
+The spec is of the form:
+
+  entities:             # Entity schemas or value types. Default is all
+    - https://example.org/Person
+  blocking:             # Only entities sharing a blocking value are compared
+    - lastName
+  attributes:
+    - key: lastName
+      schemaNodeIds: [ https://a/lastName, https://b/surname ]
+      comparator: normalized
+    - key: firstName
+      schemaNodeIds: [ https://a/firstName, https://b/givenName ]
+      comparator: jaroWinkler
+      weight: 2
+    - schemaNodeIds: [ https://a/birthDate ]
+      comparator: date
+      maxDays: 30
+  threshold: 0.85
+  action: sameAs
+
+Comparators are exact, normalized, jaroWinkler, and date. Match
+attributes can also be declared in the schema or in an overlay using
+the https://lschema.org/transform/match/ terms: key, comparator,
+weight, maxDays, and blocking.`)
+}
+
+func (step *ResolveEntitiesStep) Run(pipeline *pipeline.PipelineContext) error {
+	if !step.initialized {
+		step.resolver = &transform.EntityResolver{}
+		if len(step.SpecFile) > 0 {
+			if err := cmdutil.ReadJSONOrYAML(step.SpecFile, &step.resolver.Spec); err != nil {
+				return err
+			}
+		}
+		if step.Threshold != 0 {
+			step.resolver.Spec.Threshold = step.Threshold
+		}
+		if len(step.Action) > 0 {
+			step.resolver.Spec.Action = step.Action
+		}
+		if len(step.MergePolicy) > 0 {
+			if err := ls.ValidateMergePolicy(step.MergePolicy); err != nil {
+				return err
+			}
+			step.resolver.MergeOptions.DefaultPolicy = step.MergePolicy
+		}
+		if err := step.resolver.Spec.Validate(); err != nil {
+			return err
+		}
+		step.initialized = true
+	}
+	matches, err := step.resolver.Resolve(pipeline.GetGraphRW())
+	// Merged entities are removed from the graph
+	pipeline.InvalidateEntityIndex()
+	if err != nil {
+		return err
+	}
+	pipeline.GetLogger().Debug(map[string]interface{}{"resolve": "done", "matches": len(matches)})
+	if len(step.Report) > 0 {
+		if err := writeJSONReport(step.Report, matches); err != nil {
+			return err
+		}
+	}
+	return pipeline.Next()
+}
+
+func init() {
+	rootCmd.AddCommand(resolveCmd)
+	resolveCmd.Flags().String("input", "json", "Input graph format (json, jsonld, binary)")
+	resolveCmd.Flags().String("output", "json", "Output format, json, jsonld, binary, or dot")
+	resolveCmd.Flags().Bool("includeSchema", false, "Include schema in the output")
+	resolveCmd.Flags().String("spec", "", "Entity resolution spec file, YAML or JSON")
+	resolveCmd.Flags().Float64("threshold", 0, "Match threshold, overrides the spec")
+	resolveCmd.Flags().String("action", "", "sameAs or merge, overrides the spec")
+	resolveCmd.Flags().String("mergePolicy", "", "Default merge policy if action is merge (replace, keepFirst, append)")
+	resolveCmd.Flags().String("report", "", "Write the matches to this file as JSON")
+
+	pipeline.RegisterStep("resolve", func() pipeline.Step { return &ResolveEntitiesStep{} })
+}
+
+var resolveCmd = &cobra.Command{
+	Use:   "resolve [graphFile]",
+	Short: "Resolve the entities of a graph",
+	Long: `Match the entities of the graph using attribute comparators, and
+connect the matching entities with sameAs edges, or merge them. Run
+"layers pipeline --help" for the spec format.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		step := &ResolveEntitiesStep{}
+		step.SpecFile, _ = cmd.Flags().GetString("spec")
+		step.Threshold, _ = cmd.Flags().GetFloat64("threshold")
+		step.Action, _ = cmd.Flags().GetString("action")
+		step.MergePolicy, _ = cmd.Flags().GetString("mergePolicy")
+		step.Report, _ = cmd.Flags().GetString("report")
+		p := []pipeline.Step{
+			NewReadGraphStep(cmd),
+			step,
+			NewWriteGraphStep(cmd),
+		}
+		_, err := runPipeline(p, "", args)
+		return err
+	},
+}
@@ -20,15 +20,21 @@ import (
 	"log"
 	"os"
 	"runtime/pprof"
+	"strings"
 
 	"github.com/spf13/cobra"
 
 	"github.com/cloudprivacylabs/lsa/pkg/ls"
 	"github.com/cloudprivacylabs/lsa/pkg/repo/fs"
+	httprepo "github.com/cloudprivacylabs/lsa/pkg/repo/http"
 )
 
 var logger = ls.NewDefaultLogger()
 
+// compiledSchemaCache is the cache of compiled schemas. It is nil if
+// caching is disabled.
+var compiledSchemaCache = ls.DefaultCompiledSchemaCache()
+
 var (
 	rootCmd = &cobra.Command{
 		Use:   "layers",
@@ -45,6 +51,9 @@ var (
 			if b, _ := cmd.Flags().GetBool("log"); b {
 				logger.Level = ls.LogLevelDebug
 			}
+			if b, _ := cmd.Flags().GetBool("noCache"); b {
+				compiledSchemaCache = nil
+			}
 		},
 		PersistentPostRun: func(cmd *cobra.Command, _ []string) {
 			if f, _ := cmd.Flags().GetString("cpuprofile"); len(f) > 0 {
@@ -64,6 +73,7 @@ func init() {
 	rootCmd.PersistentFlags().Bool("log", false, "Enable logging")
 	rootCmd.PersistentFlags().Bool("log.debug", false, "Enable logging at debug level")
 	rootCmd.PersistentFlags().Bool("log.info", false, "Enable logging at info level")
+	rootCmd.PersistentFlags().Bool("noCache", false, "Do not use the compiled schema cache")
 
 	rootCmd.PersistentFlags().String("rankdir", "LR", "DOT: rankdir option")
 }
@@ -111,7 +121,32 @@ func unroll(in interface{}, depth int) interface{} {
 	return in
 }
 
-func getRepo(repodir string, interner ls.Interner) (*fs.Repository, error) {
+// schemaRepository is implemented by the file system repository and
+// the HTTP repository client
+type schemaRepository interface {
+	GetComposedSchema(*ls.Context, string) (*ls.Layer, error)
+	LoadAndCompose(*ls.Context, string) (*ls.Layer, error)
+	GetCompiledSchema(*ls.Context, string) (*ls.Layer, error)
+	SchemaLoader(*ls.Context) ls.SchemaLoader
+}
+
+// getRepo returns the repository for repodir. If repodir is an HTTP
+// URL, returns a client for the repository server.
+func getRepo(repodir string, interner ls.Interner) (schemaRepository, error) {
+	if strings.HasPrefix(repodir, "http://") || strings.HasPrefix(repodir, "https://") {
+		return httprepo.NewClient(repodir, interner), nil
+	}
+	repo, err := getFSRepo(repodir, interner)
+	if err != nil {
+		return nil, err
+	}
+	repo.SetCompiledSchemaCache(compiledSchemaCache)
+	return repo, nil
+}
+
+// getFSRepo returns the file system repository under repodir,
+// updating its index if necessary
+func getFSRepo(repodir string, interner ls.Interner) (*fs.Repository, error) {
 	repo := fs.NewWithInterner(repodir, interner)
 	if err := repo.Load(); err != nil {
 		if errors.Is(err, fs.ErrNoIndex) || errors.Is(err, fs.ErrBadIndex) {
@@ -16,11 +16,18 @@ package cmd
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
 	csvimport "github.com/cloudprivacylabs/lsa/pkg/csv"
@@ -34,6 +41,37 @@ type Bundle struct {
 	Base               string                    `json:"base" yaml:"base"`
 	SchemaSpreadsheets []SpreadsheetReference    `json:"schemaSpreadsheets" yaml:"schemaSpreadsheets"`
 	TypeNames          map[string]*BundleVariant `json:"typeNames" yaml:"typeNames"`
+	// ConflictPolicy determines how composition conflicts are
+	// resolved for the variants of this bundle (error, preferLater,
+	// preferEarlier/preferSchema)
+	ConflictPolicy string `json:"conflictPolicy,omitempty" yaml:"conflictPolicy,omitempty"`
+	// Import lists other bundle files. The imported bundles are merged
+	// first, and the definitions of this bundle override them.
+	Import []string `json:"import,omitempty" yaml:"import,omitempty"`
+	// Profiles are named sets of variant definitions, such as dev or
+	// prod overlays. The variants of a selected profile override the
+	// variants of the bundle.
+	Profiles map[string]*BundleProfile `json:"profiles,omitempty" yaml:"profiles,omitempty"`
+}
+
+// BundleProfile is a named set of variant definitions that are
+// merged into the bundle when the profile is selected
+type BundleProfile struct {
+	TypeNames map[string]*BundleVariant `json:"typeNames" yaml:"typeNames"`
+}
+
+// ApplyProfile merges the variants of the named profile into the
+// bundle. An empty profile name is a no-op.
+func (b *Bundle) ApplyProfile(name string) error {
+	if len(name) == 0 {
+		return nil
+	}
+	profile, ok := b.Profiles[name]
+	if !ok || profile == nil {
+		return fmt.Errorf("Unknown bundle profile: %s", name)
+	}
+	b.mergeVariants(profile.TypeNames)
+	return nil
 }
 
 type SpreadsheetReference struct {
@@ -101,10 +139,48 @@ func (b *Bundle) Merge(bundle Bundle) {
 		b.TypeNames = make(map[string]*BundleVariant)
 	}
 	b.SchemaSpreadsheets = append(b.SchemaSpreadsheets, bundle.SchemaSpreadsheets...)
-	for typeName, variant := range bundle.TypeNames {
-		existingVariant, ok := b.TypeNames[typeName]
+	if len(b.ConflictPolicy) == 0 {
+		b.ConflictPolicy = bundle.ConflictPolicy
+	}
+	b.mergeVariants(bundle.TypeNames)
+	for name, profile := range bundle.Profiles {
+		if profile == nil {
+			continue
+		}
+		if b.Profiles == nil {
+			b.Profiles = make(map[string]*BundleProfile)
+		}
+		existing, ok := b.Profiles[name]
+		if !ok || existing == nil {
+			b.Profiles[name] = profile
+			continue
+		}
+		existing.mergeVariants(profile.TypeNames)
+	}
+}
+
+func (b *Bundle) mergeVariants(variants map[string]*BundleVariant) {
+	if b.TypeNames == nil {
+		b.TypeNames = make(map[string]*BundleVariant)
+	}
+	mergeVariants(b.TypeNames, variants)
+}
+
+func (p *BundleProfile) mergeVariants(variants map[string]*BundleVariant) {
+	if p.TypeNames == nil {
+		p.TypeNames = make(map[string]*BundleVariant)
+	}
+	mergeVariants(p.TypeNames, variants)
+}
+
+func mergeVariants(target, variants map[string]*BundleVariant) {
+	for typeName, variant := range variants {
+		if variant == nil {
+			continue
+		}
+		existingVariant, ok := target[typeName]
 		if !ok || existingVariant == nil {
-			b.TypeNames[typeName] = variant
+			target[typeName] = variant
 			continue
 		}
 		existingVariant.Merge(*variant)
@@ -125,6 +201,17 @@ func (b *Bundle) ResolveFilenames(dir string) {
 	if len(b.Base) > 0 {
 		b.Base = getRelativeFileName(dir, b.Base)
 	}
+	for i := range b.Import {
+		b.Import[i] = getRelativeFileName(dir, b.Import[i])
+	}
+	for _, profile := range b.Profiles {
+		if profile == nil {
+			continue
+		}
+		for _, v := range profile.TypeNames {
+			v.ResolveFilenames(dir)
+		}
+	}
 }
 
 type BundleSchemaRef struct {
@@ -173,6 +260,11 @@ type JSONSchemaReference struct {
 type BundleVariant struct {
 	BundleSchemaRef `yaml:",inline"`
 	Overlays        []BundleSchemaRef `json:"overlays" yaml:"overlays"`
+	// ReplaceOverlays is used when the variant overrides a variant of
+	// an imported bundle or the bundle of a profile. If true, the
+	// overlays of this variant replace the overlays of the overridden
+	// variant. Otherwise, they are appended.
+	ReplaceOverlays bool `json:"replaceOverlays,omitempty" yaml:"replaceOverlays,omitempty"`
 }
 
 func (b *BundleVariant) ResolveFilenames(dir string) {
@@ -185,9 +277,15 @@ func (b *BundleVariant) ResolveFilenames(dir string) {
 	}
 }
 
-// Merge variant into b
+// Merge variant into b. The variant overrides b: its schema
+// replaces the schema of b, and its overlays are appended to the
+// overlays of b, or replace them if the variant sets ReplaceOverlays.
 func (b *BundleVariant) Merge(variant BundleVariant) {
 	b.BundleSchemaRef.Merge(variant.BundleSchemaRef)
+	if variant.ReplaceOverlays {
+		b.Overlays = append([]BundleSchemaRef{}, variant.Overlays...)
+		return
+	}
 	b.Overlays = append(b.Overlays, variant.Overlays...)
 }
 
@@ -232,6 +330,14 @@ func (bundle *Bundle) importJSONSchema(ctx *ls.Context, typeTerm string, importE
 
 // GetLayers returns the layers of the bundle keyed by variant type
 func (bundle *Bundle) GetLayers(ctx *ls.Context, layers map[string]*ls.Layer, loader func(s string) (*ls.Layer, error), fileLoader func(string) (io.ReadCloser, error)) (map[string]*ls.Layer, error) {
+	if err := bundle.resolveLayers(ctx, layers, loader, fileLoader); err != nil {
+		return nil, err
+	}
+	return bundle.composeVariants(ctx)
+}
+
+// resolveLayers loads the schemas and the overlays of all variants
+func (bundle *Bundle) resolveLayers(ctx *ls.Context, layers map[string]*ls.Layer, loader func(s string) (*ls.Layer, error), fileLoader func(string) (io.ReadCloser, error)) error {
 	// For JSON-LD schemas, layerId refers to the filename. We use this map to map that filename to loaded layerid
 	layerIDMap := make(map[string]string)
 	// entities keyed by layer id
@@ -287,11 +393,11 @@ func (bundle *Bundle) GetLayers(ctx *ls.Context, layers map[string]*ls.Layer, lo
 	// Load all layers, construct entities
 	for variantType, variant := range bundle.TypeNames {
 		if err := processRef(variantType, &variant.BundleSchemaRef, schemaEntities); err != nil {
-			return nil, err
+			return err
 		}
 		for ovl := range variant.Overlays {
 			if err := processRef(variantType, &variant.Overlays[ovl], ovlEntities); err != nil {
-				return nil, err
+				return err
 			}
 		}
 	}
@@ -319,10 +425,10 @@ func (bundle *Bundle) GetLayers(ctx *ls.Context, layers map[string]*ls.Layer, lo
 	}
 
 	if err := importJson(schemaEntities, ls.SchemaTerm); err != nil {
-		return nil, err
+		return err
 	}
 	if err := importJson(ovlEntities, ls.OverlayTerm); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Assign layers for imported JSON schemas
@@ -333,7 +439,7 @@ func (bundle *Bundle) GetLayers(ctx *ls.Context, layers map[string]*ls.Layer, lo
 			}
 		}
 		if variant.layer == nil {
-			return nil, fmt.Errorf("Cannot find the schema for variant %s", variantType)
+			return fmt.Errorf("Cannot find the schema for variant %s", variantType)
 		}
 		for ovl := range variant.Overlays {
 			if variant.Overlays[ovl].layer == nil {
@@ -341,25 +447,70 @@ func (bundle *Bundle) GetLayers(ctx *ls.Context, layers map[string]*ls.Layer, lo
 					variant.Overlays[ovl].layer = layers[variant.Overlays[ovl].JSONSchema.LayerID]
 				}
 				if variant.Overlays[ovl].layer == nil {
-					return nil, fmt.Errorf("Cannot find schema for overlay %d of variant %s", ovl, variantType)
+					return fmt.Errorf("Cannot find schema for overlay %d of variant %s", ovl, variantType)
 				}
 			}
 		}
 	}
+	return nil
+}
 
+// composeVariants composes the resolved variants
+func (bundle *Bundle) composeVariants(ctx *ls.Context) (map[string]*ls.Layer, error) {
+	// The conflict policy of the context overrides the bundle policy
+	composeCtx := ctx
+	if len(bundle.ConflictPolicy) > 0 && len(ctx.GetConflictPolicy()) == 0 {
+		policy, err := ls.ParseConflictPolicy(bundle.ConflictPolicy)
+		if err != nil {
+			return nil, err
+		}
+		composeCtx = ctx.WithConflictPolicy(policy)
+	}
 	resultBundle := ls.BundleByType{}
-	for variantType, variant := range bundle.TypeNames {
+	// Variants are composed in dependency order: the base schema of a
+	// variant is composed before the variant, so overlays can target
+	// inherited attributes. composing is used to detect cycles.
+	composing := make(map[string]struct{})
+	var compose func(string) error
+	compiler := ls.Compiler{
+		Loader: ls.SchemaLoaderFunc(func(ref string) (*ls.Layer, error) {
+			id, _ := ls.SplitVersionedRef(ref)
+			if _, ok := bundle.TypeNames[id]; ok {
+				if err := compose(id); err != nil {
+					return nil, err
+				}
+			}
+			return resultBundle.LoadSchema(id)
+		}),
+	}
+	compose = func(variantType string) error {
+		if _, ok := resultBundle.Variants[variantType]; ok {
+			return nil
+		}
+		if _, ok := composing[variantType]; ok {
+			return ls.ErrExtendsCycle(variantType)
+		}
+		composing[variantType] = struct{}{}
+		defer delete(composing, variantType)
+
 		ctx.GetLogger().Debug(map[string]interface{}{"bundle": "getLayer", "variantType": variantType})
-		sch := variant.layer
+		variant := bundle.TypeNames[variantType]
+		sch, err := compiler.ResolveExtends(variant.layer)
+		if err != nil {
+			return err
+		}
 		ovl := make([]*ls.Layer, 0, len(variant.Overlays))
 		for _, o := range variant.Overlays {
 			ovl = append(ovl, o.layer)
 		}
-		if len(ovl) > 0 {
+		if len(ovl) > 0 && sch == variant.layer {
 			sch = sch.Clone()
 		}
-		_, err := resultBundle.Add(ctx, variantType, sch, ovl...)
-		if err != nil {
+		_, err = resultBundle.Add(composeCtx, variantType, sch, ovl...)
+		return err
+	}
+	for variantType := range bundle.TypeNames {
+		if err := compose(variantType); err != nil {
 			return nil, err
 		}
 	}
@@ -367,46 +518,108 @@ func (bundle *Bundle) GetLayers(ctx *ls.Context, layers map[string]*ls.Layer, lo
 }
 
 func loadBundleChain(ctx *ls.Context, file string) (Bundle, error) {
+	return loadBundleFile(ctx, file, make(map[string]struct{}))
+}
+
+// loadBundleFile reads the bundle file, and merges its base and
+// imported bundles. The loading map contains the bundle files that
+// are being loaded, and is used to detect import cycles.
+func loadBundleFile(ctx *ls.Context, file string, loading map[string]struct{}) (Bundle, error) {
+	absName, err := filepath.Abs(file)
+	if err != nil {
+		absName = file
+	}
+	if _, ok := loading[absName]; ok {
+		return Bundle{}, fmt.Errorf("Bundle import cycle: %s", file)
+	}
+	loading[absName] = struct{}{}
+	defer delete(loading, absName)
+
 	var b Bundle
 	if err := cmdutil.ReadJSONOrYAML(file, &b); err != nil {
 		return Bundle{}, fmt.Errorf("While reading %s: %w", file, err)
 	}
 	b.ResolveFilenames(filepath.Dir(file))
 	if len(b.Base) > 0 {
-		base, err := loadBundleChain(ctx, b.Base)
+		base, err := loadBundleFile(ctx, b.Base, loading)
 		if err != nil {
 			return Bundle{}, err
 		}
-		b.Merge(base)
+		// Definitions of this bundle override the base bundle
+		base.Merge(b)
+		if len(b.ConflictPolicy) > 0 {
+			base.ConflictPolicy = b.ConflictPolicy
+		}
+		base.Base = b.Base
+		base.Import = b.Import
+		b = base
+	}
+	if len(b.Import) == 0 {
+		return b, nil
+	}
+	var imported Bundle
+	for _, f := range b.Import {
+		x, err := loadBundleFile(ctx, f, loading)
+		if err != nil {
+			return Bundle{}, fmt.Errorf("While importing %s: %w", f, err)
+		}
+		imported.Merge(x)
 	}
-	return b, nil
+	// Definitions of this bundle override the imported definitions
+	imported.Merge(b)
+	if len(b.ConflictPolicy) > 0 {
+		imported.ConflictPolicy = b.ConflictPolicy
+	}
+	return imported, nil
 }
 
-func LoadBundle(ctx *ls.Context, file []string) (ls.SchemaLoader, error) {
+// readBundles reads and merges the bundle files, and applies the
+// profile
+func readBundles(ctx *ls.Context, files []string, profile string) (Bundle, error) {
 	var bundle Bundle
-	for _, f := range file {
+	for _, f := range files {
 		b, err := loadBundleChain(ctx, f)
 		if err != nil {
-			return nil, fmt.Errorf("While reading %s: %w", f, err)
+			return Bundle{}, fmt.Errorf("While reading %s: %w", f, err)
 		}
 		bundle.Merge(b)
 	}
+	if err := bundle.ApplyProfile(profile); err != nil {
+		return Bundle{}, err
+	}
+	return bundle, nil
+}
+
+// loadLayerFile reads a JSON-LD layer file
+func loadLayerFile(fname string) (*ls.Layer, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var input interface{}
+	err = json.Unmarshal([]byte(data), &input)
+	if err != nil {
+		return nil, err
+	}
+	return ls.UnmarshalLayer(input, nil)
+}
+
+func LoadBundle(ctx *ls.Context, file []string) (ls.SchemaLoader, error) {
+	return LoadBundleProfile(ctx, file, "")
+}
+
+// LoadBundleProfile loads the bundles using the variants of the
+// given profile
+func LoadBundleProfile(ctx *ls.Context, file []string, profile string) (ls.SchemaLoader, error) {
+	bundle, err := readBundles(ctx, file, profile)
+	if err != nil {
+		return nil, err
+	}
 	schemaMap, err := bundle.LoadSpreadsheets(ctx)
 	if err != nil {
 		return nil, err
 	}
-	items, err := bundle.GetLayers(ctx, schemaMap, func(fname string) (*ls.Layer, error) {
-		data, err := ioutil.ReadFile(fname)
-		if err != nil {
-			return nil, err
-		}
-		var input interface{}
-		err = json.Unmarshal([]byte(data), &input)
-		if err != nil {
-			return nil, err
-		}
-		return ls.UnmarshalLayer(input, nil)
-	}, DefaultFileLoader)
+	items, err := bundle.GetLayers(ctx, schemaMap, loadLayerFile, DefaultFileLoader)
 	if err != nil {
 		return nil, err
 	}
@@ -461,3 +674,204 @@ func getRelativeFileName(dir, fname string) string {
 	}
 	return filepath.Join(dir, fname)
 }
+
+// fileHashKey identifies a version of a local file
+type fileHashKey struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// hashedFile is the hash of a file, and the $ref values in it if it
+// is a JSON schema
+type hashedFile struct {
+	hash []byte
+	// refs are parsed when they are first needed
+	refs       []string
+	refsParsed bool
+}
+
+// fileHashes caches the local files hashed for the compiled schema
+// cache keys by path, modification time, and size for the life of
+// the process, so unchanged files are not read again
+var fileHashes = struct {
+	sync.Mutex
+	files map[fileHashKey]*hashedFile
+}{files: make(map[fileHashKey]*hashedFile)}
+
+// hashFile returns the hash of the file or URL. If jsonRefs is set,
+// the $ref values of the JSON document are also returned. Local
+// files are read once for each modification time and size. URLs are
+// read every time.
+func hashFile(file string, jsonRefs bool) (*hashedFile, error) {
+	path := file
+	if u, err := url.Parse(file); err == nil && u.Scheme == "file" {
+		path = u.Path
+	} else if err != nil || len(u.Scheme) > 0 {
+		path = ""
+	}
+	var key fileHashKey
+	if len(path) > 0 {
+		if info, err := os.Stat(path); err == nil {
+			key = fileHashKey{path: path, modTime: info.ModTime(), size: info.Size()}
+			fileHashes.Lock()
+			ret := fileHashes.files[key]
+			fileHashes.Unlock()
+			if ret != nil && (ret.refsParsed || !jsonRefs) {
+				return ret, nil
+			}
+		}
+	}
+	data, err := cmdutil.ReadURL(file)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	ret := &hashedFile{hash: hash[:]}
+	if jsonRefs {
+		ret.refs = jsonSchemaRefs(data)
+		ret.refsParsed = true
+	}
+	if len(key.path) > 0 {
+		fileHashes.Lock()
+		fileHashes.files[key] = ret
+		fileHashes.Unlock()
+	}
+	return ret, nil
+}
+
+// bundleCacheKey returns the compiled schema cache key for the
+// variant of the bundles with the profile. The key is computed from the merged bundle
+// definitions and the hashes of the files referenced by them.
+func bundleCacheKey(ctx *ls.Context, bundleNames []string, profile, name string) (string, error) {
+	bundle, err := readBundles(ctx, bundleNames, profile)
+	if err != nil {
+		return "", err
+	}
+	definition, err := json.Marshal(bundle)
+	if err != nil {
+		return "", err
+	}
+	key := ls.NewCompiledSchemaCacheKey(ctx)
+	key.AddString(name)
+	key.AddFile("bundle", definition)
+
+	files := make(map[string]struct{})
+	jsonSchemas := make(map[string]struct{})
+	addRef := func(ref BundleSchemaRef) {
+		if len(ref.Schema) > 0 {
+			files[ref.Schema] = struct{}{}
+		}
+		if ref.JSONSchema != nil && len(ref.JSONSchema.Ref) > 0 {
+			// Drop the fragment pointing to the definition
+			file, _, _ := strings.Cut(ref.JSONSchema.Ref, "#")
+			files[file] = struct{}{}
+			jsonSchemas[file] = struct{}{}
+		}
+	}
+	for _, x := range bundle.SchemaSpreadsheets {
+		files[x.File] = struct{}{}
+	}
+	for _, variant := range bundle.TypeNames {
+		if variant == nil {
+			continue
+		}
+		addRef(variant.BundleSchemaRef)
+		for _, ovl := range variant.Overlays {
+			addRef(ovl)
+		}
+	}
+	names := make([]string, 0, len(files))
+	for x := range files {
+		names = append(names, x)
+	}
+	sort.Strings(names)
+	seen := make(map[string]struct{}, len(names))
+	for _, file := range names {
+		seen[file] = struct{}{}
+	}
+	for _, file := range names {
+		_, isJSONSchema := jsonSchemas[file]
+		hashed, err := hashFile(file, isJSONSchema)
+		if err != nil {
+			return "", err
+		}
+		key.AddFile(file, hashed.hash)
+		if isJSONSchema {
+			if err := addJSONSchemaRefs(key, file, hashed.refs, seen); err != nil {
+				return "", err
+			}
+		}
+	}
+	return key.String(), nil
+}
+
+// jsonSchemaRefs returns the $ref values of the JSON document,
+// sorted. Returns nil if data is not JSON.
+func jsonSchemaRefs(data []byte) []string {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil
+	}
+	refs := make([]string, 0)
+	var walk func(interface{})
+	walk = func(in interface{}) {
+		switch t := in.(type) {
+		case map[string]interface{}:
+			for k, v := range t {
+				if s, ok := v.(string); ok && k == "$ref" {
+					refs = append(refs, s)
+					continue
+				}
+				walk(v)
+			}
+		case []interface{}:
+			for _, x := range t {
+				walk(x)
+			}
+		}
+	}
+	walk(doc)
+	sort.Strings(refs)
+	return refs
+}
+
+// addJSONSchemaRefs adds the hashes of the files referenced by $ref
+// from the JSON schema file to the cache key, recursively. seen
+// contains the files that are already in the key.
+func addJSONSchemaRefs(key *ls.CompiledSchemaCacheKey, file string, refs []string, seen map[string]struct{}) error {
+	for _, ref := range refs {
+		// References within the same document have only a fragment
+		ref, _, _ = strings.Cut(ref, "#")
+		if len(ref) == 0 {
+			continue
+		}
+		u, err := url.Parse(ref)
+		if err != nil {
+			continue
+		}
+		// Relative references are resolved against the referencing
+		// file, or the URL of the referencing document
+		target := ref
+		if len(u.Scheme) == 0 && !filepath.IsAbs(ref) {
+			if base, err := url.Parse(file); err == nil && len(base.Scheme) > 0 && base.Scheme != "file" {
+				target = base.ResolveReference(u).String()
+			} else {
+				target = filepath.Join(filepath.Dir(file), ref)
+			}
+		}
+		if _, ok := seen[target]; ok {
+			continue
+		}
+		seen[target] = struct{}{}
+		hashed, err := hashFile(target, true)
+		if err != nil {
+			return err
+		}
+		key.AddFile(target, hashed.hash)
+		if err := addJSONSchemaRefs(key, target, hashed.refs, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,652 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cloudprivacylabs/opencypher"
+	"github.com/cloudprivacylabs/opencypher/graph"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
+)
+
+const shellHelp = `Enter an openCypher query to run it on the loaded graph. End a line
+with \ to continue the query on the next line.
+
+Commands:
+  :load file [file...]       Load graphs, adding them to the current graph
+  :save file [format]        Write the current graph (json, jsonld, binary, dot)
+  :clear                     Remove all nodes of the current graph
+  :schema                    Summarize the labels, properties, and entities of the graph
+  :format [table|json|csv]   Show or set the output format for query results
+  :pipe operation [k=v...]   Run a pipeline step on the result graph. Values
+                             are parsed as YAML, e.g.
+                               :pipe writeGraph format=json
+                               :pipe filter includeSchema=true labels=[a,b]
+                               :pipe export/json
+  :pipe pipelineFile         Run the steps of a pipeline file on the result graph
+  :history                   Show the query and command history
+  :help                      Show this help
+  :quit                      Exit
+
+The result graph contains the nodes and paths returned by the last
+query, and the edges between them. If the last query did not return
+any nodes, the result graph is a copy of the current graph, so :pipe
+does not modify the current graph.`
+
+// Shell is an interactive openCypher shell over a graph loaded in
+// memory
+type Shell struct {
+	Graph       graph.Graph
+	Interner    ls.Interner
+	InputFormat string
+	// Output format for query results: table, json, or csv
+	Format string
+	Out    io.Writer
+	// If nonempty, the history is read from and appended to this file
+	HistoryFile string
+	History     []string
+	Cmd         *cobra.Command
+
+	result graph.Graph
+}
+
+// NewShell returns a new shell with an empty graph
+func NewShell(cmd *cobra.Command, out io.Writer) *Shell {
+	return &Shell{
+		Graph:       ls.NewDocumentGraph(),
+		Interner:    ls.NewInterner(),
+		InputFormat: "json",
+		Format:      "table",
+		Out:         out,
+		Cmd:         cmd,
+	}
+}
+
+// LoadHistory reads the history file, if there is one
+func (sh *Shell) LoadHistory() {
+	if len(sh.HistoryFile) == 0 {
+		return
+	}
+	data, err := os.ReadFile(sh.HistoryFile)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(strings.TrimSpace(line)) > 0 {
+			sh.History = append(sh.History, line)
+		}
+	}
+}
+
+func (sh *Shell) addHistory(line string) {
+	sh.History = append(sh.History, line)
+	if len(sh.HistoryFile) == 0 {
+		return
+	}
+	f, err := os.OpenFile(sh.HistoryFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(f, line)
+	f.Close()
+}
+
+// Run reads queries and commands from in until end of input or
+// :quit. Errors are printed, and do not stop the shell.
+func (sh *Shell) Run(in io.Reader, prompt bool) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var buf strings.Builder
+	for {
+		if prompt {
+			if buf.Len() == 0 {
+				fmt.Fprint(sh.Out, "layers> ")
+			} else {
+				fmt.Fprint(sh.Out, "   ...> ")
+			}
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := scanner.Text()
+		if strings.HasSuffix(line, "\\") {
+			buf.WriteString(strings.TrimSuffix(line, "\\"))
+			buf.WriteString("\n")
+			continue
+		}
+		buf.WriteString(line)
+		line = strings.TrimSpace(buf.String())
+		buf.Reset()
+		if len(line) == 0 {
+			continue
+		}
+		sh.addHistory(strings.ReplaceAll(line, "\n", " "))
+		quit, err := sh.Exec(line)
+		if err != nil {
+			fmt.Fprintf(sh.Out, "Error: %v\n", err)
+		}
+		if quit {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// Exec runs a single query or command. It returns true if the shell
+// should exit.
+func (sh *Shell) Exec(line string) (bool, error) {
+	if !strings.HasPrefix(line, ":") {
+		return false, sh.Query(line)
+	}
+	args := strings.Fields(line)
+	switch args[0] {
+	case ":quit", ":exit", ":q":
+		return true, nil
+	case ":help":
+		fmt.Fprintln(sh.Out, shellHelp)
+	case ":load":
+		if len(args) < 2 {
+			return false, fmt.Errorf("Usage: :load file [file...]")
+		}
+		for _, file := range args[1:] {
+			if err := sh.Load(file); err != nil {
+				return false, err
+			}
+		}
+		fmt.Fprintf(sh.Out, "%d nodes, %d edges\n", sh.Graph.NumNodes(), sh.Graph.NumEdges())
+	case ":save":
+		if len(args) < 2 || len(args) > 3 {
+			return false, fmt.Errorf("Usage: :save file [format]")
+		}
+		format := "json"
+		if len(args) == 3 {
+			format = args[2]
+		}
+		return false, sh.Save(args[1], format)
+	case ":clear":
+		sh.Graph = ls.NewDocumentGraph()
+		sh.result = nil
+	case ":schema":
+		sh.WriteSchema()
+	case ":format":
+		if len(args) == 1 {
+			fmt.Fprintln(sh.Out, sh.Format)
+			return false, nil
+		}
+		switch args[1] {
+		case "table", "json", "csv":
+			sh.Format = args[1]
+		default:
+			return false, fmt.Errorf("Unknown format: %s", args[1])
+		}
+	case ":pipe":
+		if len(args) < 2 {
+			return false, fmt.Errorf("Usage: :pipe operation [key=value...] | pipelineFile")
+		}
+		return false, sh.Pipe(args[1], args[2:])
+	case ":history":
+		for i, h := range sh.History {
+			fmt.Fprintf(sh.Out, "%5d  %s\n", i+1, h)
+		}
+	default:
+		return false, fmt.Errorf("Unknown command: %s. Type :help for help", args[0])
+	}
+	return false, nil
+}
+
+// Load reads a graph file and adds it to the current graph
+func (sh *Shell) Load(file string) error {
+	format := sh.InputFormat
+	if f, err := cmdutil.GraphFileFormat(file); err != nil {
+		return err
+	} else if f == "binary" {
+		format = f
+	}
+	g, err := cmdutil.ReadGraph([]string{file}, sh.Interner, format)
+	if err != nil {
+		return err
+	}
+	if sh.Graph.NumNodes() == 0 {
+		sh.Graph = g
+	} else {
+		ls.CopyGraph(sh.Graph, g, nil, nil)
+	}
+	sh.result = nil
+	return nil
+}
+
+// Save writes the current graph to a file
+func (sh *Shell) Save(file, format string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return cmdutil.WriteGraph(sh.Cmd, sh.Graph, format, f)
+}
+
+// Query runs an openCypher query on the current graph, and writes
+// the results
+func (sh *Shell) Query(query string) error {
+	v, err := opencypher.ParseAndEvaluate(query, opencypher.NewEvalContext(sh.Graph))
+	if err != nil {
+		return err
+	}
+	switch rs := v.Get().(type) {
+	case opencypher.ResultSet:
+		sh.result = sh.resultGraph(rs)
+		return sh.writeResultSet(rs)
+	case *opencypher.ResultSet:
+		sh.result = sh.resultGraph(*rs)
+		return sh.writeResultSet(*rs)
+	}
+	sh.result = nil
+	return sh.writeResultSet(opencypher.ResultSet{Rows: []map[string]opencypher.Value{{"": v}}})
+}
+
+// resultGraph returns the subgraph containing the nodes and paths of
+// the result set and the edges between them, or nil if the result set
+// has no nodes
+func (sh *Shell) resultGraph(rs opencypher.ResultSet) graph.Graph {
+	nodes := make(map[graph.Node]struct{})
+	for _, row := range rs.Rows {
+		for _, col := range row {
+			switch t := col.Get().(type) {
+			case graph.Node:
+				nodes[t] = struct{}{}
+			case []graph.Edge:
+				for _, edge := range t {
+					nodes[edge.GetFrom()] = struct{}{}
+					nodes[edge.GetTo()] = struct{}{}
+				}
+			}
+		}
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	target := graph.NewOCGraph()
+	ls.CopyGraph(target, sh.Graph, func(n graph.Node) bool {
+		_, ok := nodes[n]
+		return ok
+	}, func(edge graph.Edge) bool {
+		_, from := nodes[edge.GetFrom()]
+		_, to := nodes[edge.GetTo()]
+		return from && to
+	})
+	return target
+}
+
+// resultColumns returns the sorted column names of the result set
+func resultColumns(rs opencypher.ResultSet) []string {
+	cols := make(map[string]struct{})
+	for _, row := range rs.Rows {
+		for k := range row {
+			cols[k] = struct{}{}
+		}
+	}
+	ret := make([]string, 0, len(cols))
+	for k := range cols {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (sh *Shell) writeResultSet(rs opencypher.ResultSet) error {
+	cols := resultColumns(rs)
+	switch sh.Format {
+	case "json":
+		rows := make([]map[string]interface{}, 0, len(rs.Rows))
+		for _, row := range rs.Rows {
+			out := make(map[string]interface{}, len(row))
+			for k, v := range row {
+				out[k] = shellJSONValue(v.Get())
+			}
+			rows = append(rows, out)
+		}
+		data, err := json.MarshalIndent(rows, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(sh.Out, string(data))
+	case "csv":
+		wr := csv.NewWriter(sh.Out)
+		wr.Write(cols)
+		for _, row := range rs.Rows {
+			rec := make([]string, 0, len(cols))
+			for _, c := range cols {
+				rec = append(rec, shellValueString(row[c]))
+			}
+			wr.Write(rec)
+		}
+		wr.Flush()
+		return wr.Error()
+	default:
+		w := tabwriter.NewWriter(sh.Out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(cols, "\t"))
+		for _, row := range rs.Rows {
+			rec := make([]string, 0, len(cols))
+			for _, c := range cols {
+				rec = append(rec, strings.ReplaceAll(shellValueString(row[c]), "\t", " "))
+			}
+			fmt.Fprintln(w, strings.Join(rec, "\t"))
+		}
+		w.Flush()
+		fmt.Fprintf(sh.Out, "(%d rows)\n", len(rs.Rows))
+	}
+	return nil
+}
+
+// shortTerm replaces the layered schemas namespace with ls:
+func shortTerm(term string) string {
+	if strings.HasPrefix(term, ls.LS) {
+		return "ls:" + term[len(ls.LS):]
+	}
+	return term
+}
+
+func shellPropertiesString(container interface {
+	ForEachProperty(func(string, interface{}) bool) bool
+}) string {
+	props := make([]string, 0)
+	container.ForEachProperty(func(key string, value interface{}) bool {
+		props = append(props, fmt.Sprintf("%s: %v", shortTerm(key), value))
+		return true
+	})
+	if len(props) == 0 {
+		return ""
+	}
+	sort.Strings(props)
+	return " {" + strings.Join(props, ", ") + "}"
+}
+
+func shellNodeString(node graph.Node) string {
+	labels := node.GetLabels().Slice()
+	for i := range labels {
+		labels[i] = shortTerm(labels[i])
+	}
+	sort.Strings(labels)
+	return "(" + strings.Join(labels, " ") + shellPropertiesString(node) + ")"
+}
+
+func shellEdgeString(edge graph.Edge) string {
+	return "-[" + shortTerm(edge.GetLabel()) + shellPropertiesString(edge) + "]->"
+}
+
+// shellValueString returns a compact string representation of a
+// result value
+func shellValueString(v interface{}) string {
+	if value, ok := v.(opencypher.Value); ok {
+		v = value.Get()
+	}
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case graph.Node:
+		return shellNodeString(t)
+	case graph.Edge:
+		return shellEdgeString(t)
+	case []graph.Edge:
+		if len(t) == 0 {
+			return ""
+		}
+		var out strings.Builder
+		out.WriteString(shellNodeString(t[0].GetFrom()))
+		for _, edge := range t {
+			out.WriteString(shellEdgeString(edge))
+			out.WriteString(shellNodeString(edge.GetTo()))
+		}
+		return out.String()
+	case []opencypher.Value:
+		items := make([]string, 0, len(t))
+		for _, x := range t {
+			items = append(items, shellValueString(x))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return fmt.Sprint(v)
+}
+
+func shellJSONProperties(container interface {
+	ForEachProperty(func(string, interface{}) bool) bool
+}) map[string]interface{} {
+	ret := make(map[string]interface{})
+	container.ForEachProperty(func(key string, value interface{}) bool {
+		ret[key] = value
+		return true
+	})
+	return ret
+}
+
+// shellJSONValue returns a JSON marshalable representation of a
+// result value
+func shellJSONValue(v interface{}) interface{} {
+	if value, ok := v.(opencypher.Value); ok {
+		v = value.Get()
+	}
+	switch t := v.(type) {
+	case graph.Node:
+		return map[string]interface{}{
+			"labels":     t.GetLabels().Slice(),
+			"properties": shellJSONProperties(t),
+		}
+	case graph.Edge:
+		return map[string]interface{}{
+			"label":      t.GetLabel(),
+			"properties": shellJSONProperties(t),
+		}
+	case []graph.Edge:
+		ret := make([]interface{}, 0, len(t)*2+1)
+		for i, edge := range t {
+			if i == 0 {
+				ret = append(ret, shellJSONValue(edge.GetFrom()))
+			}
+			ret = append(ret, shellJSONValue(edge), shellJSONValue(edge.GetTo()))
+		}
+		return ret
+	case []opencypher.Value:
+		ret := make([]interface{}, 0, len(t))
+		for _, x := range t {
+			ret = append(ret, shellJSONValue(x))
+		}
+		return ret
+	}
+	return v
+}
+
+// WriteSchema writes the node labels, edge labels, node property
+// keys, and the entities of the current graph with their counts
+func (sh *Shell) WriteSchema() {
+	nodeLabels := make(map[string]int)
+	edgeLabels := make(map[string]int)
+	properties := make(map[string]int)
+	entities := make(map[string]int)
+	for nodes := sh.Graph.GetNodes(); nodes.Next(); {
+		node := nodes.Node()
+		for _, l := range node.GetLabels().Slice() {
+			nodeLabels[l]++
+		}
+		node.ForEachProperty(func(key string, _ interface{}) bool {
+			properties[key]++
+			return true
+		})
+		if ls.IsDocumentNode(node) && ls.IsNodeEntityRoot(node) {
+			entities[ls.AsPropertyValue(node.GetProperty(ls.EntitySchemaTerm)).AsString()]++
+		}
+	}
+	for edges := sh.Graph.GetEdges(); edges.Next(); {
+		edgeLabels[edges.Edge().GetLabel()]++
+	}
+	w := tabwriter.NewWriter(sh.Out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Nodes\t%d\n", sh.Graph.NumNodes())
+	fmt.Fprintf(w, "Edges\t%d\n", sh.Graph.NumEdges())
+	for _, section := range []struct {
+		title  string
+		values map[string]int
+	}{
+		{"Node labels", nodeLabels},
+		{"Edge labels", edgeLabels},
+		{"Node properties", properties},
+		{"Entities", entities},
+	} {
+		if len(section.values) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s:\n", section.title)
+		for _, v := range sortValueCounts(section.values) {
+			fmt.Fprintf(w, "  %s\t%d\n", v.Value, v.Count)
+		}
+	}
+	w.Flush()
+}
+
+// Pipe runs a pipeline on the result graph of the last query, or on
+// a copy of the current graph if the last query did not return
+// nodes. If
+// operation is a registered pipeline step, the pipeline contains only
+// that step, with params of the form key=value. Otherwise, operation
+// is a pipeline file.
+func (sh *Shell) Pipe(operation string, params []string) error {
+	var steps pipeline.Pipeline
+	var err error
+	if pipeline.GetStepFactory(operation) != nil {
+		p := make(map[string]interface{}, len(params))
+		for _, param := range params {
+			i := strings.Index(param, "=")
+			if i == -1 {
+				return fmt.Errorf("Parameter is not key=value: %s", param)
+			}
+			p[param[:i]] = parsePipeParam(param[i+1:])
+		}
+		data, err := json.Marshal([]map[string]interface{}{{"operation": operation, "params": p}})
+		if err != nil {
+			return err
+		}
+		steps, err = pipeline.ReadPipeline(bytes.NewReader(data), nil)
+		if err != nil {
+			return err
+		}
+	} else {
+		if len(params) > 0 {
+			return fmt.Errorf("Unknown operation: %s", operation)
+		}
+		steps, err = readPipeline(operation, nil)
+		if err != nil {
+			return err
+		}
+	}
+	for _, step := range steps {
+		if wr, ok := step.(*WriteGraphStep); ok {
+			wr.Cmd = sh.Cmd
+		}
+	}
+	// The pipeline runs on a copy of the current graph, so the steps
+	// do not modify the loaded graph
+	g := sh.result
+	if g == nil {
+		g = graph.NewOCGraph()
+		ls.CopyGraph(g, sh.Graph, nil, nil)
+	}
+	ctx := pipeline.NewContext(getContext(), steps...).SetOutput(sh.Out)
+	ctx.SetGraph(g)
+	return ctx.Run()
+}
+
+// parsePipeParam parses a :pipe parameter value as YAML, so booleans,
+// numbers, and lists are passed to the step with their types. Values
+// that are not scalars or lists are passed as strings.
+func parsePipeParam(value string) interface{} {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(value), &v); err != nil || v == nil {
+		return value
+	}
+	if _, ok := v.(map[interface{}]interface{}); ok {
+		return value
+	}
+	if _, err := json.Marshal(v); err != nil {
+		return value
+	}
+	return v
+}
+
+func init() {
+	rootCmd.AddCommand(shellCmd)
+	shellCmd.Flags().String("input", "json", "Input graph format (json, jsonld, binary)")
+	shellCmd.Flags().String("format", "table", "Output format for query results, table, json, or csv")
+	shellCmd.Flags().String("history", "", "History file. Default is $HOME/.layers_history")
+	shellCmd.Flags().Bool("noHistory", false, "Do not read or write the history file")
+}
+
+var shellCmd = &cobra.Command{
+	Use:   "shell [graphFile...]",
+	Short: "Run openCypher queries interactively on graphs",
+	Long: `Load the given graphs once, and then run openCypher queries and
+shell commands read from stdin. Type :help in the shell for the
+commands.
+
+  layers shell graph.json
+
+The shell reads plain lines from stdin, without line editing or
+history recall with the arrow keys. The history is written to the
+history file and listed with :history. For line editing, run the
+shell under a line editor wrapper such as rlwrap:
+
+  rlwrap layers shell graph.json
+
+` + shellHelp,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sh := NewShell(cmd, os.Stdout)
+		sh.InputFormat, _ = cmd.Flags().GetString("input")
+		sh.Format, _ = cmd.Flags().GetString("format")
+		if noHistory, _ := cmd.Flags().GetBool("noHistory"); !noHistory {
+			sh.HistoryFile, _ = cmd.Flags().GetString("history")
+			if len(sh.HistoryFile) == 0 {
+				if home, err := os.UserHomeDir(); err == nil {
+					sh.HistoryFile = filepath.Join(home, ".layers_history")
+				}
+			}
+			sh.LoadHistory()
+		}
+		for _, file := range args {
+			if err := sh.Load(file); err != nil {
+				return err
+			}
+		}
+		// Show prompts only if the input is a terminal
+		prompt := false
+		if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			prompt = true
+			fmt.Fprintf(sh.Out, "%d nodes, %d edges. Type :help for help\n", sh.Graph.NumNodes(), sh.Graph.NumEdges())
+		}
+		return sh.Run(os.Stdin, prompt)
+	},
+}
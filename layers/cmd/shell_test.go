@@ -0,0 +1,112 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+)
+
+func TestShell(t *testing.T) {
+	out := bytes.Buffer{}
+	sh := NewShell(nil, &out)
+	for _, name := range []string{"John", "Jane"} {
+		root := sh.Graph.NewNode([]string{ls.DocumentNodeTerm, ls.AttributeTypeObject}, nil)
+		value := sh.Graph.NewNode([]string{ls.DocumentNodeTerm, ls.AttributeTypeValue}, map[string]interface{}{
+			"name": ls.StringPropertyValue(name),
+		})
+		sh.Graph.NewEdge(root, value, ls.HasTerm, nil)
+	}
+
+	in := strings.NewReader(`:format csv
+match (n {name:"Jane"}) \
+  return n.name as name
+:unknown
+:quit
+match (n) return n`)
+	if err := sh.Run(in, false); err != nil {
+		t.Fatal(err)
+	}
+	if s := out.String(); !strings.Contains(s, "name\nJane\n") || !strings.Contains(s, "Unknown command") {
+		t.Errorf("Unexpected output: %s", s)
+	}
+	if len(sh.History) != 4 {
+		t.Errorf("Wrong history: %v", sh.History)
+	}
+
+	// The result graph of the last query feeds the pipeline
+	if _, err := sh.Exec(`match (n {name:"Jane"}) return n`); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if _, err := sh.Exec(":pipe writeGraph format=json"); err != nil {
+		t.Fatal(err)
+	}
+	if s := out.String(); !strings.Contains(s, "Jane") || strings.Contains(s, "John") {
+		t.Errorf("Unexpected result graph: %s", s)
+	}
+}
+
+func TestShellPipeCopy(t *testing.T) {
+	out := bytes.Buffer{}
+	sh := NewShell(nil, &out)
+	sh.Graph.NewNode([]string{ls.DocumentNodeTerm}, nil)
+	// Without a result graph, the pipeline runs on a copy of the current graph
+	if err := sh.Pipe("oc", []string{"expr=create (n:X)"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := sh.Graph.NumNodes(); n != 1 {
+		t.Errorf("Pipeline modified the current graph: %d nodes", n)
+	}
+}
+
+func TestShellPipeParams(t *testing.T) {
+	out := bytes.Buffer{}
+	sh := NewShell(nil, &out)
+	for _, name := range []string{"John", "Jane"} {
+		root := sh.Graph.NewNode([]string{ls.DocumentNodeTerm, ls.AttributeTypeObject}, nil)
+		value := sh.Graph.NewNode([]string{ls.DocumentNodeTerm, ls.AttributeTypeValue}, map[string]interface{}{
+			ls.AttributeNameTerm: ls.StringPropertyValue("name"),
+			ls.NodeValueTerm:     ls.StringPropertyValue(name),
+		})
+		sh.Graph.NewEdge(root, value, ls.HasTerm, nil)
+	}
+	if v, ok := parsePipeParam("true").(bool); !ok || !v {
+		t.Errorf("Expecting bool param")
+	}
+	if v := parsePipeParam("a: b"); v != "a: b" {
+		t.Errorf("Expecting string param, got %v", v)
+	}
+
+	// A bool parameter
+	if _, err := sh.Exec(":pipe filter includeSchema=true labels=[" + ls.AttributeTypeValue + "]"); err != nil {
+		t.Error(err)
+	}
+
+	// Export the result of a query
+	if _, err := sh.Exec(`match (n {` + "`" + ls.NodeValueTerm + "`" + `:"Jane"}) return n`); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if _, err := sh.Exec(":pipe export/json"); err != nil {
+		t.Fatal(err)
+	}
+	if s := out.String(); !strings.Contains(s, "Jane") || strings.Contains(s, "John") {
+		t.Errorf("Unexpected export: %s", s)
+	}
+}
@@ -26,6 +26,7 @@ import (
 
 	"github.com/cloudprivacylabs/lsa/layers/cmd/cmdutil"
 	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/pipeline"
 )
 
 type Valuesets struct {
@@ -351,7 +352,7 @@ params:
 	fmt.Println(baseIngestParamsHelp)
 }
 
-func (vs *ValuesetStep) Run(pipeline *PipelineContext) error {
+func (vs *ValuesetStep) Run(pipeline *pipeline.PipelineContext) error {
 	if !vs.initialized {
 		err := LoadValuesetFiles(&vs.valuesets, vs.ValuesetFiles)
 		if err != nil {
@@ -360,7 +361,7 @@ func (vs *ValuesetStep) Run(pipeline *PipelineContext) error {
 		if vs.IsEmptySchema() {
 			vs.layer, _ = pipeline.Properties["layer"].(*ls.Layer)
 		} else {
-			vs.layer, err = LoadSchemaFromFileOrRepo(pipeline.Context, vs.CompiledSchema, vs.Repo, vs.Schema, vs.Type, vs.Bundle)
+			vs.layer, err = LoadSchemaFromFileOrRepo(pipeline.Context, vs.CompiledSchema, vs.Repo, vs.Schema, vs.Type, vs.Bundle, vs.BundleProfile)
 			if err != nil {
 				return err
 			}
@@ -373,6 +374,7 @@ func (vs *ValuesetStep) Run(pipeline *PipelineContext) error {
 	builder := ls.NewGraphBuilder(pipeline.GetGraphRW(), ls.GraphBuilderOptions{
 		EmbedSchemaNodes: true,
 	})
+	builder.SetEntityIndex(pipeline.GetEntityIndex())
 
 	pipeline.Context.GetLogger().Debug(map[string]interface{}{"pipeline": "valueset"})
 	prc := ls.NewValuesetProcessor(vs.layer, vs.valuesets.Lookup)
@@ -385,12 +387,12 @@ func (vs *ValuesetStep) Run(pipeline *PipelineContext) error {
 
 func init() {
 	rootCmd.AddCommand(valuesetCmd)
-	valuesetCmd.Flags().String("input", "json", "Input graph format (json, jsonld)")
-	valuesetCmd.Flags().String("output", "json", "Output format, json, jsonld, or dot")
+	valuesetCmd.Flags().String("input", "json", "Input graph format (json, jsonld, binary)")
+	valuesetCmd.Flags().String("output", "json", "Output format, json, jsonld, binary, or dot")
 	valuesetCmd.Flags().StringSlice("valueset", nil, "Valueset file(s)")
 	addSchemaFlags(valuesetCmd.Flags())
 
-	operations["valueset"] = func() Step { return &ValuesetStep{} }
+	pipeline.RegisterStep("valueset", func() pipeline.Step { return &ValuesetStep{} })
 }
 
 var valuesetCmd = &cobra.Command{
@@ -436,7 +438,7 @@ Individual valueset objects can be given as separate files as well:
 		step := &ValuesetStep{}
 		step.fromCmd(cmd)
 		step.ValuesetFiles, _ = cmd.Flags().GetStringSlice("valueset")
-		p := []Step{
+		p := []pipeline.Step{
 			NewReadGraphStep(cmd),
 			step,
 			NewWriteGraphStep(cmd),
@@ -0,0 +1,400 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package diff compares layers
+package diff
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/validators"
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+// CompatChangeKind describes the kind of a schema change
+type CompatChangeKind string
+
+const (
+	AttributeAdded        CompatChangeKind = "attributeAdded"
+	AttributeRemoved      CompatChangeKind = "attributeRemoved"
+	TypeChanged           CompatChangeKind = "typeChanged"
+	ValueTypeChanged      CompatChangeKind = "valueTypeChanged"
+	RequiredAdded         CompatChangeKind = "requiredAdded"
+	RequiredRemoved       CompatChangeKind = "requiredRemoved"
+	EnumerationNarrowed   CompatChangeKind = "enumerationNarrowed"
+	EnumerationWidened    CompatChangeKind = "enumerationWidened"
+	PatternAdded          CompatChangeKind = "patternAdded"
+	PatternChanged        CompatChangeKind = "patternChanged"
+	PatternRemoved        CompatChangeKind = "patternRemoved"
+	EntityIDFieldsChanged CompatChangeKind = "entityIdFieldsChanged"
+	ReferenceChanged      CompatChangeKind = "referenceChanged"
+)
+
+// CompatChange is a change between two versions of a schema
+type CompatChange struct {
+	Kind CompatChangeKind `json:"kind"`
+	// Breaking is true if data valid under the old schema may not be
+	// valid under the new one, or if downstream consumers of the
+	// data may break
+	Breaking bool `json:"breaking"`
+	// AttributeID is the attribute ID. If the attribute is matched
+	// by path, this is the ID of the attribute in the new schema.
+	AttributeID string `json:"attributeId,omitempty"`
+	// Path is the attribute path in the new schema, or in the old
+	// schema if the attribute is removed
+	Path string      `json:"path,omitempty"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// CompatReport is the result of a compatibility check
+type CompatReport struct {
+	OldID      string `json:"oldId"`
+	OldVersion string `json:"oldVersion,omitempty"`
+	NewID      string `json:"newId"`
+	NewVersion string `json:"newVersion,omitempty"`
+	// Compatible is true if there are no breaking changes
+	Compatible bool           `json:"compatible"`
+	Changes    []CompatChange `json:"changes"`
+}
+
+// Breaking returns the breaking changes
+func (r CompatReport) Breaking() []CompatChange {
+	ret := make([]CompatChange, 0)
+	for _, x := range r.Changes {
+		if x.Breaking {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
+
+// WriteText writes the report in human readable form
+func (r CompatReport) WriteText(out io.Writer) {
+	fmt.Fprintf(out, "Old: %s %s\nNew: %s %s\n", r.OldID, r.OldVersion, r.NewID, r.NewVersion)
+	for _, x := range r.Changes {
+		severity := "compatible"
+		if x.Breaking {
+			severity = "BREAKING"
+		}
+		fmt.Fprintf(out, "%-10s %-22s %s", severity, x.Kind, x.Path)
+		if x.Old != nil || x.New != nil {
+			fmt.Fprintf(out, " (%v -> %v)", x.Old, x.New)
+		}
+		fmt.Fprintln(out)
+	}
+	if r.Compatible {
+		fmt.Fprintln(out, "Compatible")
+	} else {
+		fmt.Fprintln(out, "Not compatible")
+	}
+}
+
+// AttributePathString returns the attribute path as a dot-separated
+// string of attribute names. If an attribute in the path does not
+// have a name, its ID is used.
+func AttributePathString(path []graph.Node) string {
+	parts := make([]string, 0, len(path))
+	for _, node := range path {
+		if !ls.IsAttributeNode(node) {
+			continue
+		}
+		name := ls.AsPropertyValue(node.GetProperty(ls.AttributeNameTerm)).AsString()
+		if len(name) == 0 {
+			name = ls.GetNodeID(node)
+		}
+		parts = append(parts, name)
+	}
+	return strings.Join(parts, ".")
+}
+
+type compatAttribute struct {
+	node graph.Node
+	path string
+}
+
+// MatchAttributes matches the attributes of the old layer to the
+// attributes of the new layer. Attributes are matched by ID. If an
+// attribute cannot be matched by ID, it is matched by path. The
+// returned map is keyed by the old attribute node. Unmatched
+// attributes are not in the map.
+func MatchAttributes(oldLayer, newLayer *ls.Layer) map[graph.Node]graph.Node {
+	ret, _, _ := matchAttributes(oldLayer, newLayer)
+	return ret
+}
+
+func collectAttributes(layer *ls.Layer) []compatAttribute {
+	ret := make([]compatAttribute, 0)
+	layer.ForEachAttributeOrdered(func(node graph.Node, path []graph.Node) bool {
+		// Paths are relative to the schema root
+		if len(path) > 1 {
+			path = path[1:]
+		}
+		ret = append(ret, compatAttribute{node: node, path: AttributePathString(path)})
+		return true
+	})
+	// Attributes of an overlay given in attributeOverlays
+	for _, node := range layer.GetOverlayAttributes() {
+		ret = append(ret, compatAttribute{node: node, path: AttributePathString([]graph.Node{node})})
+	}
+	return ret
+}
+
+func matchAttributes(oldLayer, newLayer *ls.Layer) (map[graph.Node]graph.Node, []compatAttribute, []compatAttribute) {
+	oldAttrs := collectAttributes(oldLayer)
+	newAttrs := collectAttributes(newLayer)
+	newByID := make(map[string]graph.Node)
+	newByPath := make(map[string]graph.Node)
+	for _, x := range newAttrs {
+		newByID[ls.GetNodeID(x.node)] = x.node
+		newByPath[x.path] = x.node
+	}
+	matches := make(map[graph.Node]graph.Node)
+	matched := make(map[graph.Node]struct{})
+	// Match by ID first, so path matches do not steal attributes that
+	// match by ID
+	for _, x := range oldAttrs {
+		if n, ok := newByID[ls.GetNodeID(x.node)]; ok {
+			matches[x.node] = n
+			matched[n] = struct{}{}
+		}
+	}
+	for _, x := range oldAttrs {
+		if _, ok := matches[x.node]; ok {
+			continue
+		}
+		if n, ok := newByPath[x.path]; ok {
+			if _, used := matched[n]; !used {
+				matches[x.node] = n
+				matched[n] = struct{}{}
+			}
+		}
+	}
+	return matches, oldAttrs, newAttrs
+}
+
+// CheckCompatibility compares the new version of a schema to the old
+// version attribute by attribute, and classifies the changes as
+// compatible or breaking.
+func CheckCompatibility(oldLayer, newLayer *ls.Layer) CompatReport {
+	report := CompatReport{
+		OldID:      oldLayer.GetID(),
+		OldVersion: oldLayer.GetVersion(),
+		NewID:      newLayer.GetID(),
+		NewVersion: newLayer.GetVersion(),
+		Changes:    make([]CompatChange, 0),
+	}
+	matches, oldAttrs, newAttrs := matchAttributes(oldLayer, newLayer)
+	newPaths := make(map[graph.Node]string)
+	for _, x := range newAttrs {
+		newPaths[x.node] = x.path
+	}
+	matchedNew := make(map[graph.Node]struct{})
+	for _, x := range oldAttrs {
+		newNode, ok := matches[x.node]
+		if !ok {
+			report.Changes = append(report.Changes, CompatChange{
+				Kind:        AttributeRemoved,
+				Breaking:    true,
+				AttributeID: ls.GetNodeID(x.node),
+				Path:        x.path,
+			})
+			continue
+		}
+		matchedNew[newNode] = struct{}{}
+		report.Changes = append(report.Changes, compareAttributes(x.node, newNode, newPaths[newNode])...)
+	}
+	for _, x := range newAttrs {
+		if _, ok := matchedNew[x.node]; ok {
+			continue
+		}
+		// A new required attribute breaks existing data
+		kind := AttributeAdded
+		required := isRequired(x.node)
+		if required {
+			kind = RequiredAdded
+		}
+		report.Changes = append(report.Changes, CompatChange{
+			Kind:        kind,
+			Breaking:    required,
+			AttributeID: ls.GetNodeID(x.node),
+			Path:        x.path,
+		})
+	}
+
+	oldIDFields := oldLayer.GetEntityIDNodes()
+	newIDFields := newLayer.GetEntityIDNodes()
+	if !sameStrings(oldIDFields, newIDFields, false) {
+		report.Changes = append(report.Changes, CompatChange{
+			Kind:     EntityIDFieldsChanged,
+			Breaking: true,
+			Old:      oldIDFields,
+			New:      newIDFields,
+		})
+	}
+	report.Compatible = len(report.Breaking()) == 0
+	return report
+}
+
+func compareAttributes(oldNode, newNode graph.Node, path string) []CompatChange {
+	ret := make([]CompatChange, 0)
+	change := func(kind CompatChangeKind, breaking bool, old, new interface{}) {
+		ret = append(ret, CompatChange{
+			Kind:        kind,
+			Breaking:    breaking,
+			AttributeID: ls.GetNodeID(newNode),
+			Path:        path,
+			Old:         old,
+			New:         new,
+		})
+	}
+
+	oldTypes := attributeTypes(oldNode)
+	newTypes := attributeTypes(newNode)
+	if !sameStrings(oldTypes, newTypes, true) {
+		change(TypeChanged, true, oldTypes, newTypes)
+	}
+
+	// Values of the old type may not be valid for the new type, and
+	// consumers of the data may expect the old type
+	oldValueType := ls.AsPropertyValue(oldNode.GetProperty(ls.ValueTypeTerm)).Slice()
+	newValueType := ls.AsPropertyValue(newNode.GetProperty(ls.ValueTypeTerm)).Slice()
+	if !sameStrings(oldValueType, newValueType, true) {
+		change(ValueTypeChanged, true, strings.Join(oldValueType, ","), strings.Join(newValueType, ","))
+	}
+
+	oldRequired := isRequired(oldNode)
+	newRequired := isRequired(newNode)
+	if !oldRequired && newRequired {
+		change(RequiredAdded, true, nil, nil)
+	} else if oldRequired && !newRequired {
+		change(RequiredRemoved, false, nil, nil)
+	}
+
+	oldEnum, oldHasEnum := enumeration(oldNode)
+	newEnum, newHasEnum := enumeration(newNode)
+	switch {
+	case !oldHasEnum && newHasEnum:
+		change(EnumerationNarrowed, true, nil, newEnum)
+	case oldHasEnum && !newHasEnum:
+		change(EnumerationWidened, false, oldEnum, nil)
+	case oldHasEnum && newHasEnum && !sameStrings(oldEnum, newEnum, true):
+		if isSubset(oldEnum, newEnum) {
+			change(EnumerationWidened, false, oldEnum, newEnum)
+		} else {
+			change(EnumerationNarrowed, true, oldEnum, newEnum)
+		}
+	}
+
+	oldPattern := ls.AsPropertyValue(oldNode.GetProperty(validators.PatternTerm)).AsString()
+	newPattern := ls.AsPropertyValue(newNode.GetProperty(validators.PatternTerm)).AsString()
+	switch {
+	case len(oldPattern) == 0 && len(newPattern) > 0:
+		change(PatternAdded, true, nil, newPattern)
+	case len(oldPattern) > 0 && len(newPattern) == 0:
+		change(PatternRemoved, false, oldPattern, nil)
+	case oldPattern != newPattern:
+		// We cannot tell if the new pattern accepts everything the old
+		// pattern accepted
+		change(PatternChanged, true, oldPattern, newPattern)
+	}
+
+	oldRef := ls.AsPropertyValue(oldNode.GetProperty(ls.ReferenceTerm)).AsString()
+	newRef := ls.AsPropertyValue(newNode.GetProperty(ls.ReferenceTerm)).AsString()
+	if oldRef != newRef && (len(oldRef) > 0 || len(newRef) > 0) {
+		change(ReferenceChanged, true, oldRef, newRef)
+	}
+	return ret
+}
+
+// attributeTypes returns the types of an attribute, excluding
+// ls:Attribute, sorted
+func attributeTypes(node graph.Node) []string {
+	ret := make([]string, 0)
+	for _, x := range node.GetLabels().Slice() {
+		if x != ls.AttributeNodeTerm {
+			ret = append(ret, x)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// isRequired returns true if the attribute is marked as required, or
+// if the parent object lists the attribute as required
+func isRequired(node graph.Node) bool {
+	req := ls.AsPropertyValue(node.GetProperty(validators.RequiredTerm))
+	if req.IsString() && req.AsString() == "true" {
+		return true
+	}
+	parent := ls.GetParentAttribute(node)
+	if parent == nil {
+		return false
+	}
+	id := ls.GetNodeID(node)
+	if preq := ls.AsPropertyValue(parent.GetProperty(validators.RequiredTerm)); preq.IsStringSlice() || preq.IsString() {
+		for _, x := range preq.MustStringSlice() {
+			if x == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// enumeration returns the allowed values of the attribute given by
+// an enumeration or a const
+func enumeration(node graph.Node) ([]string, bool) {
+	for _, term := range []string{validators.EnumTerm, validators.ConstTerm} {
+		p := ls.AsPropertyValue(node.GetProperty(term))
+		if p.IsString() || p.IsStringSlice() {
+			return p.MustStringSlice(), true
+		}
+	}
+	return nil, false
+}
+
+func isSubset(subset, set []string) bool {
+	m := make(map[string]struct{}, len(set))
+	for _, x := range set {
+		m[x] = struct{}{}
+	}
+	for _, x := range subset {
+		if _, ok := m[x]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// sameStrings compares two string slices. If unordered is true, the
+// order of elements is ignored.
+func sameStrings(a, b []string, unordered bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	if unordered {
+		return isSubset(a, b) && isSubset(b, a)
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
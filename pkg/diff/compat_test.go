@@ -0,0 +1,90 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diff
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+)
+
+func readLayer(t *testing.T, file string) *ls.Layer {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := ls.UnmarshalLayer(v, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+func TestCompatibility(t *testing.T) {
+	oldLayer := readLayer(t, "testdata/compat_old.json")
+	newLayer := readLayer(t, "testdata/compat_new.json")
+
+	report := CheckCompatibility(oldLayer, newLayer)
+	if report.Compatible {
+		t.Errorf("Expected incompatible")
+	}
+	if report.OldVersion != "1.0.0" || report.NewVersion != "2.0.0" {
+		t.Errorf("Wrong versions: %+v", report)
+	}
+	type key struct {
+		kind CompatChangeKind
+		path string
+	}
+	expected := map[key]bool{
+		{RequiredAdded, "ssn"}:          true,
+		{RequiredRemoved, "name"}:       false,
+		{EnumerationWidened, "status"}:  false,
+		{EnumerationNarrowed, "gender"}: true,
+		{TypeChanged, "age"}:            true,
+		{ValueTypeChanged, "birthDate"}: true,
+		{ValueTypeChanged, "count"}:     true,
+		{PatternChanged, "phone"}:       true,
+		{ReferenceChanged, "employer"}:  true,
+		{AttributeRemoved, "nickname"}:  true,
+		{EntityIDFieldsChanged, ""}:     true,
+	}
+	got := make(map[key]bool)
+	for _, x := range report.Changes {
+		got[key{x.Kind, x.Path}] = x.Breaking
+	}
+	for k, v := range expected {
+		breaking, ok := got[k]
+		if !ok {
+			t.Errorf("Missing change %v", k)
+			continue
+		}
+		if breaking != v {
+			t.Errorf("Wrong breaking flag for %v", k)
+		}
+	}
+	if len(got) != len(expected) {
+		t.Errorf("Unexpected changes: %v", got)
+	}
+
+	if r := CheckCompatibility(oldLayer, oldLayer); !r.Compatible || len(r.Changes) != 0 {
+		t.Errorf("Expected no changes, got %v", r.Changes)
+	}
+}
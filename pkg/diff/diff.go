@@ -0,0 +1,308 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diff
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/cloudprivacylabs/lsa/pkg/dot"
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+// AttributeStatus describes how an attribute changed
+type AttributeStatus string
+
+const (
+	StatusUnchanged AttributeStatus = ""
+	StatusAdded     AttributeStatus = "added"
+	StatusRemoved   AttributeStatus = "removed"
+	// StatusMoved is used for attributes that moved under a
+	// different parent. A moved attribute can also have property
+	// changes.
+	StatusMoved    AttributeStatus = "moved"
+	StatusModified AttributeStatus = "modified"
+)
+
+// TypesKey is used as the term of property changes for attribute
+// type changes
+const TypesKey = "@type"
+
+// PropertyChange is a change in the value of a term
+type PropertyChange struct {
+	Term string      `json:"term"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// AttributeDiff describes the changes of an attribute
+type AttributeDiff struct {
+	Status      AttributeStatus  `json:"status"`
+	AttributeID string           `json:"attributeId"`
+	OldPath     string           `json:"oldPath,omitempty"`
+	NewPath     string           `json:"newPath,omitempty"`
+	Properties  []PropertyChange `json:"properties,omitempty"`
+
+	oldNode graph.Node
+	newNode graph.Node
+}
+
+// LayerDiff is the structural and annotation difference between two
+// layers
+type LayerDiff struct {
+	OldID string `json:"oldId"`
+	NewID string `json:"newId"`
+	// Properties are the changes of the layer annotations
+	Properties []PropertyChange `json:"properties,omitempty"`
+	// Attributes are the changed attributes
+	Attributes []AttributeDiff `json:"attributes"`
+
+	// all contains unchanged attributes as well, used to render the
+	// diff
+	all []AttributeDiff
+}
+
+// IsEmpty returns true if there are no differences
+func (d LayerDiff) IsEmpty() bool {
+	return len(d.Properties) == 0 && len(d.Attributes) == 0
+}
+
+// Diff compares two layers, and returns the added, removed, moved,
+// and modified attributes. Attributes are matched by ID, and by path
+// if the ID changed.
+func Diff(oldLayer, newLayer *ls.Layer) LayerDiff {
+	ret := LayerDiff{
+		OldID:      oldLayer.GetID(),
+		NewID:      newLayer.GetID(),
+		Properties: diffProperties(oldLayer.GetLayerRootNode(), newLayer.GetLayerRootNode()),
+		Attributes: make([]AttributeDiff, 0),
+	}
+	matches, oldAttrs, newAttrs := matchAttributes(oldLayer, newLayer)
+	reverse := make(map[graph.Node]graph.Node, len(matches))
+	oldPaths := make(map[graph.Node]string, len(oldAttrs))
+	for k, v := range matches {
+		reverse[v] = k
+	}
+	for _, x := range oldAttrs {
+		oldPaths[x.node] = x.path
+	}
+	add := func(d AttributeDiff) {
+		ret.all = append(ret.all, d)
+		if d.Status != StatusUnchanged {
+			ret.Attributes = append(ret.Attributes, d)
+		}
+	}
+	for _, x := range newAttrs {
+		d := AttributeDiff{
+			AttributeID: ls.GetNodeID(x.node),
+			NewPath:     x.path,
+			newNode:     x.node,
+		}
+		oldNode, ok := reverse[x.node]
+		if !ok {
+			d.Status = StatusAdded
+			add(d)
+			continue
+		}
+		d.oldNode = oldNode
+		d.OldPath = oldPaths[oldNode]
+		d.Properties = diffAttributes(oldNode, x.node)
+		switch {
+		case isMoved(oldNode, x.node, matches):
+			d.Status = StatusMoved
+		case len(d.Properties) > 0:
+			d.Status = StatusModified
+		}
+		add(d)
+	}
+	for _, x := range oldAttrs {
+		if _, ok := matches[x.node]; ok {
+			continue
+		}
+		add(AttributeDiff{
+			Status:      StatusRemoved,
+			AttributeID: ls.GetNodeID(x.node),
+			OldPath:     x.path,
+			oldNode:     x.node,
+		})
+	}
+	return ret
+}
+
+// isMoved returns true if the parent of the old attribute does not
+// match the parent of the new attribute
+func isMoved(oldNode, newNode graph.Node, matches map[graph.Node]graph.Node) bool {
+	oldParent := ls.GetParentAttribute(oldNode)
+	newParent := ls.GetParentAttribute(newNode)
+	if oldParent == nil || newParent == nil {
+		return oldParent != newParent
+	}
+	return matches[oldParent] != newParent
+}
+
+// diffAttributes compares the types and properties of two attribute
+// nodes
+func diffAttributes(oldNode, newNode graph.Node) []PropertyChange {
+	ret := make([]PropertyChange, 0)
+	oldTypes := attributeTypes(oldNode)
+	newTypes := attributeTypes(newNode)
+	if !sameStrings(oldTypes, newTypes, true) {
+		ret = append(ret, PropertyChange{Term: TypesKey, Old: oldTypes, New: newTypes})
+	}
+	ret = append(ret, diffProperties(oldNode, newNode)...)
+	if len(ret) == 0 {
+		return nil
+	}
+	return ret
+}
+
+// diffProperties compares the property values of two nodes. Node ID
+// and attribute index are ignored.
+func diffProperties(oldNode, newNode graph.Node) []PropertyChange {
+	values := func(node graph.Node) map[string]*ls.PropertyValue {
+		ret := make(map[string]*ls.PropertyValue)
+		node.ForEachProperty(func(k string, v interface{}) bool {
+			if pv, ok := v.(*ls.PropertyValue); ok && k != ls.NodeIDTerm && k != ls.AttributeIndexTerm {
+				ret[k] = pv
+			}
+			return true
+		})
+		return ret
+	}
+	oldValues := values(oldNode)
+	newValues := values(newNode)
+	terms := make([]string, 0, len(oldValues)+len(newValues))
+	for k := range oldValues {
+		terms = append(terms, k)
+	}
+	for k := range newValues {
+		if _, ok := oldValues[k]; !ok {
+			terms = append(terms, k)
+		}
+	}
+	sort.Strings(terms)
+	ret := make([]PropertyChange, 0)
+	for _, term := range terms {
+		oldValue, newValue := oldValues[term], newValues[term]
+		if oldValue != nil && newValue != nil && oldValue.IsEqual(newValue) {
+			continue
+		}
+		change := PropertyChange{Term: term}
+		if oldValue != nil {
+			change.Old = oldValue.GetNativeValue()
+		}
+		if newValue != nil {
+			change.New = newValue.GetNativeValue()
+		}
+		ret = append(ret, change)
+	}
+	if len(ret) == 0 {
+		return nil
+	}
+	return ret
+}
+
+// WriteText writes the diff in human readable form
+func (d LayerDiff) WriteText(out io.Writer) {
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", d.OldID, d.NewID)
+	writeProperties := func(props []PropertyChange) {
+		for _, p := range props {
+			fmt.Fprintf(out, "    %s: %v -> %v\n", p.Term, p.Old, p.New)
+		}
+	}
+	if len(d.Properties) > 0 {
+		fmt.Fprintln(out, "~ layer")
+		writeProperties(d.Properties)
+	}
+	for _, a := range d.Attributes {
+		switch a.Status {
+		case StatusAdded:
+			fmt.Fprintf(out, "+ %s (%s)\n", a.NewPath, a.AttributeID)
+		case StatusRemoved:
+			fmt.Fprintf(out, "- %s (%s)\n", a.OldPath, a.AttributeID)
+		case StatusMoved:
+			fmt.Fprintf(out, "> %s -> %s (%s)\n", a.OldPath, a.NewPath, a.AttributeID)
+		case StatusModified:
+			fmt.Fprintf(out, "~ %s (%s)\n", a.NewPath, a.AttributeID)
+		}
+		writeProperties(a.Properties)
+	}
+}
+
+// StatusColors are the fill colors used to render attributes in DOT
+var StatusColors = map[AttributeStatus]string{
+	StatusAdded:    "palegreen",
+	StatusRemoved:  "lightpink",
+	StatusMoved:    "lightblue",
+	StatusModified: "khaki",
+}
+
+// WriteDOT renders the union of the old and new attribute trees in
+// DOT format. Nodes are colored by their status using
+// StatusColors. Removed attributes are shown under their old parent.
+func (d LayerDiff) WriteDOT(out io.Writer) error {
+	target := graph.NewOCGraph()
+	// Maps the old and the new attribute nodes to the rendered nodes
+	nodeMap := make(map[graph.Node]graph.Node)
+	status := make(map[graph.Node]AttributeStatus)
+	for _, a := range d.all {
+		source := a.newNode
+		if source == nil {
+			source = a.oldNode
+		}
+		node := graph.CopyNode(source, target, ls.ClonePropertyValueFunc)
+		status[node] = a.Status
+		if a.oldNode != nil {
+			nodeMap[a.oldNode] = node
+		}
+		if a.newNode != nil {
+			nodeMap[a.newNode] = node
+		}
+	}
+	connect := func(child graph.Node) {
+		parent := ls.GetParentAttribute(child)
+		if parent == nil {
+			return
+		}
+		from, ok := nodeMap[parent]
+		if !ok {
+			return
+		}
+		label := ""
+		for edges := child.GetEdges(graph.IncomingEdge); edges.Next(); {
+			if edge := edges.Edge(); edge.GetFrom() == parent && ls.IsAttributeTreeEdge(edge) {
+				label = edge.GetLabel()
+				break
+			}
+		}
+		target.NewEdge(from, nodeMap[child], label, nil)
+	}
+	for _, a := range d.all {
+		if a.newNode != nil {
+			connect(a.newNode)
+		} else {
+			connect(a.oldNode)
+		}
+	}
+	renderer := dot.Renderer{
+		Options: dot.DefaultOptions(),
+		NodeColorFunc: func(node graph.Node) string {
+			return StatusColors[status[node]]
+		},
+	}
+	return renderer.Render(target, "g", out)
+}
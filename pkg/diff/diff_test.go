@@ -0,0 +1,48 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diff
+
+import (
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	oldLayer := readLayer(t, "testdata/diff_old.json")
+	newLayer := readLayer(t, "testdata/diff_new.json")
+
+	d := Diff(oldLayer, newLayer)
+	got := make(map[string]AttributeDiff)
+	for _, x := range d.Attributes {
+		got[x.AttributeID] = x
+	}
+	if len(got) != 4 {
+		t.Errorf("Unexpected changes: %+v", d.Attributes)
+	}
+	if x := got["http://example.org/Person/street"]; x.Status != StatusMoved || x.OldPath != "street" || x.NewPath != "address.street" {
+		t.Errorf("Wrong move: %+v", x)
+	}
+	if x := got["http://example.org/Person/address/city"]; x.Status != StatusModified || len(x.Properties) != 1 || x.Properties[0].New != "location" {
+		t.Errorf("Wrong modification: %+v", x)
+	}
+	if x := got["http://example.org/Person/fax"]; x.Status != StatusRemoved {
+		t.Errorf("Expected removed: %+v", x)
+	}
+	if x := got["http://example.org/Person/email"]; x.Status != StatusAdded {
+		t.Errorf("Expected added: %+v", x)
+	}
+	if !Diff(oldLayer, oldLayer).IsEmpty() {
+		t.Errorf("Expected empty diff")
+	}
+}
@@ -0,0 +1,391 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diff
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+// PathElement is a step in the path of a document node from its
+// entity root
+type PathElement struct {
+	// Label is the label of the edge from the parent node. It is empty
+	// for ls.HasTerm edges.
+	Label        string `json:"label,omitempty"`
+	SchemaNodeID string `json:"schemaNodeId"`
+	Index        int    `json:"index"`
+	// N distinguishes the siblings that have the same schema node ID
+	// and index
+	N int `json:"n,omitempty"`
+}
+
+// NodePath is the path of a document node from its entity root. The
+// path of the entity root is empty.
+type NodePath []PathElement
+
+func (p NodePath) String() string {
+	elements := make([]string, 0, len(p))
+	for _, x := range p {
+		s := fmt.Sprintf("%s[%d]", x.SchemaNodeID, x.Index)
+		if len(x.Label) > 0 {
+			s = fmt.Sprintf("(%s)%s", x.Label, s)
+		}
+		if x.N > 0 {
+			s += fmt.Sprintf("#%d", x.N)
+		}
+		elements = append(elements, s)
+	}
+	return "/" + strings.Join(elements, "/")
+}
+
+func (p NodePath) key() string {
+	elements := make([]string, 0, len(p))
+	for _, x := range p {
+		elements = append(elements, fmt.Sprintf("%s\x00%s\x00%d\x00%d", x.Label, x.SchemaNodeID, x.Index, x.N))
+	}
+	return strings.Join(elements, "\x01")
+}
+
+// edgeLabel returns the label of the edge from the parent node
+func (x PathElement) edgeLabel() string {
+	if len(x.Label) == 0 {
+		return ls.HasTerm
+	}
+	return x.Label
+}
+
+// DocNode is a document node added to a graph
+type DocNode struct {
+	Path   NodePath `json:"path"`
+	Labels []string `json:"labels"`
+	// Properties are string or []string
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// NodeRef refers to a document node in an entity
+type NodeRef struct {
+	EntitySchema string   `json:"entitySchema"`
+	EntityID     []string `json:"entityId"`
+	Path         NodePath `json:"path"`
+}
+
+// NodeChange is an added, removed, or modified document node of an
+// entity
+type NodeChange struct {
+	Status AttributeStatus `json:"status"`
+	Path   NodePath        `json:"path"`
+	// Node is set for added nodes
+	Node *DocNode `json:"node,omitempty"`
+	// Properties are the property changes of modified nodes. Changes
+	// of the node value have the term ls.NodeValueTerm.
+	Properties []PropertyChange `json:"properties,omitempty"`
+}
+
+// EntityChanges contains the changes of an entity
+type EntityChanges struct {
+	Status       AttributeStatus `json:"status"`
+	EntitySchema string          `json:"entitySchema"`
+	EntityID     []string        `json:"entityId"`
+	// Nodes are the nodes of an added entity, with the entity root
+	// first, or the node changes of a modified entity
+	Nodes []NodeChange `json:"nodes,omitempty"`
+	// Parent is the document node an added entity is attached to, if
+	// any
+	Parent *NodeRef `json:"parent,omitempty"`
+}
+
+// GraphChangeSet is the difference between two document graphs
+type GraphChangeSet struct {
+	Entities []EntityChanges `json:"entities"`
+}
+
+// IsEmpty returns true if there are no changes
+func (c GraphChangeSet) IsEmpty() bool {
+	return len(c.Entities) == 0
+}
+
+// WriteText writes the change set in human readable form
+func (c GraphChangeSet) WriteText(out io.Writer) {
+	marks := map[AttributeStatus]string{StatusAdded: "+", StatusRemoved: "-", StatusModified: "~"}
+	for _, entity := range c.Entities {
+		fmt.Fprintf(out, "%s %s %v\n", marks[entity.Status], entity.EntitySchema, entity.EntityID)
+		if entity.Status != StatusModified {
+			continue
+		}
+		for _, node := range entity.Nodes {
+			fmt.Fprintf(out, "  %s %s\n", marks[node.Status], node.Path)
+			for _, p := range node.Properties {
+				fmt.Fprintf(out, "      %s: %v -> %v\n", p.Term, p.Old, p.New)
+			}
+		}
+	}
+}
+
+// graphDiffIgnoredProperties are not compared. Node IDs are assigned
+// during ingestion, and the schema node ID and attribute index are
+// part of the node path.
+var graphDiffIgnoredProperties = map[string]struct{}{
+	ls.NodeIDTerm:         {},
+	ls.SchemaNodeIDTerm:   {},
+	ls.AttributeIndexTerm: {},
+}
+
+// entityNodes contains the document nodes of an entity by path
+type entityNodes struct {
+	root  graph.Node
+	info  ls.EntityInfo
+	paths []NodePath
+	nodes map[string]graph.Node
+}
+
+type nodeLocation struct {
+	entity *entityNodes
+	path   NodePath
+}
+
+// docChildren returns the edges to the children of the document node
+// in the entity, sorted by edge label, schema node ID, and attribute
+// index. Pending links and the edges to other entities are excluded.
+func docChildren(node graph.Node) []graph.Edge {
+	ret := make([]graph.Edge, 0)
+	for edges := node.GetEdges(graph.OutgoingEdge); edges.Next(); {
+		edge := edges.Edge()
+		child := edge.GetTo()
+		if !ls.IsDocumentNode(child) || ls.IsNodeEntityRoot(child) || child.GetLabels().Has(ls.PendingLinkTerm) {
+			continue
+		}
+		ret = append(ret, edge)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if li, lj := ret[i].GetLabel(), ret[j].GetLabel(); li != lj {
+			return li < lj
+		}
+		ci, cj := ret[i].GetTo(), ret[j].GetTo()
+		si, sj := ls.AsPropertyValue(ci.GetProperty(ls.SchemaNodeIDTerm)).AsString(), ls.AsPropertyValue(cj.GetProperty(ls.SchemaNodeIDTerm)).AsString()
+		if si != sj {
+			return si < sj
+		}
+		return ls.GetNodeIndex(ci) < ls.GetNodeIndex(cj)
+	})
+	return ret
+}
+
+// collectEntityNodes returns the document nodes of the entity by path
+func collectEntityNodes(root graph.Node, locations map[graph.Node]nodeLocation) *entityNodes {
+	ret := &entityNodes{
+		root:  root,
+		nodes: make(map[string]graph.Node),
+	}
+	var walk func(graph.Node, NodePath)
+	walk = func(node graph.Node, path NodePath) {
+		ret.paths = append(ret.paths, path)
+		ret.nodes[path.key()] = node
+		if locations != nil {
+			locations[node] = nodeLocation{entity: ret, path: path}
+		}
+		seen := make(map[PathElement]int)
+		for _, edge := range docChildren(node) {
+			child := edge.GetTo()
+			element := PathElement{
+				SchemaNodeID: ls.AsPropertyValue(child.GetProperty(ls.SchemaNodeIDTerm)).AsString(),
+				Index:        ls.GetNodeIndex(child),
+			}
+			if label := edge.GetLabel(); label != ls.HasTerm {
+				element.Label = label
+			}
+			n := seen[element]
+			seen[element] = n + 1
+			element.N = n
+			childPath := append(append(NodePath{}, path...), element)
+			walk(child, childPath)
+		}
+	}
+	walk(ret.root, NodePath{})
+	return ret
+}
+
+// collectGraphEntities returns the entities of the graph grouped by
+// entity schema and entity ID. Entities with the same schema and ID
+// are ordered by node ID.
+func collectGraphEntities(g graph.Graph) (map[string][]*entityNodes, []string, map[graph.Node]nodeLocation) {
+	roots := make([]ls.EntityInfo, 0)
+	for _, info := range ls.GetEntityRootNodes(g) {
+		roots = append(roots, info)
+	}
+	sort.Slice(roots, func(i, j int) bool {
+		return ls.GetNodeID(roots[i].GetRoot()) < ls.GetNodeID(roots[j].GetRoot())
+	})
+	locations := make(map[graph.Node]nodeLocation)
+	entities := make(map[string][]*entityNodes)
+	keys := make([]string, 0)
+	for _, info := range roots {
+		key := entityKey(info.GetEntitySchema(), info.GetID())
+		if _, ok := entities[key]; !ok {
+			keys = append(keys, key)
+		}
+		nodes := collectEntityNodes(info.GetRoot(), locations)
+		nodes.info = info
+		entities[key] = append(entities[key], nodes)
+	}
+	return entities, keys, locations
+}
+
+func entityKey(entitySchema string, id []string) string {
+	return entitySchema + "\x00" + strings.Join(id, "\x00")
+}
+
+// DiffGraphs compares two document graphs. Entities are aligned by
+// entity schema and entity ID, and the nodes of an entity are
+// aligned by their paths of schema node IDs and attribute indexes
+// from the entity root. The returned change set contains the added
+// and removed entities, and the added, removed, and modified nodes
+// of the entities that exist in both graphs.
+func DiffGraphs(oldGraph, newGraph graph.Graph) GraphChangeSet {
+	oldEntities, oldKeys, _ := collectGraphEntities(oldGraph)
+	newEntities, newKeys, newLocations := collectGraphEntities(newGraph)
+	ret := GraphChangeSet{Entities: make([]EntityChanges, 0)}
+	keys := append([]string{}, oldKeys...)
+	for _, k := range newKeys {
+		if _, ok := oldEntities[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		oldList, newList := oldEntities[key], newEntities[key]
+		for i := 0; i < len(oldList) || i < len(newList); i++ {
+			switch {
+			case i >= len(newList):
+				ret.Entities = append(ret.Entities, EntityChanges{
+					Status:       StatusRemoved,
+					EntitySchema: oldList[i].info.GetEntitySchema(),
+					EntityID:     oldList[i].info.GetID(),
+				})
+			case i >= len(oldList):
+				ret.Entities = append(ret.Entities, addedEntity(newList[i], newLocations))
+			default:
+				if changes := diffEntity(oldList[i], newList[i]); len(changes) > 0 {
+					ret.Entities = append(ret.Entities, EntityChanges{
+						Status:       StatusModified,
+						EntitySchema: newList[i].info.GetEntitySchema(),
+						EntityID:     newList[i].info.GetID(),
+						Nodes:        changes,
+					})
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func addedEntity(entity *entityNodes, locations map[graph.Node]nodeLocation) EntityChanges {
+	ret := EntityChanges{
+		Status:       StatusAdded,
+		EntitySchema: entity.info.GetEntitySchema(),
+		EntityID:     entity.info.GetID(),
+	}
+	for _, path := range entity.paths {
+		ret.Nodes = append(ret.Nodes, NodeChange{
+			Status: StatusAdded,
+			Path:   path,
+			Node:   newDocNode(entity.nodes[path.key()], path),
+		})
+	}
+	for _, parent := range ls.GetParentDocumentNodes(entity.root) {
+		if loc, ok := locations[parent]; ok {
+			ret.Parent = &NodeRef{
+				EntitySchema: loc.entity.info.GetEntitySchema(),
+				EntityID:     loc.entity.info.GetID(),
+				Path:         loc.path,
+			}
+			break
+		}
+	}
+	return ret
+}
+
+func newDocNode(node graph.Node, path NodePath) *DocNode {
+	ret := &DocNode{
+		Path:       path,
+		Labels:     node.GetLabels().Slice(),
+		Properties: make(map[string]interface{}),
+	}
+	sort.Strings(ret.Labels)
+	node.ForEachProperty(func(k string, v interface{}) bool {
+		if pv, ok := v.(*ls.PropertyValue); ok {
+			ret.Properties[k] = pv.GetNativeValue()
+		}
+		return true
+	})
+	return ret
+}
+
+// diffEntity compares the nodes of two entities
+func diffEntity(oldEntity, newEntity *entityNodes) []NodeChange {
+	ret := make([]NodeChange, 0)
+	for _, path := range newEntity.paths {
+		newNode := newEntity.nodes[path.key()]
+		oldNode, ok := oldEntity.nodes[path.key()]
+		if !ok {
+			// Only the top of an added subtree is recorded
+			if len(path) > 0 {
+				if _, parentAdded := oldEntity.nodes[path[:len(path)-1].key()]; !parentAdded {
+					continue
+				}
+			}
+			// Record the added node and the nodes under it, parents first
+			for _, p := range newEntity.paths {
+				if len(p) >= len(path) && p[:len(path)].key() == path.key() {
+					ret = append(ret, NodeChange{Status: StatusAdded, Path: p, Node: newDocNode(newEntity.nodes[p.key()], p)})
+				}
+			}
+			continue
+		}
+		if props := diffDocNodeProperties(oldNode, newNode); len(props) > 0 {
+			ret = append(ret, NodeChange{Status: StatusModified, Path: path, Properties: props})
+		}
+	}
+	for _, path := range oldEntity.paths {
+		if _, ok := newEntity.nodes[path.key()]; ok {
+			continue
+		}
+		// Only the top of a removed subtree is recorded
+		if len(path) > 0 {
+			if _, ok := newEntity.nodes[path[:len(path)-1].key()]; !ok {
+				continue
+			}
+		}
+		ret = append(ret, NodeChange{Status: StatusRemoved, Path: path})
+	}
+	return ret
+}
+
+// diffDocNodeProperties compares the properties of two document
+// nodes, ignoring the node ID, schema node ID, and attribute index
+func diffDocNodeProperties(oldNode, newNode graph.Node) []PropertyChange {
+	ret := make([]PropertyChange, 0)
+	for _, change := range diffProperties(oldNode, newNode) {
+		if _, ok := graphDiffIgnoredProperties[change.Term]; !ok {
+			ret = append(ret, change)
+		}
+	}
+	return ret
+}
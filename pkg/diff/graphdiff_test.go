@@ -0,0 +1,241 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diff
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+const graphDiffTestSchema = `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@id": "https://person",
+  "@type": "ls:Schema",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "person",
+    "ls:entityIdFields": "id",
+    "ls:Object/attributes": [
+      {"@id": "id", "@type": "ls:Value"},
+      {"@id": "name", "@type": "ls:Value"},
+      {"@id": "phones", "@type": "ls:Array", "ls:Array/elements": {"@id": "phone", "@type": "ls:Value"}}
+    ]
+  }
+}`
+
+type graphDiffTestPerson struct {
+	id, name string
+	phones   []string
+}
+
+func buildGraphDiffTestGraph(t *testing.T, layer *ls.Layer, people ...graphDiffTestPerson) graph.Graph {
+	builder := ls.NewGraphBuilder(nil, ls.GraphBuilderOptions{EmbedSchemaNodes: true})
+	for _, p := range people {
+		_, root, _ := builder.ObjectAsNode(layer.GetSchemaRootNode(), nil)
+		builder.ValueAsNode(layer.GetAttributeByID("id"), root, p.id)
+		builder.ValueAsNode(layer.GetAttributeByID("name"), root, p.name)
+		_, arr, _ := builder.ArrayAsNode(layer.GetAttributeByID("phones"), root)
+		for i, phone := range p.phones {
+			_, n, _ := builder.ValueAsNode(layer.GetAttributeByID("phone"), arr, phone)
+			ls.SetNodeIndex(n, i)
+		}
+	}
+	return builder.GetGraph()
+}
+
+func TestGraphDiffAndPatch(t *testing.T) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(graphDiffTestSchema), &v); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := ls.UnmarshalLayer(v, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler := ls.Compiler{
+		Loader: ls.SchemaLoaderFunc(func(string) (*ls.Layer, error) { return layer, nil }),
+	}
+	layer, err = compiler.Compile(ls.DefaultContext(), "https://person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldGraph := buildGraphDiffTestGraph(t, layer,
+		graphDiffTestPerson{id: "1", name: "John", phones: []string{"111"}},
+		graphDiffTestPerson{id: "2", name: "Jane"},
+	)
+	newGraph := buildGraphDiffTestGraph(t, layer,
+		graphDiffTestPerson{id: "1", name: "Johnny", phones: []string{"111", "222"}},
+		graphDiffTestPerson{id: "3", name: "Bob", phones: []string{"333"}},
+	)
+
+	changes := DiffGraphs(oldGraph, newGraph)
+	got := make(map[string]EntityChanges)
+	for _, x := range changes.Entities {
+		got[x.EntityID[0]] = x
+	}
+	if len(got) != 3 {
+		t.Fatalf("Unexpected changes: %+v", changes)
+	}
+	if got["2"].Status != StatusRemoved {
+		t.Errorf("Expected removed: %+v", got["2"])
+	}
+	if x := got["3"]; x.Status != StatusAdded || len(x.Nodes) != 5 {
+		t.Errorf("Expected added with 5 nodes: %+v", x)
+	}
+	modified := got["1"]
+	if modified.Status != StatusModified || len(modified.Nodes) != 2 {
+		t.Fatalf("Expected 2 node changes: %+v", modified)
+	}
+	for _, node := range modified.Nodes {
+		switch node.Status {
+		case StatusModified:
+			if node.Path.String() != "/name[1]" || node.Properties[0].Term != ls.NodeValueTerm || node.Properties[0].New != "Johnny" {
+				t.Errorf("Wrong modification: %+v", node)
+			}
+		case StatusAdded:
+			if node.Path.String() != "/phones[2]/phone[1]" {
+				t.Errorf("Wrong addition: %+v", node)
+			}
+		default:
+			t.Errorf("Unexpected change: %+v", node)
+		}
+	}
+	if !DiffGraphs(newGraph, newGraph).IsEmpty() {
+		t.Errorf("Expected empty diff")
+	}
+
+	// Patch using the JSON form of the change set
+	data, err := json.Marshal(changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshaled GraphChangeSet
+	if err := json.Unmarshal(data, &unmarshaled); err != nil {
+		t.Fatal(err)
+	}
+	if err := PatchGraph(oldGraph, unmarshaled); err != nil {
+		t.Fatal(err)
+	}
+	if d := DiffGraphs(oldGraph, newGraph); !d.IsEmpty() {
+		t.Errorf("Expected empty diff after patch: %+v", d)
+	}
+	if err := PatchGraph(oldGraph, unmarshaled); err == nil {
+		t.Errorf("Expected error patching a removed entity")
+	}
+}
+
+func TestGraphDiffEdgeLabels(t *testing.T) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(graphDiffTestSchema), &v); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := ls.UnmarshalLayer(v, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler := ls.Compiler{
+		Loader: ls.SchemaLoaderFunc(func(string) (*ls.Layer, error) { return layer, nil }),
+	}
+	layer, err = compiler.Compile(ls.DefaultContext(), "https://person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Add a node connected with a non-has edge to the entity root
+	annotate := func(g graph.Graph, notes ...string) {
+		for nodes := g.GetNodes(); nodes.Next(); {
+			root := nodes.Node()
+			if !ls.IsNodeEntityRoot(root) {
+				continue
+			}
+			for _, note := range notes {
+				n := g.NewNode([]string{ls.DocumentNodeTerm, ls.AttributeTypeValue}, map[string]interface{}{
+					ls.NodeValueTerm: ls.StringPropertyValue(note),
+				})
+				g.NewEdge(root, n, "annotation", nil)
+			}
+		}
+	}
+	oldGraph := buildGraphDiffTestGraph(t, layer, graphDiffTestPerson{id: "1", name: "John"})
+	annotate(oldGraph, "a")
+	newGraph := buildGraphDiffTestGraph(t, layer, graphDiffTestPerson{id: "1", name: "John"})
+	annotate(newGraph, "b", "c")
+
+	changes := DiffGraphs(oldGraph, newGraph)
+	if len(changes.Entities) != 1 || len(changes.Entities[0].Nodes) != 2 {
+		t.Fatalf("Unexpected changes: %+v", changes)
+	}
+	for _, node := range changes.Entities[0].Nodes {
+		if node.Path[0].Label != "annotation" {
+			t.Errorf("Wrong path: %+v", node.Path)
+		}
+	}
+	if err := PatchGraph(oldGraph, changes); err != nil {
+		t.Fatal(err)
+	}
+	if d := DiffGraphs(oldGraph, newGraph); !d.IsEmpty() {
+		t.Errorf("Expected empty diff after patch: %+v", d)
+	}
+	n := 0
+	for edges := oldGraph.GetEdges(); edges.Next(); {
+		if edges.Edge().GetLabel() == "annotation" {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Errorf("Expecting 2 annotation edges, got %d", n)
+	}
+}
+
+func TestGraphPatchNestedEntity(t *testing.T) {
+	newEntity := func(g graph.Graph, schema, id string) graph.Node {
+		root := g.NewNode([]string{ls.DocumentNodeTerm, ls.AttributeTypeObject}, map[string]interface{}{
+			ls.EntitySchemaTerm: ls.StringPropertyValue(schema),
+			ls.EntityIDTerm:     ls.StringPropertyValue(id),
+			ls.SchemaNodeIDTerm: ls.StringPropertyValue(schema),
+		})
+		value := g.NewNode([]string{ls.DocumentNodeTerm, ls.AttributeTypeValue}, map[string]interface{}{
+			ls.SchemaNodeIDTerm: ls.StringPropertyValue(schema + "/id"),
+			ls.NodeValueTerm:    ls.StringPropertyValue(id),
+		})
+		g.NewEdge(root, value, ls.HasTerm, nil)
+		return root
+	}
+	newGraph := ls.NewDocumentGraph()
+	person := newEntity(newGraph, "https://person", "1")
+	address := newEntity(newGraph, "https://address", "a")
+	newGraph.NewEdge(person, address, ls.HasTerm, nil)
+
+	oldGraph := ls.NewDocumentGraph()
+	changes := DiffGraphs(oldGraph, newGraph)
+	if len(changes.Entities) != 2 {
+		t.Fatalf("Unexpected changes: %+v", changes)
+	}
+	// Add the nested entity before its parent
+	if changes.Entities[0].Parent == nil {
+		changes.Entities[0], changes.Entities[1] = changes.Entities[1], changes.Entities[0]
+	}
+	if changes.Entities[0].Parent == nil {
+		t.Fatalf("Nested entity has no parent: %+v", changes)
+	}
+	if err := PatchGraph(oldGraph, changes); err != nil {
+		t.Fatal(err)
+	}
+	if d := DiffGraphs(oldGraph, newGraph); !d.IsEmpty() {
+		t.Errorf("Expected empty diff after patch: %+v", d)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diff
+
+import (
+	"fmt"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+// ErrPatch is returned if a change cannot be applied to a graph
+type ErrPatch struct {
+	EntitySchema string
+	EntityID     []string
+	Path         string
+	Msg          string
+}
+
+func (e ErrPatch) Error() string {
+	return fmt.Sprintf("Cannot patch %s %v %s: %s", e.EntitySchema, e.EntityID, e.Path, e.Msg)
+}
+
+// PatchGraph applies the change set to the graph. The changes of an
+// entity are applied to the first entity with the same entity schema
+// and entity ID. Added entities are attached to their parents after
+// all entities are added, so a nested entity can be added before its
+// parent entity. Returns ErrPatch if an entity or a node of the
+// change set cannot be found.
+func PatchGraph(g graph.Graph, changes GraphChangeSet) error {
+	index := ls.NewEntityIndexFromGraph(g)
+	findEntity := func(entity EntityChanges) graph.Node {
+		for _, root := range index.Find(entity.EntitySchema, entity.EntityID) {
+			if info, _ := index.GetEntityInfo(root); info.GetEntitySchema() == entity.EntitySchema {
+				return root
+			}
+		}
+		return nil
+	}
+	// The roots of the added entities that have a parent
+	attach := make([]graph.Node, 0)
+	attachEntities := make([]EntityChanges, 0)
+	for _, entity := range changes.Entities {
+		fail := func(path NodePath, msg string) error {
+			return ErrPatch{EntitySchema: entity.EntitySchema, EntityID: entity.EntityID, Path: path.String(), Msg: msg}
+		}
+		switch entity.Status {
+		case StatusRemoved:
+			root := findEntity(entity)
+			if root == nil {
+				return fail(nil, "entity not found")
+			}
+			nodes := collectEntityNodes(root, nil)
+			for _, node := range nodes.nodes {
+				node.DetachAndRemove()
+			}
+			index.Remove(root)
+
+		case StatusAdded:
+			created := make(map[string]graph.Node)
+			for _, change := range entity.Nodes {
+				if change.Node == nil {
+					return fail(change.Path, "missing node")
+				}
+				var parent graph.Node
+				if len(change.Path) > 0 {
+					parent = created[change.Path[:len(change.Path)-1].key()]
+					if parent == nil {
+						return fail(change.Path, "parent node not found")
+					}
+				}
+				created[change.Path.key()] = newPatchNode(g, parent, change.Path, change.Node)
+			}
+			root := created[NodePath{}.key()]
+			if root == nil {
+				return fail(nil, "missing entity root")
+			}
+			if entity.Parent != nil {
+				attach = append(attach, root)
+				attachEntities = append(attachEntities, entity)
+			}
+			index.Add(root)
+
+		case StatusModified:
+			root := findEntity(entity)
+			if root == nil {
+				return fail(nil, "entity not found")
+			}
+			nodes := collectEntityNodes(root, nil)
+			for _, change := range entity.Nodes {
+				switch change.Status {
+				case StatusRemoved:
+					if _, ok := nodes.nodes[change.Path.key()]; !ok {
+						return fail(change.Path, "node not found")
+					}
+					for _, p := range nodes.paths {
+						if len(p) >= len(change.Path) && p[:len(change.Path)].key() == change.Path.key() {
+							if node, ok := nodes.nodes[p.key()]; ok {
+								node.DetachAndRemove()
+								delete(nodes.nodes, p.key())
+							}
+						}
+					}
+				case StatusAdded:
+					if len(change.Path) == 0 || change.Node == nil {
+						return fail(change.Path, "invalid added node")
+					}
+					parent := nodes.nodes[change.Path[:len(change.Path)-1].key()]
+					if parent == nil {
+						return fail(change.Path, "parent node not found")
+					}
+					nodes.nodes[change.Path.key()] = newPatchNode(g, parent, change.Path, change.Node)
+				case StatusModified:
+					node := nodes.nodes[change.Path.key()]
+					if node == nil {
+						return fail(change.Path, "node not found")
+					}
+					for _, p := range change.Properties {
+						if p.New == nil {
+							node.RemoveProperty(p.Term)
+						} else {
+							node.SetProperty(p.Term, patchPropertyValue(p.New))
+						}
+					}
+				}
+			}
+			// The entity ID may have changed
+			index.Add(root)
+		}
+	}
+	for i, root := range attach {
+		entity := attachEntities[i]
+		fail := func(msg string) error {
+			return ErrPatch{EntitySchema: entity.EntitySchema, EntityID: entity.EntityID, Path: entity.Parent.Path.String(), Msg: msg}
+		}
+		parentRoot := findEntity(EntityChanges{EntitySchema: entity.Parent.EntitySchema, EntityID: entity.Parent.EntityID})
+		if parentRoot == nil {
+			return fail("parent entity not found")
+		}
+		parents := collectEntityNodes(parentRoot, nil)
+		parent := parents.nodes[entity.Parent.Path.key()]
+		if parent == nil {
+			return fail("parent node not found")
+		}
+		g.NewEdge(parent, root, ls.HasTerm, nil)
+	}
+	return nil
+}
+
+// newPatchNode creates a new document node under parent. The edge
+// from the parent has the label of the last element of the path.
+func newPatchNode(g graph.Graph, parent graph.Node, path NodePath, docNode *DocNode) graph.Node {
+	props := make(map[string]interface{}, len(docNode.Properties))
+	for k, v := range docNode.Properties {
+		props[k] = patchPropertyValue(v)
+	}
+	node := g.NewNode(docNode.Labels, props)
+	if parent != nil && len(path) > 0 {
+		g.NewEdge(parent, node, path[len(path)-1].edgeLabel(), nil)
+	}
+	return node
+}
+
+// patchPropertyValue converts a change set value to a property value.
+// Slices unmarshaled from JSON are []interface{}.
+func patchPropertyValue(v interface{}) *ls.PropertyValue {
+	switch t := v.(type) {
+	case string:
+		return ls.StringPropertyValue(t)
+	case []string:
+		return ls.StringSlicePropertyValue(t)
+	case []interface{}:
+		s := make([]string, 0, len(t))
+		for _, x := range t {
+			s = append(s, fmt.Sprint(x))
+		}
+		return ls.StringSlicePropertyValue(s)
+	}
+	return ls.StringPropertyValue(fmt.Sprint(v))
+}
@@ -202,6 +202,20 @@ type Renderer struct {
 	Options          Options
 	NodeSelectorFunc func(graph.Node) bool
 	EdgeSelectorFunc func(graph.Edge) bool
+	// NodeColorFunc returns the fill color for a node. If it returns
+	// empty string, the node is not filled
+	NodeColorFunc func(graph.Node) string
+}
+
+// nodeStyle returns the style attributes for the node
+func (r Renderer) nodeStyle(node graph.Node) string {
+	if r.NodeColorFunc == nil {
+		return ""
+	}
+	if color := r.NodeColorFunc(node); len(color) > 0 {
+		return fmt.Sprintf(" style=filled fillcolor=\"%s\" ", color)
+	}
+	return ""
 }
 
 // escapeForDot escapes double quotes and backslashes, and replaces Graphviz's
@@ -229,7 +243,7 @@ func (r Renderer) NodeBoxRenderer(ID string, node graph.Node, wr io.Writer) (boo
 		return true
 	})
 
-	io.WriteString(wr, fmt.Sprintf("%s [shape=box %s label=\"%s\"];\n", ID, r.Options.Font.String(), label.String()))
+	io.WriteString(wr, fmt.Sprintf("%s [shape=box %s%s label=\"%s\"];\n", ID, r.Options.Font.String(), r.nodeStyle(node), label.String()))
 
 	return true, nil
 }
@@ -237,6 +251,11 @@ func (r Renderer) NodeBoxRenderer(ID string, node graph.Node, wr io.Writer) (boo
 func (r Renderer) NodeTableRenderer(ID string, node graph.Node, wr io.Writer) (bool, error) {
 	to := r.Options.Table
 	to.ID = ID
+	if r.NodeColorFunc != nil {
+		if color := r.NodeColorFunc(node); len(color) > 0 {
+			to.BGColor = color
+		}
+	}
 	io.WriteString(wr, fmt.Sprintf("%s [shape=plaintext label=<", ID))
 	io.WriteString(wr, to.String())
 
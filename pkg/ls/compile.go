@@ -70,6 +70,7 @@ func (d *DefaultCompiledGraph) PutCompiledSchema(context *Context, ref string, l
 	newLayer := NewLayerInGraph(d.g)
 	newLayer.SetID(layer.GetID())
 	newLayer.SetLayerType(SchemaTerm)
+	newLayer.SetExtends(layer.GetExtends())
 	// attributeMap keeps track of copied attribute nodes. Key belongs
 	// to layer, value belongs to d.g
 	attributeMap := make(map[graph.Node]graph.Node)
@@ -148,6 +149,9 @@ type Compiler struct {
 type compilerContext struct {
 	loadedSchemas map[string]*Layer
 	blankNodeID   uint
+	// extending contains the IDs of the schemas whose extensions are
+	// being resolved, used to detect cycles
+	extending map[string]struct{}
 }
 
 func (c *compilerContext) blankNodeNamer(node graph.Node) {
@@ -165,10 +169,74 @@ func (compiler Compiler) loadSchema(ctx *compilerContext, ref string) (*Layer, e
 	if err != nil {
 		return nil, err
 	}
+	// If the loader does not support versioned references, load
+	// using the ID and check the version
+	if id, constraint := SplitVersionedRef(ref); layer == nil && len(constraint) > 0 {
+		layer, err = compiler.Loader.LoadSchema(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if layer != nil {
+		if err := layer.CheckVersion(ref); err != nil {
+			return nil, err
+		}
+		layer, err = compiler.resolveExtends(ctx, layer)
+		if err != nil {
+			return nil, err
+		}
+	}
 	ctx.loadedSchemas[ref] = layer
 	return layer, nil
 }
 
+// resolveExtends returns the schema with its base schema extension
+// applied. If the schema does not extend another schema, it is
+// returned unmodified.
+func (compiler Compiler) resolveExtends(ctx *compilerContext, layer *Layer) (*Layer, error) {
+	baseRef := layer.GetExtends()
+	if len(baseRef) == 0 {
+		return layer, nil
+	}
+	if ctx.extending == nil {
+		ctx.extending = make(map[string]struct{})
+	}
+	if _, ok := ctx.extending[layer.GetID()]; ok {
+		return nil, ErrExtendsCycle(layer.GetID())
+	}
+	ctx.extending[layer.GetID()] = struct{}{}
+	defer delete(ctx.extending, layer.GetID())
+	base, err := compiler.loadSchema(ctx, baseRef)
+	if err != nil {
+		return nil, err
+	}
+	if base == nil {
+		return nil, ErrNotFound(baseRef)
+	}
+	return ExtendLayer(base, layer)
+}
+
+// ResolveExtends returns the schema with its base schema extension
+// applied, loading the base schemas using the compiler loader. The
+// returned schema no longer extends another schema, so overlays
+// can be composed with the inherited attributes before the schema
+// is compiled. If the schema does not extend another schema, it is
+// returned unmodified.
+func (compiler Compiler) ResolveExtends(layer *Layer) (*Layer, error) {
+	if len(layer.GetExtends()) == 0 {
+		return layer, nil
+	}
+	ctx := &compilerContext{
+		loadedSchemas: make(map[string]*Layer),
+	}
+	ret, err := compiler.resolveExtends(ctx, layer)
+	if err != nil {
+		return nil, err
+	}
+	ret.SetExtends("")
+	return ret, nil
+}
+
 // Compile compiles the schema by resolving all references and
 // building all compositions.
 func (compiler *Compiler) Compile(context *Context, ref string) (*Layer, error) {
@@ -181,8 +249,13 @@ func (compiler *Compiler) Compile(context *Context, ref string) (*Layer, error)
 // CompileSchema compiles the loaded schema
 func (compiler *Compiler) CompileSchema(context *Context, schema *Layer) (*Layer, error) {
 	ctx := &compilerContext{
-		loadedSchemas: map[string]*Layer{schema.GetID(): schema},
+		loadedSchemas: map[string]*Layer{},
+	}
+	schema, err := compiler.resolveExtends(ctx, schema)
+	if err != nil {
+		return nil, err
 	}
+	ctx.loadedSchemas[schema.GetID()] = schema
 	return compiler.compile(context, ctx, schema.GetID())
 }
 
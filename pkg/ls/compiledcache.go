@@ -0,0 +1,264 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+)
+
+// compiledCacheFormat is incremented when the format of the cached
+// graphs change, or when compilation changes in a way that
+// invalidates cached graphs
+const compiledCacheFormat = "1"
+
+// lsaModule is the module path of this package
+const lsaModule = "github.com/cloudprivacylabs/lsa"
+
+// LSAVersion returns the version of the LSA module linked into the
+// running binary. Returns "(devel)" for development builds.
+func LSAVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(devel)"
+	}
+	if info.Main.Path == lsaModule {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == lsaModule {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "(devel)"
+}
+
+// lsaBuild returns the version of the LSA module, and for
+// development builds, the VCS revision and modification flag of the
+// build, so rebuilding from a different source tree invalidates
+// cached schemas.
+func lsaBuild() []string {
+	version := LSAVersion()
+	ret := []string{version}
+	if len(version) > 0 && version != "(devel)" {
+		return ret
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ret
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision", "vcs.modified":
+			ret = append(ret, setting.Key, setting.Value)
+		}
+	}
+	return ret
+}
+
+// CompiledSchemaCacheKey computes the key of a compiled schema from
+// everything that contributes to it. The key includes the LSA
+// version, so upgrades invalidate cached schemas.
+type CompiledSchemaCacheKey struct {
+	h hash.Hash
+}
+
+// NewCompiledSchemaCacheKey returns a new key. The key includes the
+// context options that affect compilation.
+func NewCompiledSchemaCacheKey(context *Context) *CompiledSchemaCacheKey {
+	ret := &CompiledSchemaCacheKey{h: sha256.New()}
+	ret.AddString(compiledCacheFormat)
+	ret.AddString(lsaBuild()...)
+	ret.AddString(string(context.GetConflictPolicy()), fmt.Sprint(context.IsProvenanceEnabled()))
+	return ret
+}
+
+// AddString adds strings to the key
+func (k *CompiledSchemaCacheKey) AddString(s ...string) {
+	for _, x := range s {
+		k.add([]byte(x))
+	}
+}
+
+// AddFile adds the name and the contents of a file to the key
+func (k *CompiledSchemaCacheKey) AddFile(name string, data []byte) {
+	k.add([]byte(name))
+	k.add(data)
+}
+
+// add writes the length of the data before the data so different
+// splits of the same bytes produce different keys
+func (k *CompiledSchemaCacheKey) add(data []byte) {
+	var l [8]byte
+	n := uint64(len(data))
+	for i := range l {
+		l[i] = byte(n >> (8 * i))
+	}
+	k.h.Write(l[:])
+	k.h.Write(data)
+}
+
+// String returns the hex encoded key
+func (k *CompiledSchemaCacheKey) String() string {
+	return hex.EncodeToString(k.h.Sum(nil))
+}
+
+// CompiledSchemaCache is an on-disk cache of compiled schema
+// graphs. Each entry is a file in the cache directory named by the
+// cache key, containing the compiled graph and the ID of the
+// compiled schema.
+type CompiledSchemaCache struct {
+	Dir string
+}
+
+type compiledCacheEntry struct {
+	LayerID string          `json:"layerId"`
+	Graph   json.RawMessage `json:"graph"`
+}
+
+// DefaultCompiledSchemaCacheDir returns the directory of the
+// compiled schema cache. This is $LSA_CACHE_DIR if set, or the
+// lsa/compiled directory under the user cache directory.
+func DefaultCompiledSchemaCacheDir() (string, error) {
+	if dir := os.Getenv("LSA_CACHE_DIR"); len(dir) > 0 {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "lsa", "compiled"), nil
+}
+
+// DefaultCompiledSchemaCache returns the cache under the default
+// cache directory. Returns nil if there is no default cache
+// directory.
+func DefaultCompiledSchemaCache() *CompiledSchemaCache {
+	dir, err := DefaultCompiledSchemaCacheDir()
+	if err != nil {
+		return nil
+	}
+	return &CompiledSchemaCache{Dir: dir}
+}
+
+func (c *CompiledSchemaCache) file(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
+
+// Get returns the compiled schema for the key. Returns nil if the
+// schema is not in the cache. The terms of the returned schema are
+// compiled.
+func (c *CompiledSchemaCache) Get(context *Context, key string) (*Layer, error) {
+	data, err := ioutil.ReadFile(c.file(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entry compiledCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	g := NewLayerGraph()
+	if err := NewJSONMarshaler(context.GetInterner()).Unmarshal(entry.Graph, g); err != nil {
+		return nil, err
+	}
+	for _, layer := range LayersFromGraph(g) {
+		if layer.GetID() == entry.LayerID {
+			if err := CompileTerms(layer); err != nil {
+				return nil, err
+			}
+			return layer, nil
+		}
+	}
+	return nil, nil
+}
+
+// Put writes the compiled graph of the schema to the cache
+func (c *CompiledSchemaCache) Put(key string, layer *Layer) error {
+	marshaler := JSONMarshaler{}
+	g, err := marshaler.Marshal(layer.Graph)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(compiledCacheEntry{LayerID: layer.GetID(), Graph: g})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so concurrent readers do not
+	// see partial entries
+	f, err := ioutil.TempFile(c.Dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), c.file(key))
+}
+
+// Clear removes all cached schemas
+func (c *CompiledSchemaCache) Clear() error {
+	err := os.RemoveAll(c.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Compile returns the compiled schema for the key from the cache. If
+// the schema is not in the cache, calls compile and writes the
+// result to the cache. Cache errors are logged and otherwise
+// ignored. A nil cache always calls compile.
+func (c *CompiledSchemaCache) Compile(context *Context, key string, compile func() (*Layer, error)) (*Layer, error) {
+	if c == nil {
+		return compile()
+	}
+	layer, err := c.Get(context, key)
+	if err != nil {
+		context.GetLogger().Debug(map[string]interface{}{"compiledSchemaCache": key, "error": err.Error()})
+	}
+	if layer != nil {
+		return layer, nil
+	}
+	layer, err = compile()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Put(key, layer); err != nil {
+		context.GetLogger().Debug(map[string]interface{}{"compiledSchemaCache": key, "error": err.Error()})
+	}
+	return layer, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCompiledSchemaCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compiled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var v interface{}
+	json.Unmarshal([]byte(`{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "ls:Schema",
+  "@id": "http://person/schema",
+  "ls:valueType": "Person",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "http://person",
+    "ls:Object/attributes": [
+      {"@id": "firstName", "@type": "ls:Value", "ls:attributeName": "firstName"}
+    ]
+  }
+}`), &v)
+	schema, err := UnmarshalLayer(v, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nCompiled := 0
+	compile := func() (*Layer, error) {
+		nCompiled++
+		compiler := Compiler{
+			Loader: SchemaLoaderFunc(func(string) (*Layer, error) { return schema, nil }),
+		}
+		return compiler.Compile(DefaultContext(), schema.GetID())
+	}
+
+	key := NewCompiledSchemaCacheKey(DefaultContext())
+	key.AddFile("schema.json", []byte("1"))
+	key2 := NewCompiledSchemaCacheKey(DefaultContext())
+	key2.AddFile("schema.json", []byte("2"))
+	if key.String() == key2.String() {
+		t.Errorf("Same key for different contents")
+	}
+	key3 := NewCompiledSchemaCacheKey(DefaultContext().SetProvenance(true))
+	key3.AddFile("schema.json", []byte("1"))
+	if key.String() == key3.String() {
+		t.Errorf("Same key with provenance")
+	}
+
+	cache := &CompiledSchemaCache{Dir: dir}
+	if l, err := cache.Get(DefaultContext(), key.String()); l != nil || err != nil {
+		t.Errorf("Expecting cache miss: %v %v", l, err)
+	}
+	for i := 0; i < 2; i++ {
+		l, err := cache.Compile(DefaultContext(), key.String(), compile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.GetID() != schema.GetID() || l.GetAttributeByID("firstName") == nil {
+			t.Errorf("Wrong compiled schema")
+		}
+		if s := AsPropertyValue(l.GetSchemaRootNode().GetProperty(EntitySchemaTerm)).AsString(); s != schema.GetID() {
+			t.Errorf("Wrong entity schema: %s", s)
+		}
+	}
+	if nCompiled != 1 {
+		t.Errorf("Compiled %d times", nCompiled)
+	}
+	if _, err := cache.Compile(DefaultContext(), key2.String(), compile); err != nil {
+		t.Fatal(err)
+	}
+	if nCompiled != 2 {
+		t.Errorf("Changed key did not recompile")
+	}
+
+	if err := cache.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := cache.Get(DefaultContext(), key.String()); l != nil {
+		t.Errorf("Cache not cleared")
+	}
+}
@@ -15,11 +15,15 @@
 package ls
 
 import (
+	"fmt"
+
 	"github.com/cloudprivacylabs/opencypher/graph"
 )
 
 // Compose schema layers. Directly modifies the source and the
-// target. The source must be an overlay.
+// target. The source must be an overlay. If provenance is enabled in
+// the context, the layers contributing to the values of each term
+// are recorded in the ProvenanceTerm of the attributes.
 func (layer *Layer) Compose(context *Context, source *Layer) error {
 	if source.GetLayerType() != OverlayTerm {
 		return ErrCompositionSourceNotOverlay
@@ -33,6 +37,17 @@ func (layer *Layer) Compose(context *Context, source *Layer) error {
 		}
 	}
 	sourceCompose := AsPropertyValue(source.GetLayerRootNode().GetProperty(ComposeTerm)).AsString()
+	sourceLayerID := source.GetID()
+	if context.IsProvenanceEnabled() {
+		// Values without provenance come from the target layer
+		layer.ForEachAttribute(func(node graph.Node, _ []graph.Node) bool {
+			initProvenance(node, layer.GetID())
+			return true
+		})
+		for _, node := range layer.GetOverlayAttributes() {
+			initProvenance(node, layer.GetID())
+		}
+	}
 	nodeMap := make(map[graph.Node]graph.Node)
 	var err error
 
@@ -48,6 +63,17 @@ func (layer *Layer) Compose(context *Context, source *Layer) error {
 		}
 	}
 
+	// Guarded source attributes are not composed. They are added as
+	// conditional annotations to the target attributes.
+	addConditional := func(targetNode, sourceNode graph.Node) bool {
+		guard := source.GetAttributeGuard(sourceNode)
+		if len(guard) == 0 {
+			return false
+		}
+		AddConditionalAnnotations(targetNode, sourceNode, guard)
+		return true
+	}
+
 	processedSourceNodes := make(map[graph.Node]struct{})
 	// Process overlay attributes first
 	targetOverlayAttrs := make(map[string]graph.Node)
@@ -60,17 +86,21 @@ func (layer *Layer) Compose(context *Context, source *Layer) error {
 	}
 	for srcId, srcAttr := range sourceOverlayAttrs {
 		if tgt, ok := targetOverlayAttrs[srcId]; ok {
-			// Compose target
-			if err = mergeNodes(context, layer, tgt, srcAttr, sourceCompose, processedSourceNodes); err != nil {
-				return err
+			// The target overlay attribute is the attribute with this
+			// ID, so it is composed only once
+			if !addConditional(tgt, srcAttr) {
+				if err = mergeNodes(context, layer, tgt, srcAttr, sourceCompose, sourceLayerID, processedSourceNodes); err != nil {
+					return err
+				}
+				copySubtree(tgt, srcAttr)
 			}
-			copySubtree(tgt, srcAttr)
+			continue
 		}
 		targetNode, _ := layer.FindAttributeByID(srcId)
-		if targetNode == nil {
+		if targetNode == nil || addConditional(targetNode, srcAttr) {
 			continue
 		}
-		if err = mergeNodes(context, layer, targetNode, srcAttr, sourceCompose, processedSourceNodes); err != nil {
+		if err = mergeNodes(context, layer, targetNode, srcAttr, sourceCompose, sourceLayerID, processedSourceNodes); err != nil {
 			return err
 		}
 		copySubtree(targetNode, srcAttr)
@@ -90,8 +120,8 @@ func (layer *Layer) Compose(context *Context, source *Layer) error {
 		targetNode, targetPath := layer.FindAttributeByID(sourceID)
 		if targetNode != nil {
 			// Target node exists. Merge if paths match
-			if pathsMatch(targetPath, sourcePath) {
-				if err = mergeNodes(context, layer, targetNode, sourceNode, sourceCompose, processedSourceNodes); err != nil {
+			if pathsMatch(targetPath, sourcePath) && !addConditional(targetNode, sourceNode) {
+				if err = mergeNodes(context, layer, targetNode, sourceNode, sourceCompose, sourceLayerID, processedSourceNodes); err != nil {
 					return false
 				}
 				// Add any annotation subtrees
@@ -99,6 +129,11 @@ func (layer *Layer) Compose(context *Context, source *Layer) error {
 			}
 		} else {
 			// Target node does not exist.
+			// Attributes cannot be added conditionally
+			if len(source.GetAttributeGuard(sourceNode)) > 0 {
+				err = fmt.Errorf("%w: guarded attribute %s does not exist in %s", ErrInvalidComposition, sourceID, layer.GetID())
+				return false
+			}
 			// Parent node must exist, because this is a depth-first algorithm
 			if len(sourcePath) <= 1 {
 				err = ErrInvalidComposition
@@ -112,6 +147,9 @@ func (layer *Layer) Compose(context *Context, source *Layer) error {
 			}
 
 			newNode := CopySchemaNodeIntoGraph(layer.Graph, sourceNode)
+			if context.IsProvenanceEnabled() {
+				initProvenance(newNode, sourceLayerID)
+			}
 			for edges := sourceNode.GetEdges(graph.IncomingEdge); edges.Next(); {
 				edge := edges.Edge()
 				if edge.GetFrom() == parent {
@@ -128,8 +166,9 @@ func (layer *Layer) Compose(context *Context, source *Layer) error {
 	return nil
 }
 
-// Merge source into target.
-func mergeNodes(context *Context, targetLayer *Layer, target, source graph.Node, sourceCompose string, processedSourceNodes map[graph.Node]struct{}) error {
+// Merge source into target. sourceLayerID is used to record
+// provenance.
+func mergeNodes(context *Context, targetLayer *Layer, target, source graph.Node, sourceCompose, sourceLayerID string, processedSourceNodes map[graph.Node]struct{}) error {
 	if _, processed := processedSourceNodes[source]; processed {
 		return nil
 	}
@@ -149,10 +188,17 @@ func mergeNodes(context *Context, targetLayer *Layer, target, source graph.Node,
 			if p, ok := value.(*PropertyValue); ok {
 				tp, _ := target.GetProperty(key)
 				targetProperty, _ := tp.(*PropertyValue)
+				comp := cType
 				newValue, err := cType.Compose(targetProperty, p)
 				if err != nil {
-					retErr = err
-					return false
+					newValue, comp, err = resolveConflict(context, target, key, comp, targetLayer.GetID(), sourceLayerID, targetProperty, p, err)
+					if err != nil {
+						retErr = err
+						return false
+					}
+				}
+				if context.IsProvenanceEnabled() {
+					recordProvenance(target, key, comp, targetLayer.GetID(), sourceLayerID, targetProperty, p)
 				}
 				target.SetProperty(key, newValue)
 			}
@@ -160,11 +206,7 @@ func mergeNodes(context *Context, targetLayer *Layer, target, source graph.Node,
 		})
 		return retErr
 	}
-	if err := ComposeProperties(context, target, source); err != nil {
-		return err
-	}
-
-	return nil
+	return composeProperties(context, target, source, targetLayer.GetID(), sourceLayerID)
 }
 
 // ComposeProperty composes targetValue and sourceValue for key
@@ -178,17 +220,39 @@ func ComposeProperty(context *Context, key string, targetValue, sourceValue *Pro
 }
 
 // ComposeProperties will combine the properties in source to
-// target. The target properties will be modified directly
+// target. The target properties will be modified directly. If
+// provenance is enabled in the context, the contributing layers are
+// found from the graphs of the target and the source nodes.
 func ComposeProperties(context *Context, target, source graph.Node) error {
+	var targetLayerID, sourceLayerID string
+	if context.IsProvenanceEnabled() {
+		targetLayerID = getLayerIDOfNode(target)
+		sourceLayerID = getLayerIDOfNode(source)
+	}
+	return composeProperties(context, target, source, targetLayerID, sourceLayerID)
+}
+
+func composeProperties(context *Context, target, source graph.Node, targetLayerID, sourceLayerID string) error {
 	var retErr error
 	source.ForEachProperty(func(key string, value interface{}) bool {
 		if p, ok := value.(*PropertyValue); ok {
 			tp, _ := target.GetProperty(key)
 			targetProperty, _ := tp.(*PropertyValue)
+			comp := GetTermInfo(key).Composition
+			if len(comp) == 0 {
+				// Unknown terms use set composition
+				comp = SetComposition
+			}
 			newValue, err := ComposeProperty(context, key, targetProperty, p)
 			if err != nil {
-				retErr = err
-				return false
+				newValue, comp, err = resolveConflict(context, target, key, comp, targetLayerID, sourceLayerID, targetProperty, p, err)
+				if err != nil {
+					retErr = err
+					return false
+				}
+			}
+			if context.IsProvenanceEnabled() && len(sourceLayerID) > 0 {
+				recordProvenance(target, key, comp, targetLayerID, sourceLayerID, targetProperty, p)
 			}
 			target.SetProperty(key, newValue)
 		}
@@ -0,0 +1,157 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+// ConflictPolicy determines how composition conflicts are resolved. A
+// composition conflict happens when two layers set different values
+// for a term with ErrorComposition.
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyError fails composition on conflict. This is the
+	// default.
+	ConflictPolicyError ConflictPolicy = "error"
+	// ConflictPolicyPreferLater uses the value of the layer composed
+	// later
+	ConflictPolicyPreferLater ConflictPolicy = "preferLater"
+	// ConflictPolicyPreferEarlier keeps the existing value. Since the
+	// schema is composed first, this prefers the schema value over
+	// overlays.
+	ConflictPolicyPreferEarlier ConflictPolicy = "preferEarlier"
+)
+
+// ErrUnknownConflictPolicy is returned if a conflict policy cannot be
+// parsed
+type ErrUnknownConflictPolicy string
+
+func (e ErrUnknownConflictPolicy) Error() string {
+	return "Unknown conflict policy: " + string(e)
+}
+
+// ParseConflictPolicy parses a conflict policy. Empty string is the
+// default error policy. "preferSchema" is accepted as a synonym of
+// "preferEarlier".
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch s {
+	case "", string(ConflictPolicyError):
+		return ConflictPolicyError, nil
+	case string(ConflictPolicyPreferLater):
+		return ConflictPolicyPreferLater, nil
+	case string(ConflictPolicyPreferEarlier), "preferSchema":
+		return ConflictPolicyPreferEarlier, nil
+	}
+	return "", ErrUnknownConflictPolicy(s)
+}
+
+// CompositionConflict describes a term of an attribute that was set
+// to different values by different layers
+type CompositionConflict struct {
+	Term        string      `json:"term"`
+	AttributeID string      `json:"attributeId"`
+	TargetValue interface{} `json:"targetValue"`
+	SourceValue interface{} `json:"sourceValue"`
+	// TargetLayers are the layers that contributed the existing
+	// value. This is only known if the target layer ID is known, or if
+	// provenance is enabled.
+	TargetLayers []string `json:"targetLayers,omitempty"`
+	SourceLayer  string   `json:"sourceLayer,omitempty"`
+}
+
+func (c CompositionConflict) Error() string {
+	return fmt.Sprintf("Composition conflict for %s of %s: %v (%s) vs. %v (%s)", c.Term, c.AttributeID, c.TargetValue, strings.Join(c.TargetLayers, ","), c.SourceValue, c.SourceLayer)
+}
+
+func (c CompositionConflict) Unwrap() error { return ErrInvalidComposition }
+
+// CompositionConflicts collects composition conflicts. If a
+// CompositionConflicts is set in the context, composition does not
+// fail on conflicts, and records them instead.
+type CompositionConflicts struct {
+	sync.Mutex
+	conflicts []CompositionConflict
+}
+
+// Add a new conflict
+func (c *CompositionConflicts) Add(conflict CompositionConflict) {
+	c.Lock()
+	defer c.Unlock()
+	c.conflicts = append(c.conflicts, conflict)
+}
+
+// All returns all recorded conflicts
+func (c *CompositionConflicts) All() []CompositionConflict {
+	c.Lock()
+	defer c.Unlock()
+	ret := make([]CompositionConflict, len(c.conflicts))
+	copy(ret, c.conflicts)
+	return ret
+}
+
+// Len returns the number of recorded conflicts
+func (c *CompositionConflicts) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.conflicts)
+}
+
+// resolveConflict is called when composing a term of target fails
+// with err. If err is a composition conflict, it is recorded and
+// resolved based on the conflict policy of the context. Returns the
+// value to set, and the composition type to record as provenance.
+func resolveConflict(context *Context, target graph.Node, term string, comp CompositionType, targetLayerID, sourceLayerID string, targetValue, sourceValue *PropertyValue, err error) (*PropertyValue, CompositionType, error) {
+	if !errors.Is(err, ErrInvalidComposition) {
+		return nil, comp, err
+	}
+	conflict := CompositionConflict{
+		Term:        term,
+		AttributeID: GetNodeID(target),
+		SourceLayer: sourceLayerID,
+	}
+	if targetValue != nil {
+		conflict.TargetValue = targetValue.GetNativeValue()
+	}
+	if sourceValue != nil {
+		conflict.SourceValue = sourceValue.GetNativeValue()
+	}
+	if entry, ok := GetTermProvenance(target, term); ok {
+		conflict.TargetLayers = entry.Layers
+	} else if len(targetLayerID) > 0 {
+		conflict.TargetLayers = []string{targetLayerID}
+	}
+	recorder := context.GetConflictRecorder()
+	if recorder != nil {
+		recorder.Add(conflict)
+	}
+	switch context.GetConflictPolicy() {
+	case ConflictPolicyPreferLater:
+		return sourceValue, OverrideComposition, nil
+	case ConflictPolicyPreferEarlier:
+		return targetValue, NoComposition, nil
+	}
+	if recorder != nil {
+		// Dry run: keep the existing value and continue
+		return targetValue, NoComposition, nil
+	}
+	return nil, comp, conflict
+}
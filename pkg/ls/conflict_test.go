@@ -0,0 +1,140 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var testConflictTerm = NewTerm("https://test.org/", "code", false, false, ErrorComposition, nil)
+
+func TestCompositionConflicts(t *testing.T) {
+	layer := func(s string) *Layer {
+		var v interface{}
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			t.Fatal(err)
+		}
+		l, err := UnmarshalLayer(v, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	layers := func() (*Layer, *Layer, *Layer) {
+		schema := layer(`{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "ls:Schema",
+  "@id": "http://schema",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "root",
+    "ls:Object/attributes": [
+      {"@id": "attr1", "@type": "ls:Value", "ls:attributeName": "a", "https://test.org/code": "s"},
+      {"@id": "attr2", "@type": "ls:Value", "ls:attributeName": "b"}
+    ]
+  }
+}`)
+		ovl1 := layer(`{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "ls:Overlay",
+  "@id": "http://ovl1",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "root",
+    "ls:Object/attributes": [
+      {"@id": "attr1", "@type": "ls:Value", "https://test.org/code": "o1"},
+      {"@id": "attr2", "@type": "ls:Value", "https://test.org/code": "o1"}
+    ]
+  }
+}`)
+		ovl2 := layer(`{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "ls:Overlay",
+  "@id": "http://ovl2",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "root",
+    "ls:Object/attributes": [
+      {"@id": "attr2", "@type": "ls:Value", "https://test.org/code": "o2"}
+    ]
+  }
+}`)
+		return schema, ovl1, ovl2
+	}
+	value := func(l *Layer, attr string) string {
+		return AsPropertyValue(l.GetAttributeByID(attr).GetProperty(testConflictTerm)).AsString()
+	}
+
+	// Default policy fails on the first conflict
+	schema, ovl1, _ := layers()
+	err := schema.Compose(DefaultContext(), ovl1)
+	if !errors.Is(err, ErrInvalidComposition) {
+		t.Errorf("Expecting composition error, got %v", err)
+	}
+
+	// Dry run collects all conflicts
+	schema, ovl1, ovl2 := layers()
+	conflicts := &CompositionConflicts{}
+	ctx := DefaultContext().SetProvenance(true).SetConflictRecorder(conflicts)
+	if err := schema.Compose(ctx, ovl1); err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.Compose(ctx, ovl2); err != nil {
+		t.Fatal(err)
+	}
+	expected := []CompositionConflict{
+		{Term: testConflictTerm, AttributeID: "attr1", TargetValue: "s", SourceValue: "o1", TargetLayers: []string{"http://schema"}, SourceLayer: "http://ovl1"},
+		{Term: testConflictTerm, AttributeID: "attr2", TargetValue: "o1", SourceValue: "o2", TargetLayers: []string{"http://ovl1"}, SourceLayer: "http://ovl2"},
+	}
+	if !reflect.DeepEqual(conflicts.All(), expected) {
+		t.Errorf("Wrong conflicts: %+v", conflicts.All())
+	}
+	if value(schema, "attr1") != "s" || value(schema, "attr2") != "o1" {
+		t.Errorf("Dry run changed values")
+	}
+
+	// Prefer later
+	schema, ovl1, ovl2 = layers()
+	ctx = DefaultContext().SetConflictPolicy(ConflictPolicyPreferLater)
+	if err := schema.Compose(ctx, ovl1); err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.Compose(ctx, ovl2); err != nil {
+		t.Fatal(err)
+	}
+	if value(schema, "attr1") != "o1" || value(schema, "attr2") != "o2" {
+		t.Errorf("preferLater failed: %s %s", value(schema, "attr1"), value(schema, "attr2"))
+	}
+
+	// Prefer schema
+	schema, ovl1, ovl2 = layers()
+	policy, err := ParseConflictPolicy("preferSchema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = DefaultContext().SetConflictPolicy(policy)
+	if err := schema.Compose(ctx, ovl1); err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.Compose(ctx, ovl2); err != nil {
+		t.Fatal(err)
+	}
+	if value(schema, "attr1") != "s" || value(schema, "attr2") != "o1" {
+		t.Errorf("preferSchema failed: %s %s", value(schema, "attr1"), value(schema, "attr2"))
+	}
+}
@@ -6,8 +6,12 @@ import (
 
 type Context struct {
 	context.Context
-	logger   Logger
-	interner Interner
+	logger     Logger
+	interner   Interner
+	provenance bool
+
+	conflictPolicy ConflictPolicy
+	conflicts      *CompositionConflicts
 }
 
 func (ctx *Context) GetLogger() Logger {
@@ -22,6 +26,61 @@ func (ctx *Context) SetLogger(log Logger) *Context {
 	return ctx
 }
 
+// SetProvenance enables or disables recording composition
+// provenance. If enabled, layer composition records the layers that
+// contributed the values of each term of an attribute.
+func (ctx *Context) SetProvenance(enabled bool) *Context {
+	ctx.provenance = enabled
+	return ctx
+}
+
+// IsProvenanceEnabled returns true if composition provenance should
+// be recorded
+func (ctx *Context) IsProvenanceEnabled() bool {
+	return ctx != nil && ctx.provenance
+}
+
+// SetConflictPolicy sets how composition conflicts are resolved
+func (ctx *Context) SetConflictPolicy(policy ConflictPolicy) *Context {
+	ctx.conflictPolicy = policy
+	return ctx
+}
+
+// GetConflictPolicy returns the composition conflict policy. Empty
+// policy means ConflictPolicyError.
+func (ctx *Context) GetConflictPolicy() ConflictPolicy {
+	if ctx == nil {
+		return ""
+	}
+	return ctx.conflictPolicy
+}
+
+// WithConflictPolicy returns a copy of the context with the given
+// conflict policy
+func (ctx *Context) WithConflictPolicy(policy ConflictPolicy) *Context {
+	ret := *ctx
+	ret.conflictPolicy = policy
+	return &ret
+}
+
+// SetConflictRecorder sets the recorder for composition
+// conflicts. When set, composition does not fail on conflicts. All
+// conflicts are recorded and the existing values are kept unless the
+// conflict policy says otherwise. This can be used to dry-run
+// composition.
+func (ctx *Context) SetConflictRecorder(conflicts *CompositionConflicts) *Context {
+	ctx.conflicts = conflicts
+	return ctx
+}
+
+// GetConflictRecorder returns the conflict recorder, or nil
+func (ctx *Context) GetConflictRecorder() *CompositionConflicts {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.conflicts
+}
+
 func (ctx *Context) GetInterner() Interner {
 	return ctx.interner
 }
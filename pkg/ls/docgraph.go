@@ -42,7 +42,8 @@ func (e EntityInfo) GetValueType() []string {
 }
 
 // GetEntityRootNodes returns all the nodes that are entity roots,
-// i.e. nodes containing EntitySchemaTerm
+// i.e. nodes containing EntitySchemaTerm. Use an EntityIndex to
+// look up entities by ID.
 func GetEntityRootNodes(g graph.Graph) map[graph.Node]EntityInfo {
 	ret := make(map[graph.Node]EntityInfo)
 	for nodes := g.GetNodesWithProperty(EntitySchemaTerm); nodes.Next(); {
@@ -0,0 +1,189 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"strings"
+
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+// EntityIndex indexes the entity root nodes of a document graph by
+// (value type, entity ID) and (entity schema, entity ID). The
+// GraphBuilder maintains an entity index incrementally as it creates
+// entity roots and sets entity IDs. If the graph is modified by
+// other means, the index can be rebuilt using
+// NewEntityIndexFromGraph, or updated using Add and Remove.
+type EntityIndex struct {
+	entities map[graph.Node]EntityInfo
+	// The index keys of each entity root
+	keys  map[graph.Node][]entityIndexKey
+	index map[entityIndexKey][]graph.Node
+	// The keys that have more than one entity root
+	duplicated map[entityIndexKey]struct{}
+	// The entity roots added or changed since they were last taken,
+	// and the order they are changed
+	changed      map[graph.Node]struct{}
+	changedOrder []graph.Node
+}
+
+type entityIndexKey struct {
+	// Value type or entity schema
+	typeName string
+	id       string
+}
+
+// makeEntityIndexID encodes an ID tuple as a string
+func makeEntityIndexID(id []string) string {
+	return strings.Join(id, "\x00")
+}
+
+// NewEntityIndex returns an empty entity index
+func NewEntityIndex() *EntityIndex {
+	return &EntityIndex{
+		entities:   make(map[graph.Node]EntityInfo),
+		keys:       make(map[graph.Node][]entityIndexKey),
+		index:      make(map[entityIndexKey][]graph.Node),
+		duplicated: make(map[entityIndexKey]struct{}),
+		changed:    make(map[graph.Node]struct{}),
+	}
+}
+
+// NewEntityIndexFromGraph returns an entity index containing all the
+// entity roots of the graph
+func NewEntityIndexFromGraph(g graph.Graph) *EntityIndex {
+	ret := NewEntityIndex()
+	for nodes := g.GetNodesWithProperty(EntitySchemaTerm); nodes.Next(); {
+		ret.Add(nodes.Node())
+	}
+	return ret
+}
+
+// Add adds the entity root node to the index, or updates the index
+// entries of the node if it is already in the index. This must be
+// called when the entity ID of the node changes. Nodes without an
+// entity schema are ignored.
+func (ix *EntityIndex) Add(root graph.Node) {
+	sch := AsPropertyValue(root.GetProperty(EntitySchemaTerm)).AsString()
+	if len(sch) == 0 {
+		return
+	}
+	ix.Remove(root)
+	info := EntityInfo{root: root, sch: sch}
+	ix.entities[root] = info
+	ix.markChanged(root)
+	id := info.GetID()
+	if len(id) == 0 {
+		return
+	}
+	idStr := makeEntityIndexID(id)
+	keys := []entityIndexKey{{typeName: sch, id: idStr}}
+	for _, t := range info.GetValueType() {
+		if t != sch {
+			keys = append(keys, entityIndexKey{typeName: t, id: idStr})
+		}
+	}
+	for _, k := range keys {
+		ix.index[k] = append(ix.index[k], root)
+		if len(ix.index[k]) > 1 {
+			ix.duplicated[k] = struct{}{}
+		}
+	}
+	ix.keys[root] = keys
+}
+
+// Remove removes the entity root node from the index
+func (ix *EntityIndex) Remove(root graph.Node) {
+	for _, k := range ix.keys[root] {
+		nodes := ix.index[k]
+		for i := range nodes {
+			if nodes[i] == root {
+				nodes = append(nodes[:i], nodes[i+1:]...)
+				break
+			}
+		}
+		if len(nodes) == 0 {
+			delete(ix.index, k)
+		} else {
+			ix.index[k] = nodes
+		}
+	}
+	delete(ix.keys, root)
+	delete(ix.entities, root)
+	delete(ix.changed, root)
+}
+
+// markChanged records that the entity root is added or changed
+func (ix *EntityIndex) markChanged(root graph.Node) {
+	if _, ok := ix.changed[root]; ok {
+		return
+	}
+	// Removed roots stay in the order until the changes are taken, so
+	// drop them if the changes are not taken for a while
+	if len(ix.changedOrder) > 2*len(ix.changed)+64 {
+		order := make([]graph.Node, 0, len(ix.changed)+1)
+		for _, x := range ix.changedOrder {
+			if _, ok := ix.changed[x]; ok {
+				order = append(order, x)
+			}
+		}
+		ix.changedOrder = order
+	}
+	ix.changed[root] = struct{}{}
+	ix.changedOrder = append(ix.changedOrder, root)
+}
+
+// takeChanged returns the entity roots that are added or changed
+// since the last call, in the order they are changed
+func (ix *EntityIndex) takeChanged() []graph.Node {
+	ret := make([]graph.Node, 0, len(ix.changed))
+	for _, root := range ix.changedOrder {
+		if _, ok := ix.changed[root]; ok {
+			ret = append(ret, root)
+			delete(ix.changed, root)
+		}
+	}
+	ix.changedOrder = nil
+	return ret
+}
+
+// Find returns the entity roots whose value type or entity schema is
+// typeName, and whose entity ID is id. The nodes are returned in the
+// order they are added to the index.
+func (ix *EntityIndex) Find(typeName string, id []string) []graph.Node {
+	if len(id) == 0 {
+		return nil
+	}
+	nodes := ix.index[entityIndexKey{typeName: typeName, id: makeEntityIndexID(id)}]
+	return append([]graph.Node{}, nodes...)
+}
+
+// GetEntityInfo returns the entity information for the root node
+func (ix *EntityIndex) GetEntityInfo(root graph.Node) (EntityInfo, bool) {
+	ret, ok := ix.entities[root]
+	return ret, ok
+}
+
+// GetEntityRootNodes returns all the entity roots in the index. The
+// returned map is the same as the one returned by
+// GetEntityRootNodes for the graph, and must not be modified.
+func (ix *EntityIndex) GetEntityRootNodes() map[graph.Node]EntityInfo {
+	return ix.entities
+}
+
+// Len returns the number of entity roots in the index
+func (ix *EntityIndex) Len() int {
+	return len(ix.entities)
+}
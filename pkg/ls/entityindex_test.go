@@ -0,0 +1,123 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEntityIndex(t *testing.T) {
+	layer, err := ReadLayerFromFile("testdata/link_1/root.json")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compiler := Compiler{
+		Loader: SchemaLoaderFunc(func(ref string) (*Layer, error) {
+			return layer, nil
+		}),
+	}
+	layer, err = compiler.Compile(DefaultContext(), layer.GetID())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	builder := NewGraphBuilder(nil, GraphBuilderOptions{
+		EmbedSchemaNodes: true,
+	})
+	ix := builder.GetEntityIndex()
+	_, root1, _ := builder.ObjectAsNode(layer.GetSchemaRootNode(), nil)
+	builder.ValueAsNode(layer.GetAttributeByID("https://idField"), root1, "123")
+	_, root2, _ := builder.ObjectAsNode(layer.GetSchemaRootNode(), nil)
+	if ix.Len() != 2 {
+		t.Errorf("Expecting 2 entities, got %d", ix.Len())
+	}
+	if nodes := ix.Find("https://root", []string{"123"}); len(nodes) != 1 || nodes[0] != root1 {
+		t.Errorf("Wrong result by schema: %v", nodes)
+	}
+	if nodes := ix.Find("root", []string{"123"}); len(nodes) != 1 || nodes[0] != root1 {
+		t.Errorf("Wrong result by value type: %v", nodes)
+	}
+	if nodes := ix.Find("https://root", []string{"456"}); len(nodes) != 0 {
+		t.Errorf("Unexpected result: %v", nodes)
+	}
+
+	// Setting the ID re-indexes the node
+	builder.ValueAsNode(layer.GetAttributeByID("https://idField"), root2, "456")
+	if nodes := ix.Find("https://root", []string{"456"}); len(nodes) != 1 || nodes[0] != root2 {
+		t.Errorf("Wrong result after setting ID: %v", nodes)
+	}
+	root2.SetProperty(EntityIDTerm, StringPropertyValue("123"))
+	ix.Add(root2)
+	if nodes := ix.Find("https://root", []string{"123"}); len(nodes) != 2 {
+		t.Errorf("Expecting 2 nodes: %v", nodes)
+	}
+	if nodes := ix.Find("https://root", []string{"456"}); len(nodes) != 0 {
+		t.Errorf("Stale entry: %v", nodes)
+	}
+
+	ix.Remove(root1)
+	if nodes := ix.Find("https://root", []string{"123"}); len(nodes) != 1 || nodes[0] != root2 {
+		t.Errorf("Wrong result after remove: %v", nodes)
+	}
+	if ix.Len() != 1 {
+		t.Errorf("Expecting 1 entity, got %d", ix.Len())
+	}
+	if NewEntityIndexFromGraph(builder.GetGraph()).Len() != 2 {
+		t.Errorf("Rebuilt index must have 2 entities")
+	}
+}
+
+func TestSharedEntityIndex(t *testing.T) {
+	layer, err := ReadLayerFromFile("testdata/link_1/root.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler := Compiler{
+		Loader: SchemaLoaderFunc(func(ref string) (*Layer, error) {
+			return layer, nil
+		}),
+	}
+	layer, err = compiler.Compile(DefaultContext(), layer.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewDocumentGraph()
+	builder := NewGraphBuilder(g, GraphBuilderOptions{EmbedSchemaNodes: true})
+	_, root, _ := builder.ObjectAsNode(layer.GetSchemaRootNode(), nil)
+	builder.ValueAsNode(layer.GetAttributeByID("https://idField"), root, "0")
+	if builder.entityIndex.index != nil {
+		t.Errorf("Entity index is built before use")
+	}
+	// The index is built once, and shared by the builders
+	ix := builder.GetEntityIndex()
+	for i := 1; i < 100; i++ {
+		b := NewGraphBuilder(g, GraphBuilderOptions{EmbedSchemaNodes: true})
+		b.SetEntityIndex(ix)
+		_, root, _ := b.ObjectAsNode(layer.GetSchemaRootNode(), nil)
+		b.ValueAsNode(layer.GetAttributeByID("https://idField"), root, fmt.Sprint(i))
+		if b.GetEntityIndex() != ix {
+			t.Fatalf("Entity index rebuilt")
+		}
+	}
+	if ix.Len() != 100 {
+		t.Errorf("Expecting 100 entities, got %d", ix.Len())
+	}
+	if nodes := ix.Find("https://root", []string{"99"}); len(nodes) != 1 {
+		t.Errorf("Wrong result: %v", nodes)
+	}
+}
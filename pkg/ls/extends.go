@@ -0,0 +1,230 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"fmt"
+
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+var (
+	// ExtendsTerm is defined at the layer node of a schema, and gives
+	// the reference of the base schema. The reference can be
+	// versioned (id@constraint). The schema inherits the attribute
+	// tree of the base schema. Attributes of the schema with the same
+	// ID as an inherited attribute override that attribute, other
+	// attributes are added.
+	ExtendsTerm = NewTerm(LS, "extends", false, false, OverrideComposition, nil)
+
+	// RemovedTerm marks an inherited attribute as removed. If an
+	// attribute of an extending schema has ls:removed: true, the
+	// inherited attribute with the same ID is removed together with
+	// its subtree.
+	RemovedTerm = NewTerm(LS, "removed", false, false, OverrideComposition, nil)
+
+	// InheritedFromTerm is set for inherited attributes when a schema
+	// extension is resolved. It gives the ID of the schema that
+	// declared the attribute.
+	InheritedFromTerm = NewTerm(LS, "inheritedFrom", false, false, NoComposition, nil)
+)
+
+// ErrExtendsCycle is returned if schemas extend each other
+type ErrExtendsCycle string
+
+func (e ErrExtendsCycle) Error() string {
+	return fmt.Sprintf("Cyclic schema extension: %s", string(e))
+}
+
+// ErrInvalidExtension is returned if a schema extension cannot be
+// resolved
+type ErrInvalidExtension struct {
+	ID  string
+	Msg string
+}
+
+func (e ErrInvalidExtension) Error() string {
+	return fmt.Sprintf("Invalid schema extension for %s: %s", e.ID, e.Msg)
+}
+
+// GetExtends returns the base schema reference of the layer
+func (l *Layer) GetExtends() string {
+	return AsPropertyValue(l.layerInfo.GetProperty(ExtendsTerm)).AsString()
+}
+
+// SetExtends sets the base schema reference of the layer
+func (l *Layer) SetExtends(ref string) {
+	if len(ref) == 0 {
+		l.layerInfo.RemoveProperty(ExtendsTerm)
+		return
+	}
+	l.layerInfo.SetProperty(ExtendsTerm, StringPropertyValue(ref))
+}
+
+// IsAttributeRemoved returns true if the attribute is marked as
+// removed
+func IsAttributeRemoved(node graph.Node) bool {
+	return AsPropertyValue(node.GetProperty(RemovedTerm)).AsString() == "true"
+}
+
+// ExtendLayer returns a new schema that inherits the attribute tree
+// of base, and applies the attributes of layer to it. The base
+// schema must be resolved already, that is, if it extends another
+// schema, that extension must be applied first. Neither base nor
+// layer is modified.
+//
+// The layer node and the schema root node of the result have the
+// properties of layer. Attributes of layer that exist in base
+// override the properties and the attribute type of the inherited
+// attribute. Attributes that do not exist in base are added under
+// their parent. Attributes marked with ls:removed are removed with
+// their subtrees. Inherited attributes are marked with
+// ls:inheritedFrom.
+func ExtendLayer(base, layer *Layer) (*Layer, error) {
+	if base.GetLayerType() != SchemaTerm || layer.GetLayerType() != SchemaTerm {
+		return nil, ErrInvalidExtension{ID: layer.GetID(), Msg: "Only schemas can be extended"}
+	}
+	result := base.Clone()
+	resultRoot := result.GetSchemaRootNode()
+	layerRoot := layer.GetSchemaRootNode()
+	if resultRoot == nil || layerRoot == nil {
+		return nil, ErrInvalidExtension{ID: layer.GetID(), Msg: "Schema has no root attribute"}
+	}
+	// Mark inherited attributes
+	result.ForEachAttribute(func(node graph.Node, _ []graph.Node) bool {
+		if _, ok := node.GetProperty(InheritedFromTerm); !ok {
+			node.SetProperty(InheritedFromTerm, StringPropertyValue(base.GetID()))
+		}
+		return true
+	})
+	// The layer node gets the properties of the extending layer
+	if valueType := layer.GetValueType(); len(valueType) > 0 {
+		result.SetValueType(valueType)
+	}
+	overrideProperties(result.GetLayerRootNode(), layer.GetLayerRootNode())
+	result.SetID(layer.GetID())
+	// The root node is the root node of the extending layer
+	overrideAttribute(resultRoot, layerRoot)
+	resultRoot.RemoveProperty(InheritedFromTerm)
+
+	removed := make(map[graph.Node]struct{})
+	var err error
+	ForEachAttributeNode(layerRoot, func(node graph.Node, path []graph.Node) bool {
+		if node == layerRoot {
+			return true
+		}
+		for _, x := range path {
+			if _, ok := removed[x]; ok {
+				// Descendant of a removed attribute
+				return true
+			}
+		}
+		id := GetAttributeID(node)
+		existing := result.GetAttributeByID(id)
+		if IsAttributeRemoved(node) {
+			removed[node] = struct{}{}
+			if existing != nil {
+				removeAttributeSubtree(existing)
+			}
+			return true
+		}
+		if existing != nil {
+			overrideAttribute(existing, node)
+			return true
+		}
+		// New attribute
+		parent := path[len(path)-2]
+		parentInResult := resultRoot
+		if parent != layerRoot {
+			parentInResult = result.GetAttributeByID(GetAttributeID(parent))
+		}
+		if parentInResult == nil {
+			err = ErrInvalidExtension{ID: layer.GetID(), Msg: fmt.Sprintf("Cannot find parent of %s", id)}
+			return false
+		}
+		newNode := CopySchemaNodeIntoGraph(result.Graph, node)
+		// New attributes are placed after the inherited attributes
+		index := 0
+		for edges := parentInResult.GetEdges(graph.OutgoingEdge); edges.Next(); {
+			edge := edges.Edge()
+			if IsAttributeTreeEdge(edge) && IsAttributeNode(edge.GetTo()) {
+				if i := GetNodeIndex(edge.GetTo()) + 1; i > index {
+					index = i
+				}
+			}
+		}
+		SetNodeIndex(newNode, index)
+		for edges := node.GetEdges(graph.IncomingEdge); edges.Next(); {
+			edge := edges.Edge()
+			if edge.GetFrom() == parent {
+				result.Graph.NewEdge(parentInResult, newNode, edge.GetLabel(), CloneProperties(edge))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// overrideProperties sets the properties of target to the properties
+// of source. Properties of target that are not in source are kept.
+func overrideProperties(target, source graph.Node) {
+	source.ForEachProperty(func(key string, value interface{}) bool {
+		if p, ok := value.(*PropertyValue); ok && key != RemovedTerm {
+			target.SetProperty(key, p.Clone())
+		}
+		return true
+	})
+}
+
+// overrideAttribute overrides the properties, attribute type, and the
+// annotation subtrees of target using source
+func overrideAttribute(target, source graph.Node) {
+	SetNodeID(target, GetNodeID(source))
+	overrideProperties(target, source)
+	sourceTypes := source.GetLabels()
+	labels := target.GetLabels()
+	if len(FilterAttributeTypes(sourceTypes.Slice())) > 0 {
+		for _, x := range FilterAttributeTypes(labels.Slice()) {
+			labels.Remove(x)
+		}
+	}
+	labels.AddSet(sourceTypes)
+	target.SetLabels(labels)
+	nodeMap := map[graph.Node]graph.Node{source: target}
+	for edges := source.GetEdges(graph.OutgoingEdge); edges.Next(); {
+		edge := edges.Edge()
+		if IsAttributeTreeEdge(edge) {
+			continue
+		}
+		graph.CopySubgraph(edge.GetTo(), target.GetGraph(), ClonePropertyValueFunc, nodeMap)
+		graph.CopyEdge(edge, target.GetGraph(), ClonePropertyValueFunc, nodeMap)
+	}
+}
+
+// removeAttributeSubtree removes the attribute node, and all the
+// nodes under it
+func removeAttributeSubtree(node graph.Node) {
+	nodes := make([]graph.Node, 0)
+	IterateDescendants(node, func(n graph.Node) bool {
+		nodes = append(nodes, n)
+		return true
+	}, nil, false)
+	for _, n := range nodes {
+		n.DetachAndRemove()
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExtends(t *testing.T) {
+	layer := func(s string) *Layer {
+		var v interface{}
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			t.Fatal(err)
+		}
+		l, err := UnmarshalLayer(v, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	person := layer(`{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "ls:Schema",
+  "@id": "http://person/schema",
+  "ls:valueType": "Person",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "http://person",
+    "ls:Object/attributes": [
+      {"@id": "firstName", "@type": "ls:Value", "ls:attributeName": "firstName"},
+      {"@id": "ssn", "@type": "ls:Value", "ls:attributeName": "ssn"},
+      {"@id": "address", "@type": "ls:Object", "ls:attributeName": "address",
+       "ls:Object/attributes": [
+         {"@id": "city", "@type": "ls:Value", "ls:attributeName": "city"}
+       ]}
+    ]
+  }
+}`)
+	patient := layer(`{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "ls:Schema",
+  "@id": "http://patient/schema",
+  "ls:valueType": "Patient",
+  "ls:extends": "http://person/schema",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "http://patient",
+    "ls:Object/attributes": [
+      {"@id": "firstName", "@type": "ls:Value", "ls:description": "Patient first name"},
+      {"@id": "ssn", "@type": "ls:Value", "ls:removed": true},
+      {"@id": "address", "@type": "ls:Object",
+       "ls:Object/attributes": [
+         {"@id": "zip", "@type": "ls:Value", "ls:attributeName": "zip"}
+       ]},
+      {"@id": "mrn", "@type": "ls:Value", "ls:attributeName": "mrn"}
+    ]
+  }
+}`)
+	layers := map[string]*Layer{person.GetID(): person, patient.GetID(): patient}
+	compiler := Compiler{
+		Loader: SchemaLoaderFunc(func(x string) (*Layer, error) {
+			return layers[x], nil
+		}),
+	}
+	result, err := compiler.Compile(DefaultContext(), patient.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.GetID() != "http://patient/schema" {
+		t.Errorf("Wrong layer: %s", result.GetID())
+	}
+	if root := result.GetSchemaRootNode(); GetNodeID(root) != "http://patient" || !root.GetLabels().Has("Patient") || root.GetLabels().Has("Person") {
+		t.Errorf("Wrong root: %s %v", GetNodeID(root), root.GetLabels())
+	}
+	for _, id := range []string{"firstName", "address", "city", "zip", "mrn"} {
+		if result.GetAttributeByID(id) == nil {
+			t.Errorf("Missing %s", id)
+		}
+	}
+	if result.GetAttributeByID("ssn") != nil {
+		t.Errorf("ssn is not removed")
+	}
+	firstName := result.GetAttributeByID("firstName")
+	if s := AsPropertyValue(firstName.GetProperty(AttributeNameTerm)).AsString(); s != "firstName" {
+		t.Errorf("Wrong name: %s", s)
+	}
+	if s := AsPropertyValue(firstName.GetProperty(DescriptionTerm)).AsString(); s != "Patient first name" {
+		t.Errorf("Wrong description: %s", s)
+	}
+	if s := AsPropertyValue(firstName.GetProperty(InheritedFromTerm)).AsString(); s != "http://person/schema" {
+		t.Errorf("Wrong inheritedFrom: %s", s)
+	}
+	if _, ok := result.GetAttributeByID("mrn").GetProperty(InheritedFromTerm); ok {
+		t.Errorf("mrn is not inherited")
+	}
+	if p := GetParentAttribute(result.GetAttributeByID("zip")); GetNodeID(p) != "address" {
+		t.Errorf("Wrong parent for zip")
+	}
+	// The original layers are not modified
+	if person.GetAttributeByID("ssn") == nil || person.GetAttributeByID("zip") != nil {
+		t.Errorf("Base schema modified")
+	}
+
+	marshaled, err := MarshalLayer(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(marshaled)
+	for _, x := range []string{ExtendsTerm, InheritedFromTerm} {
+		if !strings.Contains(string(data), x) {
+			t.Errorf("Expecting %s in marshaled layer: %s", x, string(data))
+		}
+	}
+
+	// Cycles are detected
+	person.SetExtends(patient.GetID())
+	compiler.CGraph = nil
+	_, err = compiler.Compile(DefaultContext(), patient.GetID())
+	var cycle ErrExtendsCycle
+	if !errors.As(err, &cycle) {
+		t.Errorf("Expecting cycle error, got %v", err)
+	}
+}
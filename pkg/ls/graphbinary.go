@@ -0,0 +1,606 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+// The binary graph format is a sequence of segments. Each segment
+// starts with BinaryGraphMagic, followed by records. A record is a
+// record type byte, the uvarint payload length, and the payload:
+//
+//	string: the string bytes. Strings are numbered in the order they
+//	  appear in the segment, and used for labels and property keys
+//	node:   uvarint label count, label string numbers, properties
+//	edge:   uvarint from and to node numbers, label string number,
+//	  properties
+//
+// Nodes are numbered in the order they appear in the segment. Edges
+// refer to the nodes of the same segment. Properties are a uvarint
+// count, and for each property the key string number, a value type
+// byte, and the value. Segments are independent, so a segment can be
+// appended to an existing file, and files can be concatenated.
+var BinaryGraphMagic = []byte{'L', 'S', 'G', 1}
+
+// Binary record types
+const (
+	binaryStringRecord byte = 1
+	binaryNodeRecord   byte = 2
+	binaryEdgeRecord   byte = 3
+)
+
+// Binary property value types
+const (
+	binaryPropertyValueString byte = 1
+	binaryPropertyValueSlice  byte = 2
+	binaryString              byte = 3
+	binaryInt                 byte = 4
+	binaryFloat               byte = 5
+	binaryBool                byte = 6
+)
+
+// ErrInvalidBinaryGraph is returned if the binary graph input is
+// malformed
+type ErrInvalidBinaryGraph struct {
+	Msg string
+}
+
+func (e ErrInvalidBinaryGraph) Error() string {
+	return "Invalid binary graph: " + e.Msg
+}
+
+// IsBinaryGraph returns true if data starts with the binary graph
+// magic
+func IsBinaryGraph(data []byte) bool {
+	return bytes.HasPrefix(data, BinaryGraphMagic)
+}
+
+// ErrBinaryGraphModified is returned by BinaryGraphEncoder if a node
+// or edge that is already written is modified or removed
+type ErrBinaryGraphModified struct {
+	Msg string
+}
+
+func (e ErrBinaryGraphModified) Error() string {
+	return "Graph modified after encoding: " + e.Msg
+}
+
+// BinaryGraphEncoder writes a graph in the binary graph format.
+// Properties whose values are *PropertyValue, string, int, float64,
+// or bool are written, other properties are skipped.
+//
+// The encoder is append-only. It remembers the nodes and edges it
+// wrote, so Encode can be called repeatedly as the graph grows to
+// write only the new nodes and edges. The nodes and edges that are
+// written cannot be changed: Encode returns ErrBinaryGraphModified if
+// the labels or properties of a written node or edge change, or if a
+// written node or edge is removed from the graph.
+//
+// Each encoder writes one segment, and the edges of a segment can
+// only refer to the nodes of the same segment. A new encoder
+// appending to an existing file starts a new segment that cannot
+// refer to the nodes written by earlier encoders, so it should
+// encode a complete graph.
+type BinaryGraphEncoder struct {
+	w       *bufio.Writer
+	strings map[string]uint64
+	nodes   map[graph.Node]binaryWrittenItem
+	edges   map[graph.Edge]binaryWrittenItem
+	started bool
+	buf     bytes.Buffer
+}
+
+// binaryWrittenItem is a node or edge written by the encoder. The
+// fingerprint is used to detect changes after the item is written.
+type binaryWrittenItem struct {
+	id          uint64
+	fingerprint uint64
+}
+
+// NewBinaryGraphEncoder returns a new encoder that starts a new
+// segment on w. If w is an existing file opened for append, the
+// graph is appended to the file.
+func NewBinaryGraphEncoder(w io.Writer) *BinaryGraphEncoder {
+	return &BinaryGraphEncoder{
+		w:       bufio.NewWriter(w),
+		strings: make(map[string]uint64),
+		nodes:   make(map[graph.Node]binaryWrittenItem),
+		edges:   make(map[graph.Edge]binaryWrittenItem),
+	}
+}
+
+// Encode writes the nodes and edges of the graph that are not
+// written yet, and flushes the output. Returns
+// ErrBinaryGraphModified if a node or edge written before is changed
+// or removed.
+func (e *BinaryGraphEncoder) Encode(g graph.Graph) error {
+	nWritten := len(e.nodes)
+	seen := 0
+	for nodes := g.GetNodes(); nodes.Next(); {
+		node := nodes.Node()
+		if _, ok := e.nodes[node]; ok {
+			seen++
+		}
+		if err := e.EncodeNode(node); err != nil {
+			return err
+		}
+	}
+	if seen < nWritten {
+		return ErrBinaryGraphModified{Msg: "nodes removed"}
+	}
+	nWritten = len(e.edges)
+	seen = 0
+	for edges := g.GetEdges(); edges.Next(); {
+		edge := edges.Edge()
+		if _, ok := e.edges[edge]; ok {
+			seen++
+		}
+		if err := e.EncodeEdge(edge); err != nil {
+			return err
+		}
+	}
+	if seen < nWritten {
+		return ErrBinaryGraphModified{Msg: "edges removed"}
+	}
+	return e.Flush()
+}
+
+// Flush writes the buffered data to the underlying writer
+func (e *BinaryGraphEncoder) Flush() error {
+	return e.w.Flush()
+}
+
+// EncodeNode writes the node if it is not written yet. Returns
+// ErrBinaryGraphModified if the node is written before, and its
+// labels or properties changed.
+func (e *BinaryGraphEncoder) EncodeNode(node graph.Node) error {
+	labels := node.GetLabels().Slice()
+	fingerprint := binaryFingerprint(labels, node)
+	if written, ok := e.nodes[node]; ok {
+		if written.fingerprint != fingerprint {
+			return ErrBinaryGraphModified{Msg: "node labels or properties changed"}
+		}
+		return nil
+	}
+	labelIDs := make([]uint64, 0, len(labels))
+	for _, l := range labels {
+		id, err := e.stringID(l)
+		if err != nil {
+			return err
+		}
+		labelIDs = append(labelIDs, id)
+	}
+	props, err := e.collectProperties(node)
+	if err != nil {
+		return err
+	}
+	e.buf.Reset()
+	putUvarint(&e.buf, uint64(len(labelIDs)))
+	for _, id := range labelIDs {
+		putUvarint(&e.buf, id)
+	}
+	e.writeProperties(props)
+	if err := e.writeRecord(binaryNodeRecord, e.buf.Bytes()); err != nil {
+		return err
+	}
+	e.nodes[node] = binaryWrittenItem{id: uint64(len(e.nodes)), fingerprint: fingerprint}
+	return nil
+}
+
+// EncodeEdge writes the edge if it is not written yet. The endpoints
+// of the edge are written first if necessary. Returns
+// ErrBinaryGraphModified if the edge is written before, and its
+// properties changed.
+func (e *BinaryGraphEncoder) EncodeEdge(edge graph.Edge) error {
+	fingerprint := binaryFingerprint([]string{edge.GetLabel()}, edge)
+	if written, ok := e.edges[edge]; ok {
+		if written.fingerprint != fingerprint {
+			return ErrBinaryGraphModified{Msg: "edge properties changed"}
+		}
+		return nil
+	}
+	if err := e.EncodeNode(edge.GetFrom()); err != nil {
+		return err
+	}
+	if err := e.EncodeNode(edge.GetTo()); err != nil {
+		return err
+	}
+	label, err := e.stringID(edge.GetLabel())
+	if err != nil {
+		return err
+	}
+	props, err := e.collectProperties(edge)
+	if err != nil {
+		return err
+	}
+	e.buf.Reset()
+	putUvarint(&e.buf, e.nodes[edge.GetFrom()].id)
+	putUvarint(&e.buf, e.nodes[edge.GetTo()].id)
+	putUvarint(&e.buf, label)
+	e.writeProperties(props)
+	if err := e.writeRecord(binaryEdgeRecord, e.buf.Bytes()); err != nil {
+		return err
+	}
+	e.edges[edge] = binaryWrittenItem{fingerprint: fingerprint}
+	return nil
+}
+
+// binaryFingerprint returns a hash of the labels and the properties
+// of a node or edge that are written by the encoder
+func binaryFingerprint(labels []string, item interface {
+	ForEachProperty(func(string, interface{}) bool) bool
+}) uint64 {
+	h := fnv.New64a()
+	labels = append([]string{}, labels...)
+	sort.Strings(labels)
+	for _, l := range labels {
+		h.Write([]byte(l))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte{1})
+	values := make(map[string]string)
+	keys := make([]string, 0)
+	item.ForEachProperty(func(key string, value interface{}) bool {
+		switch v := value.(type) {
+		case *PropertyValue:
+			if v.IsStringSlice() {
+				values[key] = "[" + strings.Join(v.MustStringSlice(), "\x00")
+			} else {
+				values[key] = v.AsString()
+			}
+		case string, int, float64, bool:
+			values[key] = fmt.Sprintf("%T:%v", v, v)
+		default:
+			return true
+		}
+		keys = append(keys, key)
+		return true
+	})
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(values[k]))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+type binaryProperty struct {
+	key   uint64
+	value interface{}
+}
+
+// collectProperties returns the properties that can be written, and
+// writes the string records of their keys
+func (e *BinaryGraphEncoder) collectProperties(item interface {
+	ForEachProperty(func(string, interface{}) bool) bool
+}) ([]binaryProperty, error) {
+	ret := make([]binaryProperty, 0)
+	var err error
+	item.ForEachProperty(func(key string, value interface{}) bool {
+		switch value.(type) {
+		case *PropertyValue, string, int, float64, bool:
+		default:
+			return true
+		}
+		var id uint64
+		id, err = e.stringID(key)
+		if err != nil {
+			return false
+		}
+		ret = append(ret, binaryProperty{key: id, value: value})
+		return true
+	})
+	return ret, err
+}
+
+func (e *BinaryGraphEncoder) writeProperties(props []binaryProperty) {
+	putUvarint(&e.buf, uint64(len(props)))
+	for _, p := range props {
+		putUvarint(&e.buf, p.key)
+		switch v := p.value.(type) {
+		case *PropertyValue:
+			if v.IsStringSlice() {
+				e.buf.WriteByte(binaryPropertyValueSlice)
+				slice := v.MustStringSlice()
+				putUvarint(&e.buf, uint64(len(slice)))
+				for _, s := range slice {
+					putString(&e.buf, s)
+				}
+			} else {
+				e.buf.WriteByte(binaryPropertyValueString)
+				putString(&e.buf, v.AsString())
+			}
+		case string:
+			e.buf.WriteByte(binaryString)
+			putString(&e.buf, v)
+		case int:
+			e.buf.WriteByte(binaryInt)
+			var b [binary.MaxVarintLen64]byte
+			e.buf.Write(b[:binary.PutVarint(b[:], int64(v))])
+		case float64:
+			e.buf.WriteByte(binaryFloat)
+			var b [8]byte
+			binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+			e.buf.Write(b[:])
+		case bool:
+			e.buf.WriteByte(binaryBool)
+			if v {
+				e.buf.WriteByte(1)
+			} else {
+				e.buf.WriteByte(0)
+			}
+		}
+	}
+}
+
+// stringID returns the number of the string, writing a string record
+// if the string is not written yet
+func (e *BinaryGraphEncoder) stringID(s string) (uint64, error) {
+	if id, ok := e.strings[s]; ok {
+		return id, nil
+	}
+	if err := e.writeRecord(binaryStringRecord, []byte(s)); err != nil {
+		return 0, err
+	}
+	id := uint64(len(e.strings))
+	e.strings[s] = id
+	return id, nil
+}
+
+func (e *BinaryGraphEncoder) writeRecord(recordType byte, payload []byte) error {
+	if !e.started {
+		if _, err := e.w.Write(BinaryGraphMagic); err != nil {
+			return err
+		}
+		e.started = true
+	}
+	if err := e.w.WriteByte(recordType); err != nil {
+		return err
+	}
+	var b [binary.MaxVarintLen64]byte
+	if _, err := e.w.Write(b[:binary.PutUvarint(b[:], uint64(len(payload)))]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(payload)
+	return err
+}
+
+func putUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func putString(buf *bytes.Buffer, s string) {
+	putUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// BinaryGraphDecoder reads graphs written in the binary graph format
+// as a stream. Records are added to the target graph as they are
+// read.
+type BinaryGraphDecoder struct {
+	r        *bufio.Reader
+	interner Interner
+	strings  []string
+	nodes    []graph.Node
+	// inSegment is set after the first segment header
+	inSegment bool
+}
+
+// NewBinaryGraphDecoder returns a new decoder reading from r. If
+// interner is nil, a new interner is used.
+func NewBinaryGraphDecoder(r io.Reader, interner Interner) *BinaryGraphDecoder {
+	if interner == nil {
+		interner = NewInterner()
+	}
+	return &BinaryGraphDecoder{r: bufio.NewReader(r), interner: interner}
+}
+
+// Decode reads all segments of the input into the target graph
+func (d *BinaryGraphDecoder) Decode(target graph.Graph) error {
+	for {
+		err := d.DecodeRecord(target)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// DecodeRecord reads the next record into the target graph. Returns
+// io.EOF at the end of input.
+func (d *BinaryGraphDecoder) DecodeRecord(target graph.Graph) error {
+	recordType, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if recordType == BinaryGraphMagic[0] {
+		// New segment
+		rest := make([]byte, len(BinaryGraphMagic)-1)
+		if _, err := io.ReadFull(d.r, rest); err != nil || !bytes.Equal(rest, BinaryGraphMagic[1:]) {
+			return ErrInvalidBinaryGraph{Msg: "bad segment header"}
+		}
+		d.strings = d.strings[:0]
+		d.nodes = d.nodes[:0]
+		d.inSegment = true
+		recordType, err = d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+	}
+	if !d.inSegment {
+		return ErrInvalidBinaryGraph{Msg: "missing segment header"}
+	}
+	length, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return ErrInvalidBinaryGraph{Msg: "truncated record"}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(d.r, payload); err != nil {
+		return ErrInvalidBinaryGraph{Msg: "truncated record"}
+	}
+	rd := bytes.NewReader(payload)
+	switch recordType {
+	case binaryStringRecord:
+		d.strings = append(d.strings, d.interner.Intern(string(payload)))
+	case binaryNodeRecord:
+		n, err := binary.ReadUvarint(rd)
+		if err != nil {
+			return ErrInvalidBinaryGraph{Msg: "bad node record"}
+		}
+		labels := make([]string, 0, n)
+		for i := uint64(0); i < n; i++ {
+			s, err := d.readStringRef(rd)
+			if err != nil {
+				return err
+			}
+			labels = append(labels, s)
+		}
+		props, err := d.readProperties(rd)
+		if err != nil {
+			return err
+		}
+		d.nodes = append(d.nodes, target.NewNode(labels, props))
+	case binaryEdgeRecord:
+		from, err := d.readNodeRef(rd)
+		if err != nil {
+			return err
+		}
+		to, err := d.readNodeRef(rd)
+		if err != nil {
+			return err
+		}
+		label, err := d.readStringRef(rd)
+		if err != nil {
+			return err
+		}
+		props, err := d.readProperties(rd)
+		if err != nil {
+			return err
+		}
+		target.NewEdge(from, to, label, props)
+	default:
+		return ErrInvalidBinaryGraph{Msg: fmt.Sprintf("unknown record type %d", recordType)}
+	}
+	return nil
+}
+
+func (d *BinaryGraphDecoder) readStringRef(rd *bytes.Reader) (string, error) {
+	id, err := binary.ReadUvarint(rd)
+	if err != nil || id >= uint64(len(d.strings)) {
+		return "", ErrInvalidBinaryGraph{Msg: "bad string reference"}
+	}
+	return d.strings[id], nil
+}
+
+func (d *BinaryGraphDecoder) readNodeRef(rd *bytes.Reader) (graph.Node, error) {
+	id, err := binary.ReadUvarint(rd)
+	if err != nil || id >= uint64(len(d.nodes)) {
+		return nil, ErrInvalidBinaryGraph{Msg: "bad node reference"}
+	}
+	return d.nodes[id], nil
+}
+
+func readBinaryString(rd *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(rd)
+	if err != nil || n > uint64(rd.Len()) {
+		return "", ErrInvalidBinaryGraph{Msg: "bad string"}
+	}
+	b := make([]byte, n)
+	rd.Read(b)
+	return string(b), nil
+}
+
+func (d *BinaryGraphDecoder) readProperties(rd *bytes.Reader) (map[string]interface{}, error) {
+	n, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return nil, ErrInvalidBinaryGraph{Msg: "bad properties"}
+	}
+	ret := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		key, err := d.readStringRef(rd)
+		if err != nil {
+			return nil, err
+		}
+		t, err := rd.ReadByte()
+		if err != nil {
+			return nil, ErrInvalidBinaryGraph{Msg: "bad property"}
+		}
+		switch t {
+		case binaryPropertyValueString:
+			s, err := readBinaryString(rd)
+			if err != nil {
+				return nil, err
+			}
+			ret[key] = StringPropertyValue(s)
+		case binaryPropertyValueSlice:
+			count, err := binary.ReadUvarint(rd)
+			if err != nil || count > uint64(rd.Len()) {
+				return nil, ErrInvalidBinaryGraph{Msg: "bad property"}
+			}
+			slice := make([]string, 0, count)
+			for j := uint64(0); j < count; j++ {
+				s, err := readBinaryString(rd)
+				if err != nil {
+					return nil, err
+				}
+				slice = append(slice, s)
+			}
+			ret[key] = StringSlicePropertyValue(slice)
+		case binaryString:
+			s, err := readBinaryString(rd)
+			if err != nil {
+				return nil, err
+			}
+			ret[key] = s
+		case binaryInt:
+			v, err := binary.ReadVarint(rd)
+			if err != nil {
+				return nil, ErrInvalidBinaryGraph{Msg: "bad property"}
+			}
+			ret[key] = int(v)
+		case binaryFloat:
+			var b [8]byte
+			if _, err := io.ReadFull(rd, b[:]); err != nil {
+				return nil, ErrInvalidBinaryGraph{Msg: "bad property"}
+			}
+			ret[key] = math.Float64frombits(binary.LittleEndian.Uint64(b[:]))
+		case binaryBool:
+			b, err := rd.ReadByte()
+			if err != nil {
+				return nil, ErrInvalidBinaryGraph{Msg: "bad property"}
+			}
+			ret[key] = b != 0
+		default:
+			return nil, ErrInvalidBinaryGraph{Msg: fmt.Sprintf("unknown property type %d", t)}
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+func TestBinaryGraph(t *testing.T) {
+	g := NewDocumentGraph()
+	n1 := g.NewNode([]string{DocumentNodeTerm, AttributeTypeObject}, map[string]interface{}{
+		EntitySchemaTerm: StringPropertyValue("https://person"),
+		EntityIDTerm:     StringSlicePropertyValue([]string{"1", "a"}),
+		"count":          3,
+		"flag":           true,
+		"score":          0.5,
+	})
+	SetNodeID(n1, "root")
+	n2 := g.NewNode([]string{DocumentNodeTerm, AttributeTypeValue}, map[string]interface{}{
+		NodeValueTerm: StringPropertyValue("John"),
+	})
+	g.NewEdge(n1, n2, HasTerm, map[string]interface{}{"w": StringPropertyValue("x")})
+
+	buf := bytes.Buffer{}
+	enc := NewBinaryGraphEncoder(&buf)
+	if err := enc.Encode(g); err != nil {
+		t.Fatal(err)
+	}
+	// Incremental encoding writes only the new nodes and edges
+	size := buf.Len()
+	n3 := g.NewNode([]string{DocumentNodeTerm}, map[string]interface{}{NodeValueTerm: StringPropertyValue("Smith")})
+	g.NewEdge(n1, n3, HasTerm, nil)
+	if err := enc.Encode(g); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() == size {
+		t.Errorf("Nothing appended")
+	}
+	if !IsBinaryGraph(buf.Bytes()) {
+		t.Errorf("Missing magic")
+	}
+
+	target := NewDocumentGraph()
+	if err := NewBinaryGraphDecoder(bytes.NewReader(buf.Bytes()), nil).Decode(target); err != nil {
+		t.Fatal(err)
+	}
+	if !graph.CheckIsomorphism(g, target, func(n1, n2 graph.Node) bool {
+		return IsPropertiesEqual(PropertiesAsMap(n1), PropertiesAsMap(n2)) && n1.GetLabels().IsEqual(n2.GetLabels())
+	}, func(e1, e2 graph.Edge) bool {
+		return e1.GetLabel() == e2.GetLabel() && IsPropertiesEqual(PropertiesAsMap(e1), PropertiesAsMap(e2))
+	}) {
+		t.Errorf("Graphs are not the same")
+	}
+	var root graph.Node
+	for nodes := target.GetNodes(); nodes.Next(); {
+		if GetNodeID(nodes.Node()) == "root" {
+			root = nodes.Node()
+		}
+	}
+	if root == nil {
+		t.Fatalf("Node ID not decoded")
+	}
+	if v, _ := root.GetProperty("count"); v != 3 {
+		t.Errorf("Wrong int: %v", v)
+	}
+	if v, _ := root.GetProperty("score"); v != 0.5 {
+		t.Errorf("Wrong float: %v", v)
+	}
+	if v := AsPropertyValue(root.GetProperty(EntityIDTerm)).MustStringSlice(); len(v) != 2 || v[1] != "a" {
+		t.Errorf("Wrong slice: %v", v)
+	}
+
+	// Appended segments are decoded as disjoint subgraphs
+	appended := append(append([]byte{}, buf.Bytes()...), buf.Bytes()...)
+	target = NewDocumentGraph()
+	if err := NewBinaryGraphDecoder(bytes.NewReader(appended), nil).Decode(target); err != nil {
+		t.Fatal(err)
+	}
+	if n := target.NumNodes(); n != 6 {
+		t.Errorf("Expecting 6 nodes, got %d", n)
+	}
+
+	if err := NewBinaryGraphDecoder(bytes.NewReader(buf.Bytes()[:buf.Len()-2]), nil).Decode(NewDocumentGraph()); err == nil {
+		t.Errorf("Expecting error for truncated input")
+	}
+}
+
+func TestBinaryGraphAppendOnly(t *testing.T) {
+	newGraph := func() (graph.Graph, graph.Node, graph.Edge) {
+		g := NewDocumentGraph()
+		n1 := g.NewNode([]string{DocumentNodeTerm}, map[string]interface{}{NodeValueTerm: StringPropertyValue("a")})
+		n2 := g.NewNode([]string{DocumentNodeTerm}, nil)
+		return g, n1, g.NewEdge(n1, n2, HasTerm, nil)
+	}
+	for name, modify := range map[string]func(graph.Node, graph.Edge){
+		"property":      func(n graph.Node, e graph.Edge) { n.SetProperty(NodeValueTerm, StringPropertyValue("b")) },
+		"label":         func(n graph.Node, e graph.Edge) { n.SetLabels(graph.NewStringSet(AttributeTypeValue)) },
+		"node removed":  func(n graph.Node, e graph.Edge) { n.DetachAndRemove() },
+		"edge property": func(n graph.Node, e graph.Edge) { e.SetProperty("x", StringPropertyValue("y")) },
+		"edge removed":  func(n graph.Node, e graph.Edge) { e.Remove() },
+	} {
+		g, n, e := newGraph()
+		enc := NewBinaryGraphEncoder(&bytes.Buffer{})
+		if err := enc.Encode(g); err != nil {
+			t.Fatal(err)
+		}
+		modify(n, e)
+		var merr ErrBinaryGraphModified
+		if err := enc.Encode(g); !errors.As(err, &merr) {
+			t.Errorf("%s: Expecting ErrBinaryGraphModified, got %v", name, err)
+		}
+	}
+
+	// A new encoder writes an independent segment. Its edges do not
+	// refer to the nodes of the earlier segments.
+	g, n, _ := newGraph()
+	buf := bytes.Buffer{}
+	if err := NewBinaryGraphEncoder(&buf).Encode(g); err != nil {
+		t.Fatal(err)
+	}
+	n3 := g.NewNode([]string{DocumentNodeTerm}, nil)
+	g.NewEdge(n, n3, HasTerm, nil)
+	if err := NewBinaryGraphEncoder(&buf).Encode(g); err != nil {
+		t.Fatal(err)
+	}
+	target := NewDocumentGraph()
+	if err := NewBinaryGraphDecoder(bytes.NewReader(buf.Bytes()), nil).Decode(target); err != nil {
+		t.Fatal(err)
+	}
+	if target.NumNodes() != 5 || target.NumEdges() != 3 {
+		t.Errorf("Expecting 5 nodes and 3 edges, got %d %d", target.NumNodes(), target.NumEdges())
+	}
+}
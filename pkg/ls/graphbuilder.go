@@ -29,6 +29,11 @@ type GraphBuilderOptions struct {
 	// If OnlySchemaAttributes is true, only ingest data points if there is a schema for it.
 	// If OnlySchemaAttributes is false, ingest whether or not there is a schema for it.
 	OnlySchemaAttributes bool
+	// If DeferUnresolvedLinks is true, references that cannot be
+	// resolved are recorded as pending link nodes containing the
+	// foreign key values. Pending links can be resolved later using
+	// ResolvePendingLinks.
+	DeferUnresolvedLinks bool
 }
 
 // GraphBuilder contains the methods to ingest a graph
@@ -37,6 +42,13 @@ type GraphBuilder struct {
 	// SchemaNodeMap keeps the map of schema nodes copied into the target graph
 	schemaNodeMap map[graph.Node]graph.Node
 	targetGraph   graph.Graph
+	// entityIndex indexes the entity roots of the target graph. It
+	// is built on first use, and shared by the copies of the builder.
+	entityIndex *builderEntityIndex
+}
+
+type builderEntityIndex struct {
+	index *EntityIndex
 }
 
 type ErrCannotInstantiateSchemaNode struct {
@@ -58,6 +70,7 @@ func NewGraphBuilder(g graph.Graph, options GraphBuilderOptions) GraphBuilder {
 		options:       &options,
 		targetGraph:   g,
 		schemaNodeMap: make(map[graph.Node]graph.Node),
+		entityIndex:   &builderEntityIndex{},
 	}
 	return ret
 }
@@ -70,6 +83,33 @@ func (gb GraphBuilder) GetGraph() graph.Graph {
 	return gb.targetGraph
 }
 
+// GetEntityIndex returns the index of the entity roots of the target
+// graph. The index is built from the target graph on first use, and
+// it is updated as the builder creates entity roots and sets entity
+// IDs.
+func (gb GraphBuilder) GetEntityIndex() *EntityIndex {
+	if gb.entityIndex.index == nil {
+		gb.entityIndex.index = NewEntityIndexFromGraph(gb.targetGraph)
+	}
+	return gb.entityIndex.index
+}
+
+// SetEntityIndex sets the entity index of the target graph. Use this
+// to share an index among the builders working on the same graph, so
+// the index is not rebuilt for every builder.
+func (gb GraphBuilder) SetEntityIndex(index *EntityIndex) {
+	gb.entityIndex.index = index
+}
+
+// addToEntityIndex updates the entity index for the root node if the
+// index is built. Otherwise, the node will be indexed when the index
+// is built.
+func (gb GraphBuilder) addToEntityIndex(root graph.Node) {
+	if gb.entityIndex.index != nil {
+		gb.entityIndex.index.Add(root)
+	}
+}
+
 func determineEdgeLabel(schemaNode graph.Node) string {
 	if x, ok := schemaNode.GetProperty(EdgeLabelTerm); ok {
 		if label := x.(*PropertyValue).AsString(); len(label) > 0 {
@@ -104,6 +144,7 @@ func (gb GraphBuilder) NewNode(schemaNode graph.Node) graph.Node {
 	// If this is an entity boundary, mark it
 	if pv, rootNode := schemaNode.GetProperty(EntitySchemaTerm); rootNode {
 		newNode.SetProperty(EntitySchemaTerm, pv)
+		gb.addToEntityIndex(newNode)
 	}
 
 	copyNodesAttachedToSchema := func(targetNode graph.Node) {
@@ -187,9 +228,10 @@ func (gb GraphBuilder) setEntityID(value string, parentDocumentNode, schemaNode
 
 	if idFieldsProp.IsString() {
 		entityRootNode.SetProperty(EntityIDTerm, StringPropertyValue(value))
-		return nil
+	} else {
+		entityRootNode.SetProperty(EntityIDTerm, StringSlicePropertyValue(existingEntityIDSlice))
 	}
-	entityRootNode.SetProperty(EntityIDTerm, StringSlicePropertyValue(existingEntityIDSlice))
+	gb.addToEntityIndex(entityRootNode)
 	return nil
 }
 
@@ -349,12 +391,41 @@ func (gb GraphBuilder) ArrayAsEdge(schemaNode, parentNode graph.Node, types ...s
 	return gb.CollectionAsEdge(schemaNode, parentNode, AttributeTypeArray, types...)
 }
 
-// Link the given node, or create a link from the parent node.
+// followDocumentEdgesInEntity follows the edges to document nodes
+// that do not cross entity boundaries
+func followDocumentEdgesInEntity(edge graph.Edge) EdgeFuncResult {
+	if !edge.GetTo().GetLabels().Has(DocumentNodeTerm) {
+		return SkipEdgeResult
+	}
+	return FollowEdgesInEntity(edge)
+}
+
+// LinkNode links the given node, or creates a link from the parent
+// node. The link targets are found in entityInfo. If entityInfo is
+// nil, the entity index of the builder is used.
+func (gb GraphBuilder) LinkNode(spec *LinkSpec, docNode, parentNode graph.Node, entityInfo map[graph.Node]EntityInfo) error {
+	entityIndex := entityIndexOf(entityInfo)
+	if entityIndex == nil {
+		entityIndex = gb.GetEntityIndex()
+	}
+	return gb.LinkNodeWithReport(spec, docNode, parentNode, entityIndex, nil)
+}
+
+// LinkNodeWithReport links the given node, or creates a link from the
+// parent node.
 //
 // `spec` is the link spec. `docNode` contains the ingested document
 // node that will be linked. It can be nil. `parentNode` is the
-// document node containing the docNode.
-func (gb GraphBuilder) LinkNode(spec *LinkSpec, docNode, parentNode graph.Node, entityInfo map[graph.Node]EntityInfo) error {
+// document node containing the docNode. The foreign keys are searched
+// in the entity containing the parent node, and the link targets are
+// found using the entity index. If report is non-nil, the foreign
+// keys that cannot be resolved are recorded in the report. If the
+// builder defers unresolved links, a pending link node is created
+// under the parent node for each unresolved foreign key. Targets that
+// are already linked are not linked again, and existing pending links
+// are reused, so the same nodes can be linked repeatedly, as in
+// incremental ingestion.
+func (gb GraphBuilder) LinkNodeWithReport(spec *LinkSpec, docNode, parentNode graph.Node, entityIndex *EntityIndex, report *LinkReport) error {
 	entityRoot := GetEntityRoot(parentNode)
 	if entityRoot == nil {
 		return ErrCannotResolveLink(*spec)
@@ -371,7 +442,7 @@ func (gb GraphBuilder) LinkNode(spec *LinkSpec, docNode, parentNode graph.Node,
 			}
 		}
 		return true
-	}, OnlyDocumentNodes, false)
+	}, followDocumentEdgesInEntity, false)
 	// All foreign key elements must have the same number of elements, and no index must be skipped
 	var numKeys int
 	for index := 0; index < len(foreignKeyNodes); index++ {
@@ -405,31 +476,48 @@ func (gb GraphBuilder) LinkNode(spec *LinkSpec, docNode, parentNode graph.Node,
 		for k, v := range foreignKeyNodes {
 			fk[k], _ = GetRawNodeValue(v[i])
 		}
-		ref, err := spec.FindReference(entityInfo, fk)
+		ref, err := spec.FindReference(entityIndex, fk)
 		if err != nil {
 			return err
 		}
 		if len(ref) == 0 {
+			if gb.options.DeferUnresolvedLinks {
+				NewPendingLinkNode(g, spec, parentNode, fk)
+				report.addPending()
+			} else {
+				report.addUnresolved(spec, GetNodeID(spec.SchemaNode), entityRoot, fk)
+			}
 			continue
 		}
+		report.addResolved()
+		// A pending link recorded for this key earlier is resolved now
+		if pending := findPendingLinkNode(parentNode, spec, fk); pending != nil {
+			pending.DetachAndRemove()
+		}
 		for _, linkRef := range ref {
 			if spec.IngestAs == IngestAsEdge {
-				// Node is already removed. Make an edge
-				if spec.Forward {
-					g.NewEdge(parentNode, linkRef, spec.Label, nodeProperties)
-				} else {
-					g.NewEdge(linkRef, parentNode, spec.Label, nodeProperties)
+				// Node is already removed. Make an edge, unless the
+				// parent is already linked to the target
+				from, to := parentNode, linkRef
+				if !spec.Forward {
+					from, to = linkRef, parentNode
+				}
+				if !hasLinkEdge(from, to, spec.Label) {
+					g.NewEdge(from, to, spec.Label, nodeProperties)
 				}
 			} else {
 				if docNode == nil {
 					docNode = gb.NewNode(spec.SchemaNode)
 					gb.targetGraph.NewEdge(parentNode, docNode, HasTerm, nil)
 				}
-				// A link from this document node to target is created
-				if spec.Forward {
-					gb.targetGraph.NewEdge(docNode, linkRef, spec.Label, nil)
-				} else {
-					gb.targetGraph.NewEdge(linkRef, docNode, spec.Label, nil)
+				// A link from this document node to target is created,
+				// unless it is already linked
+				from, to := docNode, linkRef
+				if !spec.Forward {
+					from, to = linkRef, docNode
+				}
+				if !hasLinkEdge(from, to, spec.Label) {
+					gb.targetGraph.NewEdge(from, to, spec.Label, nil)
 				}
 			}
 		}
@@ -438,7 +526,46 @@ func (gb GraphBuilder) LinkNode(spec *LinkSpec, docNode, parentNode graph.Node,
 	return nil
 }
 
+// hasLinkEdge returns true if there is an edge with the label from
+// the node to the target node
+func hasLinkEdge(from, to graph.Node, label string) bool {
+	for edges := from.GetEdgesWithLabel(graph.OutgoingEdge, label); edges.Next(); {
+		if edges.Edge().GetTo() == to {
+			return true
+		}
+	}
+	return false
+}
+
+// LinkNodes links the document nodes that are instances of the
+// reference attributes of the schema. The link targets are found in
+// entityInfo. If entityInfo is nil, the entity index of the builder
+// is used.
 func (gb GraphBuilder) LinkNodes(schema *Layer, entityInfo map[graph.Node]EntityInfo) error {
+	return gb.LinkNodesWithReport(schema, entityIndexOf(entityInfo), nil)
+}
+
+// entityIndexOf returns an entity index containing the entity roots
+// of entityInfo, or nil if entityInfo is nil
+func entityIndexOf(entityInfo map[graph.Node]EntityInfo) *EntityIndex {
+	if entityInfo == nil {
+		return nil
+	}
+	ix := NewEntityIndex()
+	for root := range entityInfo {
+		ix.Add(root)
+	}
+	return ix
+}
+
+// LinkNodesWithReport links the document nodes that are instances of
+// the reference attributes of the schema. If entityIndex is nil, the
+// entity index of the builder is used. If report is non-nil, link
+// resolution results are recorded in the report.
+func (gb GraphBuilder) LinkNodesWithReport(schema *Layer, entityIndex *EntityIndex, report *LinkReport) error {
+	if entityIndex == nil {
+		entityIndex = gb.GetEntityIndex()
+	}
 	for nodes := schema.Graph.GetNodes(); nodes.Next(); {
 		attrNode := nodes.Node()
 		ls, err := GetLinkSpec(attrNode)
@@ -454,24 +581,56 @@ func (gb GraphBuilder) LinkNodes(schema *Layer, entityInfo map[graph.Node]Entity
 		// Find nodes that are instance of this node
 		parentDocNodes := GetNodesInstanceOf(gb.targetGraph, GetNodeID(parentSchemaNode))
 		for _, parent := range parentDocNodes {
-			// Each parent node has at least one reference node child
-			childFound := false
-			for edges := parent.GetEdges(graph.OutgoingEdge); edges.Next(); {
-				childNode := edges.Edge().GetTo()
-				if !IsDocumentNode(childNode) {
-					continue
-				}
-				if AsPropertyValue(childNode.GetProperty(SchemaNodeIDTerm)).AsString() != attrId {
-					continue
-				}
-				// childNode is an instance of attrNode, which is a link
-				childFound = true
-				if err := gb.LinkNode(ls, childNode, parent, entityInfo); err != nil {
-					return err
-				}
+			if err := gb.linkParentNode(ls, attrId, parent, entityIndex, report); err != nil {
+				return err
 			}
-			if !childFound {
-				if err := gb.LinkNode(ls, nil, parent, entityInfo); err != nil {
+		}
+	}
+	return nil
+}
+
+// LinkChangedEntities links the document nodes that are instances of
+// the reference attributes of the schema in the entities added or
+// changed since the last call, using the entity index of the
+// builder. The first call links all entities in the index. This is
+// used to link a graph that is built incrementally, so the entities
+// that are already linked are not linked again.
+func (gb GraphBuilder) LinkChangedEntities(schema *Layer, report *LinkReport) error {
+	entityIndex := gb.GetEntityIndex()
+	type linkAttr struct {
+		spec   *LinkSpec
+		attrId string
+	}
+	// Link attributes by the ID of their parent attribute
+	attrs := make(map[string][]linkAttr)
+	for nodes := schema.Graph.GetNodes(); nodes.Next(); {
+		attrNode := nodes.Node()
+		ls, err := GetLinkSpec(attrNode)
+		if err != nil {
+			return err
+		}
+		if ls == nil {
+			continue
+		}
+		parentId := GetNodeID(GetParentAttribute(attrNode))
+		attrs[parentId] = append(attrs[parentId], linkAttr{spec: ls, attrId: GetNodeID(attrNode)})
+	}
+	if len(attrs) == 0 {
+		entityIndex.takeChanged()
+		return nil
+	}
+	for _, root := range entityIndex.takeChanged() {
+		// Collect the parents first, because linking modifies the entity
+		parents := make([]graph.Node, 0)
+		IterateDescendants(root, func(n graph.Node) bool {
+			if _, ok := attrs[AsPropertyValue(n.GetProperty(SchemaNodeIDTerm)).AsString()]; ok {
+				parents = append(parents, n)
+			}
+			return true
+		}, followDocumentEdgesInEntity, false)
+		for _, parent := range parents {
+			for _, attr := range attrs[AsPropertyValue(parent.GetProperty(SchemaNodeIDTerm)).AsString()] {
+				if err := gb.linkParentNode(attr.spec, attr.attrId, parent, entityIndex, report); err != nil {
 					return err
 				}
 			}
@@ -479,3 +638,33 @@ func (gb GraphBuilder) LinkNodes(schema *Layer, entityInfo map[graph.Node]Entity
 	}
 	return nil
 }
+
+// linkParentNode links the children of the parent document node that
+// are instances of the reference attribute attrId
+func (gb GraphBuilder) linkParentNode(spec *LinkSpec, attrId string, parent graph.Node, entityIndex *EntityIndex, report *LinkReport) error {
+	// Each parent node has at least one reference node
+	// child. Pending links are not reference nodes, they are
+	// reused by LinkNode. The children are collected first,
+	// because linking modifies the edges of the parent.
+	children := make([]graph.Node, 0)
+	for edges := parent.GetEdges(graph.OutgoingEdge); edges.Next(); {
+		childNode := edges.Edge().GetTo()
+		if !IsDocumentNode(childNode) || childNode.HasLabel(PendingLinkTerm) {
+			continue
+		}
+		if AsPropertyValue(childNode.GetProperty(SchemaNodeIDTerm)).AsString() != attrId {
+			continue
+		}
+		// childNode is an instance of attrNode, which is a link
+		children = append(children, childNode)
+	}
+	if len(children) == 0 {
+		return gb.LinkNodeWithReport(spec, nil, parent, entityIndex, report)
+	}
+	for _, childNode := range children {
+		if err := gb.LinkNodeWithReport(spec, childNode, parent, entityIndex, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+var (
+	// GuardTerm is an openCypher expression that makes the annotations
+	// of an overlay conditional. It can be given at the layer node of
+	// an overlay, in which case it applies to all attributes of the
+	// overlay, or at an overlay attribute. The guard is evaluated for
+	// each document node of the attribute, and the annotations are
+	// composed with only those nodes for which the guard is true.
+	GuardTerm = NewTerm(LS, "guard", false, false, OverrideComposition, nil)
+
+	// ConditionalAnnotationsTerm is the edge label connecting a schema
+	// attribute to its conditional annotations. Guarded overlay
+	// attributes are not composed with the schema attributes
+	// directly. Instead, they are kept as conditional annotations of
+	// the schema attribute, and applied to document nodes when
+	// their guard holds.
+	ConditionalAnnotationsTerm = NewTerm(LS, "conditionalAnnotations", false, false, NoComposition, nil)
+
+	// ConditionalAnnotationsNodeTerm is the label of the nodes
+	// containing conditional annotations
+	ConditionalAnnotationsNodeTerm = NewTerm(LS, "ConditionalAnnotations", false, false, NoComposition, nil)
+)
+
+// GetGuard returns the guard expression of the overlay
+func (l *Layer) GetGuard() string {
+	return AsPropertyValue(l.layerInfo.GetProperty(GuardTerm)).AsString()
+}
+
+// GetAttributeGuard returns the guard of the overlay attribute. If
+// the attribute does not have a guard, returns the guard of the
+// overlay.
+func (l *Layer) GetAttributeGuard(attribute graph.Node) string {
+	if g := AsPropertyValue(attribute.GetProperty(GuardTerm)).AsString(); len(g) > 0 {
+		return g
+	}
+	return l.GetGuard()
+}
+
+// GetConditionalAnnotations returns the conditional annotation nodes
+// of a schema attribute
+func GetConditionalAnnotations(schemaNode graph.Node) []graph.Node {
+	return graph.TargetNodes(schemaNode.GetEdgesWithLabel(graph.OutgoingEdge, ConditionalAnnotationsTerm))
+}
+
+// AddConditionalAnnotations adds the properties of source as
+// conditional annotations of target, with the given guard. Returns
+// nil if source has no annotations.
+func AddConditionalAnnotations(target, source graph.Node, guard string) graph.Node {
+	properties := make(map[string]interface{})
+	source.ForEachProperty(func(key string, value interface{}) bool {
+		if p, ok := value.(*PropertyValue); ok && key != GuardTerm {
+			properties[key] = p.Clone()
+		}
+		return true
+	})
+	if len(properties) == 0 {
+		return nil
+	}
+	properties[GuardTerm] = StringPropertyValue(guard)
+	g := target.GetGraph()
+	node := g.NewNode([]string{ConditionalAnnotationsNodeTerm}, properties)
+	g.NewEdge(target, node, ConditionalAnnotationsTerm, nil)
+	return node
+}
+
+// GetConditionalAnnotationsGuard returns the guard of a conditional
+// annotations node
+func GetConditionalAnnotationsGuard(node graph.Node) string {
+	return AsPropertyValue(node.GetProperty(GuardTerm)).AsString()
+}
+
+// HasConditionalAnnotations returns true if any attribute of the
+// layer has conditional annotations
+func (l *Layer) HasConditionalAnnotations() bool {
+	found := false
+	l.ForEachAttribute(func(node graph.Node, _ []graph.Node) bool {
+		if len(GetConditionalAnnotations(node)) > 0 {
+			found = true
+			return false
+		}
+		return true
+	})
+	return found
+}
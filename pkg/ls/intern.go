@@ -14,6 +14,10 @@
 
 package ls
 
+import (
+	"sync"
+)
+
 // Interner interface is used to keep a string table to reduce memory footprint by eliminated repeated keys
 type Interner interface {
 	Intern(string) string
@@ -48,3 +52,27 @@ func (s StringInterner) Intern(key string) string {
 	}
 	return result
 }
+
+// SyncInterner is an interner that is safe for concurrent use
+type SyncInterner struct {
+	mu      sync.Mutex
+	strings map[string]string
+}
+
+// NewSyncInterner returns a new interner that is safe for concurrent
+// use
+func NewSyncInterner() *SyncInterner {
+	return &SyncInterner{strings: make(map[string]string)}
+}
+
+// Intern a string and return the corresponding interned string
+func (s *SyncInterner) Intern(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, ok := s.strings[key]
+	if !ok {
+		result = key
+		s.strings[key] = result
+	}
+	return result
+}
@@ -308,16 +308,18 @@ func GetAttributePath(root, node graph.Node) []graph.Node {
 	ret := make([]graph.Node, 0)
 	ret = append(ret, node)
 	for node != root {
-		hasEdges := false
+		hasParent := false
 		for edges := node.GetEdges(graph.IncomingEdge); edges.Next(); {
-			hasEdges = true
 			edge := edges.Edge()
 			if IsAttributeTreeEdge(edge) && IsAttributeNode(edge.GetFrom()) {
+				hasParent = true
 				ret = append(ret, edge.GetFrom())
 				node = edge.GetFrom()
 			}
 		}
-		if !hasEdges {
+		// Stop at nodes that are not in the attribute tree, such as
+		// overlay attributes
+		if !hasParent {
 			break
 		}
 	}
@@ -16,6 +16,7 @@ package ls
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/cloudprivacylabs/opencypher/graph"
 )
@@ -65,6 +66,14 @@ var (
 
 	// ReferenceMultiTerm specifies if there can be more than one link targets
 	ReferenceMultiTerm = NewTerm(LS+"Reference/", "multi", false, false, OverrideComposition, nil)
+
+	// PendingLinkTerm is the label of the document nodes that record
+	// references that could not be resolved when ingested. Pending
+	// links are resolved by ResolvePendingLinks.
+	PendingLinkTerm = NewTerm(LS, "PendingLink", false, false, ErrorComposition, nil)
+
+	// ReferenceFKValueTerm is the foreign key values of a pending link
+	ReferenceFKValueTerm = NewTerm(LS+"Reference/", "fkValue", false, false, ErrorComposition, nil)
 )
 
 type ErrInvalidLinkSpec struct {
@@ -128,6 +137,16 @@ func GetLinkSpec(schemaNode graph.Node) (*LinkSpec, error) {
 		return ls.(*LinkSpec), nil
 	}
 
+	ret, err := parseLinkSpec(schemaNode)
+	if err != nil || ret == nil {
+		return nil, err
+	}
+	schemaNode.SetProperty("$linkSpec", ret)
+	return ret, nil
+}
+
+// parseLinkSpec parses the link spec from the properties of the node
+func parseLinkSpec(schemaNode graph.Node) (*LinkSpec, error) {
 	// A reference to another entity is either a reference node, or a node that has Entity schema reference in it
 	ref := AsPropertyValue(schemaNode.GetProperty(ReferenceTerm)).AsString()
 	if len(ref) == 0 {
@@ -175,38 +194,90 @@ func GetLinkSpec(schemaNode graph.Node) (*LinkSpec, error) {
 	if len(ret.FK) == 0 {
 		return nil, ErrInvalidLinkSpec{ID: GetNodeID(schemaNode), Msg: "Empty foreign key"}
 	}
-	schemaNode.SetProperty("$linkSpec", &ret)
 	return &ret, nil
 }
 
-// FindReference finds the root nodes with entitySchema=spec.Schema, with entityId=fk
-func (spec *LinkSpec) FindReference(entityInfo map[graph.Node]EntityInfo, fk []string) ([]graph.Node, error) {
-	ret := make([]graph.Node, 0)
-	for _, ei := range entityInfo {
-		var exists bool
-		for _, typeName := range ei.GetValueType() {
-			if typeName == spec.TargetEntity {
-				exists = true
-				break
-			}
-		}
-		if exists || ei.GetEntitySchema() == spec.TargetEntity {
-			id := ei.GetID()
-			if len(id) != len(fk) {
-				continue
-			}
-			found := true
-			for i := range fk {
-				if id[i] != fk[i] {
-					found = false
-					break
-				}
-			}
-			if found {
-				ret = append(ret, ei.GetRoot())
-			}
-		}
+// FindReference finds the root nodes with entitySchema=spec.Schema
+// or valueType=spec.Schema, with entityId=fk
+func (spec *LinkSpec) FindReference(entityIndex *EntityIndex, fk []string) ([]graph.Node, error) {
+	return entityIndex.Find(spec.TargetEntity, fk), nil
+}
+
+// UnresolvedLink describes a reference whose foreign key did not
+// resolve to an entity
+type UnresolvedLink struct {
+	// The entity schema and the ID of the entity containing the reference
+	SourceEntitySchema string   `json:"sourceEntitySchema"`
+	SourceEntityID     []string `json:"sourceEntityId,omitempty"`
+	// The foreign key values
+	FK []string `json:"fk"`
+	// The referenced entity type
+	TargetEntity string `json:"targetEntity"`
+	// The ID of the reference attribute
+	SchemaNodeID string `json:"schemaNodeId"`
+}
+
+// LinkReport contains the results of link resolution
+type LinkReport struct {
+	// Number of foreign keys resolved
+	Resolved int `json:"resolved"`
+	// Number of foreign keys recorded as pending links
+	Pending int `json:"pending"`
+	// Foreign keys that did not resolve
+	Unresolved []UnresolvedLink `json:"unresolved"`
+}
+
+// NewLinkReport returns an empty link report
+func NewLinkReport() *LinkReport {
+	return &LinkReport{Unresolved: make([]UnresolvedLink, 0)}
+}
+
+// Err returns ErrUnresolvedLinks if there are unresolved links in
+// the report
+func (r *LinkReport) Err() error {
+	if r == nil || len(r.Unresolved) == 0 {
+		return nil
 	}
+	return ErrUnresolvedLinks(r.Unresolved)
+}
 
-	return ret, nil
+func (r *LinkReport) addResolved() {
+	if r != nil {
+		r.Resolved++
+	}
+}
+
+func (r *LinkReport) addPending() {
+	if r != nil {
+		r.Pending++
+	}
+}
+
+func (r *LinkReport) addUnresolved(spec *LinkSpec, schemaNodeID string, entityRoot graph.Node, fk []string) {
+	if r == nil {
+		return
+	}
+	item := UnresolvedLink{
+		FK:           fk,
+		TargetEntity: spec.TargetEntity,
+		SchemaNodeID: schemaNodeID,
+	}
+	if entityRoot != nil {
+		item.SourceEntitySchema = AsPropertyValue(entityRoot.GetProperty(EntitySchemaTerm)).AsString()
+		item.SourceEntityID = AsPropertyValue(entityRoot.GetProperty(EntityIDTerm)).MustStringSlice()
+	}
+	r.Unresolved = append(r.Unresolved, item)
+}
+
+// ErrUnresolvedLinks is returned in strict mode if there are
+// references whose foreign keys did not resolve
+type ErrUnresolvedLinks []UnresolvedLink
+
+func (err ErrUnresolvedLinks) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d unresolved links:", len(err))
+	for _, x := range err {
+		fmt.Fprintf(&b, "\n  %s %v: %s -> %s %v", x.SourceEntitySchema, x.SourceEntityID, x.SchemaNodeID, x.TargetEntity, x.FK)
+	}
+	return b.String()
 }
@@ -21,14 +21,15 @@ import (
 	"github.com/cloudprivacylabs/opencypher/graph"
 )
 
-func TestBasicLink(t *testing.T) {
+// basicLinkGraph builds a graph with a root entity, an entity
+// referencing it, and an entity with an unresolved reference
+func basicLinkGraph(t *testing.T) (builder GraphBuilder, layer *Layer, root1, root2 graph.Node) {
 	schemas := make([]*Layer, 2)
 	for i, x := range []string{"testdata/link_1/root.json", "testdata/link_1/2.json"} {
 		var err error
 		schemas[i], err = ReadLayerFromFile(x)
 		if err != nil {
-			t.Error(err)
-			return
+			t.Fatal(err)
 		}
 	}
 	compiler := Compiler{
@@ -43,37 +44,142 @@ func TestBasicLink(t *testing.T) {
 	}
 	layer0, err := compiler.Compile(DefaultContext(), schemas[0].GetID())
 	if err != nil {
+		t.Fatal(err)
+	}
+	layer2, err := compiler.Compile(DefaultContext(), schemas[1].GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builder = NewGraphBuilder(nil, GraphBuilderOptions{
+		EmbedSchemaNodes: true,
+	})
+	_, root1, _ = builder.ObjectAsNode(layer0.GetSchemaRootNode(), nil)
+	builder.ValueAsNode(layer0.GetAttributeByID("https://idField"), root1, "123")
+
+	_, root2, _ = builder.ObjectAsNode(layer2.GetSchemaRootNode(), nil)
+	builder.ValueAsNode(layer2.GetAttributeByID("idField"), root2, "456")
+	builder.ValueAsNode(layer2.GetAttributeByID("https://rootid"), root2, "123")
+
+	_, root3, _ := builder.ObjectAsNode(layer2.GetSchemaRootNode(), nil)
+	builder.ValueAsNode(layer2.GetAttributeByID("idField"), root3, "789")
+	builder.ValueAsNode(layer2.GetAttributeByID("https://rootid"), root3, "999")
+	return builder, layer2, root1, root2
+}
+
+func hasEdgeTo(from, to graph.Node) bool {
+	for edges := from.GetEdges(graph.OutgoingEdge); edges.Next(); {
+		if edges.Edge().GetTo() == to {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBasicLink(t *testing.T) {
+	builder, layer2, root1, root2 := basicLinkGraph(t)
+	entityIndex := NewEntityIndexFromGraph(builder.GetGraph())
+	report := NewLinkReport()
+	if err := builder.LinkNodesWithReport(layer2, entityIndex, report); err != nil {
 		t.Error(err)
 		return
 	}
-	layer2, err := compiler.Compile(DefaultContext(), schemas[1].GetID())
+	// There must be an edge from root1 to root2
+	if !hasEdgeTo(root1, root2) {
+		t.Errorf("No edges from root1 to root2")
+	}
+
+	if report.Resolved != 1 || len(report.Unresolved) != 1 {
+		t.Errorf("Wrong report: %+v", report)
+		return
+	}
+	unresolved := report.Unresolved[0]
+	if unresolved.TargetEntity != "https://root" || unresolved.SchemaNodeID != "https://test_ref" || len(unresolved.FK) != 1 || unresolved.FK[0] != "999" || len(unresolved.SourceEntityID) != 1 || unresolved.SourceEntityID[0] != "789" {
+		t.Errorf("Wrong unresolved link: %+v", unresolved)
+	}
+	if _, ok := report.Err().(ErrUnresolvedLinks); !ok {
+		t.Errorf("Expecting ErrUnresolvedLinks")
+	}
+}
+
+func TestLinkNodesEntityInfo(t *testing.T) {
+	builder, layer2, root1, root2 := basicLinkGraph(t)
+	if err := builder.LinkNodes(layer2, GetEntityRootNodes(builder.GetGraph())); err != nil {
+		t.Error(err)
+		return
+	}
+	if !hasEdgeTo(root1, root2) {
+		t.Errorf("No edges from root1 to root2")
+	}
+}
+
+func TestDeferredLink(t *testing.T) {
+	schemas := make(map[string]*Layer)
+	for _, x := range []string{"testdata/link_1/root.json", "testdata/link_1/2.json"} {
+		layer, err := ReadLayerFromFile(x)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		schemas[layer.GetID()] = layer
+	}
+	compiler := Compiler{
+		Loader: SchemaLoaderFunc(func(ref string) (*Layer, error) {
+			if l, ok := schemas[ref]; ok {
+				return l, nil
+			}
+			return nil, fmt.Errorf("Not found: %s", ref)
+		}),
+	}
+	layer0, err := compiler.Compile(DefaultContext(), "https://root")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	layer2, err := compiler.Compile(DefaultContext(), "https://2")
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
 	builder := NewGraphBuilder(nil, GraphBuilderOptions{
-		EmbedSchemaNodes: true,
+		EmbedSchemaNodes:     true,
+		DeferUnresolvedLinks: true,
 	})
-	_, root1, _ := builder.ObjectAsNode(layer0.GetSchemaRootNode(), nil)
-	builder.ValueAsNode(layer0.GetAttributeByID("https://idField"), root1, "123")
-
 	_, root2, _ := builder.ObjectAsNode(layer2.GetSchemaRootNode(), nil)
 	builder.ValueAsNode(layer2.GetAttributeByID("idField"), root2, "456")
 	builder.ValueAsNode(layer2.GetAttributeByID("https://rootid"), root2, "123")
+	report := NewLinkReport()
+	if err := builder.LinkNodesWithReport(layer2, nil, report); err != nil {
+		t.Error(err)
+		return
+	}
+	if report.Pending != 1 || len(GetPendingLinkNodes(builder.GetGraph())) != 1 {
+		t.Errorf("Expecting 1 pending link: %+v", report)
+		return
+	}
 
-	entityInfo := GetEntityRootNodes(builder.GetGraph())
-	builder.LinkNodes(layer2, entityInfo)
-	// There must be an edge from root1 to root2
+	// The target is ingested later
+	_, root1, _ := builder.ObjectAsNode(layer0.GetSchemaRootNode(), nil)
+	builder.ValueAsNode(layer0.GetAttributeByID("https://idField"), root1, "123")
+	report = NewLinkReport()
+	if err := ResolvePendingLinks(builder.GetGraph(), nil, report, false); err != nil {
+		t.Error(err)
+		return
+	}
+	if report.Resolved != 1 || len(report.Unresolved) != 0 {
+		t.Errorf("Wrong report: %+v", report)
+	}
+	if len(GetPendingLinkNodes(builder.GetGraph())) != 0 {
+		t.Errorf("Pending link not removed")
+	}
 	found := false
 	for edges := root1.GetEdges(graph.OutgoingEdge); edges.Next(); {
-		edge := edges.Edge()
-		if edge.GetTo() == root2 {
+		if edges.Edge().GetTo() == root2 {
 			found = true
 		}
 	}
 	if !found {
 		t.Errorf("No edges from root1 to root2")
 	}
-
 }
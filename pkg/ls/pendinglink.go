@@ -0,0 +1,154 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+// NewPendingLinkNode creates a pending link node under the parent
+// node for a reference that cannot be resolved yet. The pending link
+// node records the link spec and the foreign key values, so it can
+// be resolved without the schema. If the parent node already has a
+// pending link for the same reference and foreign key values, that
+// node is returned.
+func NewPendingLinkNode(g graph.Graph, spec *LinkSpec, parentNode graph.Node, fk []string) graph.Node {
+	if node := findPendingLinkNode(parentNode, spec, fk); node != nil {
+		return node
+	}
+	link := "from"
+	if spec.Forward {
+		link = "to"
+	}
+	multi := "true"
+	if !spec.Multi {
+		multi = "false"
+	}
+	node := g.NewNode([]string{DocumentNodeTerm, PendingLinkTerm}, map[string]interface{}{
+		SchemaNodeIDTerm:     StringPropertyValue(GetNodeID(spec.SchemaNode)),
+		ReferenceTerm:        StringPropertyValue(spec.TargetEntity),
+		ReferenceFKTerm:      StringSlicePropertyValue(spec.FK),
+		ReferenceLinkTerm:    StringPropertyValue(link),
+		ReferenceLabelTerm:   StringPropertyValue(spec.Label),
+		ReferenceMultiTerm:   StringPropertyValue(multi),
+		IngestAsTerm:         StringPropertyValue(spec.IngestAs),
+		ReferenceFKValueTerm: StringSlicePropertyValue(fk),
+	})
+	g.NewEdge(parentNode, node, HasTerm, nil)
+	return node
+}
+
+// findPendingLinkNode returns the pending link node of the parent
+// node for the reference and the foreign key values, or nil
+func findPendingLinkNode(parentNode graph.Node, spec *LinkSpec, fk []string) graph.Node {
+	schemaNodeID := GetNodeID(spec.SchemaNode)
+	for edges := parentNode.GetEdgesWithLabel(graph.OutgoingEdge, HasTerm); edges.Next(); {
+		node := edges.Edge().GetTo()
+		if !node.HasLabel(PendingLinkTerm) || AsPropertyValue(node.GetProperty(SchemaNodeIDTerm)).AsString() != schemaNodeID {
+			continue
+		}
+		values := AsPropertyValue(node.GetProperty(ReferenceFKValueTerm)).MustStringSlice()
+		if len(values) != len(fk) {
+			continue
+		}
+		match := true
+		for i := range fk {
+			if values[i] != fk[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return node
+		}
+	}
+	return nil
+}
+
+// GetPendingLinkNodes returns the pending link nodes of the graph
+func GetPendingLinkNodes(g graph.Graph) []graph.Node {
+	ret := make([]graph.Node, 0)
+	for nodes := g.GetNodesWithAllLabels(graph.NewStringSet(PendingLinkTerm)); nodes.Next(); {
+		ret = append(ret, nodes.Node())
+	}
+	return ret
+}
+
+// ResolvePendingLinks resolves the pending link nodes of the graph
+// using the entity index. If entityIndex is nil, an index is built
+// from the graph. Resolved references are linked the same way as
+// LinkNode, and the pending link nodes are cleaned up: if the
+// reference is ingested as an edge, the pending link node is
+// removed, otherwise it becomes the link node. Unresolved pending
+// links are recorded in the report, and removed if removeUnresolved
+// is set.
+func ResolvePendingLinks(g graph.Graph, entityIndex *EntityIndex, report *LinkReport, removeUnresolved bool) error {
+	if entityIndex == nil {
+		entityIndex = NewEntityIndexFromGraph(g)
+	}
+	for _, node := range GetPendingLinkNodes(g) {
+		spec, err := parseLinkSpec(node)
+		if err != nil {
+			return err
+		}
+		schemaNodeID := AsPropertyValue(node.GetProperty(SchemaNodeIDTerm)).AsString()
+		if spec == nil {
+			return ErrInvalidLinkSpec{ID: schemaNodeID, Msg: "Invalid pending link"}
+		}
+		var parentNode graph.Node
+		for edges := node.GetEdges(graph.IncomingEdge); edges.Next(); {
+			if edge := edges.Edge(); edge.GetLabel() == HasTerm {
+				parentNode = edge.GetFrom()
+				break
+			}
+		}
+		if parentNode == nil {
+			return ErrCannotResolveLink(*spec)
+		}
+		fk := AsPropertyValue(node.GetProperty(ReferenceFKValueTerm)).MustStringSlice()
+		ref, err := spec.FindReference(entityIndex, fk)
+		if err != nil {
+			return err
+		}
+		if len(ref) == 0 {
+			report.addUnresolved(spec, schemaNodeID, GetEntityRoot(parentNode), fk)
+			if removeUnresolved {
+				node.DetachAndRemove()
+			}
+			continue
+		}
+		report.addResolved()
+		from := parentNode
+		if spec.IngestAs == IngestAsNode {
+			from = node
+		}
+		for _, linkRef := range ref {
+			if spec.Forward {
+				g.NewEdge(from, linkRef, spec.Label, nil)
+			} else {
+				g.NewEdge(linkRef, from, spec.Label, nil)
+			}
+		}
+		if spec.IngestAs == IngestAsEdge {
+			node.DetachAndRemove()
+			continue
+		}
+		labels := node.GetLabels()
+		labels.Remove(PendingLinkTerm)
+		node.SetLabels(labels)
+		node.RemoveProperty(ReferenceFKValueTerm)
+	}
+	return nil
+}
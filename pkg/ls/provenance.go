@@ -0,0 +1,177 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+// ProvenanceTerm records which layers contributed the values of the
+// terms of an attribute during composition. It is only recorded if
+// provenance is enabled in the context. Each value is of the form
+//
+//	term compositionType layerId [layerId...]
+var ProvenanceTerm = NewTerm(LS, "provenance", false, false, NoComposition, nil)
+
+// ProvenanceEntry gives the layers that contributed the value of a
+// term, and the composition type used to compose the last
+// contribution
+type ProvenanceEntry struct {
+	Term        string          `json:"term"`
+	Composition CompositionType `json:"composition,omitempty"`
+	Layers      []string        `json:"layers"`
+}
+
+func (p ProvenanceEntry) String() string {
+	comp := string(p.Composition)
+	if len(comp) == 0 {
+		comp = "-"
+	}
+	return strings.Join(append([]string{p.Term, comp}, p.Layers...), " ")
+}
+
+// ParseProvenanceEntry parses a provenance entry in string form
+func ParseProvenanceEntry(s string) (ProvenanceEntry, bool) {
+	parts := strings.Fields(s)
+	if len(parts) < 2 {
+		return ProvenanceEntry{}, false
+	}
+	ret := ProvenanceEntry{Term: parts[0], Layers: parts[2:]}
+	if parts[1] != "-" {
+		ret.Composition = CompositionType(parts[1])
+	}
+	return ret, true
+}
+
+// GetProvenance returns the provenance entries of a node, sorted by
+// term
+func GetProvenance(node graph.Node) []ProvenanceEntry {
+	ret := make([]ProvenanceEntry, 0)
+	p := AsPropertyValue(node.GetProperty(ProvenanceTerm))
+	if p == nil {
+		return ret
+	}
+	for _, x := range p.MustStringSlice() {
+		if entry, ok := ParseProvenanceEntry(x); ok {
+			ret = append(ret, entry)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Term < ret[j].Term })
+	return ret
+}
+
+// GetTermProvenance returns the provenance entry of a term of the node
+func GetTermProvenance(node graph.Node, term string) (ProvenanceEntry, bool) {
+	for _, x := range GetProvenance(node) {
+		if x.Term == term {
+			return x, true
+		}
+	}
+	return ProvenanceEntry{}, false
+}
+
+// SetTermProvenance sets the provenance entry for a term of the
+// node. The property value is replaced, not modified, so nodes
+// sharing the same property value are not affected.
+func SetTermProvenance(node graph.Node, entry ProvenanceEntry) {
+	values := make([]string, 0)
+	for _, x := range GetProvenance(node) {
+		if x.Term != entry.Term {
+			values = append(values, x.String())
+		}
+	}
+	values = append(values, entry.String())
+	sort.Strings(values)
+	node.SetProperty(ProvenanceTerm, StringSlicePropertyValue(values))
+}
+
+// recordProvenance records the contribution of sourceLayer to the
+// term of the target node. targetLayer is recorded as the
+// contributor of the existing value if the node does not have
+// provenance information for the term yet.
+func recordProvenance(target graph.Node, term string, comp CompositionType, targetLayer, sourceLayer string, targetValue, sourceValue *PropertyValue) {
+	if !isProvenanceTracked(term) || sourceValue == nil {
+		return
+	}
+	entry, ok := GetTermProvenance(target, term)
+	if !ok && targetValue != nil && len(targetLayer) > 0 {
+		entry.Layers = []string{targetLayer}
+	}
+	entry.Term = term
+	layers := make([]string, 0, len(entry.Layers)+1)
+	switch {
+	case targetValue == nil, comp == OverrideComposition:
+	case comp == NoComposition:
+		layers = append(layers, entry.Layers...)
+	default:
+		for _, x := range entry.Layers {
+			if x != sourceLayer {
+				layers = append(layers, x)
+			}
+		}
+	}
+	if targetValue == nil || comp != NoComposition {
+		layers = append(layers, sourceLayer)
+	}
+	entry.Layers = layers
+	entry.Composition = comp
+	SetTermProvenance(target, entry)
+}
+
+// isProvenanceTracked returns false for the terms that are not
+// composed from layers
+func isProvenanceTracked(term string) bool {
+	return term != ProvenanceTerm && term != NodeIDTerm && term != AttributeIndexTerm
+}
+
+// initProvenance records layerID as the contributor of all the
+// properties of the node
+func initProvenance(node graph.Node, layerID string) {
+	terms := make([]string, 0)
+	node.ForEachProperty(func(k string, v interface{}) bool {
+		if _, ok := v.(*PropertyValue); ok && isProvenanceTracked(k) {
+			terms = append(terms, k)
+		}
+		return true
+	})
+	for _, term := range terms {
+		if _, exists := GetTermProvenance(node, term); !exists {
+			SetTermProvenance(node, ProvenanceEntry{Term: term, Layers: []string{layerID}})
+		}
+	}
+}
+
+// getLayerIDOfNode returns the ID of the layer the node belongs
+// to. If the graph of the node contains more than one layer, returns
+// empty string.
+func getLayerIDOfNode(node graph.Node) string {
+	g := node.GetGraph()
+	if g == nil {
+		return ""
+	}
+	id := ""
+	for _, t := range []string{SchemaTerm, OverlayTerm} {
+		for nodes := g.GetNodesWithAllLabels(graph.NewStringSet(t)); nodes.Next(); {
+			if len(id) > 0 {
+				return ""
+			}
+			id = GetNodeID(nodes.Node())
+		}
+	}
+	return id
+}
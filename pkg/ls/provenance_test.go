@@ -0,0 +1,126 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCompositionProvenance(t *testing.T) {
+	layer := func(s string) *Layer {
+		var v interface{}
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			t.Fatal(err)
+		}
+		l, err := UnmarshalLayer(v, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	schema := layer(`{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "ls:Schema",
+  "@id": "http://schema",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "root",
+    "ls:Object/attributes": [
+      {"@id": "attr1", "@type": "ls:Value", "ls:attributeName": "a", "ls:description": "base"}
+    ]
+  }
+}`)
+	ovl1 := layer(`{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "ls:Overlay",
+  "@id": "http://ovl1",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "root",
+    "ls:Object/attributes": [
+      {"@id": "attr1", "@type": "ls:Value", "ls:description": "ovl1", "ls:privacyClassification": "pii"},
+      {"@id": "attr2", "@type": "ls:Value", "ls:attributeName": "b"}
+    ]
+  }
+}`)
+	ovl2 := layer(`{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "ls:Overlay",
+  "@id": "http://ovl2",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "root",
+    "ls:Object/attributes": [
+      {"@id": "attr1", "@type": "ls:Value", "ls:privacyClassification": "sensitive"}
+    ]
+  }
+}`)
+	ctx := DefaultContext().SetProvenance(true)
+	if err := schema.Compose(ctx, ovl1); err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.Compose(ctx, ovl2); err != nil {
+		t.Fatal(err)
+	}
+	attr1 := schema.GetAttributeByID("attr1")
+	check := func(term string, layers []string) {
+		entry, ok := GetTermProvenance(attr1, term)
+		if !ok {
+			t.Errorf("No provenance for %s", term)
+			return
+		}
+		if !reflect.DeepEqual(entry.Layers, layers) {
+			t.Errorf("%s: expected %v got %v", term, layers, entry.Layers)
+		}
+	}
+	check(AttributeNameTerm, []string{"http://schema"})
+	check("https://lschema.org/description", []string{"http://schema", "http://ovl1"})
+	check("https://lschema.org/privacyClassification", []string{"http://ovl1", "http://ovl2"})
+
+	attr2 := schema.GetAttributeByID("attr2")
+	if entry, ok := GetTermProvenance(attr2, AttributeNameTerm); !ok || !reflect.DeepEqual(entry.Layers, []string{"http://ovl1"}) {
+		t.Errorf("Wrong provenance for new attribute: %v", entry)
+	}
+
+	// Provenance is marshaled
+	marshaled, err := MarshalLayer(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(marshaled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	json.Unmarshal(data, &v)
+	unmarshaled, err := UnmarshalLayer(v, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(GetProvenance(unmarshaled.GetAttributeByID("attr1")), GetProvenance(attr1)) {
+		t.Errorf("Provenance not marshaled")
+	}
+
+	// No provenance unless enabled
+	plain := layer(`{"@context": {"ls": "https://lschema.org/"}, "@type": "ls:Schema", "@id": "http://schema", "ls:layer": {"@type": "ls:Object", "@id": "root"}}`)
+	if err := plain.Compose(DefaultContext(), ovl2); err != nil {
+		t.Fatal(err)
+	}
+	if len(GetProvenance(plain.GetAttributeByID("attr1"))) != 0 {
+		t.Errorf("Unexpected provenance")
+	}
+}
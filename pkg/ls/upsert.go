@@ -0,0 +1,414 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+// Merge policies used when an ingested entity is merged into an
+// existing entity with the same entity schema and ID
+const (
+	// The ingested value replaces the existing value
+	MergeReplace = "replace"
+	// The existing value is kept
+	MergeKeepFirst = "keepFirst"
+	// The ingested array elements are appended to the existing
+	// array. Ingested values are added next to the existing values.
+	MergeAppend = "append"
+)
+
+// MergePolicyTerm specifies how the instances of an attribute are
+// merged when an entity is upserted. It is one of replace,
+// keepFirst, or append.
+var MergePolicyTerm = NewTerm(LS, "mergePolicy", false, false, OverrideComposition, nil)
+
+type ErrInvalidMergePolicy string
+
+func (err ErrInvalidMergePolicy) Error() string {
+	return fmt.Sprintf("Invalid merge policy: %s", string(err))
+}
+
+// ValidateMergePolicy returns an error if policy is not one of the
+// merge policies
+func ValidateMergePolicy(policy string) error {
+	switch policy {
+	case MergeReplace, MergeKeepFirst, MergeAppend:
+		return nil
+	}
+	return ErrInvalidMergePolicy(policy)
+}
+
+// UpsertOptions control how entities are merged
+type UpsertOptions struct {
+	// DefaultPolicy is used for the attributes that do not have a
+	// merge policy. If empty, MergeReplace is used
+	DefaultPolicy string
+	// AttributePolicies are the merge policies by schema attribute
+	// ID. These override the merge policies declared in the schema.
+	AttributePolicies map[string]string
+}
+
+// policy returns the merge policy for the document node
+func (options UpsertOptions) policy(node graph.Node) string {
+	if p, ok := options.AttributePolicies[AsPropertyValue(node.GetProperty(SchemaNodeIDTerm)).AsString()]; ok {
+		return p
+	}
+	if pv, ok := GetNodeOrSchemaProperty(node, MergePolicyTerm); ok && len(pv.AsString()) > 0 {
+		return pv.AsString()
+	}
+	if len(options.DefaultPolicy) > 0 {
+		return options.DefaultPolicy
+	}
+	return MergeReplace
+}
+
+// Kinds of attribute changes
+const (
+	// The attribute did not exist in the existing entity
+	AttributeAdded = "added"
+	// The value of the attribute is replaced
+	AttributeReplaced = "replaced"
+	// Array elements or values are appended to the existing ones
+	AttributeAppended = "appended"
+)
+
+// AttributeChange describes a change to an attribute of an existing
+// entity
+type AttributeChange struct {
+	SchemaNodeID string `json:"schemaNodeId,omitempty"`
+	// Property is set if a node property other than the node value
+	// changed
+	Property string `json:"property,omitempty"`
+	Kind     string `json:"kind"`
+	OldValue string `json:"oldValue,omitempty"`
+	NewValue string `json:"newValue,omitempty"`
+}
+
+// EntityChange contains the changes to an existing entity
+type EntityChange struct {
+	EntitySchema string            `json:"entitySchema"`
+	EntityID     []string          `json:"entityId"`
+	Changes      []AttributeChange `json:"changes"`
+}
+
+// UpsertReport describes the changes made by upserting entities
+type UpsertReport struct {
+	// Entities contains the existing entities that had ingested
+	// entities merged into them
+	Entities []EntityChange `json:"entities"`
+}
+
+// NewUpsertReport returns an empty upsert report
+func NewUpsertReport() *UpsertReport {
+	return &UpsertReport{Entities: make([]EntityChange, 0)}
+}
+
+// upsertStructuralProperties are not merged
+var upsertStructuralProperties = map[string]struct{}{
+	NodeIDTerm:         {},
+	AttributeIndexTerm: {},
+	SchemaNodeIDTerm:   {},
+	EntitySchemaTerm:   {},
+	EntityIDTerm:       {},
+}
+
+// UpsertEntities merges the entity roots that have the same entity
+// schema and entity ID as an entity that was already in the graph
+// into the existing entity, and removes them. Attribute instances
+// are matched by schema node ID, and merged using the merge policy
+// of the attribute. If report is non-nil, the changes are recorded
+// in the report.
+func (gb GraphBuilder) UpsertEntities(options UpsertOptions, report *UpsertReport) error {
+	for _, group := range gb.GetEntityIndex().duplicates() {
+		existing := group[0]
+		for _, incoming := range group[1:] {
+			// Nested entities may have been merged with their parents
+			if _, ok := gb.GetEntityIndex().GetEntityInfo(incoming); !ok {
+				continue
+			}
+			if _, ok := gb.GetEntityIndex().GetEntityInfo(existing); !ok {
+				existing = incoming
+				continue
+			}
+			change := gb.MergeEntity(existing, incoming, options)
+			if report != nil {
+				report.Entities = append(report.Entities, change)
+			}
+		}
+	}
+	return nil
+}
+
+// duplicates returns the groups of entity roots that have the same
+// entity schema and ID, in the order they are added to the index
+func (ix *EntityIndex) duplicates() [][]graph.Node {
+	keys := make([]entityIndexKey, 0)
+	for k := range ix.duplicated {
+		nodes := ix.index[k]
+		if len(nodes) < 2 {
+			delete(ix.duplicated, k)
+			continue
+		}
+		if info, ok := ix.entities[nodes[0]]; !ok || info.GetEntitySchema() != k.typeName {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].typeName == keys[j].typeName {
+			return keys[i].id < keys[j].id
+		}
+		return keys[i].typeName < keys[j].typeName
+	})
+	ret := make([][]graph.Node, 0, len(keys))
+	for _, k := range keys {
+		ret = append(ret, append([]graph.Node{}, ix.index[k]...))
+	}
+	return ret
+}
+
+// MergeEntity merges the incoming entity root into the existing
+// entity root using the merge policies of options, and removes the
+// incoming entity. The two entities need not have the same entity
+// schema or entity ID. Returns the changes made to the existing
+// entity.
+func (gb GraphBuilder) MergeEntity(existing, incoming graph.Node, options UpsertOptions) EntityChange {
+	change := EntityChange{
+		EntitySchema: AsPropertyValue(existing.GetProperty(EntitySchemaTerm)).AsString(),
+		EntityID:     AsPropertyValue(existing.GetProperty(EntityIDTerm)).MustStringSlice(),
+		Changes:      make([]AttributeChange, 0),
+	}
+	gb.mergeEntity(existing, incoming, options, &change)
+	return change
+}
+
+// mergeEntity merges the incoming entity root into the existing
+// entity root, and removes the incoming entity
+func (gb GraphBuilder) mergeEntity(existing, incoming graph.Node, options UpsertOptions, change *EntityChange) {
+	gb.mergeNode(existing, incoming, options, change)
+	// Edges pointing to the incoming entity now point to the existing
+	// entity
+	for _, edge := range graph.EdgeSlice(incoming.GetEdges(graph.IncomingEdge)) {
+		gb.targetGraph.NewEdge(edge.GetFrom(), existing, edge.GetLabel(), cloneEdgeProperties(edge))
+	}
+	gb.removeDocumentSubtree(incoming)
+	if gb.entityIndex.index != nil {
+		gb.entityIndex.index.markChanged(existing)
+	}
+}
+
+// mergeNode merges the properties and the children of incoming into
+// existing. The children of incoming are either merged into the
+// matching children of existing, or moved under existing.
+func (gb GraphBuilder) mergeNode(existing, incoming graph.Node, options UpsertOptions, change *EntityChange) {
+	policy := options.policy(incoming)
+	schemaNodeID := AsPropertyValue(incoming.GetProperty(SchemaNodeIDTerm)).AsString()
+	if policy != MergeKeepFirst {
+		incoming.ForEachProperty(func(key string, value interface{}) bool {
+			if _, ok := upsertStructuralProperties[key]; ok {
+				return true
+			}
+			newValue, _ := value.(*PropertyValue)
+			oldValue := AsPropertyValue(existing.GetProperty(key))
+			if newValue == nil || oldValue.IsEqual(newValue) {
+				return true
+			}
+			existing.SetProperty(key, newValue.Clone())
+			c := AttributeChange{
+				SchemaNodeID: schemaNodeID,
+				Kind:         AttributeReplaced,
+				NewValue:     propertyValueString(newValue),
+			}
+			if oldValue == nil {
+				c.Kind = AttributeAdded
+			} else {
+				c.OldValue = propertyValueString(oldValue)
+			}
+			if key != NodeValueTerm {
+				c.Property = key
+			}
+			change.Changes = append(change.Changes, c)
+			return true
+		})
+	}
+
+	for _, edge := range graph.EdgeSlice(incoming.GetEdges(graph.OutgoingEdge)) {
+		child := edge.GetTo()
+		if !IsDocumentNode(child) || child.GetLabels().Has(PendingLinkTerm) {
+			continue
+		}
+		childPolicy := options.policy(child)
+		match := findMatchingChild(existing, edge)
+		childID := AsPropertyValue(child.GetProperty(SchemaNodeIDTerm)).AsString()
+		switch {
+		case match == nil:
+			gb.moveChild(existing, edge, -1)
+			change.Changes = append(change.Changes, AttributeChange{SchemaNodeID: childID, Kind: AttributeAdded, NewValue: nodeValueString(child)})
+
+		case childPolicy == MergeKeepFirst:
+
+		case child.GetLabels().Has(AttributeTypeArray):
+			if childPolicy == MergeAppend {
+				next := 0
+				for _, x := range childDocumentEdges(match) {
+					if ix := GetNodeIndex(x.GetTo()); ix >= next {
+						next = ix + 1
+					}
+				}
+				elements := childDocumentEdges(child)
+				SortEdges(elements)
+				for _, elEdge := range elements {
+					gb.moveChild(match, elEdge, next)
+					next++
+				}
+				if len(elements) > 0 {
+					change.Changes = append(change.Changes, AttributeChange{SchemaNodeID: childID, Kind: AttributeAppended})
+				}
+			} else {
+				gb.removeDocumentSubtree(match)
+				gb.moveChild(existing, edge, -1)
+				change.Changes = append(change.Changes, AttributeChange{SchemaNodeID: childID, Kind: AttributeReplaced})
+			}
+
+		case childPolicy == MergeAppend && child.GetLabels().Has(AttributeTypeValue):
+			gb.moveChild(existing, edge, -1)
+			change.Changes = append(change.Changes, AttributeChange{SchemaNodeID: childID, Kind: AttributeAppended, NewValue: nodeValueString(child)})
+
+		case IsNodeEntityRoot(child):
+			gb.mergeEntity(match, child, options, change)
+
+		default:
+			gb.mergeNode(match, child, options, change)
+		}
+	}
+}
+
+// findMatchingChild returns the child of the parent node that is
+// connected with the same edge label, and that is an instance of the
+// same schema attribute as the target of the edge. Nodes without a
+// schema attribute are matched by attribute name. Entity roots must
+// also have the same entity ID.
+func findMatchingChild(parent graph.Node, edge graph.Edge) graph.Node {
+	child := edge.GetTo()
+	schemaNodeID := AsPropertyValue(child.GetProperty(SchemaNodeIDTerm)).AsString()
+	name := AsPropertyValue(child.GetProperty(AttributeNameTerm)).AsString()
+	isEntity := IsNodeEntityRoot(child)
+	entityID := AsPropertyValue(child.GetProperty(EntityIDTerm))
+	for _, e := range childDocumentEdges(parent) {
+		if e.GetLabel() != edge.GetLabel() {
+			continue
+		}
+		candidate := e.GetTo()
+		if AsPropertyValue(candidate.GetProperty(SchemaNodeIDTerm)).AsString() != schemaNodeID {
+			continue
+		}
+		if len(schemaNodeID) == 0 && AsPropertyValue(candidate.GetProperty(AttributeNameTerm)).AsString() != name {
+			continue
+		}
+		if isEntity && !AsPropertyValue(candidate.GetProperty(EntityIDTerm)).IsEqual(entityID) {
+			continue
+		}
+		return candidate
+	}
+	return nil
+}
+
+// childDocumentEdges returns the edges to the document nodes under
+// the node, excluding pending links and links to other entities
+func childDocumentEdges(node graph.Node) []graph.Edge {
+	ret := make([]graph.Edge, 0)
+	for edges := node.GetEdges(graph.OutgoingEdge); edges.Next(); {
+		edge := edges.Edge()
+		to := edge.GetTo()
+		if !IsDocumentNode(to) || to.GetLabels().Has(PendingLinkTerm) {
+			continue
+		}
+		ret = append(ret, edge)
+	}
+	return ret
+}
+
+// moveChild moves the target of the edge under the new parent. If
+// index is not negative, sets the attribute index of the child.
+func (gb GraphBuilder) moveChild(newParent graph.Node, edge graph.Edge, index int) {
+	child := edge.GetTo()
+	gb.targetGraph.NewEdge(newParent, child, edge.GetLabel(), cloneEdgeProperties(edge))
+	edge.Remove()
+	if index >= 0 {
+		SetNodeIndex(child, index)
+	}
+}
+
+// removeDocumentSubtree removes the document node and the document
+// nodes under it. Nested entities are removed if they are not
+// referenced from outside the subtree.
+func (gb GraphBuilder) removeDocumentSubtree(root graph.Node) {
+	remove := make(map[graph.Node]struct{})
+	var collect func(graph.Node)
+	collect = func(node graph.Node) {
+		IterateDescendants(node, func(n graph.Node) bool {
+			remove[n] = struct{}{}
+			return true
+		}, func(edge graph.Edge) EdgeFuncResult {
+			to := edge.GetTo()
+			if !IsDocumentNode(to) {
+				return SkipEdgeResult
+			}
+			if IsNodeEntityRoot(to) {
+				if edge.GetLabel() == HasTerm && len(GetParentDocumentNodes(to)) == 1 {
+					collect(to)
+				}
+				return SkipEdgeResult
+			}
+			return FollowEdgeResult
+		}, false)
+	}
+	collect(root)
+	for n := range remove {
+		if gb.entityIndex.index != nil {
+			gb.entityIndex.index.Remove(n)
+		}
+		n.DetachAndRemove()
+	}
+}
+
+func cloneEdgeProperties(edge graph.Edge) map[string]interface{} {
+	properties := make(map[string]interface{})
+	edge.ForEachProperty(func(key string, value interface{}) bool {
+		if p, ok := value.(*PropertyValue); ok {
+			properties[key] = p.Clone()
+		} else {
+			properties[key] = value
+		}
+		return true
+	})
+	return properties
+}
+
+func nodeValueString(node graph.Node) string {
+	s, _ := GetRawNodeValue(node)
+	return s
+}
+
+func propertyValueString(p *PropertyValue) string {
+	if p.IsStringSlice() {
+		return fmt.Sprint(p.AsStringSlice())
+	}
+	return p.AsString()
+}
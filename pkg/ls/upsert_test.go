@@ -0,0 +1,129 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+const upsertTestSchema = `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@id": "https://person",
+  "@type": "ls:Schema",
+  "ls:valueType": "Person",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "person",
+    "ls:entityIdFields": "id",
+    "ls:Object/attributes": [
+      {"@id": "id", "@type": "ls:Value"},
+      {"@id": "name", "@type": "ls:Value"},
+      {"@id": "nickname", "@type": "ls:Value", "ls:mergePolicy": "keepFirst"},
+      {"@id": "email", "@type": "ls:Value"},
+      {"@id": "phones", "@type": "ls:Array", "ls:mergePolicy": "append", "ls:Array/elements": {"@id": "phone", "@type": "ls:Value"}}
+    ]
+  }
+}`
+
+func TestUpsertEntities(t *testing.T) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(upsertTestSchema), &v); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := UnmarshalLayer(v, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler := Compiler{
+		Loader: SchemaLoaderFunc(func(string) (*Layer, error) { return layer, nil }),
+	}
+	layer, err = compiler.Compile(DefaultContext(), "https://person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := NewGraphBuilder(nil, GraphBuilderOptions{EmbedSchemaNodes: true})
+	ingest := func(values map[string]string, phones ...string) graph.Node {
+		_, root, _ := builder.ObjectAsNode(layer.GetSchemaRootNode(), nil)
+		for k, v := range values {
+			builder.ValueAsNode(layer.GetAttributeByID(k), root, v)
+		}
+		_, arr, _ := builder.ArrayAsNode(layer.GetAttributeByID("phones"), root)
+		for i, p := range phones {
+			_, n, _ := builder.ValueAsNode(layer.GetAttributeByID("phone"), arr, p)
+			SetNodeIndex(n, i)
+		}
+		return root
+	}
+	existing := ingest(map[string]string{"id": "1", "name": "John", "nickname": "Johnny"}, "111")
+	ingest(map[string]string{"id": "1", "name": "Jon", "nickname": "J", "email": "j@example.org"}, "222", "333")
+	other := ingest(map[string]string{"id": "2", "name": "Jane"})
+
+	report := NewUpsertReport()
+	if err := builder.UpsertEntities(UpsertOptions{}, report); err != nil {
+		t.Fatal(err)
+	}
+	if builder.GetEntityIndex().Len() != 2 {
+		t.Errorf("Expecting 2 entities, got %d", builder.GetEntityIndex().Len())
+	}
+	if nodes := builder.GetEntityIndex().Find("https://person", []string{"1"}); len(nodes) != 1 || nodes[0] != existing {
+		t.Errorf("Wrong entity: %v", nodes)
+	}
+	if nodes := builder.GetEntityIndex().Find("https://person", []string{"2"}); len(nodes) != 1 || nodes[0] != other {
+		t.Errorf("Wrong entity: %v", nodes)
+	}
+	values := make(map[string][]string)
+	IterateDescendants(existing, func(n graph.Node) bool {
+		if s, ok := GetRawNodeValue(n); ok {
+			id := AsPropertyValue(n.GetProperty(SchemaNodeIDTerm)).AsString()
+			values[id] = append(values[id], s)
+		}
+		return true
+	}, OnlyDocumentNodes, true)
+	expected := map[string][]string{
+		"id":       {"1"},
+		"name":     {"Jon"},
+		"nickname": {"Johnny"},
+		"email":    {"j@example.org"},
+		"phone":    {"111", "222", "333"},
+	}
+	for k, v := range expected {
+		if len(values[k]) != len(v) {
+			t.Errorf("Wrong values for %s: %v", k, values[k])
+			continue
+		}
+		for i := range v {
+			if values[k][i] != v[i] {
+				t.Errorf("Wrong values for %s: %v", k, values[k])
+			}
+		}
+	}
+	if len(report.Entities) != 1 {
+		t.Errorf("Wrong report: %+v", report)
+		return
+	}
+	kinds := make(map[string]string)
+	for _, c := range report.Entities[0].Changes {
+		kinds[c.SchemaNodeID] = c.Kind
+	}
+	if kinds["name"] != AttributeReplaced || kinds["email"] != AttributeAdded || kinds["phones"] != AttributeAppended {
+		t.Errorf("Wrong changes: %+v", report.Entities[0].Changes)
+	}
+	if _, ok := kinds["nickname"]; ok {
+		t.Errorf("Unexpected nickname change")
+	}
+}
@@ -0,0 +1,499 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	// VersionTerm is the semantic version of a layer. It is defined
+	// at the layer node.
+	VersionTerm = NewTerm(LS, "version", false, false, OverrideComposition, nil)
+
+	// TargetVersionTerm is a version constraint for overlays,
+	// declaring the versions of the schema the overlay can be
+	// applied to. It is defined at the layer node.
+	TargetVersionTerm = NewTerm(LS, "targetVersion", false, false, OverrideComposition, nil)
+)
+
+// ErrInvalidVersion is returned if a version or a version constraint
+// cannot be parsed
+type ErrInvalidVersion string
+
+func (e ErrInvalidVersion) Error() string {
+	return fmt.Sprintf("Invalid version: %s", string(e))
+}
+
+// ErrVersionMismatch is returned if a loaded layer does not satisfy
+// the requested version constraint
+type ErrVersionMismatch struct {
+	ID         string
+	Version    string
+	Constraint string
+}
+
+func (e ErrVersionMismatch) Error() string {
+	return fmt.Sprintf("Layer %s version %s does not satisfy %s", e.ID, e.Version, e.Constraint)
+}
+
+// Version is a semantic version
+type Version struct {
+	Major      int
+	Minor      int
+	Patch      int
+	PreRelease string
+}
+
+// ParseVersion parses a semantic version. The version can be given
+// as major, major.minor, or major.minor.patch, optionally followed
+// by -prerelease. A leading "v" is ignored. Build metadata after "+"
+// is ignored.
+func ParseVersion(s string) (Version, error) {
+	v, n, err := parsePartialVersion(s)
+	if err != nil {
+		return Version{}, err
+	}
+	if n == 0 {
+		return Version{}, ErrInvalidVersion(s)
+	}
+	return v, nil
+}
+
+// parsePartialVersion parses a version, and returns the number of
+// numeric components given. Wildcard components (x, X, *) end the
+// version.
+func parsePartialVersion(s string) (Version, int, error) {
+	var ret Version
+	str := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if ix := strings.IndexByte(str, '+'); ix != -1 {
+		str = str[:ix]
+	}
+	if ix := strings.IndexByte(str, '-'); ix != -1 {
+		ret.PreRelease = str[ix+1:]
+		str = str[:ix]
+	}
+	if len(str) == 0 {
+		return ret, 0, ErrInvalidVersion(s)
+	}
+	parts := strings.Split(str, ".")
+	if len(parts) > 3 {
+		return ret, 0, ErrInvalidVersion(s)
+	}
+	n := 0
+	for _, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		value, err := strconv.Atoi(part)
+		if err != nil || value < 0 {
+			return ret, 0, ErrInvalidVersion(s)
+		}
+		switch n {
+		case 0:
+			ret.Major = value
+		case 1:
+			ret.Minor = value
+		case 2:
+			ret.Patch = value
+		}
+		n++
+	}
+	return ret, n, nil
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.PreRelease) > 0 {
+		s += "-" + v.PreRelease
+	}
+	return s
+}
+
+// Compare returns -1 if v<w, 0 if v==w, and 1 if v>w. A prerelease
+// version has lower precedence than the release version.
+func (v Version) Compare(w Version) int {
+	cmp := func(a, b int) int {
+		if a < b {
+			return -1
+		}
+		if a > b {
+			return 1
+		}
+		return 0
+	}
+	if c := cmp(v.Major, w.Major); c != 0 {
+		return c
+	}
+	if c := cmp(v.Minor, w.Minor); c != 0 {
+		return c
+	}
+	if c := cmp(v.Patch, w.Patch); c != 0 {
+		return c
+	}
+	switch {
+	case v.PreRelease == w.PreRelease:
+		return 0
+	case len(v.PreRelease) == 0:
+		return 1
+	case len(w.PreRelease) == 0:
+		return -1
+	}
+	return comparePreRelease(v.PreRelease, w.PreRelease)
+}
+
+// comparePreRelease compares the dot separated prerelease
+// identifiers. Numeric identifiers are compared numerically, and have
+// lower precedence than alphanumeric identifiers. If all the
+// preceding identifiers are equal, the shorter set of identifiers has
+// lower precedence.
+func comparePreRelease(a, b string) int {
+	aIds, bIds := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aIds) && i < len(bIds); i++ {
+		aNum, aErr := strconv.ParseUint(aIds[i], 10, 64)
+		bNum, bErr := strconv.ParseUint(bIds[i], 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if aNum < bNum {
+				return -1
+			}
+			if aNum > bNum {
+				return 1
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		case aIds[i] < bIds[i]:
+			return -1
+		case aIds[i] > bIds[i]:
+			return 1
+		}
+	}
+	switch {
+	case len(aIds) < len(bIds):
+		return -1
+	case len(aIds) > len(bIds):
+		return 1
+	}
+	return 0
+}
+
+type versionComparison struct {
+	op      string
+	version Version
+}
+
+func (c versionComparison) matches(v Version) bool {
+	r := v.Compare(c.version)
+	switch c.op {
+	case "=":
+		return r == 0
+	case ">":
+		return r > 0
+	case ">=":
+		return r >= 0
+	case "<":
+		return r < 0
+	case "<=":
+		return r <= 0
+	}
+	return false
+}
+
+// VersionConstraint is a set of version ranges. A version satisfies
+// the constraint if it is in any of the ranges.
+type VersionConstraint struct {
+	source string
+	ranges [][]versionComparison
+}
+
+// ParseVersionConstraint parses a version constraint. The constraint
+// is a list of ranges separated by "||". A range is a list of
+// comparisons separated by spaces or commas. The following are
+// supported:
+//
+//	1.2.3, =1.2.3   Exact version
+//	1.2, 1.2.x      Any 1.2 version
+//	^1.2.3          >=1.2.3 <2.0.0
+//	~1.2.3          >=1.2.3 <1.3.0
+//	>, >=, <, <=    Comparisons
+//	*, or empty     Any version
+//
+// A prerelease version satisfies a range only if a comparison of the
+// range names a prerelease of the same major.minor.patch version, so
+// ^1.0 does not match 1.1.0-beta, but >=1.1.0-alpha <2 does. Any
+// version, including prereleases, satisfies * or the empty constraint.
+func ParseVersionConstraint(s string) (VersionConstraint, error) {
+	ret := VersionConstraint{source: strings.TrimSpace(s)}
+	for _, rng := range strings.Split(s, "||") {
+		comparisons := make([]versionComparison, 0)
+		for _, term := range strings.FieldsFunc(rng, func(r rune) bool { return r == ' ' || r == ',' }) {
+			c, err := parseVersionTerm(term)
+			if err != nil {
+				return VersionConstraint{}, err
+			}
+			comparisons = append(comparisons, c...)
+		}
+		ret.ranges = append(ret.ranges, comparisons)
+	}
+	return ret, nil
+}
+
+func parseVersionTerm(term string) ([]versionComparison, error) {
+	if term == "*" || term == "x" || term == "X" || term == "latest" {
+		return nil, nil
+	}
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(term, op) {
+			v, n, err := parsePartialVersion(term[len(op):])
+			if err != nil {
+				return nil, err
+			}
+			if op == "=" {
+				return partialRange(v, n), nil
+			}
+			return []versionComparison{{op: op, version: v}}, nil
+		}
+	}
+	switch term[0] {
+	case '^':
+		v, n, err := parsePartialVersion(term[1:])
+		if err != nil {
+			return nil, err
+		}
+		upper := Version{Major: v.Major + 1}
+		switch {
+		case v.Major == 0 && v.Minor == 0 && n == 3:
+			upper = Version{Patch: v.Patch + 1}
+		case v.Major == 0 && n >= 2:
+			upper = Version{Minor: v.Minor + 1}
+		}
+		return []versionComparison{{op: ">=", version: v}, {op: "<", version: upper}}, nil
+	case '~':
+		v, n, err := parsePartialVersion(term[1:])
+		if err != nil {
+			return nil, err
+		}
+		upper := Version{Major: v.Major, Minor: v.Minor + 1}
+		if n == 1 {
+			upper = Version{Major: v.Major + 1}
+		}
+		return []versionComparison{{op: ">=", version: v}, {op: "<", version: upper}}, nil
+	}
+	v, n, err := parsePartialVersion(term)
+	if err != nil {
+		return nil, err
+	}
+	return partialRange(v, n), nil
+}
+
+// partialRange returns the range for a version with n components
+// given
+func partialRange(v Version, n int) []versionComparison {
+	switch n {
+	case 0:
+		return nil
+	case 1:
+		return []versionComparison{{op: ">=", version: Version{Major: v.Major}}, {op: "<", version: Version{Major: v.Major + 1}}}
+	case 2:
+		return []versionComparison{{op: ">=", version: Version{Major: v.Major, Minor: v.Minor}}, {op: "<", version: Version{Major: v.Major, Minor: v.Minor + 1}}}
+	}
+	return []versionComparison{{op: "=", version: v}}
+}
+
+// Matches returns true if the version satisfies the constraint
+func (c VersionConstraint) Matches(v Version) bool {
+	if len(c.ranges) == 0 {
+		return true
+	}
+	for _, rng := range c.ranges {
+		ok := len(v.PreRelease) == 0 || len(rng) == 0 || namesPreRelease(rng, v)
+		for _, cmp := range rng {
+			if !ok {
+				break
+			}
+			ok = cmp.matches(v)
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// namesPreRelease returns true if one of the comparisons of the range
+// is with a prerelease of the same major.minor.patch version as v
+func namesPreRelease(rng []versionComparison, v Version) bool {
+	for _, cmp := range rng {
+		if len(cmp.version.PreRelease) > 0 && cmp.version.Major == v.Major && cmp.version.Minor == v.Minor && cmp.version.Patch == v.Patch {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesString parses the version and returns true if it satisfies
+// the constraint. An empty or invalid version only satisfies the
+// empty constraint.
+func (c VersionConstraint) MatchesString(version string) bool {
+	if len(version) == 0 {
+		return c.IsAny()
+	}
+	v, err := ParseVersion(version)
+	if err != nil {
+		return c.IsAny()
+	}
+	return c.Matches(v)
+}
+
+// IsAny returns true if the constraint matches all versions
+func (c VersionConstraint) IsAny() bool {
+	for _, rng := range c.ranges {
+		if len(rng) == 0 {
+			return true
+		}
+	}
+	return len(c.ranges) == 0
+}
+
+func (c VersionConstraint) String() string { return c.source }
+
+// SplitVersionedRef splits a reference of the form id@constraint
+// into the id and the version constraint. If the reference does not
+// have a version constraint, returns the reference and an empty
+// constraint.
+func SplitVersionedRef(ref string) (string, string) {
+	ix := strings.LastIndexByte(ref, '@')
+	if ix == -1 || ix == len(ref)-1 {
+		return ref, ""
+	}
+	constraint := ref[ix+1:]
+	// Make sure this is a version constraint, not part of a URL
+	if strings.ContainsAny(constraint, "/:") {
+		return ref, ""
+	}
+	if _, err := ParseVersionConstraint(constraint); err != nil {
+		return ref, ""
+	}
+	return ref[:ix], constraint
+}
+
+// SelectVersion returns the index of the highest version satisfying
+// the constraint, or -1 if there is none. Unversioned entries are
+// selected only if there is no constraint, and if there are no
+// versioned entries. If there is no constraint, prereleases are
+// selected only if there are no releases.
+func SelectVersion(versions []string, constraint VersionConstraint) int {
+	best := -1
+	var bestVersion Version
+	bestVersioned := false
+	anyVersion := constraint.IsAny()
+	better := func(v Version) bool {
+		if !bestVersioned {
+			return true
+		}
+		if anyVersion {
+			vPre, bestPre := len(v.PreRelease) > 0, len(bestVersion.PreRelease) > 0
+			if vPre != bestPre {
+				return bestPre
+			}
+		}
+		return v.Compare(bestVersion) > 0
+	}
+	for i, str := range versions {
+		if len(str) == 0 {
+			if anyVersion && best == -1 {
+				best = i
+			}
+			continue
+		}
+		v, err := ParseVersion(str)
+		if err != nil || !constraint.Matches(v) {
+			continue
+		}
+		if better(v) {
+			best, bestVersion, bestVersioned = i, v, true
+		}
+	}
+	return best
+}
+
+// GetVersion returns the version of the layer
+func (l *Layer) GetVersion() string {
+	return AsPropertyValue(l.layerInfo.GetProperty(VersionTerm)).AsString()
+}
+
+// SetVersion sets the version of the layer
+func (l *Layer) SetVersion(version string) {
+	if len(version) == 0 {
+		l.layerInfo.RemoveProperty(VersionTerm)
+		return
+	}
+	l.layerInfo.SetProperty(VersionTerm, StringPropertyValue(version))
+}
+
+// GetTargetVersion returns the schema version constraint of an
+// overlay
+func (l *Layer) GetTargetVersion() string {
+	return AsPropertyValue(l.layerInfo.GetProperty(TargetVersionTerm)).AsString()
+}
+
+// SetTargetVersion sets the schema version constraint of an overlay
+func (l *Layer) SetTargetVersion(constraint string) {
+	if len(constraint) == 0 {
+		l.layerInfo.RemoveProperty(TargetVersionTerm)
+		return
+	}
+	l.layerInfo.SetProperty(TargetVersionTerm, StringPropertyValue(constraint))
+}
+
+// CheckVersion checks if the layer satisfies the version constraint
+// of the reference. The reference can be of the form id@constraint.
+func (l *Layer) CheckVersion(ref string) error {
+	_, constraint := SplitVersionedRef(ref)
+	if len(constraint) == 0 {
+		return nil
+	}
+	c, err := ParseVersionConstraint(constraint)
+	if err != nil {
+		return err
+	}
+	if !c.MatchesString(l.GetVersion()) {
+		return ErrVersionMismatch{ID: l.GetID(), Version: l.GetVersion(), Constraint: constraint}
+	}
+	return nil
+}
+
+// CheckTargetVersion checks if the overlay can be applied to the
+// schema version. If the schema has no version, or if the overlay
+// has no target version, returns nil.
+func CheckTargetVersion(schema, overlay *Layer) error {
+	target := overlay.GetTargetVersion()
+	version := schema.GetVersion()
+	if len(target) == 0 || len(version) == 0 {
+		return nil
+	}
+	c, err := ParseVersionConstraint(target)
+	if err != nil {
+		return err
+	}
+	if !c.MatchesString(version) {
+		return ErrVersionMismatch{ID: schema.GetID(), Version: version, Constraint: target}
+	}
+	return nil
+}
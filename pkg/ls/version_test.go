@@ -0,0 +1,181 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ls
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVersionConstraint(t *testing.T) {
+	cases := []struct {
+		constraint string
+		version    string
+		matches    bool
+	}{
+		{"", "1.0.0", true},
+		{"*", "1.0.0", true},
+		{"1.2.3", "1.2.3", true},
+		{"=1.2.3", "1.2.4", false},
+		{"1.2", "1.2.9", true},
+		{"1.2.x", "1.3.0", false},
+		{"^2.1", "2.1.0", true},
+		{"^2.1", "2.9.3", true},
+		{"^2.1", "3.0.0", false},
+		{"^2.1", "2.0.9", false},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"~1.2.3", "1.2.9", true},
+		{"~1.2.3", "1.3.0", false},
+		{">=1.0 <2", "1.5.0", true},
+		{">=1.0, <2", "2.0.0", false},
+		{"<1 || >=3", "3.1.0", true},
+		{"<1 || >=3", "2.0.0", false},
+		{"^1.0", "1.1.0-beta", false},
+		{"~1.1.0", "1.1.1-beta", false},
+		{">=1.0 <2", "1.5.0-rc.1", false},
+		{"^1.1.0-beta", "1.1.0-beta.2", true},
+		{"^1.1.0-beta", "1.1.0", true},
+		{"^1.1.0-beta", "1.2.0-beta", false},
+		{">=1.5.0-rc.1 <2 || ^3", "1.5.0-rc.2", true},
+		{">1.5.0-rc.9", "1.5.0-rc.10", true},
+		{"*", "1.1.0-beta", true},
+		{"1.0.0", "v1.0.0", true},
+	}
+	for _, c := range cases {
+		constraint, err := ParseVersionConstraint(c.constraint)
+		if err != nil {
+			t.Errorf("%s: %v", c.constraint, err)
+			continue
+		}
+		if constraint.MatchesString(c.version) != c.matches {
+			t.Errorf("%s matches %s: expected %v", c.constraint, c.version, c.matches)
+		}
+	}
+	if _, err := ParseVersionConstraint("^a.b"); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	cases := []struct {
+		v, w string
+		cmp  int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0-rc.9", "1.0.0-rc.10", -1},
+		{"1.0.0-rc.10", "1.0.0-rc.9", 1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1},
+		{"1.0.0-rc.1", "1.0.0-rc.1", 0},
+	}
+	for _, c := range cases {
+		v, err := ParseVersion(c.v)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		w, err := ParseVersion(c.w)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if cmp := v.Compare(w); cmp != c.cmp {
+			t.Errorf("Compare %s %s: got %d expected %d", c.v, c.w, cmp, c.cmp)
+		}
+	}
+}
+
+func TestSplitVersionedRef(t *testing.T) {
+	cases := [][3]string{
+		{"http://example.org/Person@^2.1", "http://example.org/Person", "^2.1"},
+		{"http://example.org/Person", "http://example.org/Person", ""},
+		{"http://user@example.org/Person", "http://user@example.org/Person", ""},
+		{"Person@1.0.0", "Person", "1.0.0"},
+	}
+	for _, c := range cases {
+		id, constraint := SplitVersionedRef(c[0])
+		if id != c[1] || constraint != c[2] {
+			t.Errorf("%s: got %s %s", c[0], id, constraint)
+		}
+	}
+}
+
+func TestSelectVersion(t *testing.T) {
+	versions := []string{"1.0.0", "2.1.0", "", "2.3.1", "3.0.0"}
+	sel := func(s string) int {
+		c, err := ParseVersionConstraint(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return SelectVersion(versions, c)
+	}
+	if ix := sel("^2.1"); ix != 3 {
+		t.Errorf("Expected 3, got %d", ix)
+	}
+	if ix := sel(""); ix != 4 {
+		t.Errorf("Expected 4, got %d", ix)
+	}
+	if ix := sel("^4"); ix != -1 {
+		t.Errorf("Expected -1, got %d", ix)
+	}
+	versions = []string{"2.1.0", "2.2.0-beta", "1.0.0"}
+	if ix := sel("^2"); ix != 0 {
+		t.Errorf("Expected 0, got %d", ix)
+	}
+	if ix := sel(""); ix != 0 {
+		t.Errorf("Expected 0, got %d", ix)
+	}
+	if ix := sel("^2.2.0-alpha"); ix != 1 {
+		t.Errorf("Expected 1, got %d", ix)
+	}
+	versions = []string{"2.0.0-beta", "2.0.0-alpha"}
+	if ix := sel(""); ix != 0 {
+		t.Errorf("Expected 0, got %d", ix)
+	}
+	if ix := SelectVersion([]string{""}, VersionConstraint{}); ix != 0 {
+		t.Errorf("Expected 0, got %d", ix)
+	}
+}
+
+func TestLayerVersion(t *testing.T) {
+	schema := NewLayer()
+	schema.SetID("http://example.org/Person")
+	schema.SetVersion("2.1.0")
+	if err := schema.CheckVersion("http://example.org/Person@^2"); err != nil {
+		t.Error(err)
+	}
+	var mismatch ErrVersionMismatch
+	if err := schema.CheckVersion("http://example.org/Person@^3"); !errors.As(err, &mismatch) {
+		t.Errorf("Expected version mismatch, got %v", err)
+	}
+	overlay := NewLayer()
+	overlay.SetLayerType(OverlayTerm)
+	overlay.SetTargetVersion("~2.0")
+	if err := CheckTargetVersion(schema, overlay); err == nil {
+		t.Errorf("Expected version mismatch")
+	}
+	overlay.SetTargetVersion("^2")
+	if err := CheckTargetVersion(schema, overlay); err != nil {
+		t.Error(err)
+	}
+	schema.SetVersion("")
+	if schema.GetVersion() != "" {
+		t.Errorf("Version not removed")
+	}
+}
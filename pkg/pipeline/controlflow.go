@@ -0,0 +1,288 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cloudprivacylabs/opencypher"
+)
+
+// continuationError wraps the errors returned from the steps
+// following a sub-pipeline, so they are not mistaken for the errors
+// of the sub-pipeline itself
+type continuationError struct {
+	err error
+}
+
+func (e continuationError) Error() string { return e.err.Error() }
+func (e continuationError) Unwrap() error { return e.err }
+
+// runSubPipeline runs the sub-pipeline using the graph of ctx. Once
+// the sub-pipeline completes, the remaining steps of ctx are run
+// using the graph produced by the sub-pipeline. Errors returned from
+// the remaining steps are wrapped in continuationError. If
+// copyOnWrite is set, the sub-pipeline copies the graph before
+// modifying it, so the graph of ctx is kept if the sub-pipeline
+// fails. Otherwise, the sub-pipeline shares the graph of ctx.
+func runSubPipeline(ctx *PipelineContext, pipe Pipeline, label string, copyOnWrite bool) error {
+	sub := &PipelineContext{
+		Context:     ctx.Context,
+		graph:       ctx.graph,
+		roots:       ctx.roots,
+		Inputs:      ctx.Inputs,
+		Output:      ctx.Output,
+		Properties:  ctx.Properties,
+		currentStep: -1,
+		graphOwner:  ctx.graphOwner,
+		metrics:     ctx.metrics,
+		stack:       ctx.stack,
+		path:        ctx.subPath(label),
+	}
+	if !copyOnWrite && ctx.graphOwner == ctx {
+		sub.graphOwner = sub
+		sub.entityIndex, sub.entityIndexGraph = ctx.entityIndex, ctx.entityIndexGraph
+	}
+	sub.steps = make(Pipeline, 0, len(pipe)+1)
+	sub.steps = append(sub.steps, pipe...)
+	sub.steps = append(sub.steps, internalStep(func(s *PipelineContext) error {
+		ctx.graph = s.graph
+		ctx.roots = s.roots
+		ctx.entityIndex, ctx.entityIndexGraph = s.entityIndex, s.entityIndexGraph
+		if s.graphOwner == s {
+			ctx.graphOwner = ctx
+		} else {
+			ctx.graphOwner = s.graphOwner
+		}
+		if err := ctx.Next(); err != nil {
+			return continuationError{err: err}
+		}
+		return nil
+	}))
+	return sub.Next()
+}
+
+// subPath returns the path prefix for a sub-pipeline of the running
+// step
+func (ctx *PipelineContext) subPath(label string) string {
+	return fmt.Sprintf("%s%d/%s/", ctx.path, ctx.currentStep, label)
+}
+
+// unwrapContinuation returns the error of the following steps if err
+// is a continuationError
+func unwrapContinuation(err error) error {
+	var cerr continuationError
+	if errors.As(err, &cerr) {
+		return cerr.err
+	}
+	return err
+}
+
+// IfStep runs a sub-pipeline based on an openCypher predicate
+// evaluated on the current graph
+type IfStep struct {
+	Condition string   `json:"condition" yaml:"condition"`
+	Then      Pipeline `json:"then" yaml:"then"`
+	Else      Pipeline `json:"else" yaml:"else"`
+
+	parsed opencypher.Evaluatable
+}
+
+func (IfStep) Help() {
+	fmt.Println(`Conditional execution
+Evaluate an openCypher query on the current graph, and run one of
+the sub-pipelines based on the result. The condition is true if the
+query returns a single true value, or a nonempty result set. The pipeline continues
+with the steps following the if step.
+
+operation: if
+params:
+  condition: openCypher query # match (n:Person) return n, or return 1>0
+  then:
+    -
+  else:
+    - `)
+}
+
+// Evaluate the condition on the current graph of the pipeline
+func (step *IfStep) Evaluate(pipeline *PipelineContext) (bool, error) {
+	if step.parsed == nil {
+		var err error
+		step.parsed, err = opencypher.Parse(step.Condition)
+		if err != nil {
+			return false, err
+		}
+	}
+	v, err := step.parsed.Evaluate(opencypher.NewEvalContext(pipeline.GetGraphRO()))
+	if err != nil {
+		return false, err
+	}
+	if b, ok := opencypher.ValueAsBool(v); ok {
+		return b, nil
+	}
+	if rs, ok := v.Get().(opencypher.ResultSet); ok {
+		// A single boolean value is the result of the condition
+		if len(rs.Rows) == 1 && len(rs.Rows[0]) == 1 {
+			for _, x := range rs.Rows[0] {
+				if b, ok := opencypher.ValueAsBool(x); ok {
+					return b, nil
+				}
+			}
+		}
+		return len(rs.Rows) > 0, nil
+	}
+	return v.Get() != nil, nil
+}
+
+func (step *IfStep) Run(pipeline *PipelineContext) error {
+	cond, err := step.Evaluate(pipeline)
+	if err != nil {
+		return err
+	}
+	pipeline.GetLogger().Debug(map[string]interface{}{"if": step.Condition, "result": cond})
+	if cond {
+		return unwrapContinuation(runSubPipeline(pipeline, step.Then, "then", false))
+	}
+	return unwrapContinuation(runSubPipeline(pipeline, step.Else, "else", false))
+}
+
+// TryStep runs a sub-pipeline, and if that fails, runs the onError
+// sub-pipeline
+type TryStep struct {
+	Steps   Pipeline `json:"steps" yaml:"steps"`
+	OnError Pipeline `json:"onError" yaml:"onError"`
+}
+
+func (TryStep) Help() {
+	fmt.Println(`Error handling
+Run the steps. If any of the steps fail, run the onError steps using
+the graph before the try step. The error message is available in the
+"error" pipeline property. Errors from the steps following the try
+step are not handled. The pipeline continues after the error is handled.
+
+operation: try
+params:
+  steps:
+    -
+  onError:
+    - `)
+}
+
+func (step *TryStep) Run(pipeline *PipelineContext) error {
+	graph, roots, owner := pipeline.graph, pipeline.roots, pipeline.graphOwner
+	err := runSubPipeline(pipeline, step.Steps, "steps", true)
+	if err == nil {
+		return nil
+	}
+	var cerr continuationError
+	if errors.As(err, &cerr) {
+		return cerr.err
+	}
+	pipeline.GetLogger().Error(map[string]interface{}{"try": err.Error()})
+	pipeline.graph, pipeline.roots, pipeline.graphOwner = graph, roots, owner
+	pipeline.InvalidateEntityIndex()
+	pipeline.Properties["error"] = err.Error()
+	onError := make(Pipeline, 0, len(step.OnError)+1)
+	onError = append(onError, step.OnError...)
+	onError = append(onError, internalStep(func(ctx *PipelineContext) error {
+		delete(ctx.Properties, "error")
+		return ctx.Next()
+	}))
+	return unwrapContinuation(runSubPipeline(pipeline, onError, "onError", false))
+}
+
+// ErrorPolicy controls the handling of record-level errors of
+// ingesters
+type ErrorPolicy struct {
+	// If true, the ingester records the failing record and the error
+	// in the dead-letter file and continues with the next record
+	ContinueOnError bool `json:"continueOnError" yaml:"continueOnError"`
+	// DeadLetterFile is the file where failing records are
+	// written. If empty, the errors are logged.
+	DeadLetterFile string `json:"deadLetterFile" yaml:"deadLetterFile"`
+	// DeadLetter is the writer for failing records. If nil,
+	// DeadLetterFile is used.
+	DeadLetter io.Writer `json:"-" yaml:"-"`
+
+	deadLetterFile *os.File
+}
+
+// ErrorPolicyHelp is the help text for the error policy parameters
+const ErrorPolicyHelp = `
+  # Error handling
+  continueOnError: false # If true, failing records are skipped
+  deadLetterFile: ""     # Failing records and errors are appended to this file as JSON lines`
+
+// DeadLetterRecord is a failed record written to the dead-letter
+// file
+type DeadLetterRecord struct {
+	Input  string      `json:"input"`
+	Record int         `json:"record"`
+	Data   interface{} `json:"data,omitempty"`
+	Error  string      `json:"error"`
+}
+
+// HandleError handles a record error based on the policy. If the
+// error should stop the pipeline, returns err. Otherwise, records
+// the failed record and returns nil.
+func (policy *ErrorPolicy) HandleError(pipeline *PipelineContext, input string, record int, data interface{}, err error) error {
+	if err == nil || !policy.ContinueOnError {
+		return err
+	}
+	// Do not continue if the pipeline is canceled
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	rec := DeadLetterRecord{
+		Input:  input,
+		Record: record,
+		Data:   data,
+		Error:  err.Error(),
+	}
+	pipeline.GetLogger().Error(map[string]interface{}{"input": rec.Input, "record": rec.Record, "error": rec.Error})
+	if policy.DeadLetter == nil {
+		if len(policy.DeadLetterFile) == 0 {
+			return nil
+		}
+		f, err := os.OpenFile(policy.DeadLetterFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		policy.deadLetterFile = f
+		policy.DeadLetter = f
+	}
+	return json.NewEncoder(policy.DeadLetter).Encode(rec)
+}
+
+// Close closes the dead-letter file if it was opened
+func (policy *ErrorPolicy) Close() error {
+	if policy.deadLetterFile == nil {
+		return nil
+	}
+	err := policy.deadLetterFile.Close()
+	policy.DeadLetter = nil
+	policy.deadLetterFile = nil
+	return err
+}
+
+func init() {
+	RegisterStep("if", func() Step { return &IfStep{} })
+	RegisterStep("try", func() Step { return &TryStep{} })
+}
@@ -0,0 +1,232 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+)
+
+type ForkStep struct {
+	Steps map[string]Pipeline `json:"pipelines" yaml:"pipelines"`
+	// MaxParallel limits the number of branches running
+	// concurrently. If zero, all branches run concurrently.
+	MaxParallel int `json:"maxParallel" yaml:"maxParallel"`
+	// order keeps the declared order of the branches
+	order []string
+}
+
+func (ForkStep) Help() {
+	fmt.Println(`Create multiple parallel pipelines.
+
+Each pipeline runs concurrently on its own copy of the graph. The
+output of each pipeline is kept in memory, and the outputs are written
+in the declared order once all pipelines complete. Inputs read from a
+stream, such as stdin, are read into memory so every pipeline reads
+the whole input. If some pipelines fail, errors of all failing
+pipelines are reported.
+
+operation: fork
+params: 
+  maxParallel: 0  # Max number of pipelines to run concurrently. 0 means no limit.
+  pipelines:
+    pipelineName:
+      -
+      -
+    pipelineName:
+      -
+      -`)
+}
+
+// UnmarshalJSON unmarshals the fork step, keeping the declared order
+// of the pipelines
+func (fork *ForkStep) UnmarshalJSON(in []byte) error {
+	var aux struct {
+		Steps       json.RawMessage `json:"pipelines"`
+		MaxParallel int             `json:"maxParallel"`
+	}
+	if err := json.Unmarshal(in, &aux); err != nil {
+		return err
+	}
+	fork.MaxParallel = aux.MaxParallel
+	fork.Steps = make(map[string]Pipeline)
+	fork.order = nil
+	if len(aux.Steps) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(aux.Steps, &fork.Steps); err != nil {
+		return err
+	}
+	// Scan the keys of the pipelines object in order
+	dec := json.NewDecoder(bytes.NewReader(aux.Steps))
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if key, ok := tok.(string); ok {
+			fork.order = append(fork.order, key)
+		}
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetOrder returns the pipeline names in declared order. If the
+// order is not known, the names are sorted.
+func (fork ForkStep) GetOrder() []string {
+	if len(fork.order) == len(fork.Steps) {
+		return fork.order
+	}
+	ret := make([]string, 0, len(fork.Steps))
+	for k := range fork.Steps {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// ErrFork contains the errors from all failing fork pipelines, in
+// declared order
+type ErrFork struct {
+	Errors []error
+}
+
+func (e ErrFork) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, x := range e.Errors {
+		msgs = append(msgs, x.Error())
+	}
+	return fmt.Sprintf("Fork errors: %s", strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the first error
+func (e ErrFork) Unwrap() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e.Errors[0]
+}
+
+func (fork ForkStep) Run(ctx *PipelineContext) error {
+	names := fork.GetOrder()
+	// The output of each pipeline is buffered in full, so the outputs
+	// are not interleaved
+	outputs := make([]bytes.Buffer, len(names))
+	inputs := shareInputs(ctx.Inputs)
+	errs := make([]error, len(names))
+	var sem chan struct{}
+	if fork.MaxParallel > 0 {
+		sem = make(chan struct{}, fork.MaxParallel)
+	}
+	wg := sync.WaitGroup{}
+	for i, name := range names {
+		wg.Add(1)
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		go func(index int, name string) {
+			defer wg.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			errs[index] = forkPipeline(fork.Steps[name], ctx, name, inputs, &outputs[index])
+		}(i, name)
+	}
+	wg.Wait()
+	for i := range outputs {
+		if _, err := outputs[i].WriteTo(ctx.Output); err != nil {
+			return err
+		}
+	}
+	ferr := ErrFork{}
+	for _, err := range errs {
+		if err != nil {
+			ferr.Errors = append(ferr.Errors, err)
+		}
+	}
+	if len(ferr.Errors) == 1 {
+		return ferr.Errors[0]
+	}
+	if len(ferr.Errors) > 0 {
+		return ferr
+	}
+	return nil
+}
+
+// forkLogger adds the fork name to all log messages
+type forkLogger struct {
+	ls.Logger
+	name string
+}
+
+func (l forkLogger) props(properties map[string]interface{}) map[string]interface{} {
+	ret := make(map[string]interface{}, len(properties)+1)
+	for k, v := range properties {
+		ret[k] = v
+	}
+	ret["fork"] = l.name
+	return ret
+}
+
+func (l forkLogger) Debug(properties map[string]interface{}) { l.Logger.Debug(l.props(properties)) }
+func (l forkLogger) Info(properties map[string]interface{})  { l.Logger.Info(l.props(properties)) }
+func (l forkLogger) Error(properties map[string]interface{}) { l.Logger.Error(l.props(properties)) }
+
+func forkPipeline(pipe Pipeline, ctx *PipelineContext, name string, inputs []Input, output io.Writer) error {
+	// Each fork gets its own interner
+	lsContext := ls.NewContext(ctx.Context.Context)
+	lsContext.SetLogger(forkLogger{Logger: ctx.GetLogger(), name: name})
+	pctx := &PipelineContext{
+		Context:     lsContext,
+		graph:       ctx.graph,
+		roots:       ctx.roots,
+		Inputs:      inputs,
+		Output:      output,
+		steps:       pipe,
+		currentStep: -1,
+		graphOwner:  ctx.graphOwner,
+		metrics:     ctx.metrics,
+		stack:       &metricsStack{},
+		path:        ctx.subPath(name),
+	}
+	cpMap := make(map[string]interface{})
+	for k, prop := range ctx.Properties {
+		cpMap[k] = prop
+	}
+	pctx.Properties = cpMap
+	pctx.Context.GetLogger().Debug(map[string]interface{}{"Starting new fork": name})
+	if err := pctx.Next(); err != nil {
+		return fmt.Errorf("fork: %s, %w", name, err)
+	}
+	return nil
+}
+
+func init() {
+	RegisterStep("fork", func() Step { return &ForkStep{} })
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Input is a named input stream of a pipeline
+type Input interface {
+	// Name returns the name of the input, used in error messages
+	Name() string
+	// Open returns a reader for the input. The caller must close
+	// the reader.
+	Open() (io.ReadCloser, error)
+}
+
+type fileInput string
+
+func (f fileInput) Name() string                 { return string(f) }
+func (f fileInput) Open() (io.ReadCloser, error) { return os.Open(string(f)) }
+
+// FileInput returns an input that reads from a file
+func FileInput(file string) Input {
+	return fileInput(file)
+}
+
+// FileInputs returns inputs reading from the given files
+func FileInputs(files ...string) []Input {
+	ret := make([]Input, 0, len(files))
+	for _, x := range files {
+		ret = append(ret, FileInput(x))
+	}
+	return ret
+}
+
+type readerInput struct {
+	name   string
+	reader io.Reader
+}
+
+func (r readerInput) Name() string { return r.name }
+func (r readerInput) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(r.reader), nil
+}
+
+// ReaderInput returns an input that reads from the given reader. The
+// reader is not closed by the pipeline.
+func ReaderInput(name string, reader io.Reader) Input {
+	return readerInput{name: name, reader: reader}
+}
+
+// bufferedInput reads the reader of a reader input into memory the
+// first time it is opened, so it can be opened more than once, and
+// concurrently
+type bufferedInput struct {
+	name   string
+	reader io.Reader
+	once   sync.Once
+	data   []byte
+	err    error
+}
+
+func (b *bufferedInput) Name() string { return b.name }
+func (b *bufferedInput) Open() (io.ReadCloser, error) {
+	b.once.Do(func() {
+		b.data, b.err = ioutil.ReadAll(b.reader)
+	})
+	if b.err != nil {
+		return nil, b.err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b.data)), nil
+}
+
+// shareInputs returns the inputs to be shared by concurrent
+// pipelines. A reader input can only be read once, so reader inputs
+// are read into memory the first time they are opened, and every
+// pipeline reads the whole input.
+func shareInputs(inputs []Input) []Input {
+	ret := make([]Input, 0, len(inputs))
+	for _, input := range inputs {
+		if r, ok := input.(readerInput); ok {
+			input = &bufferedInput{name: r.name, reader: r.reader}
+		}
+		ret = append(ret, input)
+	}
+	return ret
+}
+
+// InputFunc returns an input that calls open to get the reader
+func InputFunc(name string, open func() (io.ReadCloser, error)) Input {
+	return funcInput{name: name, open: open}
+}
+
+type funcInput struct {
+	name string
+	open func() (io.ReadCloser, error)
+}
+
+func (f funcInput) Name() string                 { return f.name }
+func (f funcInput) Open() (io.ReadCloser, error) { return f.open() }
@@ -0,0 +1,191 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// StepMetrics contains the metrics collected for a pipeline
+// step. Node and edge counts are summed over all invocations.
+type StepMetrics struct {
+	// Path identifies the step in the pipeline. Steps of
+	// sub-pipelines have paths of the form parentStep/branch/step.
+	Path string `json:"path"`
+	// Name is the type of the step
+	Name string `json:"name"`
+	// Invocations is the number of times the step ran. Steps
+	// following an ingester running by rows run once for each row.
+	Invocations int `json:"invocations"`
+	// Errors is the number of invocations that failed. Errors
+	// returned from the following steps are not counted.
+	Errors int `json:"errors"`
+	// WallTime is the time spent in the step, excluding the time
+	// spent in the following steps
+	WallTime time.Duration `json:"wallTimeNs"`
+	NodesIn  int           `json:"nodesIn"`
+	EdgesIn  int           `json:"edgesIn"`
+	NodesOut int           `json:"nodesOut"`
+	EdgesOut int           `json:"edgesOut"`
+}
+
+// Metrics collects step metrics of a pipeline run. It is safe for
+// concurrent use.
+type Metrics struct {
+	mu    sync.Mutex
+	steps map[string]*StepMetrics
+	order []string
+}
+
+// NewMetrics returns a new empty metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{steps: make(map[string]*StepMetrics)}
+}
+
+// Steps returns a copy of the step metrics in the order the steps
+// first ran
+func (m *Metrics) Steps() []StepMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([]StepMetrics, 0, len(m.order))
+	for _, k := range m.order {
+		ret = append(ret, *m.steps[k])
+	}
+	return ret
+}
+
+// MarshalJSON writes the step metrics as a JSON array
+func (m *Metrics) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Steps())
+}
+
+// WriteTable writes the step metrics as a text table
+func (m *Metrics) WriteTable(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Step\tName\tInvocations\tErrors\tWall time\tNodes in\tEdges in\tNodes out\tEdges out\t")
+	var total time.Duration
+	for _, s := range m.Steps() {
+		total += s.WallTime
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%d\t%d\t%d\t%d\t\n", s.Path, s.Name, s.Invocations, s.Errors, s.WallTime.Round(time.Microsecond), s.NodesIn, s.EdgesIn, s.NodesOut, s.EdgesOut)
+	}
+	fmt.Fprintf(w, "\tTotal\t\t\t%s\t\t\t\t\t\n", total.Round(time.Microsecond))
+	return w.Flush()
+}
+
+func (m *Metrics) get(path, name string) *StepMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.steps[path]
+	if s == nil {
+		s = &StepMetrics{Path: path, Name: name}
+		m.steps[path] = s
+		m.order = append(m.order, path)
+	}
+	return s
+}
+
+// metricsFrame keeps the timing information of a running step
+type metricsFrame struct {
+	step        *StepMetrics
+	start       time.Time
+	childTime   time.Duration
+	outRecorded bool
+}
+
+// metricsStack is the stack of running steps. Nested pipelines share
+// the stack, forks running concurrently have their own stacks.
+type metricsStack struct {
+	frames []*metricsFrame
+}
+
+func (s *metricsStack) top() *metricsFrame {
+	if len(s.frames) == 0 {
+		return nil
+	}
+	return s.frames[len(s.frames)-1]
+}
+
+// internalStep is used to connect sub-pipelines to their parent
+// pipelines. Metrics are not collected for internal steps.
+type internalStep func(*PipelineContext) error
+
+func (f internalStep) Run(ctx *PipelineContext) error { return f(ctx) }
+
+// GetMetrics returns the metrics of the pipeline run
+func (ctx *PipelineContext) GetMetrics() *Metrics {
+	return ctx.metrics
+}
+
+func (ctx *PipelineContext) graphCounts() (int, int) {
+	if ctx.graph == nil {
+		return 0, 0
+	}
+	return ctx.graph.NumNodes(), ctx.graph.NumEdges()
+}
+
+// recordOutput records the graph counts for the running step when it
+// calls Next the first time
+func (ctx *PipelineContext) recordOutput() {
+	if ctx.metrics == nil {
+		return
+	}
+	frame := ctx.stack.top()
+	if frame == nil || frame.outRecorded {
+		return
+	}
+	frame.outRecorded = true
+	nodes, edges := ctx.graphCounts()
+	ctx.metrics.mu.Lock()
+	frame.step.NodesOut += nodes
+	frame.step.EdgesOut += edges
+	ctx.metrics.mu.Unlock()
+}
+
+func (ctx *PipelineContext) beginStep(step Step) *metricsFrame {
+	path := ctx.path + strconv.Itoa(ctx.currentStep)
+	name := strings.TrimPrefix(fmt.Sprintf("%T", step), "*")
+	sm := ctx.metrics.get(path, name)
+	nodes, edges := ctx.graphCounts()
+	ctx.metrics.mu.Lock()
+	sm.Invocations++
+	sm.NodesIn += nodes
+	sm.EdgesIn += edges
+	ctx.metrics.mu.Unlock()
+	frame := &metricsFrame{step: sm, start: time.Now()}
+	ctx.stack.frames = append(ctx.stack.frames, frame)
+	return frame
+}
+
+func (ctx *PipelineContext) endStep(frame *metricsFrame, failed bool) {
+	ctx.recordOutput()
+	elapsed := time.Since(frame.start)
+	ctx.stack.frames = ctx.stack.frames[:len(ctx.stack.frames)-1]
+	if parent := ctx.stack.top(); parent != nil {
+		parent.childTime += elapsed
+	}
+	ctx.metrics.mu.Lock()
+	frame.step.WallTime += elapsed - frame.childTime
+	if failed {
+		frame.step.Errors++
+	}
+	ctx.metrics.mu.Unlock()
+}
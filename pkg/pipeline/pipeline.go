@@ -0,0 +1,249 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pipeline contains the pipeline engine. A pipeline is a
+// list of steps that run in order. Each step does its work, and
+// calls PipelineContext.Next to run the remaining steps.
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+// PipelineContext keeps the state of a running pipeline
+type PipelineContext struct {
+	*ls.Context
+	graph graph.Graph
+	roots []graph.Node
+	// Inputs are the input streams of the pipeline
+	Inputs []Input
+	// Output is where the pipeline steps write their output
+	Output      io.Writer
+	currentStep int
+	steps       []Step
+	Properties  map[string]interface{}
+	graphOwner  *PipelineContext
+	// entityIndex is the entity index of entityIndexGraph. It is
+	// rebuilt if the pipeline graph changes.
+	entityIndex      *ls.EntityIndex
+	entityIndexGraph graph.Graph
+
+	metrics *Metrics
+	stack   *metricsStack
+	// path is the prefix for the step paths of this pipeline
+	path string
+}
+
+// Step is a pipeline step. A step should call PipelineContext.Next
+// to run the following steps.
+type Step interface {
+	Run(*PipelineContext) error
+}
+
+// Finisher is implemented by steps that collect the results of all
+// inputs before running the remaining steps, such as steps that
+// accumulate graphs. Once the pipeline run completes, Finish is
+// called for the finisher steps in order. A finisher that passes its
+// results to the following steps should call PipelineContext.Next to
+// run them. Finishers of sub-pipelines are not called.
+type Finisher interface {
+	Finish(*PipelineContext) error
+}
+
+// Pipeline is a list of steps
+type Pipeline []Step
+
+// StepFunc is a Step implemented as a function
+type StepFunc func(*PipelineContext) error
+
+func (f StepFunc) Run(ctx *PipelineContext) error { return f(ctx) }
+
+// NewContext returns a new pipeline context that will run the given
+// steps on an empty document graph. The pipeline can be canceled
+// using the context.Context of lsContext.
+func NewContext(lsContext *ls.Context, steps ...Step) *PipelineContext {
+	ctx := &PipelineContext{
+		Context:     lsContext,
+		graph:       ls.NewDocumentGraph(),
+		Output:      ioutil.Discard,
+		steps:       steps,
+		currentStep: -1,
+		Properties:  make(map[string]interface{}),
+		metrics:     NewMetrics(),
+		stack:       &metricsStack{},
+	}
+	ctx.Properties[VarsProperty] = make(map[string]string)
+	ctx.graphOwner = ctx
+	return ctx
+}
+
+// SetInputs sets the pipeline inputs
+func (ctx *PipelineContext) SetInputs(inputs ...Input) *PipelineContext {
+	ctx.Inputs = inputs
+	return ctx
+}
+
+// SetOutput sets the pipeline output
+func (ctx *PipelineContext) SetOutput(w io.Writer) *PipelineContext {
+	ctx.Output = w
+	return ctx
+}
+
+// SetVars sets the pipeline variables. The variables are available
+// to the steps in the "vars" property.
+func (ctx *PipelineContext) SetVars(vars map[string]string) *PipelineContext {
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	ctx.Properties[VarsProperty] = vars
+	return ctx
+}
+
+// GetVars returns the pipeline variables
+func (ctx *PipelineContext) GetVars() map[string]string {
+	vars, _ := ctx.Properties[VarsProperty].(map[string]string)
+	return vars
+}
+
+// Run runs the pipeline from the first step, and then finishes the
+// finisher steps
+func (ctx *PipelineContext) Run() error {
+	ctx.currentStep = -1
+	if err := ctx.Next(); err != nil {
+		return err
+	}
+	for i, step := range ctx.steps {
+		finisher, ok := step.(Finisher)
+		if !ok {
+			continue
+		}
+		ctx.currentStep = i
+		err := finisher.Finish(ctx)
+		ctx.currentStep = -1
+		var perr ErrPipeline
+		if err != nil && !errors.As(err, &perr) {
+			err = ErrPipeline{Wrapped: err, Step: i}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrPipeline is returned when a pipeline step fails
+type ErrPipeline struct {
+	Wrapped error
+	Step    int
+}
+
+func (e ErrPipeline) Error() string {
+	return fmt.Sprintf("Pipeline error at step %d: %v", e.Step, e.Wrapped)
+}
+
+func (e ErrPipeline) Unwrap() error {
+	return e.Wrapped
+}
+
+// GetGraphRO returns the current graph for read-only access
+func (ctx *PipelineContext) GetGraphRO() graph.Graph {
+	return ctx.graph
+}
+
+// GetGraphRW returns the current graph for modification. If the
+// graph is shared with other pipelines, it is copied first.
+func (ctx *PipelineContext) GetGraphRW() graph.Graph {
+	if ctx != ctx.graphOwner {
+		newTarget := graph.NewOCGraph()
+		nodeMap := ls.CopyGraph(newTarget, ctx.graph, nil, nil)
+		ctx.graph = newTarget
+		roots := make([]graph.Node, 0, len(ctx.roots))
+		for _, root := range ctx.roots {
+			roots = append(roots, nodeMap[root])
+		}
+		ctx.roots = roots
+		ctx.graphOwner = ctx
+	}
+	return ctx.graph
+}
+
+// SetGraph sets the pipeline graph. The pipeline context becomes the
+// owner of the graph.
+func (ctx *PipelineContext) SetGraph(g graph.Graph) *PipelineContext {
+	ctx.graph = g
+	ctx.roots = nil
+	ctx.graphOwner = ctx
+	ctx.entityIndex = nil
+	ctx.entityIndexGraph = nil
+	return ctx
+}
+
+// GetEntityIndex returns the entity index of the current graph. The
+// index is built on first use, and kept until the pipeline graph
+// changes. Steps that ingest data should pass this index to their
+// graph builders so the index is maintained incrementally. Steps that
+// change entity roots or entity IDs by other means must call
+// InvalidateEntityIndex.
+func (ctx *PipelineContext) GetEntityIndex() *ls.EntityIndex {
+	if ctx.entityIndex == nil || ctx.entityIndexGraph != ctx.graph {
+		ctx.entityIndex = ls.NewEntityIndexFromGraph(ctx.graph)
+		ctx.entityIndexGraph = ctx.graph
+	}
+	return ctx.entityIndex
+}
+
+// InvalidateEntityIndex discards the entity index of the current
+// graph, so it is rebuilt on next use
+func (ctx *PipelineContext) InvalidateEntityIndex() {
+	ctx.entityIndex = nil
+	ctx.entityIndexGraph = nil
+}
+
+// Next runs the next step of the pipeline. If the pipeline context
+// is canceled, returns the context error.
+func (ctx *PipelineContext) Next() error {
+	if ctx.Context != nil && ctx.Context.Context != nil {
+		if err := ctx.Context.Err(); err != nil {
+			return err
+		}
+	}
+	ctx.recordOutput()
+	ctx.currentStep++
+	if ctx.currentStep >= len(ctx.steps) {
+		ctx.currentStep--
+		return nil
+	}
+	step := ctx.steps[ctx.currentStep]
+	var frame *metricsFrame
+	if _, internal := step.(internalStep); !internal && ctx.metrics != nil {
+		frame = ctx.beginStep(step)
+	}
+	err := step.Run(ctx)
+	var perr ErrPipeline
+	failed := err != nil && !errors.As(err, &perr)
+	if failed {
+		err = ErrPipeline{Wrapped: err, Step: ctx.currentStep}
+	}
+	if frame != nil {
+		ctx.endStep(frame, failed)
+	}
+	ctx.currentStep--
+	return err
+}
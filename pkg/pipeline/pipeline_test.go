@@ -0,0 +1,371 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+func TestForkOrder(t *testing.T) {
+	var fork ForkStep
+	err := json.Unmarshal([]byte(`{"maxParallel":2,"pipelines":{"c":[],"a":[],"b":[]}}`), &fork)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(fork.GetOrder(), []string{"c", "a", "b"}) {
+		t.Errorf("Wrong order: %v", fork.GetOrder())
+	}
+	for _, name := range fork.GetOrder() {
+		name := name
+		fork.Steps[name] = Pipeline{StepFunc(func(ctx *PipelineContext) error {
+			ctx.GetGraphRW().NewNode([]string{name}, nil)
+			ctx.Output.Write([]byte(name))
+			if name != "a" {
+				return fmt.Errorf("fail %s", name)
+			}
+			return nil
+		})}
+	}
+	var buf bytes.Buffer
+	ctx := NewContext(ls.DefaultContext(), fork).SetOutput(&buf)
+	err = ctx.Run()
+	if buf.String() != "cab" {
+		t.Errorf("Wrong output: %s", buf.String())
+	}
+	var ferr ErrFork
+	if !errors.As(err, &ferr) || len(ferr.Errors) != 2 {
+		t.Errorf("Expecting 2 errors, got %v", err)
+	}
+	if ctx.GetGraphRO().NumNodes() != 0 {
+		t.Errorf("Fork modified the parent graph")
+	}
+}
+
+func TestForkReaderInput(t *testing.T) {
+	fork := ForkStep{Steps: make(map[string]Pipeline)}
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		fork.Steps[name] = Pipeline{StepFunc(func(ctx *PipelineContext) error {
+			rd, err := ctx.Inputs[0].Open()
+			if err != nil {
+				return err
+			}
+			defer rd.Close()
+			data, err := io.ReadAll(rd)
+			if err != nil {
+				return err
+			}
+			ctx.Output.Write([]byte(name + ":" + string(data) + ";"))
+			return nil
+		})}
+	}
+	var buf bytes.Buffer
+	ctx := NewContext(ls.DefaultContext(), fork).SetOutput(&buf)
+	ctx.SetInputs(ReaderInput("stdin", strings.NewReader("data")))
+	if err := ctx.Run(); err != nil {
+		t.Error(err)
+	}
+	if buf.String() != "a:data;b:data;c:data;" {
+		t.Errorf("Every fork should read the whole input, got %s", buf.String())
+	}
+}
+
+func TestReadForkOrder(t *testing.T) {
+	for _, def := range []string{
+		`[{"operation":"fork","params":{"pipelines":{"c":[],"a":[{"operation":"fork","params":{"pipelines":{"z":[],"w":[]}}}],"b":[]}}}]`,
+		`
+- operation: fork
+  params:
+    pipelines:
+      c: []
+      a:
+        - operation: fork
+          params:
+            pipelines:
+              z: []
+              w: []
+      b: []
+`} {
+		steps, err := ReadPipeline(strings.NewReader(def), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fork := steps[0].(*ForkStep)
+		if !reflect.DeepEqual(fork.GetOrder(), []string{"c", "a", "b"}) {
+			t.Errorf("Wrong order: %v", fork.GetOrder())
+		}
+		nested := fork.Steps["a"][0].(*ForkStep)
+		if !reflect.DeepEqual(nested.GetOrder(), []string{"z", "w"}) {
+			t.Errorf("Wrong nested order: %v", nested.GetOrder())
+		}
+	}
+}
+
+func TestIfTry(t *testing.T) {
+	addNode := func(label string) Step {
+		return StepFunc(func(ctx *PipelineContext) error {
+			ctx.GetGraphRW().NewNode([]string{label}, nil)
+			return ctx.Next()
+		})
+	}
+	fail := StepFunc(func(ctx *PipelineContext) error {
+		return fmt.Errorf("fail")
+	})
+	var seen []string
+	collect := StepFunc(func(ctx *PipelineContext) error {
+		for nodes := ctx.GetGraphRO().GetNodes(); nodes.Next(); {
+			seen = append(seen, nodes.Node().GetLabels().Slice()...)
+		}
+		if e, ok := ctx.Properties["error"]; ok {
+			seen = append(seen, e.(string))
+		}
+		return ctx.Next()
+	})
+
+	steps := Pipeline{
+		addNode("A"),
+		&IfStep{Condition: "match (n:A) return n", Then: Pipeline{addNode("B")}, Else: Pipeline{addNode("C")}},
+		&TryStep{Steps: Pipeline{addNode("D"), fail}, OnError: Pipeline{collect}},
+		collect,
+	}
+	err := NewContext(ls.DefaultContext(), steps...).Run()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(seen, []string{"A", "B", "Pipeline error at step 1: fail", "A", "B"}) {
+		t.Errorf("Wrong result: %v", seen)
+	}
+
+	// Errors after the try step are not handled by the try step
+	seen = nil
+	steps = Pipeline{
+		&TryStep{Steps: Pipeline{addNode("A")}, OnError: Pipeline{collect}},
+		fail,
+	}
+	if err = NewContext(ls.DefaultContext(), steps...).Run(); err == nil {
+		t.Errorf("Expecting error")
+	}
+	if len(seen) != 0 {
+		t.Errorf("onError ran for a following step: %v", seen)
+	}
+}
+
+func TestSubPipelineGraph(t *testing.T) {
+	var graphs []graph.Graph
+	var numRoots []int
+	record := StepFunc(func(ctx *PipelineContext) error {
+		graphs = append(graphs, ctx.GetGraphRW())
+		numRoots = append(numRoots, len(ctx.roots))
+		return ctx.Next()
+	})
+	steps := Pipeline{
+		&IfStep{Condition: "return 1>0", Then: Pipeline{record}},
+		&TryStep{Steps: Pipeline{record}},
+		record,
+	}
+	ctx := NewContext(ls.DefaultContext(), steps...)
+	initial := ctx.GetGraphRO()
+	ctx.roots = []graph.Node{initial.NewNode([]string{"root"}, nil)}
+	if err := ctx.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// The if step shares the graph, the try step copies it
+	if graphs[0] != initial || graphs[1] == initial || graphs[2] != graphs[1] {
+		t.Errorf("Wrong graph ownership")
+	}
+	if !reflect.DeepEqual(numRoots, []int{1, 1, 1}) {
+		t.Errorf("Wrong roots: %v", numRoots)
+	}
+}
+
+func TestPipelineVars(t *testing.T) {
+	vars := map[string]string{"sub": "sub", "label": "X"}
+	steps, err := ReadPipelineFile("testdata/main.yaml", vars)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx := NewContext(ls.DefaultContext(), steps...).SetVars(vars)
+	if err := ctx.Run(); err != nil {
+		t.Error(err)
+		return
+	}
+	if ctx.GetGraphRO().NumNodes() != 1 {
+		t.Errorf("Expecting 1 node, got %d", ctx.GetGraphRO().NumNodes())
+	}
+	if ctx.GetVars()["label"] != "X" {
+		t.Errorf("Variables not in properties")
+	}
+
+	if _, err := ReadPipelineFile("testdata/main.yaml", map[string]string{"label": "X"}); !errors.As(err, new(ErrUndefinedVariable)) {
+		t.Errorf("Expecting undefined variable error, got %v", err)
+	}
+
+	vars["condition"] = "true"
+	steps, err = ReadPipelineFile("testdata/main.yaml", vars)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = NewContext(ls.DefaultContext(), steps...).SetVars(vars).Run(); err == nil {
+		t.Errorf("Expecting circular include error")
+	}
+}
+
+func TestIncludeRelativePath(t *testing.T) {
+	mainFile, err := filepath.Abs("testdata/main.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	vars := map[string]string{"sub": "sub", "label": "X"}
+	steps, err := ReadPipelineFile(mainFile, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := NewContext(ls.DefaultContext(), steps...).SetVars(vars)
+	if err := ctx.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.GetGraphRO().NumNodes() != 1 {
+		t.Errorf("Expecting 1 node, got %d", ctx.GetGraphRO().NumNodes())
+	}
+}
+
+type testNodeStep struct {
+	Label string `json:"label"`
+}
+
+func (step testNodeStep) Run(ctx *PipelineContext) error {
+	ctx.GetGraphRW().NewNode([]string{step.Label}, nil)
+	return ctx.Next()
+}
+
+func init() {
+	RegisterStep("test/node", func() Step { return &testNodeStep{} })
+}
+
+func TestCancel(t *testing.T) {
+	goctx, cancel := context.WithCancel(context.Background())
+	n := 0
+	step := StepFunc(func(ctx *PipelineContext) error {
+		n++
+		cancel()
+		return ctx.Next()
+	})
+	err := NewContext(ls.NewContext(goctx), step, step).Run()
+	if !errors.Is(err, context.Canceled) || n != 1 {
+		t.Errorf("Expecting cancel after first step, got %v, %d", err, n)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	addNode := StepFunc(func(ctx *PipelineContext) error {
+		ctx.GetGraphRW().NewNode([]string{"A"}, nil)
+		return ctx.Next()
+	})
+	byRows := StepFunc(func(ctx *PipelineContext) error {
+		for i := 0; i < 3; i++ {
+			ctx.SetGraph(graph.NewOCGraph())
+			if err := ctx.Next(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	fail := StepFunc(func(ctx *PipelineContext) error {
+		if ctx.GetGraphRO().NumNodes() == 2 {
+			return fmt.Errorf("fail")
+		}
+		return nil
+	})
+	ctx := NewContext(ls.DefaultContext(), byRows, addNode, &IfStep{Condition: "return true", Then: Pipeline{addNode}}, fail)
+	if err := ctx.Run(); err == nil {
+		t.Errorf("Expecting error")
+	}
+	steps := ctx.GetMetrics().Steps()
+	paths := make([]string, 0)
+	for _, x := range steps {
+		paths = append(paths, x.Path)
+	}
+	if !reflect.DeepEqual(paths, []string{"0", "1", "2", "2/then/0", "3"}) {
+		t.Errorf("Wrong paths: %v", paths)
+	}
+	if steps[0].Invocations != 1 || steps[1].Invocations != 1 || steps[1].Errors != 0 || steps[4].Errors != 1 {
+		t.Errorf("Wrong metrics: %+v", steps)
+	}
+	if steps[1].NodesIn != 0 || steps[1].NodesOut != 1 || steps[3].NodesOut != 2 {
+		t.Errorf("Wrong counts: %+v", steps)
+	}
+	var buf bytes.Buffer
+	if err := ctx.GetMetrics().WriteTable(&buf); err != nil {
+		t.Error(err)
+	}
+	if _, err := json.Marshal(ctx.GetMetrics()); err != nil {
+		t.Error(err)
+	}
+}
+
+type accumulateStep struct {
+	n int
+}
+
+func (a *accumulateStep) Run(ctx *PipelineContext) error {
+	a.n += ctx.GetGraphRO().NumNodes()
+	return nil
+}
+
+func (a *accumulateStep) Finish(ctx *PipelineContext) error {
+	g := ls.NewDocumentGraph()
+	for i := 0; i < a.n; i++ {
+		g.NewNode([]string{"A"}, nil)
+	}
+	ctx.SetGraph(g)
+	return ctx.Next()
+}
+
+func TestFinisher(t *testing.T) {
+	source := StepFunc(func(ctx *PipelineContext) error {
+		for i := 0; i < 3; i++ {
+			ctx.SetGraph(ls.NewDocumentGraph())
+			ctx.GetGraphRW().NewNode([]string{"A"}, nil)
+			if err := ctx.Next(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	var runs, nodes int
+	count := StepFunc(func(ctx *PipelineContext) error {
+		runs++
+		nodes = ctx.GetGraphRO().NumNodes()
+		return ctx.Next()
+	})
+	if err := NewContext(ls.DefaultContext(), source, &accumulateStep{}, count).Run(); err != nil {
+		t.Error(err)
+		return
+	}
+	if runs != 1 || nodes != 3 {
+		t.Errorf("Expecting 1 run with 3 nodes, got %d runs, %d nodes", runs, nodes)
+	}
+}
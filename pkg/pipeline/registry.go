@@ -0,0 +1,369 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]func() Step)
+)
+
+// RegisterStep registers a step factory for the given operation
+// name. The factory should return a pointer to a new step
+// initialized with default values, which is then unmarshaled from
+// the step parameters.
+func RegisterStep(name string, factory func() Step) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[name] = factory
+}
+
+// GetStepFactory returns the step factory for the operation, or nil
+// if there is none
+func GetStepFactory(name string) func() Step {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return registry[name]
+}
+
+// GetStepNames returns the registered operation names, sorted
+func GetStepNames() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	ret := make([]string, 0, len(registry))
+	for k := range registry {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// ErrUnknownOperation is returned if a pipeline refers to an
+// unregistered operation
+type ErrUnknownOperation string
+
+func (e ErrUnknownOperation) Error() string {
+	return fmt.Sprintf("Unknown pipeline operation: %s", string(e))
+}
+
+// UnmarshalStep creates a new step for the operation, and
+// unmarshals the step data into it
+func UnmarshalStep(operation string, stepData interface{}) (Step, error) {
+	op := GetStepFactory(operation)
+	if op == nil {
+		return nil, ErrUnknownOperation(operation)
+	}
+	step := op()
+	if step == nil {
+		return nil, fmt.Errorf("Invalid step: %s", operation)
+	}
+	stepData = yamlToMap(stepData)
+	d, err := json.Marshal(stepData)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(d, step); err != nil {
+		return nil, err
+	}
+	return step, nil
+}
+
+type stepMarshal struct {
+	Operation string      `json:"operation" yaml:"operation"`
+	Step      interface{} `json:"params" yaml:"params"`
+}
+
+func unmarshalPipeline(stepMarshals []stepMarshal) (Pipeline, error) {
+	steps := make(Pipeline, 0, len(stepMarshals))
+	for _, stage := range stepMarshals {
+		step, err := UnmarshalStep(stage.Operation, stage.Step)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func (p *Pipeline) UnmarshalJSON(in []byte) error {
+	// Keep the step parameters as raw JSON so the steps see the
+	// parameters in the declared order
+	var stages []struct {
+		Operation string          `json:"operation"`
+		Step      json.RawMessage `json:"params"`
+	}
+	if err := json.Unmarshal(in, &stages); err != nil {
+		return err
+	}
+	steps := make(Pipeline, 0, len(stages))
+	for _, stage := range stages {
+		var stepData interface{}
+		if len(stage.Step) > 0 {
+			stepData = stage.Step
+		}
+		step, err := UnmarshalStep(stage.Operation, stepData)
+		if err != nil {
+			return err
+		}
+		steps = append(steps, step)
+	}
+	*p = steps
+	return nil
+}
+
+// ReadPipeline reads a JSON or YAML pipeline definition, and expands
+// the ${variable} references in step parameters. The order of object
+// keys is preserved, so steps such as fork see their parameters in
+// the declared order.
+func ReadPipeline(in io.Reader, vars map[string]string) (Pipeline, error) {
+	return ReadPipelineInDir(in, vars, "")
+}
+
+// ReadPipelineInDir reads a JSON or YAML pipeline definition that is
+// in the directory dir. Relative include paths are resolved against
+// dir. If dir is empty, they are resolved against the working
+// directory.
+func ReadPipelineInDir(in io.Reader, vars map[string]string, dir string) (Pipeline, error) {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	var stepMarshals []stepMarshal
+	if err := json.Unmarshal(data, &stepMarshals); err != nil {
+		if err2 := yaml.Unmarshal(data, &stepMarshals); err2 != nil {
+			return nil, err
+		}
+		var ordered []yaml.MapSlice
+		if err := yaml.Unmarshal(data, &ordered); err != nil {
+			return nil, err
+		}
+		setOrderedParams(stepMarshals, ordered)
+	} else {
+		var ordered []orderedMap
+		if err := json.Unmarshal(data, &ordered); err != nil {
+			return nil, err
+		}
+		items := make([]yaml.MapSlice, 0, len(ordered))
+		for _, x := range ordered {
+			items = append(items, yaml.MapSlice(x))
+		}
+		setOrderedParams(stepMarshals, items)
+	}
+	for i := range stepMarshals {
+		stepMarshals[i].Step, err = expandVarsInTree(yamlToMap(stepMarshals[i].Step), vars)
+		if err != nil {
+			return nil, fmt.Errorf("Step %d: %w", i, err)
+		}
+		if len(dir) > 0 {
+			resolveIncludes(stepMarshals[i].Operation, stepMarshals[i].Step, dir)
+		}
+	}
+	return unmarshalPipeline(stepMarshals)
+}
+
+// resolveIncludes resolves the relative file paths of the include
+// steps in the step parameters against dir. Nested steps are
+// resolved as well.
+func resolveIncludes(operation string, params interface{}, dir string) {
+	switch t := params.(type) {
+	case []interface{}:
+		for _, x := range t {
+			resolveIncludes("", x, dir)
+		}
+	case orderedMap:
+		// A nested step is an object with operation and params
+		nestedOp, _ := t.get("operation").(string)
+		for i := range t {
+			key := fmt.Sprint(t[i].Key)
+			if operation == "include" && key == "file" {
+				if file, ok := t[i].Value.(string); ok && len(file) > 0 && !filepath.IsAbs(file) {
+					t[i].Value = filepath.Join(dir, file)
+				}
+				continue
+			}
+			if key == "params" {
+				resolveIncludes(nestedOp, t[i].Value, dir)
+				continue
+			}
+			resolveIncludes("", t[i].Value, dir)
+		}
+	}
+}
+
+// setOrderedParams replaces the step parameters with their ordered
+// versions
+func setOrderedParams(steps []stepMarshal, ordered []yaml.MapSlice) {
+	for i := range steps {
+		if i >= len(ordered) {
+			return
+		}
+		for _, item := range ordered[i] {
+			if fmt.Sprint(item.Key) == "params" {
+				steps[i].Step = item.Value
+			}
+		}
+	}
+}
+
+// ReadPipelineFile reads a JSON or YAML pipeline file, and expands
+// the ${variable} references in step parameters. Relative include
+// paths are resolved against the directory of the file.
+func ReadPipelineFile(file string, vars map[string]string) (Pipeline, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadPipelineInDir(f, vars, filepath.Dir(file))
+}
+
+// orderedMap is a JSON object that keeps the order of its keys
+type orderedMap yaml.MapSlice
+
+// UnmarshalJSON decodes a JSON object keeping the key order. Nested
+// objects are decoded as orderedMap as well.
+func (m *orderedMap) UnmarshalJSON(in []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(in))
+	v, err := decodeOrderedJSON(dec)
+	if err != nil {
+		return err
+	}
+	om, ok := v.(orderedMap)
+	if !ok {
+		return fmt.Errorf("Expecting a JSON object")
+	}
+	*m = om
+	return nil
+}
+
+// get returns the value of the key
+func (m orderedMap) get(key string) interface{} {
+	for _, item := range m {
+		if fmt.Sprint(item.Key) == key {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+// MarshalJSON writes the object keys in order
+func (m orderedMap) MarshalJSON() ([]byte, error) {
+	buf := bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, item := range m {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(fmt.Sprint(item.Key))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(item.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func decodeOrderedJSON(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			out := orderedMap{}
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				v, err := decodeOrderedJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, yaml.MapItem{Key: key, Value: v})
+			}
+			_, err := dec.Token()
+			return out, err
+		case '[':
+			out := make([]interface{}, 0)
+			for dec.More() {
+				v, err := decodeOrderedJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, v)
+			}
+			_, err := dec.Token()
+			return out, err
+		}
+	}
+	return tok, nil
+}
+
+// yamlToMap converts the map[interface{}]interface{} values from a
+// YAML document to map[string]interface{}. Ordered maps are converted
+// to orderedMap with string keys.
+func yamlToMap(in interface{}) interface{} {
+	if arr, ok := in.([]interface{}); ok {
+		out := make([]interface{}, 0, len(arr))
+		for _, x := range arr {
+			out = append(out, yamlToMap(x))
+		}
+		return out
+	}
+	if m, ok := in.(map[interface{}]interface{}); ok {
+		out := map[string]interface{}{}
+		for k, v := range m {
+			out[fmt.Sprint(k)] = yamlToMap(v)
+		}
+		return out
+	}
+	var slice yaml.MapSlice
+	switch m := in.(type) {
+	case yaml.MapSlice:
+		slice = m
+	case orderedMap:
+		slice = yaml.MapSlice(m)
+	default:
+		return in
+	}
+	out := make(orderedMap, 0, len(slice))
+	for _, item := range slice {
+		out = append(out, yaml.MapItem{Key: fmt.Sprint(item.Key), Value: yamlToMap(item.Value)})
+	}
+	return out
+}
@@ -0,0 +1,210 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// VarsProperty is the pipeline property containing the pipeline
+// variables as map[string]string
+const VarsProperty = "vars"
+
+// includesProperty is the pipeline property containing the stack of
+// included pipeline files
+const includesProperty = "includes"
+
+// ErrUndefinedVariable is returned if a pipeline refers to a
+// variable that is not defined
+type ErrUndefinedVariable string
+
+func (e ErrUndefinedVariable) Error() string {
+	return fmt.Sprintf("Undefined pipeline variable: %s", string(e))
+}
+
+// expandVars replaces ${name} references in the input using the
+// given variables. ${name:-default} uses default if the variable is
+// not defined. $$ is replaced with $.
+func expandVars(in string, vars map[string]string) (string, error) {
+	if !strings.Contains(in, "$") {
+		return in, nil
+	}
+	out := strings.Builder{}
+	for i := 0; i < len(in); i++ {
+		if in[i] != '$' || i+1 >= len(in) {
+			out.WriteByte(in[i])
+			continue
+		}
+		switch in[i+1] {
+		case '$':
+			out.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(in[i+2:], '}')
+			if end == -1 {
+				return "", fmt.Errorf("Unterminated variable reference in %s", in)
+			}
+			expr := in[i+2 : i+2+end]
+			name, def, hasDefault := expr, "", false
+			if ix := strings.Index(expr, ":-"); ix != -1 {
+				name, def, hasDefault = expr[:ix], expr[ix+2:], true
+			}
+			name = strings.TrimSpace(name)
+			value, ok := vars[name]
+			if !ok {
+				if !hasDefault {
+					return "", ErrUndefinedVariable(name)
+				}
+				value = def
+			}
+			out.WriteString(value)
+			i += end + 2
+		default:
+			out.WriteByte(in[i])
+		}
+	}
+	return out.String(), nil
+}
+
+// expandVarsInTree expands variable references in all string values
+// of a JSON/YAML tree
+func expandVarsInTree(in interface{}, vars map[string]string) (interface{}, error) {
+	switch t := in.(type) {
+	case string:
+		return expandVars(t, vars)
+	case []interface{}:
+		for i := range t {
+			v, err := expandVarsInTree(t[i], vars)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = v
+		}
+	case map[string]interface{}:
+		for k, x := range t {
+			v, err := expandVarsInTree(x, vars)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = v
+		}
+	case orderedMap:
+		for i := range t {
+			v, err := expandVarsInTree(t[i].Value, vars)
+			if err != nil {
+				return nil, err
+			}
+			t[i].Value = v
+		}
+	}
+	return in, nil
+}
+
+// ReadEnvFile reads variables from a file containing key=value
+// lines. Empty lines and lines starting with # are ignored.
+func ReadEnvFile(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		key, value, err := ParseVarAssignment(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, line, err)
+		}
+		ret[key] = value
+	}
+	return ret, scanner.Err()
+}
+
+// ParseVarAssignment parses key=value. Value may be quoted.
+func ParseVarAssignment(in string) (string, string, error) {
+	ix := strings.IndexByte(in, '=')
+	if ix <= 0 {
+		return "", "", fmt.Errorf("Expecting key=value: %s", in)
+	}
+	key := strings.TrimSpace(in[:ix])
+	value := strings.TrimSpace(in[ix+1:])
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return key, value, nil
+}
+
+// IncludeStep runs the steps of another pipeline file
+type IncludeStep struct {
+	File string `json:"file" yaml:"file"`
+
+	steps Pipeline
+}
+
+func (IncludeStep) Help() {
+	fmt.Println(`Include another pipeline
+The steps of the included pipeline run using the current graph and
+the pipeline variables, and then the pipeline continues with the
+steps following the include step.
+
+operation: include
+params:
+  file: pipeline file. A relative path is resolved against the
+        directory of the including pipeline file.`)
+}
+
+func (step *IncludeStep) Run(pipeline *PipelineContext) error {
+	includes, _ := pipeline.Properties[includesProperty].([]string)
+	for _, x := range includes {
+		if x == step.File {
+			return fmt.Errorf("Circular pipeline include: %s", step.File)
+		}
+	}
+	if step.steps == nil {
+		steps, err := ReadPipelineFile(step.File, pipeline.GetVars())
+		if err != nil {
+			return fmt.Errorf("While reading included pipeline %s: %w", step.File, err)
+		}
+		step.steps = steps
+	}
+	newIncludes := make([]string, 0, len(includes)+1)
+	newIncludes = append(newIncludes, includes...)
+	pipeline.Properties[includesProperty] = append(newIncludes, step.File)
+	steps := make(Pipeline, 0, len(step.steps)+1)
+	steps = append(steps, step.steps...)
+	steps = append(steps, internalStep(func(ctx *PipelineContext) error {
+		ctx.Properties[includesProperty] = includes
+		return ctx.Next()
+	}))
+	err := runSubPipeline(pipeline, steps, "include", false)
+	var cerr continuationError
+	if errors.As(err, &cerr) {
+		return cerr.err
+	}
+	pipeline.Properties[includesProperty] = includes
+	return err
+}
+
+func init() {
+	RegisterStep("include", func() Step { return &IncludeStep{} })
+}
@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/cloudprivacylabs/lsa/pkg/ls"
 )
@@ -37,6 +38,7 @@ type Repository struct {
 	root     string
 	index    []IndexEntry
 	interner ls.Interner
+	cache    *ls.CompiledSchemaCache
 }
 
 // New returns a new file repository under the given directory.
@@ -49,11 +51,21 @@ func NewWithInterner(root string, interner ls.Interner) *Repository {
 	return &Repository{root: root, interner: interner}
 }
 
+// SetCompiledSchemaCache sets the cache used by GetCompiledSchema. If
+// cache is nil, schemas are compiled every time.
+func (repo *Repository) SetCompiledSchemaCache(cache *ls.CompiledSchemaCache) {
+	repo.cache = cache
+}
+
 type IndexEntry struct {
 	Type      string `json:"type"`
 	ID        string `json:"id"`
 	ValueType string `json:"valueType,omitempty"`
 	File      string `json:"file"`
+	// Version is the semantic version of the layer
+	Version string `json:"version,omitempty"`
+	// TargetVersion is the schema version constraint of an overlay
+	TargetVersion string `json:"targetVersion,omitempty"`
 }
 
 func (i IndexEntry) hasType(t string) bool {
@@ -182,12 +194,30 @@ func (repo *Repository) BuildIndex() ([]IndexEntry, []string, error) {
 					continue
 				}
 				entry := IndexEntry{
-					Type:      layer.GetLayerType(),
-					ID:        layer.GetID(),
-					ValueType: layer.GetValueType(),
-					File:      entry.Name(),
+					Type:          layer.GetLayerType(),
+					ID:            layer.GetID(),
+					ValueType:     layer.GetValueType(),
+					File:          entry.Name(),
+					Version:       layer.GetVersion(),
+					TargetVersion: layer.GetTargetVersion(),
 				}
 				ret = append(ret, entry)
+			case hasType(ls.SchemaVariantTerm), hasType("SchemaVariant"):
+				m, _ := obj.(map[string]interface{})
+				id, _ := m["@id"].(string)
+				if len(id) == 0 {
+					warnings = append(warnings, fmt.Sprintf("Schema variant without id: %s", fname))
+					continue
+				}
+				valueType, _ := m["valueType"].(string)
+				version, _ := m["version"].(string)
+				ret = append(ret, IndexEntry{
+					Type:      ls.SchemaVariantTerm,
+					ID:        id,
+					ValueType: valueType,
+					File:      entry.Name(),
+					Version:   version,
+				})
 			}
 		}
 	}
@@ -195,9 +225,74 @@ func (repo *Repository) BuildIndex() ([]IndexEntry, []string, error) {
 	return ret, warnings, nil
 }
 
+// GetIndex returns the index entries of the repository
+func (repo *Repository) GetIndex() []IndexEntry {
+	return repo.index
+}
+
+// find returns the index entry for the reference with one of the
+// given types. The reference is of the form id or
+// id@constraint. If there are multiple versions of the object, the
+// highest version satisfying the constraint is returned.
+func (repo *Repository) find(ref string, types ...string) (IndexEntry, bool) {
+	id, constraintStr := ls.SplitVersionedRef(ref)
+	constraint, err := ls.ParseVersionConstraint(constraintStr)
+	if err != nil {
+		return IndexEntry{}, false
+	}
+	candidates := make([]IndexEntry, 0)
+	versions := make([]string, 0)
+	for _, x := range repo.index {
+		if x.ID != id {
+			continue
+		}
+		for _, t := range types {
+			if x.Type == t {
+				candidates = append(candidates, x)
+				versions = append(versions, x.Version)
+				break
+			}
+		}
+	}
+	ix := ls.SelectVersion(versions, constraint)
+	if ix == -1 {
+		return IndexEntry{}, false
+	}
+	return candidates[ix], true
+}
+
+// Find returns the index entry for the reference with one of the
+// given types. The reference can be of the form id@constraint. If no
+// types are given, all types are searched.
+func (repo *Repository) Find(ref string, types ...string) (IndexEntry, bool) {
+	if len(types) == 0 {
+		types = []string{ls.SchemaTerm, ls.OverlayTerm, ls.SchemaVariantTerm}
+	}
+	return repo.find(ref, types...)
+}
+
+// ReadFile returns the contents of the file of the index entry
+func (repo *Repository) ReadFile(entry IndexEntry) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(repo.root, entry.File))
+}
+
+// Stat returns the file info of the file of the index entry
+func (repo *Repository) Stat(entry IndexEntry) (os.FileInfo, error) {
+	return os.Stat(filepath.Join(repo.root, entry.File))
+}
+
+// SchemaLoader returns a schema loader that loads layers and schema
+// variants using LoadAndCompose
+func (repo *Repository) SchemaLoader(context *ls.Context) ls.SchemaLoader {
+	return ls.SchemaLoaderFunc(func(ref string) (*ls.Layer, error) {
+		return repo.LoadAndCompose(context, ref)
+	})
+}
+
 // LoadAndCompose loads the layer or schema variant with the given
 // ID. If the loaded object is a schema variant, computes the
-// composite schema and returns it.
+// composite schema and returns it. The ID can be of the form
+// id@constraint to select a version.
 func (repo *Repository) LoadAndCompose(context *ls.Context, id string) (*ls.Layer, error) {
 	layer := repo.GetLayer(id)
 	if layer != nil {
@@ -206,29 +301,64 @@ func (repo *Repository) LoadAndCompose(context *ls.Context, id string) (*ls.Laye
 	return repo.GetComposedSchema(context, id)
 }
 
-func (repo *Repository) GetSchema(id string) *ls.Layer {
+// GetCompiledSchema compiles the layer or schema variant with the
+// given reference, resolving all references using the
+// repository. If the repository has a compiled schema cache, the
+// compiled schema is read from or written to the cache. The cache
+// key is computed from the contents of all repository files, so any
+// change in the repository invalidates the cached schemas.
+func (repo *Repository) GetCompiledSchema(context *ls.Context, ref string) (*ls.Layer, error) {
+	compile := func() (*ls.Layer, error) {
+		compiler := ls.Compiler{
+			Loader: repo.SchemaLoader(context),
+		}
+		return compiler.Compile(context, ref)
+	}
+	if repo.cache == nil {
+		return compile()
+	}
+	key, err := repo.cacheKey(context, ref)
+	if err != nil {
+		return nil, err
+	}
+	return repo.cache.Compile(context, key, compile)
+}
+
+func (repo *Repository) cacheKey(context *ls.Context, ref string) (string, error) {
+	key := ls.NewCompiledSchemaCacheKey(context)
+	key.AddString(ref)
+	files := make([]string, 0, len(repo.index))
 	for _, x := range repo.index {
-		if x.ID == id && x.Type == ls.SchemaTerm {
-			return repo.loadLayer(x.File)
+		files = append(files, x.File)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(repo.root, file))
+		if err != nil {
+			return "", err
 		}
+		key.AddFile(file, data)
+	}
+	return key.String(), nil
+}
+
+func (repo *Repository) GetSchema(id string) *ls.Layer {
+	if x, ok := repo.find(id, ls.SchemaTerm); ok {
+		return repo.loadLayer(x.File)
 	}
 	return nil
 }
 
 func (repo *Repository) GetOverlay(id string) *ls.Layer {
-	for _, x := range repo.index {
-		if x.ID == id && x.Type == ls.OverlayTerm {
-			return repo.loadLayer(x.File)
-		}
+	if x, ok := repo.find(id, ls.OverlayTerm); ok {
+		return repo.loadLayer(x.File)
 	}
 	return nil
 }
 
 func (repo *Repository) GetLayer(id string) *ls.Layer {
-	for _, x := range repo.index {
-		if x.ID == id && (x.Type == ls.OverlayTerm || x.Type == ls.SchemaTerm) {
-			return repo.loadLayer(x.File)
-		}
+	if x, ok := repo.find(id, ls.OverlayTerm, ls.SchemaTerm); ok {
+		return repo.loadLayer(x.File)
 	}
 	return nil
 }
@@ -258,10 +388,8 @@ func (repo *Repository) loadLayer(file string) *ls.Layer {
 }
 
 func (repo *Repository) GetComposedSchema(context *ls.Context, id string) (*ls.Layer, error) {
-	for _, x := range repo.index {
-		if x.ID == id && x.Type == ls.SchemaVariantTerm {
-			return repo.compose(context, x)
-		}
+	if x, ok := repo.find(id, ls.SchemaVariantTerm); ok {
+		return repo.compose(context, x)
 	}
 	return nil, nil
 }
@@ -295,7 +423,12 @@ func (repo *Repository) compose(context *ls.Context, index IndexEntry) (*ls.Laye
 		if sch == nil {
 			return nil, ErrNotFound(m.Schema)
 		}
-		result = sch
+		// Resolve the base schema first, so overlays can target
+		// inherited attributes
+		result, err = (ls.Compiler{Loader: repo.SchemaLoader(context)}).ResolveExtends(sch)
+		if err != nil {
+			return nil, err
+		}
 	}
 	for _, x := range m.Overlays {
 		ovl := repo.GetLayer(x)
@@ -305,6 +438,9 @@ func (repo *Repository) compose(context *ls.Context, index IndexEntry) (*ls.Laye
 		if result == nil {
 			result = ovl
 		} else {
+			if err := ls.CheckTargetVersion(result, ovl); err != nil {
+				return nil, err
+			}
 			err := result.Compose(context, ovl)
 			if err != nil {
 				return nil, err
@@ -313,3 +449,24 @@ func (repo *Repository) compose(context *ls.Context, index IndexEntry) (*ls.Laye
 	}
 	return result, nil
 }
+
+// GetOverlaysFor returns the index entries of the overlays that can
+// be applied to the schema. An overlay can be applied to the schema
+// if it has the same value type, and if its target version
+// constraint is satisfied by the schema version.
+func (repo *Repository) GetOverlaysFor(schema IndexEntry) []IndexEntry {
+	ret := make([]IndexEntry, 0)
+	for _, x := range repo.index {
+		if x.Type != ls.OverlayTerm || x.ValueType != schema.ValueType {
+			continue
+		}
+		if len(x.TargetVersion) > 0 && len(schema.Version) > 0 {
+			c, err := ls.ParseVersionConstraint(x.TargetVersion)
+			if err != nil || !c.MatchesString(schema.Version) {
+				continue
+			}
+		}
+		ret = append(ret, x)
+	}
+	return ret
+}
@@ -0,0 +1,117 @@
+package fs
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+)
+
+func writeRepoFiles(t *testing.T, files map[string]string) *Repository {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo := New(dir)
+	if _, err := repo.UpdateIndex(); err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func TestComposeInheritedAttribute(t *testing.T) {
+	repo := writeRepoFiles(t, map[string]string{
+		"person.json": `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "https://lschema.org/Schema",
+  "@id": "http://person/schema",
+  "ls:valueType": "Person",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "http://person",
+    "ls:Object/attributes": [{"@id": "name", "@type": "ls:Value", "ls:attributeName": "name"}]
+  }
+}`,
+		"patient.json": `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "https://lschema.org/Schema",
+  "@id": "http://patient/schema",
+  "ls:valueType": "Patient",
+  "ls:extends": "http://person/schema",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "http://patient",
+    "ls:Object/attributes": [{"@id": "mrn", "@type": "ls:Value", "ls:attributeName": "mrn"}]
+  }
+}`,
+		"patient.ovl.json": `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "https://lschema.org/Overlay",
+  "@id": "http://patient/ovl",
+  "ls:valueType": "Patient",
+  "ls:attributeOverlays": {"@list": [
+    {"@id": "name", "@type": "ls:Value", "ls:description": "patient name"}
+  ]}
+}`,
+		"patient.variant.json": `{
+  "@type": "SchemaVariant",
+  "@id": "http://patient/variant",
+  "valueType": "Patient",
+  "schema": "http://patient/schema",
+  "overlays": ["http://patient/ovl"]
+}`,
+	})
+	ctx := ls.DefaultContext()
+	compiler := ls.Compiler{Loader: repo.SchemaLoader(ctx)}
+	schema, err := compiler.Compile(ctx, "http://patient/variant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := schema.GetAttributeByID("name")
+	if name == nil {
+		t.Fatalf("Missing inherited attribute")
+	}
+	if s := ls.AsPropertyValue(name.GetProperty(ls.DescriptionTerm)).AsString(); s != "patient name" {
+		t.Errorf("Overlay not applied to inherited attribute: %s", s)
+	}
+	if schema.GetAttributeByID("mrn") == nil {
+		t.Errorf("Missing mrn")
+	}
+}
+
+func TestSelectSchemaVersion(t *testing.T) {
+	files := make(map[string]string)
+	for _, version := range []string{"1.0.0", "1.1.0", "1.2.0-beta", "2.0.0-rc.1"} {
+		files["person-"+version+".json"] = `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "https://lschema.org/Schema",
+  "@id": "http://person/schema",
+  "ls:valueType": "Person",
+  "ls:version": "` + version + `",
+  "ls:layer": {"@type": "ls:Object", "@id": "http://person"}
+}`
+	}
+	repo := writeRepoFiles(t, files)
+	for ref, expected := range map[string]string{
+		"http://person/schema":                "1.1.0",
+		"http://person/schema@^1":             "1.1.0",
+		"http://person/schema@~1.2":           "",
+		"http://person/schema@^1.2.0-alpha":   "1.2.0-beta",
+		"http://person/schema@>=2.0.0-rc.1":   "2.0.0-rc.1",
+		"http://person/schema@^2":             "",
+		"http://person/schema@1.2.0-beta":     "1.2.0-beta",
+		"http://person/schema@>=1.0.0 <2.0.0": "1.1.0",
+	} {
+		layer := repo.GetSchema(ref)
+		version := ""
+		if layer != nil {
+			version = layer.GetVersion()
+		}
+		if version != expected {
+			t.Errorf("%s: expected %s, got %s", ref, expected, version)
+		}
+	}
+}
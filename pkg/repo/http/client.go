@@ -0,0 +1,255 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/repo/fs"
+)
+
+// ErrHTTP is returned if the server returns an unexpected status
+type ErrHTTP struct {
+	URL        string
+	StatusCode int
+	Msg        string
+}
+
+func (e ErrHTTP) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.URL, e.StatusCode, e.Msg)
+}
+
+// Client is a schema repository client for a repository served by
+// Server. Responses are cached by URL, and revalidated using
+// ETags. The composition options are sent in the URL, so schemas
+// composed with different options are cached separately.
+type Client struct {
+	// BaseURL is the URL of the server
+	BaseURL string
+	// HTTPClient is used to send requests. If nil,
+	// http.DefaultClient is used
+	HTTPClient *http.Client
+
+	interner ls.Interner
+
+	mu    sync.Mutex
+	cache map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	etag string
+	data []byte
+}
+
+// NewClient returns a new client for the repository at baseURL
+func NewClient(baseURL string, interner ls.Interner) *Client {
+	if interner == nil {
+		interner = ls.NewInterner()
+	}
+	return &Client{
+		BaseURL:  strings.TrimSuffix(baseURL, "/"),
+		interner: interner,
+		cache:    make(map[string]cachedResponse),
+	}
+}
+
+// get sends a GET request to the path. Returns nil if the object is
+// not found.
+func (c *Client) get(path string, query url.Values) ([]byte, error) {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	cached, isCached := c.cache[u]
+	c.mu.Unlock()
+	if isCached {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	switch rsp.StatusCode {
+	case http.StatusNotModified:
+		if isCached {
+			return cached.data, nil
+		}
+	case http.StatusNotFound:
+		return nil, nil
+	case http.StatusOK:
+		data, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if etag := rsp.Header.Get("ETag"); len(etag) > 0 {
+			c.mu.Lock()
+			c.cache[u] = cachedResponse{etag: etag, data: data}
+			c.mu.Unlock()
+		}
+		return data, nil
+	}
+	msg, _ := ioutil.ReadAll(rsp.Body)
+	return nil, ErrHTTP{URL: u, StatusCode: rsp.StatusCode, Msg: strings.TrimSpace(string(msg))}
+}
+
+func (c *Client) getLayer(path string, query url.Values) (*ls.Layer, error) {
+	data, err := c.get(path, query)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return ls.UnmarshalLayer(v, c.interner)
+}
+
+// GetIndex returns the index entries of the repository
+func (c *Client) GetIndex() ([]fs.IndexEntry, error) {
+	data, err := c.get("/index", nil)
+	if err != nil {
+		return nil, err
+	}
+	var ret []fs.IndexEntry
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GetLayer returns the schema or the overlay with the given
+// reference. Returns nil if not found.
+func (c *Client) GetLayer(ref string) (*ls.Layer, error) {
+	layer, err := c.getLayer("/layer", url.Values{"id": {ref}})
+	if err != nil || layer == nil {
+		return nil, err
+	}
+	if t := layer.GetLayerType(); t != ls.SchemaTerm && t != ls.OverlayTerm {
+		return nil, nil
+	}
+	return layer, nil
+}
+
+// GetSchema returns the schema with the given reference. Returns nil
+// if not found.
+func (c *Client) GetSchema(ref string) (*ls.Layer, error) {
+	return c.getLayerOfType(ref, ls.SchemaTerm)
+}
+
+// GetOverlay returns the overlay with the given reference. Returns
+// nil if not found.
+func (c *Client) GetOverlay(ref string) (*ls.Layer, error) {
+	return c.getLayerOfType(ref, ls.OverlayTerm)
+}
+
+func (c *Client) getLayerOfType(ref, t string) (*ls.Layer, error) {
+	layer, err := c.GetLayer(ref)
+	if err != nil || layer == nil {
+		return nil, err
+	}
+	if layer.GetLayerType() != t {
+		return nil, nil
+	}
+	return layer, nil
+}
+
+// composeQuery adds the composition options of the context to the
+// query, so the server composes the schema the same way
+func composeQuery(context *ls.Context, query url.Values) url.Values {
+	if context.IsProvenanceEnabled() {
+		query.Set("provenance", "true")
+	}
+	if policy := context.GetConflictPolicy(); len(policy) > 0 && policy != ls.ConflictPolicyError {
+		query.Set("conflictPolicy", string(policy))
+	}
+	return query
+}
+
+// GetComposedSchema returns the composed schema variant, or the
+// layer with the given reference. The composition is done by the
+// server using the provenance and conflict policy of the context.
+func (c *Client) GetComposedSchema(context *ls.Context, ref string) (*ls.Layer, error) {
+	return c.getLayer("/schema", composeQuery(context, url.Values{"id": {ref}}))
+}
+
+// GetComposedSchemaByObjectType returns the composed schema variant
+// for the value type
+func (c *Client) GetComposedSchemaByObjectType(context *ls.Context, t string) (*ls.Layer, error) {
+	return c.getLayer("/schema", composeQuery(context, url.Values{"valueType": {t}}))
+}
+
+// LoadAndCompose loads the layer or the schema variant with the
+// given reference
+func (c *Client) LoadAndCompose(context *ls.Context, ref string) (*ls.Layer, error) {
+	return c.GetComposedSchema(context, ref)
+}
+
+// GetCompiledSchema returns the schema variant or the schema with the
+// given reference compiled by the server. The terms of the returned
+// schema are compiled.
+func (c *Client) GetCompiledSchema(context *ls.Context, ref string) (*ls.Layer, error) {
+	data, err := c.get("/schema", composeQuery(context, url.Values{"id": {ref}, "compiled": {"true"}}))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	g := ls.NewLayerGraph()
+	if err := ls.NewJSONMarshaler(c.interner).Unmarshal(data, g); err != nil {
+		return nil, err
+	}
+	layers := ls.LayersFromGraph(g)
+	id, _ := ls.SplitVersionedRef(ref)
+	var layer *ls.Layer
+	for _, l := range layers {
+		if l.GetID() == id {
+			layer = l
+			break
+		}
+	}
+	if layer == nil && len(layers) == 1 {
+		layer = layers[0]
+	}
+	if layer == nil {
+		return nil, nil
+	}
+	if err := ls.CompileTerms(layer); err != nil {
+		return nil, err
+	}
+	return layer, nil
+}
+
+// SchemaLoader returns a schema loader that loads layers and schema
+// variants using LoadAndCompose
+func (c *Client) SchemaLoader(context *ls.Context) ls.SchemaLoader {
+	return ls.SchemaLoaderFunc(func(ref string) (*ls.Layer, error) {
+		return c.LoadAndCompose(context, ref)
+	})
+}
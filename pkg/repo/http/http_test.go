@@ -0,0 +1,218 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/repo/fs"
+)
+
+var testFiles = map[string]string{
+	"schema.json": `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "https://lschema.org/Schema",
+  "@id": "http://person/schema",
+  "ls:valueType": "Person",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "http://person",
+    "ls:Object/attributes": [
+      {"@id": "firstName", "@type": "ls:Value", "ls:attributeName": "firstName"}
+    ]
+  }
+}`,
+	"overlay.json": `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "https://lschema.org/Overlay",
+  "@id": "http://person/ovl",
+  "ls:valueType": "Person",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "http://person",
+    "ls:Object/attributes": [
+      {"@id": "firstName", "@type": "ls:Value", "ls:description": "First name"}
+    ]
+  }
+}`,
+	"variant.json": `{
+  "@type": "https://lschema.org/SchemaVariant",
+  "@id": "http://person/variant",
+  "valueType": "Person",
+  "schema": "http://person/schema",
+  "overlays": ["http://person/ovl"]
+}`,
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	dir, err := ioutil.TempDir("", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, content := range testFiles {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(NewServer(fs.NewWithInterner(dir, ls.NewSyncInterner())))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func getDescription(layer *ls.Layer) string {
+	node, _ := layer.FindAttributeByID("firstName")
+	if node == nil {
+		return ""
+	}
+	return ls.AsPropertyValue(node.GetProperty(ls.DescriptionTerm)).AsString()
+}
+
+func TestClient(t *testing.T) {
+	srv := newTestServer(t)
+	client := NewClient(srv.URL, nil)
+	ctx := ls.DefaultContext()
+
+	index, err := client.GetIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 3 {
+		t.Errorf("Wrong index: %v", index)
+	}
+
+	schema, err := client.GetSchema("http://person/schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema == nil || schema.GetID() != "http://person/schema" || len(getDescription(schema)) != 0 {
+		t.Errorf("Wrong schema: %v", schema)
+	}
+	if ovl, _ := client.GetSchema("http://person/ovl"); ovl != nil {
+		t.Errorf("Overlay returned as schema")
+	}
+
+	composed, err := client.GetComposedSchema(ctx, "http://person/variant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if composed == nil || getDescription(composed) != "First name" {
+		t.Errorf("Wrong composed schema: %v", composed)
+	}
+	composed, err = client.GetComposedSchemaByObjectType(ctx, "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if composed == nil || getDescription(composed) != "First name" {
+		t.Errorf("Wrong composed schema by type: %v", composed)
+	}
+
+	compiled, err := client.GetCompiledSchema(ctx, "http://person/variant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compiled == nil || getDescription(compiled) != "First name" {
+		t.Errorf("Wrong compiled schema: %v", compiled)
+	}
+
+	compiler := ls.Compiler{Loader: client.SchemaLoader(ctx)}
+	compiled, err = compiler.Compile(ctx, "http://person/variant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getDescription(compiled) != "First name" {
+		t.Errorf("Wrong compiled schema from loader")
+	}
+
+	missing, err := client.GetComposedSchema(ctx, "http://missing")
+	if err != nil || missing != nil {
+		t.Errorf("Expecting not found, got %v %v", missing, err)
+	}
+}
+
+func TestClientComposeOptions(t *testing.T) {
+	srv := newTestServer(t)
+	client := NewClient(srv.URL, ls.NewSyncInterner())
+	hasProvenance := func(layer *ls.Layer) bool {
+		node, _ := layer.FindAttributeByID("firstName")
+		return node != nil && len(ls.AsPropertyValue(node.GetProperty(ls.ProvenanceTerm)).Slice()) > 0
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Schemas composed with different options are cached
+			// separately
+			for _, provenance := range []bool{true, false, true} {
+				ctx := ls.NewContext(context.Background()).SetProvenance(provenance)
+				layer, err := client.GetComposedSchema(ctx, "http://person/variant")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if layer == nil || hasProvenance(layer) != provenance {
+					t.Errorf("Wrong provenance, expecting %v", provenance)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	ctx := ls.NewContext(context.Background()).SetConflictPolicy("unknown")
+	if _, err := client.GetComposedSchema(ctx, "http://person/variant"); err == nil {
+		t.Errorf("Expecting error for unknown conflict policy")
+	}
+}
+
+func TestETag(t *testing.T) {
+	srv := newTestServer(t)
+	rsp, err := http.Get(srv.URL + "/layer?id=http://person/schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	etag := rsp.Header.Get("ETag")
+	if rsp.StatusCode != http.StatusOK || len(etag) == 0 {
+		t.Fatalf("Unexpected response: %d %s", rsp.StatusCode, etag)
+	}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/layer?id=http://person/schema", nil)
+	req.Header.Set("If-None-Match", etag)
+	rsp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expecting 304, got %d", rsp.StatusCode)
+	}
+
+	rsp, err = http.Get(srv.URL + "/schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expecting 400, got %d", rsp.StatusCode)
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package http implements an HTTP server that exposes a file system
+// schema repository, and a client for it.
+//
+// The server has the following endpoints:
+//
+//	GET /index                        Index entries of the repository
+//	GET /layer?id=ref                 Raw schema, overlay, or schema variant file
+//	GET /schema?id=ref                Layer or composed schema variant as JSON-LD
+//	GET /schema?valueType=t           Composed schema variant for the value type
+//	GET /schema?id=ref&compiled=true  Compiled schema as a JSON graph
+//
+// The /schema endpoint accepts the composition options
+// provenance=true and conflictPolicy=policy. References can be of the
+// form id@constraint. All responses have ETags, and conditional
+// requests with If-None-Match are supported. The ETags are computed
+// from the state of the repository files and the request, so a
+// conditional request is answered without building the response.
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/repo/fs"
+)
+
+// Server serves a file system repository over HTTP. The repository
+// index is rebuilt if it is stale. Requests are served concurrently,
+// so the repository must use an interner that is safe for concurrent
+// use, such as ls.SyncInterner.
+type Server struct {
+	repo *fs.Repository
+	// The index is rebuilt under the write lock, and requests are
+	// served under the read lock
+	mu sync.RWMutex
+	// version identifies the state of the repository files. It is
+	// updated when the index is rebuilt.
+	version string
+	// OnError is called for internal errors, if set
+	OnError func(*http.Request, error)
+}
+
+// NewServer returns a new server for the repository
+func NewServer(repo *fs.Repository) *Server {
+	return &Server{repo: repo}
+}
+
+// readLock read-locks the server, rebuilding the index first if it
+// is stale. Returns the version of the repository. If there is an
+// error, the server is not locked.
+func (s *Server) readLock() (string, error) {
+	s.mu.RLock()
+	if len(s.version) > 0 && !s.repo.IsIndexStale() {
+		return s.version, nil
+	}
+	s.mu.RUnlock()
+	s.mu.Lock()
+	if len(s.version) == 0 || s.repo.IsIndexStale() {
+		if s.repo.IsIndexStale() {
+			if _, err := s.repo.UpdateIndex(); err != nil {
+				s.mu.Unlock()
+				return "", err
+			}
+		}
+		version, err := s.repoVersion()
+		if err != nil {
+			s.mu.Unlock()
+			return "", err
+		}
+		s.version = version
+	}
+	version := s.version
+	s.mu.Unlock()
+	s.mu.RLock()
+	return version, nil
+}
+
+// repoVersion returns a hash of the names, sizes, and modification
+// times of the repository files
+func (s *Server) repoVersion() (string, error) {
+	index := s.repo.GetIndex()
+	files := make([]string, 0, len(index))
+	for _, entry := range index {
+		info, err := s.repo.Stat(entry)
+		if err != nil {
+			return "", err
+		}
+		files = append(files, fmt.Sprintf("%s %d %d", entry.File, info.Size(), info.ModTime().UnixNano()))
+	}
+	sort.Strings(files)
+	data, err := json.Marshal(files)
+	if err != nil {
+		return "", err
+	}
+	return ETag(data), nil
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	version, err := s.readLock()
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	defer s.mu.RUnlock()
+	// The response depends only on the repository files and the
+	// request
+	etag := ETag([]byte(version + "\x00" + r.URL.Path + "?" + r.URL.Query().Encode()))
+	if r.Header.Get("If-None-Match") == etag {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	var data []byte
+	var contentType string
+	switch r.URL.Path {
+	case "/index":
+		data, err = json.Marshal(s.repo.GetIndex())
+		contentType = "application/json"
+	case "/layer":
+		data, err = s.getLayer(r)
+		contentType = "application/ld+json"
+	case "/schema":
+		data, contentType, err = s.getSchema(r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	var notFound fs.ErrNotFound
+	var lsNotFound ls.ErrNotFound
+	var unknownPolicy ls.ErrUnknownConflictPolicy
+	switch {
+	case errors.As(err, &notFound), errors.As(err, &lsNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errBadRequest), errors.As(err, &unknownPolicy):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		s.internalError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+var errBadRequest = errors.New("id or valueType is required")
+
+func (s *Server) internalError(w http.ResponseWriter, r *http.Request, err error) {
+	if s.OnError != nil {
+		s.OnError(r, err)
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// ETag returns the entity tag for the data
+func ETag(data []byte) string {
+	hash := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+func (s *Server) getLayer(r *http.Request) ([]byte, error) {
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		return nil, errBadRequest
+	}
+	entry, ok := s.repo.Find(id)
+	if !ok {
+		return nil, fs.ErrNotFound(id)
+	}
+	return s.repo.ReadFile(entry)
+}
+
+func (s *Server) getSchema(r *http.Request) ([]byte, string, error) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	valueType := query.Get("valueType")
+	policy, err := ls.ParseConflictPolicy(query.Get("conflictPolicy"))
+	if err != nil {
+		return nil, "", err
+	}
+	ctx := ls.NewContext(r.Context())
+	ctx.SetProvenance(query.Get("provenance") == "true")
+	ctx.SetConflictPolicy(policy)
+	var layer *ls.Layer
+	switch {
+	case len(id) > 0:
+		layer, err = s.repo.LoadAndCompose(ctx, id)
+	case len(valueType) > 0:
+		layer, err = s.repo.GetComposedSchemaByObjectType(ctx, valueType)
+	default:
+		return nil, "", errBadRequest
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if layer == nil {
+		if len(id) == 0 {
+			id = valueType
+		}
+		return nil, "", fs.ErrNotFound(id)
+	}
+	if query.Get("compiled") == "true" {
+		ref := id
+		if len(ref) == 0 {
+			ref = s.variantForValueType(valueType)
+		}
+		compiled, err := s.repo.GetCompiledSchema(ctx, ref)
+		if err != nil {
+			return nil, "", err
+		}
+		marshaler := ls.JSONMarshaler{}
+		data, err := marshaler.Marshal(compiled.Graph)
+		return data, "application/json", err
+	}
+	marshaled, err := ls.MarshalLayer(layer)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := json.Marshal(marshaled)
+	return data, "application/ld+json", err
+}
+
+// variantForValueType returns the ID of the schema variant used for
+// the value type
+func (s *Server) variantForValueType(valueType string) string {
+	for _, x := range s.repo.GetIndex() {
+		if x.Type == ls.SchemaVariantTerm && x.ValueType == valueType {
+			return x.ID
+		}
+	}
+	return ""
+}
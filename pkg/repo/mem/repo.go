@@ -22,16 +22,17 @@ import (
 )
 
 // Repository is an in-memory schema repository. It keeps all parsed
-// schemas and schema variants
+// schemas and schema variants. There can be multiple versions of a
+// layer with the same id.
 type Repository struct {
-	layers   map[string]*ls.Layer
+	layers   map[string][]*ls.Layer
 	interner ls.Interner
 }
 
 // New returns a new empty repository
 func New() *Repository {
 	return &Repository{
-		layers:   make(map[string]*ls.Layer),
+		layers:   make(map[string][]*ls.Layer),
 		interner: ls.NewInterner(),
 	}
 }
@@ -40,15 +41,42 @@ func New() *Repository {
 func (repo *Repository) GetLayers() []*ls.Layer {
 	ret := make([]*ls.Layer, 0, len(repo.layers))
 	for _, x := range repo.layers {
-		ret = append(ret, x)
+		ret = append(ret, x...)
 	}
 	return ret
 }
 
 // AddLayer adds a new schema or overlay to the repo. If there is one
-// with the same id, the new layer replaces the old one
+// with the same id and version, the new layer replaces the old one
 func (repo *Repository) AddLayer(layer *ls.Layer) {
-	repo.layers[layer.GetID()] = layer
+	versions := repo.layers[layer.GetID()]
+	for i, x := range versions {
+		if x.GetVersion() == layer.GetVersion() {
+			versions[i] = layer
+			return
+		}
+	}
+	repo.layers[layer.GetID()] = append(versions, layer)
+}
+
+// find returns the highest version of the layer satisfying the
+// version constraint of the reference. The reference is of the form
+// id or id@constraint.
+func (repo *Repository) find(ref string) *ls.Layer {
+	id, constraintStr := ls.SplitVersionedRef(ref)
+	constraint, err := ls.ParseVersionConstraint(constraintStr)
+	if err != nil {
+		return nil
+	}
+	layers := repo.layers[id]
+	versions := make([]string, 0, len(layers))
+	for _, x := range layers {
+		versions = append(versions, x.GetVersion())
+	}
+	if ix := ls.SelectVersion(versions, constraint); ix != -1 {
+		return layers[ix]
+	}
+	return nil
 }
 
 // ParseAddObject parses the given layer or schema variant and adds
@@ -72,32 +100,51 @@ func (repo *Repository) ParseAddIntf(m interface{}) (interface{}, error) {
 	return layer, nil
 }
 
-// RemoveObject removes the object(s) with the given id
+// RemoveObject removes the object(s) with the given id, including all
+// versions
 func (repo *Repository) RemoveObject(ID string) {
 	delete(repo.layers, ID)
 }
 
-// GetSchema returns a schema with the given id
+// GetSchema returns a schema with the given id. The id can be of the
+// form id@constraint to select a version.
 func (repo *Repository) GetSchema(id string) *ls.Layer {
-	l := repo.layers[id]
+	l := repo.find(id)
 	if l != nil && l.GetLayerType() == ls.SchemaTerm {
 		return l
 	}
 	return nil
 }
 
-// GetOverlay returns an overlay with the given id
+// GetOverlay returns an overlay with the given id. The id can be of
+// the form id@constraint to select a version.
 func (repo *Repository) GetOverlay(id string) *ls.Layer {
-	l := repo.layers[id]
+	l := repo.find(id)
 	if l != nil && l.GetLayerType() == ls.OverlayTerm {
 		return l
 	}
 	return nil
 }
 
-// GetLayer returns a schema or an overlay with the given id
+// GetLayer returns a schema or an overlay with the given id. The id
+// can be of the form id@constraint to select a version.
 func (repo *Repository) GetLayer(id string) *ls.Layer {
-	return repo.layers[id]
+	return repo.find(id)
+}
+
+// SchemaLoader returns a schema loader that loads layers and schema
+// variants from the repository. Schema variants are composed.
+func (repo *Repository) SchemaLoader(context *ls.Context) ls.SchemaLoader {
+	return ls.SchemaLoaderFunc(func(ref string) (*ls.Layer, error) {
+		layer := repo.GetLayer(ref)
+		if layer == nil {
+			return nil, nil
+		}
+		if t := layer.GetLayerType(); t == ls.SchemaTerm || t == ls.OverlayTerm {
+			return layer, nil
+		}
+		return repo.GetComposedSchema(context, ref)
+	})
 }
 
 // GetComposedSchema returns a composed layer from the schema variant
@@ -121,7 +168,15 @@ func (repo *Repository) GetComposedSchema(context *ls.Context, id string) (*ls.L
 		if sch == nil {
 			return nil, ls.ErrNotFound(m.Schema)
 		}
-		result = sch.Clone()
+		// Resolve the base schema first, so overlays can target
+		// inherited attributes
+		result, err = (ls.Compiler{Loader: repo.SchemaLoader(context)}).ResolveExtends(sch)
+		if err != nil {
+			return nil, err
+		}
+		if result == sch {
+			result = sch.Clone()
+		}
 	}
 	for _, x := range m.Overlays {
 		ovl := repo.GetLayer(x)
@@ -131,6 +186,9 @@ func (repo *Repository) GetComposedSchema(context *ls.Context, id string) (*ls.L
 		if result == nil {
 			result = ovl.Clone()
 		} else {
+			if err := ls.CheckTargetVersion(result, ovl); err != nil {
+				return nil, err
+			}
 			err := result.Compose(context, ovl)
 			if err != nil {
 				return nil, err
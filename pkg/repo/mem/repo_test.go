@@ -0,0 +1,35 @@
+package mem
+
+import (
+	"testing"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+)
+
+func TestSelectSchemaVersion(t *testing.T) {
+	repo := New()
+	for _, version := range []string{"1.0.0", "1.1.0", "1.2.0-beta", "2.0.0-rc.1"} {
+		layer := ls.NewLayer()
+		layer.SetLayerType(ls.SchemaTerm)
+		layer.SetID("http://person/schema")
+		layer.SetVersion(version)
+		repo.AddLayer(layer)
+	}
+	for ref, expected := range map[string]string{
+		"http://person/schema":              "1.1.0",
+		"http://person/schema@^1":           "1.1.0",
+		"http://person/schema@~1.2":         "",
+		"http://person/schema@^1.2.0-alpha": "1.2.0-beta",
+		"http://person/schema@>=2.0.0-rc.1": "2.0.0-rc.1",
+		"http://person/schema@^2":           "",
+	} {
+		layer := repo.GetSchema(ref)
+		version := ""
+		if layer != nil {
+			version = layer.GetVersion()
+		}
+		if version != expected {
+			t.Errorf("%s: expected %s, got %s", ref, expected, version)
+		}
+	}
+}
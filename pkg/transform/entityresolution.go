@@ -0,0 +1,663 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cloudprivacylabs/opencypher/graph"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/lsa/pkg/types"
+)
+
+// Attribute comparators used for entity resolution
+const (
+	// Values are equal
+	ComparatorExact = "exact"
+	// Values are equal after case, punctuation, and whitespace
+	// normalization
+	ComparatorNormalized = "normalized"
+	// Jaro-Winkler similarity of normalized values
+	ComparatorJaroWinkler = "jaroWinkler"
+	// Dates are within maxDays of each other
+	ComparatorDate = "date"
+)
+
+// Entity resolution actions
+const (
+	// Connect matching entity roots with sameAs edges
+	ResolveSameAs = "sameAs"
+	// Merge matching entities into the first one
+	ResolveMerge = "merge"
+)
+
+// SameAsTerm is the label of the edges connecting the entity roots
+// that are resolved to be the same entity. The edge has the match
+// score.
+var SameAsTerm = ls.NewTerm(TRANSFORM, "sameAs", false, false, ls.OverrideComposition, nil)
+
+// MatchScoreTerm is the edge property containing the match score of
+// a sameAs edge
+var MatchScoreTerm = ls.NewTerm(TRANSFORM, "match/score", false, false, ls.OverrideComposition, nil)
+
+// MatchKeyTerm identifies a match attribute. Instances of schema
+// attributes that have the same match key are compared with each
+// other, so the same information from different schemas can be
+// matched. If not given, the schema attribute ID is used.
+var MatchKeyTerm = ls.NewTerm(TRANSFORM, "match/key", false, false, ls.OverrideComposition, nil)
+
+// MatchComparatorTerm gives the comparator for a schema attribute.
+// Only the attributes with a comparator are used to score matches.
+var MatchComparatorTerm = ls.NewTerm(TRANSFORM, "match/comparator", false, false, ls.OverrideComposition, nil)
+
+// MatchWeightTerm gives the weight of the attribute when scoring
+// matches. Default is 1.
+var MatchWeightTerm = ls.NewTerm(TRANSFORM, "match/weight", false, false, ls.OverrideComposition, nil)
+
+// MatchMaxDaysTerm gives the maximum number of days between two
+// dates compared using the date comparator
+var MatchMaxDaysTerm = ls.NewTerm(TRANSFORM, "match/maxDays", false, false, ls.OverrideComposition, nil)
+
+// MatchBlockingTerm marks the attribute as a blocking attribute. Only
+// the entities that share the normalized value of a blocking
+// attribute are compared.
+var MatchBlockingTerm = ls.NewTerm(TRANSFORM, "match/blocking", false, false, ls.OverrideComposition, nil)
+
+// MatchAttribute describes how the instances of a set of schema
+// attributes are compared
+type MatchAttribute struct {
+	// Key identifies the match attribute. If empty, the first schema
+	// node ID is used
+	Key string `json:"key" yaml:"key"`
+	// The instances of these schema attributes are compared with each
+	// other
+	SchemaNodeIDs []string `json:"schemaNodeIds" yaml:"schemaNodeIds"`
+	Comparator    string   `json:"comparator" yaml:"comparator"`
+	// Weight of the attribute. If zero, 1 is used
+	Weight float64 `json:"weight" yaml:"weight"`
+	// MaxDays is used by the date comparator. The similarity of two
+	// dates decreases linearly until maxDays. If zero, dates must be
+	// on the same day.
+	MaxDays float64 `json:"maxDays" yaml:"maxDays"`
+}
+
+// EntityResolutionSpec describes how entities are matched. Match
+// attributes can be given in the spec, or as annotations of the
+// schema attributes using the match terms, so they can be declared
+// in an overlay. Attributes given in the spec override the schema
+// annotations.
+type EntityResolutionSpec struct {
+	// Entities are the entity schemas or value types of the entities
+	// to resolve. If empty, all entities are resolved.
+	Entities []string `json:"entities" yaml:"entities"`
+	// Blocking contains the match keys or the schema node IDs of the
+	// blocking attributes. Only the entities that share a normalized
+	// value of a blocking attribute are compared. A blocking attribute
+	// does not have to be a match attribute. If there are no blocking
+	// attributes, all pairs of entities are compared.
+	Blocking   []string         `json:"blocking" yaml:"blocking"`
+	Attributes []MatchAttribute `json:"attributes" yaml:"attributes"`
+	// Entities whose score is greater than or equal to the threshold
+	// are matched. The score is between 0 and 1.
+	Threshold float64 `json:"threshold" yaml:"threshold"`
+	// Action is sameAs or merge. Default is sameAs.
+	Action string `json:"action" yaml:"action"`
+}
+
+// Validate checks the spec
+func (spec EntityResolutionSpec) Validate() error {
+	if spec.Threshold <= 0 || spec.Threshold > 1 {
+		return ErrInvalidMatchSpec{Msg: fmt.Sprintf("threshold must be in (0,1]: %v", spec.Threshold)}
+	}
+	switch spec.Action {
+	case "", ResolveSameAs, ResolveMerge:
+	default:
+		return ErrInvalidMatchSpec{Msg: "unknown action: " + spec.Action}
+	}
+	for _, attr := range spec.Attributes {
+		if len(attr.SchemaNodeIDs) == 0 {
+			return ErrInvalidMatchSpec{Msg: "attribute without schemaNodeIds: " + attr.Key}
+		}
+		if err := validateComparator(attr.Comparator); err != nil {
+			return err
+		}
+		if attr.Weight < 0 {
+			return ErrInvalidMatchSpec{Msg: "negative weight for " + attr.SchemaNodeIDs[0]}
+		}
+	}
+	return nil
+}
+
+func validateComparator(c string) error {
+	switch c {
+	case ComparatorExact, ComparatorNormalized, ComparatorJaroWinkler, ComparatorDate:
+		return nil
+	}
+	return ErrInvalidMatchSpec{Msg: "unknown comparator: " + c}
+}
+
+// EntityMatch is a pair of entities resolved to be the same entity
+type EntityMatch struct {
+	EntitySchema1 string   `json:"entitySchema1"`
+	EntityID1     []string `json:"entityId1"`
+	EntitySchema2 string   `json:"entitySchema2"`
+	EntityID2     []string `json:"entityId2"`
+	Score         float64  `json:"score"`
+}
+
+// EntityResolver matches the entities of a graph
+type EntityResolver struct {
+	Spec EntityResolutionSpec
+	// MergeOptions are used to merge entities if the action is merge
+	MergeOptions ls.UpsertOptions
+
+	// The match attributes by key, and the keys by schema node ID
+	attributes map[string]*MatchAttribute
+	keys       map[string]string
+	blocking   map[string]struct{}
+	// The keys of the match attributes in sorted order, so the scores
+	// are computed in the same order every time
+	attributeKeys []string
+}
+
+// matchEntity contains the match attribute values of an entity root
+type matchEntity struct {
+	info   ls.EntityInfo
+	values map[string][]graph.Node
+	blocks []string
+}
+
+// Resolve finds the matching entities of the graph, and connects them
+// with sameAs edges, or merges them. Returns the matching pairs.
+func (r *EntityResolver) Resolve(g graph.Graph) ([]EntityMatch, error) {
+	if err := r.Spec.Validate(); err != nil {
+		return nil, err
+	}
+	r.attributes = make(map[string]*MatchAttribute)
+	r.keys = make(map[string]string)
+	r.blocking = make(map[string]struct{})
+	for i := range r.Spec.Attributes {
+		attr := r.Spec.Attributes[i]
+		if len(attr.Key) == 0 {
+			attr.Key = attr.SchemaNodeIDs[0]
+		}
+		r.attributes[attr.Key] = &attr
+		for _, id := range attr.SchemaNodeIDs {
+			r.keys[id] = attr.Key
+		}
+	}
+	for _, b := range r.Spec.Blocking {
+		if key, ok := r.keys[b]; ok {
+			b = key
+		}
+		r.blocking[b] = struct{}{}
+	}
+
+	entities, err := r.collectEntities(g)
+	if err != nil {
+		return nil, err
+	}
+	// Match attributes declared in the schemas are added while
+	// collecting entities
+	r.attributeKeys = make([]string, 0, len(r.attributes))
+	for key := range r.attributes {
+		r.attributeKeys = append(r.attributeKeys, key)
+	}
+	sort.Strings(r.attributeKeys)
+	matches := make([]EntityMatch, 0)
+	matched := make([][2]int, 0)
+	for _, pair := range r.candidatePairs(entities) {
+		score, ok := r.score(entities[pair[0]], entities[pair[1]])
+		if !ok || score < r.Spec.Threshold {
+			continue
+		}
+		e1, e2 := entities[pair[0]].info, entities[pair[1]].info
+		matches = append(matches, EntityMatch{
+			EntitySchema1: e1.GetEntitySchema(),
+			EntityID1:     e1.GetID(),
+			EntitySchema2: e2.GetEntitySchema(),
+			EntityID2:     e2.GetID(),
+			Score:         score,
+		})
+		matched = append(matched, pair)
+	}
+
+	if r.Spec.Action == ResolveMerge {
+		r.merge(g, entities, matched)
+		return matches, nil
+	}
+	for i, pair := range matched {
+		from, to := entities[pair[0]].info.GetRoot(), entities[pair[1]].info.GetRoot()
+		if hasEdgeTo(from, to, SameAsTerm) {
+			continue
+		}
+		g.NewEdge(from, to, SameAsTerm, map[string]interface{}{
+			MatchScoreTerm: ls.StringPropertyValue(fmt.Sprint(matches[i].Score)),
+		})
+	}
+	return matches, nil
+}
+
+func hasEdgeTo(from, to graph.Node, label string) bool {
+	for edges := from.GetEdgesWithLabel(graph.OutgoingEdge, label); edges.Next(); {
+		if edges.Edge().GetTo() == to {
+			return true
+		}
+	}
+	return false
+}
+
+// collectEntities returns the entities to resolve with their match
+// attribute values, ordered by entity schema, entity ID, and node ID
+func (r *EntityResolver) collectEntities(g graph.Graph) ([]matchEntity, error) {
+	included := make(map[string]struct{}, len(r.Spec.Entities))
+	for _, x := range r.Spec.Entities {
+		included[x] = struct{}{}
+	}
+	isIncluded := func(info ls.EntityInfo) bool {
+		if len(included) == 0 {
+			return true
+		}
+		if _, ok := included[info.GetEntitySchema()]; ok {
+			return true
+		}
+		for _, t := range info.GetValueType() {
+			if _, ok := included[t]; ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	entities := make([]matchEntity, 0)
+	for _, info := range ls.GetEntityRootNodes(g) {
+		if !isIncluded(info) {
+			continue
+		}
+		entity := matchEntity{info: info, values: make(map[string][]graph.Node)}
+		var err error
+		ls.IterateDescendants(info.GetRoot(), func(node graph.Node) bool {
+			if _, ok := ls.GetRawNodeValue(node); !ok {
+				return true
+			}
+			key, e := r.attributeKey(node)
+			if e != nil {
+				err = e
+				return false
+			}
+			if len(key) > 0 {
+				entity.values[key] = append(entity.values[key], node)
+			}
+			return true
+		}, func(edge graph.Edge) ls.EdgeFuncResult {
+			if !ls.IsDocumentNode(edge.GetTo()) {
+				return ls.SkipEdgeResult
+			}
+			return ls.FollowEdgesInEntity(edge)
+		}, false)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, entity)
+	}
+	// Blocking attributes may be declared in the schemas, so blocks
+	// are computed after all entities are collected
+	for i := range entities {
+		for key := range r.blocking {
+			// The blocking attribute may be a schema node ID with a
+			// match key declared in the schema
+			if k, ok := r.keys[key]; ok {
+				key = k
+			}
+			for _, node := range entities[i].values[key] {
+				v, _ := ls.GetRawNodeValue(node)
+				if n := normalizeMatchValue(v); len(n) > 0 {
+					entities[i].blocks = append(entities[i].blocks, key+"\x00"+n)
+				}
+			}
+		}
+	}
+	sort.Slice(entities, func(i, j int) bool {
+		a, b := entities[i].info, entities[j].info
+		if a.GetEntitySchema() != b.GetEntitySchema() {
+			return a.GetEntitySchema() < b.GetEntitySchema()
+		}
+		if x, y := strings.Join(a.GetID(), "\x00"), strings.Join(b.GetID(), "\x00"); x != y {
+			return x < y
+		}
+		return ls.GetNodeID(a.GetRoot()) < ls.GetNodeID(b.GetRoot())
+	})
+	return entities, nil
+}
+
+// attributeKey returns the match key of the document node. If the
+// schema node ID of the node is not in the spec, the match
+// annotations of the node or its schema node are used.
+func (r *EntityResolver) attributeKey(node graph.Node) (string, error) {
+	schemaNodeID := ls.AsPropertyValue(node.GetProperty(ls.SchemaNodeIDTerm)).AsString()
+	if key, ok := r.keys[schemaNodeID]; ok {
+		return key, nil
+	}
+	comparator, _ := ls.GetNodeOrSchemaProperty(node, MatchComparatorTerm)
+	blocking, _ := ls.GetNodeOrSchemaProperty(node, MatchBlockingTerm)
+	isBlocking := blocking != nil && blocking.AsString() == "true"
+	if (comparator == nil || len(comparator.AsString()) == 0) && !isBlocking {
+		// The values of the blocking attributes of the spec are
+		// collected even if they are not scored
+		if _, ok := r.blocking[schemaNodeID]; ok && len(schemaNodeID) > 0 {
+			return schemaNodeID, nil
+		}
+		return "", nil
+	}
+	key := schemaNodeID
+	if pv, ok := ls.GetNodeOrSchemaProperty(node, MatchKeyTerm); ok && len(pv.AsString()) > 0 {
+		key = pv.AsString()
+	}
+	if len(key) == 0 {
+		return "", nil
+	}
+	if len(schemaNodeID) > 0 {
+		r.keys[schemaNodeID] = key
+	}
+	if isBlocking {
+		r.blocking[key] = struct{}{}
+	}
+	if comparator == nil || len(comparator.AsString()) == 0 {
+		return key, nil
+	}
+	if _, ok := r.attributes[key]; ok {
+		return key, nil
+	}
+	attr := MatchAttribute{
+		Key:           key,
+		SchemaNodeIDs: []string{schemaNodeID},
+		Comparator:    comparator.AsString(),
+		Weight:        1,
+	}
+	if err := validateComparator(attr.Comparator); err != nil {
+		return "", err
+	}
+	if pv, ok := ls.GetNodeOrSchemaProperty(node, MatchWeightTerm); ok {
+		if _, err := fmt.Sscan(pv.AsString(), &attr.Weight); err != nil {
+			return "", ErrInvalidMatchSpec{Msg: fmt.Sprintf("invalid weight for %s: %s", key, pv.AsString())}
+		}
+	}
+	if pv, ok := ls.GetNodeOrSchemaProperty(node, MatchMaxDaysTerm); ok {
+		if _, err := fmt.Sscan(pv.AsString(), &attr.MaxDays); err != nil {
+			return "", ErrInvalidMatchSpec{Msg: fmt.Sprintf("invalid maxDays for %s: %s", key, pv.AsString())}
+		}
+	}
+	r.attributes[key] = &attr
+	return key, nil
+}
+
+// candidatePairs returns the pairs of entity indexes that share a
+// blocking value, or all pairs if there are no blocking attributes
+func (r *EntityResolver) candidatePairs(entities []matchEntity) [][2]int {
+	ret := make([][2]int, 0)
+	if len(r.blocking) == 0 {
+		for i := range entities {
+			for j := i + 1; j < len(entities); j++ {
+				ret = append(ret, [2]int{i, j})
+			}
+		}
+		return ret
+	}
+	blocks := make(map[string][]int)
+	for i, e := range entities {
+		for _, b := range e.blocks {
+			if x := blocks[b]; len(x) == 0 || x[len(x)-1] != i {
+				blocks[b] = append(x, i)
+			}
+		}
+	}
+	seen := make(map[[2]int]struct{})
+	for _, members := range blocks {
+		for i := range members {
+			for j := i + 1; j < len(members); j++ {
+				seen[[2]int{members[i], members[j]}] = struct{}{}
+			}
+		}
+	}
+	for pair := range seen {
+		ret = append(ret, pair)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i][0] == ret[j][0] {
+			return ret[i][1] < ret[j][1]
+		}
+		return ret[i][0] < ret[j][0]
+	})
+	return ret
+}
+
+// score returns the weighted average similarity of the attributes
+// both entities have. Returns false if the entities have no common
+// attributes.
+func (r *EntityResolver) score(e1, e2 matchEntity) (float64, bool) {
+	var total, weights float64
+	for _, key := range r.attributeKeys {
+		attr := r.attributes[key]
+		v1, v2 := e1.values[key], e2.values[key]
+		if len(v1) == 0 || len(v2) == 0 {
+			continue
+		}
+		weight := attr.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		best := 0.0
+		for _, n1 := range v1 {
+			for _, n2 := range v2 {
+				if s := compareMatchValues(attr, n1, n2); s > best {
+					best = s
+				}
+			}
+		}
+		total += weight * best
+		weights += weight
+	}
+	if weights == 0 {
+		return 0, false
+	}
+	return total / weights, true
+}
+
+// merge merges the connected groups of matched entities into the
+// first entity of the group
+func (r *EntityResolver) merge(g graph.Graph, entities []matchEntity, matched [][2]int) {
+	parent := make([]int, len(entities))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for _, pair := range matched {
+		a, b := find(pair[0]), find(pair[1])
+		if a < b {
+			parent[b] = a
+		} else if b < a {
+			parent[a] = b
+		}
+	}
+	builder := ls.NewGraphBuilder(g, ls.GraphBuilderOptions{})
+	index := builder.GetEntityIndex()
+	for i := range entities {
+		target := find(i)
+		if target == i {
+			continue
+		}
+		existing, incoming := entities[target].info.GetRoot(), entities[i].info.GetRoot()
+		// Nested entities may have been merged with their parents
+		if _, ok := index.GetEntityInfo(existing); !ok {
+			continue
+		}
+		if _, ok := index.GetEntityInfo(incoming); !ok {
+			continue
+		}
+		builder.MergeEntity(existing, incoming, r.MergeOptions)
+	}
+}
+
+// compareMatchValues returns the similarity of two document nodes
+// between 0 and 1
+func compareMatchValues(attr *MatchAttribute, n1, n2 graph.Node) float64 {
+	s1, _ := ls.GetRawNodeValue(n1)
+	s2, _ := ls.GetRawNodeValue(n2)
+	switch attr.Comparator {
+	case ComparatorExact:
+		if s1 == s2 {
+			return 1
+		}
+	case ComparatorNormalized:
+		if normalizeMatchValue(s1) == normalizeMatchValue(s2) {
+			return 1
+		}
+	case ComparatorJaroWinkler:
+		return JaroWinkler(normalizeMatchValue(s1), normalizeMatchValue(s2))
+	case ComparatorDate:
+		t1, ok1 := getNodeTime(n1)
+		t2, ok2 := getNodeTime(n2)
+		if !ok1 || !ok2 {
+			return 0
+		}
+		days := math.Abs(t1.Sub(t2).Hours()) / 24
+		if attr.MaxDays <= 0 {
+			if t1.Year() == t2.Year() && t1.YearDay() == t2.YearDay() {
+				return 1
+			}
+			return 0
+		}
+		if days >= attr.MaxDays {
+			return 0
+		}
+		return 1 - days/attr.MaxDays
+	}
+	return 0
+}
+
+// getNodeTime returns the time value of the node. If the node does
+// not have a date/time type, the node value is parsed as an XSD date
+// or date time.
+func getNodeTime(node graph.Node) (time.Time, bool) {
+	type timeValue interface {
+		ToTime() time.Time
+	}
+	if v, err := ls.GetNodeValue(node); err == nil {
+		if t, ok := v.(timeValue); ok {
+			return t.ToTime(), true
+		}
+	}
+	if v, err := (types.XSDDateParser{}).GetNodeValue(node); err == nil {
+		if t, ok := v.(timeValue); ok {
+			return t.ToTime(), true
+		}
+	}
+	if v, err := (types.XSDDateTimeParser{}).GetNodeValue(node); err == nil {
+		if t, ok := v.(timeValue); ok {
+			return t.ToTime(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// normalizeMatchValue converts the value to lowercase, removes
+// punctuation, and collapses whitespace
+func normalizeMatchValue(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		return -1
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// JaroWinkler returns the Jaro-Winkler similarity of two strings
+// between 0 and 1
+func JaroWinkler(s1, s2 string) float64 {
+	r1, r2 := []rune(s1), []rune(s2)
+	if len(r1) == 0 && len(r2) == 0 {
+		return 1
+	}
+	if len(r1) == 0 || len(r2) == 0 {
+		return 0
+	}
+	window := len(r1)
+	if len(r2) > window {
+		window = len(r2)
+	}
+	window = window/2 - 1
+	if window < 0 {
+		window = 0
+	}
+	matched1 := make([]bool, len(r1))
+	matched2 := make([]bool, len(r2))
+	matches := 0
+	for i := range r1 {
+		lo, hi := i-window, i+window+1
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(r2) {
+			hi = len(r2)
+		}
+		for j := lo; j < hi; j++ {
+			if !matched2[j] && r1[i] == r2[j] {
+				matched1[i], matched2[j] = true, true
+				matches++
+				break
+			}
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+	transpositions := 0
+	j := 0
+	for i := range r1 {
+		if !matched1[i] {
+			continue
+		}
+		for !matched2[j] {
+			j++
+		}
+		if r1[i] != r2[j] {
+			transpositions++
+		}
+		j++
+	}
+	m := float64(matches)
+	jaro := (m/float64(len(r1)) + m/float64(len(r2)) + (m-float64(transpositions)/2)/m) / 3
+	prefix := 0
+	for prefix < len(r1) && prefix < len(r2) && prefix < 4 && r1[prefix] == r2[prefix] {
+		prefix++
+	}
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
@@ -0,0 +1,178 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/opencypher/graph"
+)
+
+const entityResolutionTestSchema = `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@id": "https://person",
+  "@type": "ls:Schema",
+  "ls:valueType": "Person",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "person",
+    "ls:entityIdFields": "id",
+    "ls:Object/attributes": [
+      {"@id": "id", "@type": "ls:Value"},
+      {"@id": "first", "@type": "ls:Value", "ls:transform/match/key": "name", "ls:transform/match/comparator": "jaroWinkler", "ls:transform/match/weight": "2"},
+      {"@id": "last", "@type": "ls:Value", "ls:transform/match/comparator": "normalized", "ls:transform/match/blocking": "true"},
+      {"@id": "dob", "@type": "ls:Value", "ls:transform/match/comparator": "date", "ls:transform/match/maxDays": "30"}
+    ]
+  }
+}`
+
+func buildEntityResolutionTestGraph(t *testing.T, rows ...[]string) (ls.GraphBuilder, []graph.Node) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(entityResolutionTestSchema), &v); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := ls.UnmarshalLayer(v, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler := ls.Compiler{
+		Loader: ls.SchemaLoaderFunc(func(string) (*ls.Layer, error) { return layer, nil }),
+	}
+	layer, err = compiler.Compile(ls.DefaultContext(), "https://person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := ls.NewGraphBuilder(nil, ls.GraphBuilderOptions{EmbedSchemaNodes: true})
+	roots := make([]graph.Node, 0)
+	for _, row := range rows {
+		_, root, _ := builder.ObjectAsNode(layer.GetSchemaRootNode(), nil)
+		for i, attr := range []string{"id", "first", "last", "dob"} {
+			builder.ValueAsNode(layer.GetAttributeByID(attr), root, row[i])
+		}
+		roots = append(roots, root)
+	}
+	return builder, roots
+}
+
+func TestEntityResolutionAnnotations(t *testing.T) {
+	builder, roots := buildEntityResolutionTestGraph(t,
+		[]string{"1", "John", "Smith", "1980-01-02"},
+		[]string{"2", "Jon", "SMITH", "1980-01-03"},
+		[]string{"3", "Mary", "Jones", "1980-01-02"},
+		[]string{"4", "John", "Smith", "1995-01-01"},
+	)
+	resolver := EntityResolver{Spec: EntityResolutionSpec{Threshold: 0.85}}
+	matches, err := resolver.Resolve(builder.GetGraph())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("Expecting 1 match, got %v", matches)
+	}
+	if matches[0].EntityID1[0] != "1" || matches[0].EntityID2[0] != "2" {
+		t.Errorf("Wrong match: %v", matches[0])
+	}
+	edges := graph.EdgeSlice(roots[0].GetEdgesWithLabel(graph.OutgoingEdge, SameAsTerm))
+	if len(edges) != 1 || edges[0].GetTo() != roots[1] {
+		t.Errorf("Expecting sameAs edge from 1 to 2, got %v", edges)
+	}
+	// Resolving again does not add another edge
+	if _, err := resolver.Resolve(builder.GetGraph()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(graph.EdgeSlice(roots[0].GetEdgesWithLabel(graph.OutgoingEdge, SameAsTerm))); n != 1 {
+		t.Errorf("Expecting 1 sameAs edge, got %d", n)
+	}
+}
+
+func TestEntityResolutionMerge(t *testing.T) {
+	builder, _ := buildEntityResolutionTestGraph(t,
+		[]string{"1", "John", "Smith", "1980-01-02"},
+		[]string{"2", "john", "Smith", "1980-01-02"},
+		[]string{"3", "JOHN", "Smith", "1980-01-02"},
+		[]string{"4", "Mary", "Smith", "1980-01-02"},
+	)
+	// Attributes in the spec override the schema annotations
+	resolver := EntityResolver{Spec: EntityResolutionSpec{
+		Blocking: []string{"last"},
+		Attributes: []MatchAttribute{
+			{SchemaNodeIDs: []string{"first"}, Comparator: ComparatorNormalized},
+			{SchemaNodeIDs: []string{"dob"}, Comparator: ComparatorExact},
+		},
+		Threshold: 1,
+		Action:    ResolveMerge,
+	}}
+	matches, err := resolver.Resolve(builder.GetGraph())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 3 {
+		t.Errorf("Expecting 3 matches, got %v", matches)
+	}
+	roots := ls.GetEntityRootNodes(builder.GetGraph())
+	if len(roots) != 2 {
+		t.Fatalf("Expecting 2 entities after merge, got %d", len(roots))
+	}
+	for _, info := range roots {
+		if id := info.GetID()[0]; id != "1" && id != "4" {
+			t.Errorf("Unexpected entity %s", id)
+		}
+	}
+	if _, err := (&EntityResolver{Spec: EntityResolutionSpec{Threshold: 0.5, Attributes: []MatchAttribute{{SchemaNodeIDs: []string{"first"}, Comparator: "soundex"}}}}).Resolve(builder.GetGraph()); err == nil {
+		t.Errorf("Expecting error for unknown comparator")
+	}
+}
+
+func TestJaroWinkler(t *testing.T) {
+	for _, tc := range []struct {
+		s1, s2 string
+		exp    float64
+	}{
+		{"martha", "marhta", 0.9611},
+		{"dixon", "dicksonx", 0.8133},
+		{"abc", "abc", 1},
+		{"abc", "xyz", 0},
+	} {
+		if v := JaroWinkler(tc.s1, tc.s2); math.Abs(v-tc.exp) > 0.0001 {
+			t.Errorf("%s %s: expected %v got %v", tc.s1, tc.s2, tc.exp, v)
+		}
+	}
+}
+
+func TestEntityResolutionBlockingOnly(t *testing.T) {
+	builder, _ := buildEntityResolutionTestGraph(t,
+		[]string{"1", "John", "Smith", "1980-01-02"},
+		[]string{"1", "john", "Jones", "1980-01-02"},
+		[]string{"2", "JOHN", "Brown", "1980-01-02"},
+	)
+	// id is a blocking attribute that is not scored
+	resolver := EntityResolver{Spec: EntityResolutionSpec{
+		Blocking: []string{"id"},
+		Attributes: []MatchAttribute{
+			{SchemaNodeIDs: []string{"first"}, Comparator: ComparatorNormalized},
+		},
+		Threshold: 0.6,
+	}}
+	matches, err := resolver.Resolve(builder.GetGraph())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].EntityID1[0] != "1" || matches[0].EntityID2[0] != "1" {
+		t.Errorf("Expecting a match of entities with id 1, got %v", matches)
+	}
+}
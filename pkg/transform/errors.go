@@ -50,3 +50,24 @@ func wrapReshapeError(err error, schemaNodeID string) error {
 		SchemaNodeID: schemaNodeID,
 	}
 }
+
+// ErrInvalidGuard is returned if a guard expression cannot be parsed
+type ErrInvalidGuard struct {
+	Guard string
+	Err   error
+}
+
+func (e ErrInvalidGuard) Unwrap() error { return e.Err }
+func (e ErrInvalidGuard) Error() string {
+	return fmt.Sprintf("Invalid guard %s: %s", e.Guard, e.Err.Error())
+}
+
+// ErrInvalidMatchSpec is returned if an entity resolution
+// specification is not valid
+type ErrInvalidMatchSpec struct {
+	Msg string
+}
+
+func (e ErrInvalidMatchSpec) Error() string {
+	return fmt.Sprintf("Invalid entity resolution spec: %s", e.Msg)
+}
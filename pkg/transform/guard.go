@@ -0,0 +1,155 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"github.com/cloudprivacylabs/opencypher"
+	"github.com/cloudprivacylabs/opencypher/graph"
+
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+)
+
+// guards keeps the parsed guard expressions
+type guards map[string]opencypher.Evaluatable
+
+func (g guards) get(expr string) (opencypher.Evaluatable, error) {
+	if e, ok := g[expr]; ok {
+		return e, nil
+	}
+	e, err := opencypher.Parse(expr)
+	if err != nil {
+		return nil, ErrInvalidGuard{Guard: expr, Err: err}
+	}
+	g[expr] = e
+	return e, nil
+}
+
+// EvaluateGuard evaluates a guard expression for a document
+// node. The document node is available as `this`, and the entity
+// root containing it as `entity`. The guard holds if the expression
+// returns true, or a nonempty result set. If the result set has a
+// single value, that value is used as the result.
+func EvaluateGuard(guard opencypher.Evaluatable, docNode graph.Node) (bool, error) {
+	ctx := opencypher.NewEvalContext(docNode.GetGraph())
+	ctx.SetVar("this", opencypher.RValue{Value: docNode})
+	if root := ls.GetEntityRootNode(docNode); root != nil {
+		ctx.SetVar("entity", opencypher.RValue{Value: root})
+	}
+	v, err := guard.Evaluate(ctx)
+	if err != nil {
+		return false, err
+	}
+	if b, ok := opencypher.ValueAsBool(v); ok {
+		return b, nil
+	}
+	if rs, ok := v.Get().(opencypher.ResultSet); ok {
+		if len(rs.Rows) == 1 && len(rs.Rows[0]) == 1 {
+			for _, x := range rs.Rows[0] {
+				if b, ok := opencypher.ValueAsBool(x); ok {
+					return b, nil
+				}
+			}
+		}
+		return len(rs.Rows) > 0, nil
+	}
+	return v.Get() != nil, nil
+}
+
+// composeGuarded composes the annotations with the document nodes
+// for which the guard holds
+func composeGuarded(ctx *ls.Context, docNodes []graph.Node, annotations graph.Node, guard opencypher.Evaluatable) error {
+	for _, docNode := range docNodes {
+		ok, err := EvaluateGuard(guard, docNode)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := composeAnnotations(ctx, docNode, annotations); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// composeAnnotations composes the properties of annotations with the
+// target node. The guard term itself is not composed.
+func composeAnnotations(ctx *ls.Context, target, annotations graph.Node) error {
+	var composeErr error
+	annotations.ForEachProperty(func(key string, value interface{}) bool {
+		p, ok := value.(*ls.PropertyValue)
+		if !ok || key == ls.GuardTerm {
+			return true
+		}
+		newValue, err := ls.ComposeProperty(ctx, key, ls.AsPropertyValue(target.GetProperty(key)), p)
+		if err != nil {
+			composeErr = err
+			return false
+		}
+		target.SetProperty(key, newValue)
+		return true
+	})
+	return composeErr
+}
+
+// findDocumentNodes returns the document nodes that are instances of
+// the schema node with the given ID
+func findDocumentNodes(g graph.Graph, schemaNodeID string) ([]graph.Node, error) {
+	pattern := graph.Pattern{
+		{
+			Labels: graph.NewStringSet(ls.DocumentNodeTerm),
+			Properties: map[string]interface{}{
+				ls.SchemaNodeIDTerm: ls.StringPropertyValue(schemaNodeID),
+			},
+		}}
+	return pattern.FindNodes(g, nil)
+}
+
+// ApplyConditionalAnnotations evaluates the guards of the
+// conditional annotations of the schema attributes for the document
+// nodes of g, and composes the annotations with the nodes for which
+// the guard holds. Conditional annotations are added to a schema when
+// it is composed with guarded overlays. This is used after ingestion.
+func ApplyConditionalAnnotations(ctx *ls.Context, g graph.Graph, schema *ls.Layer) error {
+	parsed := guards{}
+	var err error
+	schema.ForEachAttribute(func(schemaNode graph.Node, _ []graph.Node) bool {
+		err = applyConditionalAnnotations(ctx, g, schemaNode, parsed)
+		return err == nil
+	})
+	return err
+}
+
+func applyConditionalAnnotations(ctx *ls.Context, g graph.Graph, schemaNode graph.Node, parsed guards) error {
+	annotations := ls.GetConditionalAnnotations(schemaNode)
+	if len(annotations) == 0 {
+		return nil
+	}
+	docNodes, err := findDocumentNodes(g, ls.GetAttributeID(schemaNode))
+	if err != nil {
+		return err
+	}
+	for _, a := range annotations {
+		guard, err := parsed.get(ls.GetConditionalAnnotationsGuard(a))
+		if err != nil {
+			return err
+		}
+		if err := composeGuarded(ctx, docNodes, a, guard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2021 Cloud Privacy Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/cloudprivacylabs/opencypher/graph"
+
+	jsoningest "github.com/cloudprivacylabs/lsa/pkg/json"
+	"github.com/cloudprivacylabs/lsa/pkg/ls"
+)
+
+const guardTestSchema = `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "ls:Schema",
+  "@id": "http://person/schema",
+  "ls:valueType": "Person",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "http://person",
+    "ls:Object/attributes": [
+      {"@id": "country", "@type": "ls:Value", "ls:attributeName": "country"},
+      {"@id": "code", "@type": "ls:Value", "ls:attributeName": "code"}
+    ]
+  }
+}`
+
+const guardTestOverlay = `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "ls:Overlay",
+  "@id": "http://person/ca",
+  "ls:valueType": "Person",
+  "ls:layer": {
+    "@type": "ls:Object",
+    "@id": "http://person",
+    "ls:Object/attributes": [
+      {"@id": "code", "@type": "ls:Value",
+       "ls:description": "Canadian code",
+       "ls:guard": "match (entity)-[]->(c) where c.` + "`https://lschema.org/schemaNodeId`" + `='country' return c.` + "`https://lschema.org/value`" + `='CA'"}
+    ]
+  }
+}`
+
+func TestGuardedOverlay(t *testing.T) {
+	layer := func(s string) *ls.Layer {
+		var v interface{}
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			t.Fatal(err)
+		}
+		l, err := ls.UnmarshalLayer(v, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	ingest := func(schema *ls.Layer, docs ...string) graph.Graph {
+		g := ls.NewDocumentGraph()
+		for _, doc := range docs {
+			builder := ls.NewGraphBuilder(g, ls.GraphBuilderOptions{EmbedSchemaNodes: true})
+			parser := jsoningest.Parser{SchemaNode: schema.GetSchemaRootNode()}
+			if _, err := jsoningest.IngestBytes(ls.DefaultContext(), "http://doc", []byte(doc), parser, builder); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return g
+	}
+	descriptions := func(g graph.Graph) map[string]string {
+		ret := make(map[string]string)
+		nodes, _ := findDocumentNodes(g, "code")
+		for _, node := range nodes {
+			value, _ := ls.GetRawNodeValue(node)
+			ret[value] = ls.AsPropertyValue(node.GetProperty(ls.DescriptionTerm)).AsString()
+		}
+		return ret
+	}
+	docs := []string{`{"country": "CA", "code": "1"}`, `{"country": "US", "code": "2"}`}
+	expected := map[string]string{"1": "Canadian code", "2": ""}
+
+	compile := func(schema *ls.Layer) *ls.Layer {
+		compiler := ls.Compiler{Loader: ls.SchemaLoaderFunc(func(string) (*ls.Layer, error) { return schema, nil })}
+		compiled, err := compiler.Compile(ls.DefaultContext(), schema.GetID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return compiled
+	}
+
+	// Apply the guarded overlay to an ingested graph
+	g := ingest(compile(layer(guardTestSchema)), docs...)
+	if err := ApplyLayer(ls.DefaultContext(), g, layer(guardTestOverlay), false); err != nil {
+		t.Fatal(err)
+	}
+	if d := descriptions(g); d["1"] != expected["1"] || d["2"] != expected["2"] {
+		t.Errorf("Wrong descriptions after apply: %v", d)
+	}
+
+	// Compose the guarded overlay, and apply during ingestion
+	schema := layer(guardTestSchema)
+	if err := schema.Compose(ls.DefaultContext(), layer(guardTestOverlay)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := schema.GetAttributeByID("code").GetProperty(ls.DescriptionTerm); ok {
+		t.Errorf("Guarded annotation composed unconditionally")
+	}
+	compiled := compile(schema)
+	if !compiled.HasConditionalAnnotations() {
+		t.Fatalf("Compiled schema does not have conditional annotations")
+	}
+	g = ingest(compiled, docs...)
+	if err := ApplyConditionalAnnotations(ls.DefaultContext(), g, compiled); err != nil {
+		t.Fatal(err)
+	}
+	if d := descriptions(g); d["1"] != expected["1"] || d["2"] != expected["2"] {
+		t.Errorf("Wrong descriptions after ingestion: %v", d)
+	}
+}
+
+func TestGuardedOverlayAttributes(t *testing.T) {
+	layer := func(s string) *ls.Layer {
+		var v interface{}
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			t.Fatal(err)
+		}
+		l, err := ls.UnmarshalLayer(v, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	overlay := func(id, attr string) string {
+		return `{
+  "@context": {"ls": "https://lschema.org/"},
+  "@type": "ls:Overlay",
+  "@id": "` + id + `",
+  "ls:valueType": "Person",
+  "ls:attributeOverlays": {"@list": [` + attr + `]}
+}`
+	}
+	target := layer(overlay("http://person/ovl", `{"@id": "code", "@type": "ls:Value", "ls:description": "code"}`))
+	guards := []string{"return true", "return false"}
+	for i, guard := range guards {
+		src := layer(overlay(fmt.Sprintf("http://person/guarded%d", i), `{"@id": "code", "@type": "ls:Value", "ls:description": "guarded", "ls:guard": "`+guard+`"}`))
+		if err := target.Compose(ls.DefaultContext(), src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	attrs := target.GetOverlayAttributes()
+	if len(attrs) != 1 {
+		t.Fatalf("Wrong overlay attributes: %v", attrs)
+	}
+	if s := ls.AsPropertyValue(attrs[0].GetProperty(ls.DescriptionTerm)).AsString(); s != "code" {
+		t.Errorf("Guarded annotation composed unconditionally: %s", s)
+	}
+	found := make(map[string]int)
+	for _, node := range ls.GetConditionalAnnotations(attrs[0]) {
+		found[ls.GetConditionalAnnotationsGuard(node)]++
+	}
+	if len(found) != 2 || found[guards[0]] != 1 || found[guards[1]] != 1 {
+		t.Errorf("Wrong conditional annotations: %v", found)
+	}
+}
@@ -16,6 +16,7 @@ package transform
 
 import (
 	"github.com/cloudprivacylabs/lsa/pkg/ls"
+	"github.com/cloudprivacylabs/opencypher"
 	"github.com/cloudprivacylabs/opencypher/graph"
 )
 
@@ -25,28 +26,49 @@ import (
 // matching nodes of the graph. If reinterpretValues is set, the
 // operation will get the node value, compose, and set it back, so
 // this can be used for type conversions.
+//
+// If the layer is an overlay with guards, the annotations of the
+// guarded attributes are composed only with the document nodes for
+// which the guard holds. Conditional annotations of the layer
+// attributes are applied the same way.
 func ApplyLayer(ctx *ls.Context, g graph.Graph, layer *ls.Layer, reinterpretValues bool) error {
 	var applyErr error
+	parsed := guards{}
 
 	processNode := func(layerNode graph.Node) bool {
 		layerNodeID := ls.GetAttributeID(layerNode)
 		if len(layerNodeID) == 0 {
 			return true
 		}
+		// Guarded overlay attributes are composed only with the
+		// document nodes for which the guard holds
+		var guard opencypher.Evaluatable
+		if layer.GetLayerType() == ls.OverlayTerm {
+			if expr := layer.GetAttributeGuard(layerNode); len(expr) > 0 {
+				var err error
+				if guard, err = parsed.get(expr); err != nil {
+					applyErr = err
+					return false
+				}
+			}
+		}
 		// Find document graph nodes for this layer node
-		pattern := graph.Pattern{
-			{
-				Labels: graph.NewStringSet(ls.DocumentNodeTerm),
-				Properties: map[string]interface{}{
-					ls.SchemaNodeIDTerm: ls.StringPropertyValue(layerNodeID),
-				},
-			}}
-		nodes, err := pattern.FindNodes(g, nil)
+		nodes, err := findDocumentNodes(g, layerNodeID)
 		if err != nil {
 			applyErr = err
 			return false
 		}
 		for _, node := range nodes {
+			if guard != nil {
+				ok, err := EvaluateGuard(guard, node)
+				if err != nil {
+					applyErr = err
+					return false
+				}
+				if !ok {
+					continue
+				}
+			}
 			var value interface{}
 			if reinterpretValues && node.HasLabel(ls.AttributeTypeValue) {
 				value, err = ls.GetNodeValue(node)
@@ -55,7 +77,12 @@ func ApplyLayer(ctx *ls.Context, g graph.Graph, layer *ls.Layer, reinterpretValu
 					return false
 				}
 			}
-			if err := ls.ComposeProperties(ctx, node, layerNode); err != nil {
+			if guard != nil {
+				err = composeAnnotations(ctx, node, layerNode)
+			} else {
+				err = ls.ComposeProperties(ctx, node, layerNode)
+			}
+			if err != nil {
 				applyErr = err
 				return false
 			}
@@ -66,9 +93,13 @@ func ApplyLayer(ctx *ls.Context, g graph.Graph, layer *ls.Layer, reinterpretValu
 				}
 			}
 		}
+		if guard != nil {
+			// Guarded annotations are not composed with the schema nodes
+			return true
+		}
 		// Find schema graph nodes for this layer node
 		// This is required if schema nodes were not embedded
-		pattern = graph.Pattern{
+		pattern := graph.Pattern{
 			{
 				Labels: graph.NewStringSet(ls.AttributeNodeTerm),
 				Properties: map[string]interface{}{
@@ -86,6 +117,11 @@ func ApplyLayer(ctx *ls.Context, g graph.Graph, layer *ls.Layer, reinterpretValu
 				return false
 			}
 		}
+		// Apply the conditional annotations of the layer node
+		if err := applyConditionalAnnotations(ctx, g, layerNode, parsed); err != nil {
+			applyErr = err
+			return false
+		}
 		return true
 	}
 